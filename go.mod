@@ -0,0 +1,9 @@
+module github.com/smartwalle/m4go
+
+go 1.25.0
+
+require (
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.54.0
+	golang.org/x/text v0.40.0
+)
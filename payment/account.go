@@ -0,0 +1,133 @@
+package payment
+
+import (
+	"github.com/smartwalle/ngx"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+// ChannelKey 返回支付渠道中指定商户账号的标识，Service 中所有的 channel 参数都可以使用该标识来指定商户账号，
+// 例如 ChannelKey(K_CHANNEL_ALIPAY, "brand_a") 为 alipay:brand_a，accountId 为空时返回 channel
+func ChannelKey(channel, accountId string) string {
+	if accountId == "" {
+		return channel
+	}
+	return channel + ":" + accountId
+}
+
+// splitChannelKey 是 ChannelKey 的逆操作
+func splitChannelKey(key string) (channel, accountId string) {
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
+func accountIdOf(p PayChannel) string {
+	if ac, ok := p.(AccountChannel); ok {
+		return ac.AccountId()
+	}
+	return ""
+}
+
+func channelKeyOf(p PayChannel) string {
+	return ChannelKey(p.Identifier(), accountIdOf(p))
+}
+
+// addChannel 在回调 URL 中添加支付渠道和商户账号，Service 根据这两个参数将回调交给创建订单的账号处理
+func addChannel(u *ngx.URL, channel, accountId string) {
+	u.Add("channel", channel)
+	if accountId != "" {
+		u.Add("account", accountId)
+	}
+}
+
+// Router 同一个支付渠道注册了多个商户账号时，用于为订单选择创建交易的账号，
+// accounts 为该支付渠道已经注册的账号，返回空字符串表示使用默认的账号
+type Router interface {
+	Route(order *Order, accounts []string) (accountId string, err error)
+}
+
+type RouterFunc func(order *Order, accounts []string) (accountId string, err error)
+
+func (this RouterFunc) Route(order *Order, accounts []string) (accountId string, err error) {
+	return this(order, accounts)
+}
+
+// ChainRouter 依次使用各个路由规则，返回第一个选中的账号
+func ChainRouter(routers ...Router) Router {
+	return RouterFunc(func(order *Order, accounts []string) (string, error) {
+		for _, r := range routers {
+			accountId, err := r.Route(order, accounts)
+			if err != nil || accountId != "" {
+				return accountId, err
+			}
+		}
+		return "", nil
+	})
+}
+
+// AttributeRouter 根据订单的附加属性选择账号，rules 的 key 为属性值，value 为账号
+func AttributeRouter(attribute string, rules map[string]string) Router {
+	return RouterFunc(func(order *Order, accounts []string) (string, error) {
+		if value, ok := order.Attributes[attribute]; ok {
+			return rules[value], nil
+		}
+		return "", nil
+	})
+}
+
+// CurrencyRouter 根据订单的货币选择账号，rules 的 key 为货币代码，value 为账号
+func CurrencyRouter(rules map[string]string) Router {
+	return RouterFunc(func(order *Order, accounts []string) (string, error) {
+		return rules[order.Currency], nil
+	})
+}
+
+// AmountRule 订单金额在 [Min, Max) 之间时使用 AccountId，Max 为 0 表示没有上限
+type AmountRule struct {
+	Min       float64
+	Max       float64
+	AccountId string
+}
+
+// AmountRouter 根据订单金额选择账号，使用第一个匹配的规则
+func AmountRouter(rules ...AmountRule) Router {
+	return RouterFunc(func(order *Order, accounts []string) (string, error) {
+		var amount = order.Totals().Total
+		for _, rule := range rules {
+			if amount >= rule.Min && (rule.Max <= 0 || amount < rule.Max) {
+				return rule.AccountId, nil
+			}
+		}
+		return "", nil
+	})
+}
+
+// WeightedRouter 按照权重将订单分配到各个账号，同一个订单编号总是分配到同一个账号，避免重复创建交易时使用不同的账号
+func WeightedRouter(weights map[string]int) Router {
+	var ids = make([]string, 0, len(weights))
+	var total = 0
+	for id, weight := range weights {
+		if weight > 0 {
+			ids = append(ids, id)
+			total += weight
+		}
+	}
+	sort.Strings(ids)
+
+	return RouterFunc(func(order *Order, accounts []string) (string, error) {
+		if total == 0 {
+			return "", nil
+		}
+		var n = int(crc32.ChecksumIEEE([]byte(order.OrderNo)) % uint32(total))
+		for _, id := range ids {
+			if n < weights[id] {
+				return id, nil
+			}
+			n -= weights[id]
+		}
+		return "", nil
+	})
+}
@@ -0,0 +1,64 @@
+package payment_test
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"testing"
+)
+
+func TestService_Accounts(t *testing.T) {
+	var fa = paymenttest.NewFakeAccount("", "brand_a")
+	var fb = paymenttest.NewFakeAccount("", "brand_b")
+	var s = payment.NewService()
+	s.RegisterChannel(fa)
+	s.RegisterChannel(fb)
+
+	if accounts := s.Accounts(paymenttest.K_CHANNEL_FAKE); len(accounts) != 2 || accounts[0] != "brand_a" || accounts[1] != "brand_b" {
+		t.Fatalf("商户账号错误: %v", accounts)
+	}
+
+	// 没有路由规则时使用第一个注册的账号
+	var order = newOrder("o1")
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != nil {
+		t.Fatal(err)
+	}
+	if order.AccountId != "brand_a" || len(fa.Orders()) != 1 {
+		t.Fatalf("应该使用 brand_a 创建交易，实际为 %s", order.AccountId)
+	}
+
+	s.SetRouter(paymenttest.K_CHANNEL_FAKE, payment.AttributeRouter("brand", map[string]string{"b": "brand_b"}))
+	order = newOrder("o2")
+	order.Attributes = map[string]string{"brand": "b"}
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != nil {
+		t.Fatal(err)
+	}
+	if order.AccountId != "brand_b" || len(fb.Orders()) != 1 {
+		t.Fatalf("应该使用 brand_b 创建交易，实际为 %s", order.AccountId)
+	}
+
+	order = newOrder("o3")
+	order.AccountId = "brand_c"
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != payment.ErrUnknownAccount {
+		t.Fatalf("期望返回 ErrUnknownAccount，实际为 %v", err)
+	}
+
+	// 回调会交给创建订单的账号处理
+	fb.Pay("o2", "payer1")
+	req, _ := fb.NotifyRequest("o2", payment.K_NOTIFY_TYPE_TRADE)
+	noti, err := s.NotifyURLHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noti.AccountId != "brand_b" || noti.OrderNo != "o2" {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+	if trade, err := s.GetTradeWithOrderNo(payment.ChannelKey(paymenttest.K_CHANNEL_FAKE, "brand_b"), "o2"); err != nil || trade.TradeSuccess == false {
+		t.Fatalf("查询交易错误: %+v, %v", trade, err)
+	}
+
+	s.RemoveChannel(payment.ChannelKey(paymenttest.K_CHANNEL_FAKE, "brand_b"))
+	req, _ = fb.NotifyRequest("o2", payment.K_NOTIFY_TYPE_TRADE)
+	if _, err = s.NotifyURLHandler(req); err != payment.ErrUnknownAccount {
+		t.Fatalf("期望返回 ErrUnknownAccount，实际为 %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package payment
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var router = ChainRouter(
+		AttributeRouter("brand", map[string]string{"b": "brand_b"}),
+		CurrencyRouter(map[string]string{"USD": "hk"}),
+		AmountRouter(AmountRule{Max: 100, AccountId: "small"}, AmountRule{Min: 100, AccountId: "large"}),
+	)
+
+	var tests = []struct {
+		order  *Order
+		expect string
+	}{
+		{&Order{Attributes: map[string]string{"brand": "b"}, Currency: "USD"}, "brand_b"},
+		{&Order{Attributes: map[string]string{"brand": "a"}, Currency: "USD"}, "hk"},
+		{&Order{Shipping: 99.99}, "small"},
+		{&Order{Shipping: 100, ProductList: []*Product{{Price: 1, Quantity: 2}}}, "large"},
+	}
+
+	for _, test := range tests {
+		if accountId, err := router.Route(test.order, nil); err != nil || accountId != test.expect {
+			t.Fatalf("应该选择 %s，实际为 %s, %v", test.expect, accountId, err)
+		}
+	}
+}
+
+func TestWeightedRouter(t *testing.T) {
+	var router = WeightedRouter(map[string]int{"a": 3, "b": 1, "c": 0})
+
+	var counts = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		var order = &Order{OrderNo: fmt.Sprintf("o%d", i)}
+		accountId, _ := router.Route(order, nil)
+		if again, _ := router.Route(order, nil); again != accountId {
+			t.Fatalf("同一个订单应该选择同一个账号: %s, %s", accountId, again)
+		}
+		counts[accountId]++
+	}
+	if counts["c"] != 0 || counts["a"] < 600 || counts["b"] < 150 {
+		t.Fatalf("账号的分配比例错误: %v", counts)
+	}
+}
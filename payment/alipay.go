@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"github.com/smartwalle/alipay"
 	"github.com/smartwalle/ngx"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -14,15 +17,30 @@ const (
 )
 
 type AliPay struct {
-	client    *alipay.AliPay
-	ReturnURL string // 支付成功之后回调 URL
-	CancelURL string // 用户取消付款回调 URL
-	NotifyURL string
+	client     *alipay.AliPay
+	httpClient *http.Client
+	now        func() time.Time
+	accountId  string
+	ReturnURL  string // 支付成功之后回调 URL
+	CancelURL  string // 用户取消付款回调 URL
+	NotifyURL  string
+
+	// SettleCurrency 跨境支付的结算币种，订单的货币不是 CNY 时使用，为空时按照签约的币种结算
+	SettleCurrency string
 }
 
-func NewAliPay(appId, partnerId, aliPublicKey, privateKey string, isProduction bool) *AliPay {
+func NewAliPay(appId, partnerId, aliPublicKey, privateKey string, isProduction bool, opts ...Option) *AliPay {
+	var o = newOptions(K_CHANNEL_ALIPAY, opts...)
+
 	var p = &AliPay{}
+	p.httpClient = o.httpClient
+	p.now = o.now
+	p.accountId = o.accountId
 	p.client = alipay.New(appId, partnerId, aliPublicKey, privateKey, isProduction)
+	p.client.SetHTTPClient(o.httpClient)
+	if o.baseURL != "" {
+		p.client.SetAPIDomain(o.baseURL)
+	}
 	return p
 }
 
@@ -30,55 +48,114 @@ func (this *AliPay) Identifier() string {
 	return K_CHANNEL_ALIPAY
 }
 
-func (this *AliPay) CreateTradeOrder(order *Order) (url string, err error) {
-	var productAmount float64 = 0
-	var productTax float64 = 0
-	for _, p := range order.ProductList {
-		productAmount += p.Price * float64(p.Quantity)
-		productTax += p.Tax * float64(p.Quantity)
-	}
-	var subject = strings.TrimSpace(order.Subject)
-	if subject == "" {
-		subject = order.OrderNo
-	}
+func (this *AliPay) AccountId() string {
+	return this.accountId
+}
 
-	var amount = fmt.Sprintf("%.2f", productAmount+productTax+order.Shipping-order.Discount)
+func (this *AliPay) CreateTradeOrder(order *Order) (url string, err error) {
+	var subject, amount = this.subjectAndAmount(order)
 
 	switch order.TradeMethod {
 	case K_TRADE_METHOD_WAP:
-		return this.tradeWapPay(order.OrderNo, subject, amount, order.Timeout)
+		return this.tradeWapPay(order, subject, amount)
 	case K_TRADE_METHOD_APP:
-		return this.tradeAppPay(order.OrderNo, subject, amount, order.Timeout)
+		return this.tradeAppPay(order, subject, amount)
 	case K_TRADE_METHOD_QRCODE:
-		return this.tradeQRCode(order.OrderNo, subject, amount, order.Timeout)
+		return this.tradeQRCode(order, subject, amount)
 	case K_TRADE_METHOD_F2F:
-		return this.tradeFaceToFace(order.OrderNo, order.AuthCode, subject, amount, order.Timeout)
+		return this.tradeFaceToFace(order, subject, amount)
 	default:
-		return this.tradeWebPay(order.OrderNo, subject, amount, order.Timeout)
+		return this.tradeWebPay(order, subject, amount)
+	}
+}
+
+func (this *AliPay) subjectAndAmount(order *Order) (subject, amount string) {
+	subject = strings.TrimSpace(order.Subject)
+	if subject == "" {
+		subject = order.OrderNo
+	}
+	amount = FormatAmount(order.Currency, order.Totals().Total)
+	return subject, amount
+}
+
+// goodsDetail 返回订单的商品明细，Price 为商品单价，不包含税费
+func (this *AliPay) goodsDetail(order *Order) []*alipay.GoodsDetailItem {
+	if len(order.ProductList) == 0 {
+		return nil
+	}
+	var items = make([]*alipay.GoodsDetailItem, 0, len(order.ProductList))
+	for _, p := range order.ProductList {
+		var item = &alipay.GoodsDetailItem{}
+		item.GoodsId = p.SKU
+		if item.GoodsId == "" {
+			item.GoodsId = p.Name
+		}
+		item.GoodsName = p.Name
+		item.Quantity = strconv.Itoa(p.Quantity)
+		item.Price = FormatAmount(order.Currency, p.Price)
+		item.GoodsCategory = p.Category
+		items = append(items, item)
+	}
+	return items
+}
+
+// SupportCurrency 支付宝的所有支付方式都支持跨境支付的币种，订单的货币为空时使用 CNY
+func (this *AliPay) SupportCurrency(tradeMethod, currency string) bool {
+	return currency == "" || containsCurrency(alipayCurrencies, currency)
+}
+
+// currency 返回订单的标价币种和结算币种，订单的货币为 CNY 时不需要设置
+func (this *AliPay) currency(order *Order) (transCurrency, settleCurrency string) {
+	if order.Currency == "" || order.Currency == K_CURRENCY_CNY {
+		return "", ""
 	}
-	return "", err
+	return order.Currency, this.SettleCurrency
 }
 
-func (this *AliPay) tradeWebPay(orderNo, subject, amount string, timeout int) (url string, err error) {
+// timeExpire 返回订单的绝对过期时间（北京时间，精确到分钟），用于电脑网站支付、手机网站支付和 App 支付，
+// 与 timeoutExpress 一样，不足一分钟的部分按一分钟计算，避免过期时间早于订单的过期时间或者当前时间
+func (this *AliPay) timeExpire(order *Order) (string, error) {
+	if _, err := expireIn(order, this.now()); err != nil || order.ExpireAt.IsZero() {
+		return "", err
+	}
+	var expireAt = order.ExpireAt.Truncate(time.Minute)
+	if expireAt.Before(order.ExpireAt) {
+		expireAt = expireAt.Add(time.Minute)
+	}
+	return expireAt.In(beijing).Format("2006-01-02 15:04"), nil
+}
+
+// timeoutExpress 返回订单的相对过期时间，用于只支持 timeout_express 的接口，例如当面付和资金授权
+func (this *AliPay) timeoutExpress(order *Order) (string, error) {
+	minutes, err := expireMinutes(order, this.now())
+	if err != nil || minutes == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%dm", minutes), nil
+}
+
+func (this *AliPay) tradeWebPay(order *Order, subject, amount string) (url string, err error) {
 	var p = alipay.AliPayTradePagePay{}
-	p.OutTradeNo = orderNo
+	p.OutTradeNo = order.OrderNo
 
 	var notifyURL = ngx.MustURL(this.NotifyURL)
-	notifyURL.Add("channel", this.Identifier())
-	notifyURL.Add("order_no", orderNo)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", order.OrderNo)
 	p.NotifyURL = notifyURL.String()
 
 	var returnURL = ngx.MustURL(this.ReturnURL)
-	returnURL.Add("channel", this.Identifier())
-	returnURL.Add("order_no", orderNo)
+	addChannel(returnURL, this.Identifier(), this.accountId)
+	returnURL.Add("order_no", order.OrderNo)
 	p.ReturnURL = returnURL.String()
 
 	p.ProductCode = "FAST_INSTANT_TRADE_PAY"
 	p.Subject = subject
 	p.TotalAmount = amount
+	p.GoodsDetail = this.goodsDetail(order)
 
-	if timeout > 0 {
-		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
+	p.TransCurrency, p.SettleCurrency = this.currency(order)
+	if p.TimeExpire, err = this.timeExpire(order); err != nil {
+		return "", err
 	}
 
 	rawURL, err := this.client.TradePagePay(p)
@@ -88,30 +165,32 @@ func (this *AliPay) tradeWebPay(orderNo, subject, amount string, timeout int) (u
 	return rawURL.String(), err
 }
 
-func (this *AliPay) tradeWapPay(orderNo, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeWapPay(order *Order, subject, amount string) (url string, err error) {
 	var p = alipay.AliPayTradeWapPay{}
-	p.OutTradeNo = orderNo
+	p.OutTradeNo = order.OrderNo
 
 	var notifyURL = ngx.MustURL(this.NotifyURL)
-	notifyURL.Add("channel", this.Identifier())
-	notifyURL.Add("order_no", orderNo)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", order.OrderNo)
 	p.NotifyURL = notifyURL.String()
 
 	var returnURL = ngx.MustURL(this.ReturnURL)
-	returnURL.Add("channel", this.Identifier())
-	returnURL.Add("order_no", orderNo)
+	addChannel(returnURL, this.Identifier(), this.accountId)
+	returnURL.Add("order_no", order.OrderNo)
 	p.ReturnURL = returnURL.String()
 
 	var cancelURL = ngx.MustURL(this.CancelURL)
-	cancelURL.Add("channel", this.Identifier())
-	cancelURL.Add("order_no", orderNo)
+	addChannel(cancelURL, this.Identifier(), this.accountId)
+	cancelURL.Add("order_no", order.OrderNo)
 	p.QuitURL = cancelURL.String()
 
 	p.ProductCode = "QUICK_WAP_WAY"
 	p.Subject = subject
 	p.TotalAmount = amount
-	if timeout > 0 {
-		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
+	p.GoodsDetail = this.goodsDetail(order)
+	p.TransCurrency, p.SettleCurrency = this.currency(order)
+	if p.TimeExpire, err = this.timeExpire(order); err != nil {
+		return "", err
 	}
 
 	rawURL, err := this.client.TradeWapPay(p)
@@ -121,37 +200,41 @@ func (this *AliPay) tradeWapPay(orderNo, subject, amount string, timeout int) (u
 	return rawURL.String(), err
 }
 
-func (this *AliPay) tradeAppPay(orderNo, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeAppPay(order *Order, subject, amount string) (url string, err error) {
 	var p = alipay.AliPayTradeAppPay{}
-	p.OutTradeNo = orderNo
+	p.OutTradeNo = order.OrderNo
 
 	var notifyURL = ngx.MustURL(this.NotifyURL)
-	notifyURL.Add("channel", this.Identifier())
-	notifyURL.Add("order_no", orderNo)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", order.OrderNo)
 	p.NotifyURL = notifyURL.String()
 
 	p.ProductCode = "QUICK_MSECURITY_PAY"
 	p.Subject = subject
 	p.TotalAmount = amount
-	if timeout > 0 {
-		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
+	p.GoodsDetail = this.goodsDetail(order)
+	p.TransCurrency, p.SettleCurrency = this.currency(order)
+	if p.TimeExpire, err = this.timeExpire(order); err != nil {
+		return "", err
 	}
 	return this.client.TradeAppPay(p)
 }
 
-func (this *AliPay) tradeQRCode(orderNo, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeQRCode(order *Order, subject, amount string) (url string, err error) {
 	var p = alipay.AliPayTradePreCreate{}
-	p.OutTradeNo = orderNo
+	p.OutTradeNo = order.OrderNo
 
 	var notifyURL = ngx.MustURL(this.NotifyURL)
-	notifyURL.Add("channel", this.Identifier())
-	notifyURL.Add("order_no", orderNo)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", order.OrderNo)
 	p.NotifyURL = notifyURL.String()
 
 	p.Subject = subject
 	p.TotalAmount = amount
-	if timeout > 0 {
-		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
+	p.GoodsDetail = this.goodsDetail(order)
+	p.TransCurrency, p.SettleCurrency = this.currency(order)
+	if p.TimeoutExpress, err = this.timeoutExpress(order); err != nil {
+		return "", err
 	}
 
 	rsp, err := this.client.TradePreCreate(p)
@@ -164,21 +247,23 @@ func (this *AliPay) tradeQRCode(orderNo, subject, amount string, timeout int) (u
 	return rsp.AliPayPreCreateResponse.QRCode, err
 }
 
-func (this *AliPay) tradeFaceToFace(orderNo, authCode, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeFaceToFace(order *Order, subject, amount string) (url string, err error) {
 	var p = alipay.AliPayTradePay{}
-	p.OutTradeNo = orderNo
+	p.OutTradeNo = order.OrderNo
 
 	var notifyURL = ngx.MustURL(this.NotifyURL)
-	notifyURL.Add("channel", this.Identifier())
-	notifyURL.Add("order_no", orderNo)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", order.OrderNo)
 	p.NotifyURL = notifyURL.String()
 
-	p.AuthCode = authCode
+	p.AuthCode = order.AuthCode
 	p.Subject = subject
 	p.TotalAmount = amount
+	p.GoodsDetail = this.goodsDetail(order)
 	p.Scene = "bar_code"
-	if timeout > 0 {
-		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
+	p.TransCurrency, p.SettleCurrency = this.currency(order)
+	if p.TimeoutExpress, err = this.timeoutExpress(order); err != nil {
+		return "", err
 	}
 
 	result, err := this.client.TradePay(p)
@@ -207,6 +292,7 @@ func (this *AliPay) getTrade(tradeNo, orderNo string) (result *Trade, err error)
 	result.OrderNo = rsp.AliPayTradeQuery.OutTradeNo
 	result.TradeNo = rsp.AliPayTradeQuery.TradeNo
 	result.TradeStatus = rsp.AliPayTradeQuery.TradeStatus
+	result.Status = aliPayTradeStatus(result.TradeStatus)
 	result.TotalAmount = rsp.AliPayTradeQuery.TotalAmount
 	result.PayerId = rsp.AliPayTradeQuery.BuyerUserId
 	result.PayerEmail = rsp.AliPayTradeQuery.BuyerLogonId
@@ -224,31 +310,153 @@ func (this *AliPay) GetTradeWithOrderNo(orderNo string) (result *Trade, err erro
 	return this.getTrade("", orderNo)
 }
 
+// Refund 退款，支付宝的退款是同步完成的，使用相同的退款单号（out_request_no）重试不会重复退款
+func (this *AliPay) Refund(param *RefundParam) (result *Refund, err error) {
+	var p = alipay.AliPayTradeRefund{}
+	p.TradeNo = param.TradeNo
+	p.OutTradeNo = param.OrderNo
+	p.OutRequestNo = param.RefundNo
+	p.RefundAmount = FormatAmount(param.Currency, param.Amount)
+	p.RefundReason = param.Reason
+
+	rsp, err := this.client.TradeRefund(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.AliPayTradeRefund.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(rsp.AliPayTradeRefund.SubMsg)
+	}
+
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.OrderNo = rsp.AliPayTradeRefund.OutTradeNo
+	result.TradeNo = rsp.AliPayTradeRefund.TradeNo
+	result.RefundNo = param.RefundNo
+	result.Status = K_REFUND_STATUS_SUCCESS
+	result.Amount = p.RefundAmount
+	result.RawRefund = rsp
+	return result, nil
+}
+
+// ReturnHandler 处理用户支付完成之后跳转回来的请求，会验证支付宝附加在 URL 上的签名
+func (this *AliPay) ReturnHandler(req *http.Request) (result *Trade, err error) {
+	req.ParseForm()
+	var orderNo = req.Form.Get("order_no")
+	delete(req.Form, "channel")
+	delete(req.Form, "account")
+	delete(req.Form, "order_no")
+
+	// SDK 验证签名失败时会同时返回错误，都视为签名无效
+	if ok, err := this.client.VerifySign(req.Form); err != nil || ok == false {
+		return nil, ErrInvalidSignature
+	}
+
+	var tradeNo = req.Form.Get("trade_no")
+	if tradeNo == "" {
+		return nil, ErrUnknownTradeNo
+	}
+	if orderNo != "" && req.Form.Get("out_trade_no") != orderNo {
+		return nil, ErrTradeMismatch
+	}
+	return this.GetTrade(tradeNo)
+}
+
+// NotifyHandler 处理支付宝的异步通知，通知无法通过签名验证或者不是支付宝发送的通知时返回 ErrInvalidSignature
 func (this *AliPay) NotifyHandler(req *http.Request) (result *Notification, err error) {
 	req.ParseForm()
 	delete(req.Form, "channel")
+	delete(req.Form, "account")
 	delete(req.Form, "order_no")
 
+	switch req.Form.Get("notify_type") {
+	case k_ALIPAY_NOTIFY_TYPE_AGREEMENT_SIGN, k_ALIPAY_NOTIFY_TYPE_AGREEMENT_UNSIGN:
+		return this.agreementNotify(req)
+	}
+
+	// SDK 在解析通知的时候会验证签名，返回的错误都是通知本身的问题
 	noti, err := this.client.GetTradeNotification(req)
 	if err != nil {
-		return nil, err
+		return nil, ErrInvalidSignature
 	}
 
 	if this.client.NotifyVerify(noti.NotifyId) == false {
-		return nil, ErrUnknownNotification
+		return nil, ErrInvalidSignature
 	}
 
 	result = &Notification{}
 	result.Channel = this.Identifier()
 	result.RawNotify = noti
 
-	// TODO 需要处理退款
 	switch noti.NotifyType {
 	case alipay.K_NOTIFY_TYPE_TRADE_STATUS_SYNC:
 		result.NotifyType = K_NOTIFY_TYPE_TRADE
 		result.OrderNo = noti.OutTradeNo
 		result.TradeNo = noti.TradeNo
+		result.Status = aliPayTradeStatus(noti.TradeStatus)
+		result.RawStatus = noti.TradeStatus
+		result.TotalAmount = noti.TotalAmount
+		// 跨境支付的通知会包含标价币种 trans_currency，没有时为人民币
+		result.Currency = req.Form.Get("trans_currency")
+		if result.Currency == "" {
+			result.Currency = K_CURRENCY_CNY
+		}
+		result.PayerId = noti.BuyerId
+		if noti.GmtPayment != "" {
+			result.PaidTime, _ = time.ParseInLocation("2006-01-02 15:04:05", noti.GmtPayment, beijing)
+		}
+
+		// 支付宝的退款也通过交易状态同步通知，退款之后交易状态为 TRADE_SUCCESS（部分退款）或者 TRADE_CLOSED（全额退款）
+		if noti.RefundFee != "" || noti.GmtRefund != "" {
+			result.NotifyType = K_NOTIFY_TYPE_REFUND
+			result.Status = K_TRADE_STATUS_REFUNDED
+			result.RefundNo = noti.OutBizNo
+			result.RefundAmount = noti.RefundFee
+			// 支付宝只有退款成功之后才会发送通知
+			result.RefundStatus = K_REFUND_STATUS_SUCCESS
+			if noti.GmtRefund != "" {
+				result.RefundTime, _ = time.ParseInLocation("2006-01-02 15:04:05", noti.GmtRefund, beijing)
+			}
+		}
 	}
 
 	return result, err
 }
+
+// aliPayTradeStatus 将支付宝的交易状态转换为 K_TRADE_STATUS_*
+func aliPayTradeStatus(status string) string {
+	switch status {
+	case alipay.K_TRADE_STATUS_WAIT_BUYER_PAY:
+		return K_TRADE_STATUS_PENDING
+	case alipay.K_TRADE_STATUS_TRADE_SUCCESS, alipay.K_TRADE_STATUS_TRADE_FINISHED:
+		return K_TRADE_STATUS_SUCCESS
+	case alipay.K_TRADE_STATUS_TRADE_CLOSED:
+		return K_TRADE_STATUS_CLOSED
+	}
+	return ""
+}
+
+// DownloadBill 下载指定日期的交易账单，返回的数据为支付宝提供的 zip 压缩包
+func (this *AliPay) DownloadBill(billDate time.Time) (data []byte, err error) {
+	var p = alipay.AliPayBillDownloadURLQuery{}
+	p.BillType = "trade"
+	p.BillDate = billDate.Format("2006-01-02")
+
+	rsp, err := this.client.BillDownloadURLQuery(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.AliPayDataServiceBillDownloadURLQueryResponse.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(rsp.AliPayDataServiceBillDownloadURLQueryResponse.SubMsg)
+	}
+
+	billRsp, err := this.httpClient.Get(rsp.AliPayDataServiceBillDownloadURLQueryResponse.BillDownloadUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer billRsp.Body.Close()
+
+	if billRsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下载支付宝账单失败: %s", billRsp.Status)
+	}
+	return ioutil.ReadAll(billRsp.Body)
+}
@@ -0,0 +1,196 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smartwalle/alipay"
+	"github.com/smartwalle/ngx"
+	"net/http"
+)
+
+const (
+	k_ALIPAY_PRODUCT_CODE_CYCLE_PAY_AUTH          = "CYCLE_PAY_AUTH"
+	k_ALIPAY_PERSONAL_PRODUCT_CODE_CYCLE_PAY_AUTH = "CYCLE_PAY_AUTH_P"
+	k_ALIPAY_SIGN_SCENE_DEFAULT                   = "INDUSTRY|DEFAULT_SCENE"
+
+	k_ALIPAY_NOTIFY_TYPE_AGREEMENT_SIGN   = "dut_user_sign"
+	k_ALIPAY_NOTIFY_TYPE_AGREEMENT_UNSIGN = "dut_user_unsign"
+)
+
+// CreateAgreement 通过 alipay.user.agreement.page.sign 创建周期扣款的签约页面，支付宝的扣款周期只支持按天和按月，
+// 按周和按年会分别转换为按天和按月
+func (this *AliPay) CreateAgreement(agreement *Agreement) (url string, err error) {
+	if agreement.Currency != "" && agreement.Currency != K_CURRENCY_CNY {
+		return "", ErrCurrencyNotSupported
+	}
+
+	var p = alipay.AliPayUserAgreementPageSign{}
+	p.PersonalProductCode = k_ALIPAY_PERSONAL_PRODUCT_CODE_CYCLE_PAY_AUTH
+	p.ProductCode = k_ALIPAY_PRODUCT_CODE_CYCLE_PAY_AUTH
+	p.SignScene = k_ALIPAY_SIGN_SCENE_DEFAULT
+	p.ExternalAgreementNo = agreement.AgreementNo
+
+	// 签约通知中会包含 agreement_no 等参数，所以 URL 中只添加 channel
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	p.NotifyURL = notifyURL.String()
+
+	var returnURL = ngx.MustURL(this.ReturnURL)
+	addChannel(returnURL, this.Identifier(), this.accountId)
+	returnURL.Add("external_agreement_no", agreement.AgreementNo)
+	p.ReturnURL = returnURL.String()
+
+	var period = agreement.Period
+	if period <= 0 {
+		period = 1
+	}
+	var rule = &alipay.AliPayPeriodRuleParams{}
+	switch agreement.PeriodType {
+	case K_AGREEMENT_PERIOD_WEEK:
+		rule.PeriodType = "DAY"
+		rule.Period = period * 7
+	case K_AGREEMENT_PERIOD_MONTH:
+		rule.PeriodType = "MONTH"
+		rule.Period = period
+	case K_AGREEMENT_PERIOD_YEAR:
+		rule.PeriodType = "MONTH"
+		rule.Period = period * 12
+	default:
+		rule.PeriodType = "DAY"
+		rule.Period = period
+	}
+	var startTime = agreement.StartTime
+	if startTime.IsZero() {
+		startTime = this.now()
+	}
+	rule.ExecuteTime = startTime.In(beijing).Format("2006-01-02")
+	rule.SingleAmount = fmt.Sprintf("%.2f", agreement.Amount)
+	rule.TotalPayments = agreement.Cycles
+	p.PeriodRuleParams = rule
+
+	rawURL, err := this.client.UserAgreementPageSign(p)
+	if err != nil {
+		return "", err
+	}
+	return rawURL.String(), err
+}
+
+func (this *AliPay) getAgreement(agreementId, agreementNo string) (result *Subscription, err error) {
+	var p = alipay.AliPayUserAgreementQuery{}
+	p.AgreementNo = agreementId
+	p.ExternalAgreementNo = agreementNo
+	p.PersonalProductCode = k_ALIPAY_PERSONAL_PRODUCT_CODE_CYCLE_PAY_AUTH
+	p.SignScene = k_ALIPAY_SIGN_SCENE_DEFAULT
+
+	rsp, err := this.client.UserAgreementQuery(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var content = rsp.AliPayUserAgreementQueryResponse
+	if content.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(content.SubMsg)
+	}
+
+	result = &Subscription{}
+	result.Channel = this.Identifier()
+	result.RawAgreement = rsp
+	result.AgreementNo = content.ExternalAgreementNo
+	result.AgreementId = content.AgreementNo
+	result.Status = content.Status
+	result.PayerId = content.PrincipalId
+	if content.Status == alipay.K_AGREEMENT_STATUS_NORMAL {
+		result.Active = true
+	}
+	return result, nil
+}
+
+// AgreementReturnHandler 处理用户签约之后跳转回来的请求，使用商户协议号查询签约结果
+func (this *AliPay) AgreementReturnHandler(req *http.Request) (result *Subscription, err error) {
+	req.ParseForm()
+
+	var agreementNo = req.FormValue("external_agreement_no")
+	if agreementNo == "" {
+		return nil, ErrUnknownAgreement
+	}
+	return this.getAgreement("", agreementNo)
+}
+
+func (this *AliPay) GetAgreement(agreementId string) (result *Subscription, err error) {
+	return this.getAgreement(agreementId, "")
+}
+
+// ChargeAgreement 通过 alipay.trade.pay 按签约协议扣款
+func (this *AliPay) ChargeAgreement(param *AgreementChargeParam) (result *Trade, err error) {
+	var p = alipay.AliPayTradePay{}
+	p.OutTradeNo = param.OrderNo
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", param.OrderNo)
+	p.NotifyURL = notifyURL.String()
+
+	p.ProductCode = k_ALIPAY_PRODUCT_CODE_CYCLE_PAY_AUTH
+	p.AgreementParams = &alipay.AliPayAgreementParams{}
+	p.AgreementParams.AgreementNo = param.AgreementId
+	p.Subject = param.Subject
+	if p.Subject == "" {
+		p.Subject = param.OrderNo
+	}
+	p.TotalAmount = fmt.Sprintf("%.2f", param.Amount)
+
+	rsp, err := this.client.TradePay(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.AliPayTradePay.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(rsp.AliPayTradePay.SubMsg)
+	}
+
+	result = &Trade{}
+	result.Channel = this.Identifier()
+	result.RawTrade = rsp
+	result.OrderNo = rsp.AliPayTradePay.OutTradeNo
+	result.TradeNo = rsp.AliPayTradePay.TradeNo
+	result.TradeStatus = alipay.K_TRADE_STATUS_TRADE_SUCCESS
+	result.Status = K_TRADE_STATUS_SUCCESS
+	result.TradeSuccess = true
+	result.TotalAmount = rsp.AliPayTradePay.TotalAmount
+	result.PayerId = rsp.AliPayTradePay.BuyerUserId
+	return result, nil
+}
+
+func (this *AliPay) CancelAgreement(agreementId string) (err error) {
+	var p = alipay.AliPayUserAgreementUnsign{}
+	p.AgreementNo = agreementId
+	p.PersonalProductCode = k_ALIPAY_PERSONAL_PRODUCT_CODE_CYCLE_PAY_AUTH
+	p.SignScene = k_ALIPAY_SIGN_SCENE_DEFAULT
+
+	rsp, err := this.client.UserAgreementUnsign(p)
+	if err != nil {
+		return err
+	}
+	if rsp.AliPayUserAgreementUnsignResponse.Code != alipay.K_SUCCESS_CODE {
+		return errors.New(rsp.AliPayUserAgreementUnsignResponse.SubMsg)
+	}
+	return nil
+}
+
+// agreementNotify 处理签约和解约的异步通知，req.Form 中不能包含通知之外的参数
+func (this *AliPay) agreementNotify(req *http.Request) (result *Notification, err error) {
+	if ok, err := this.client.VerifySign(req.Form); err != nil || ok == false {
+		return nil, ErrInvalidSignature
+	}
+
+	result = &Notification{}
+	result.Channel = this.Identifier()
+	result.RawNotify = req.Form
+	result.AgreementNo = req.Form.Get("external_agreement_no")
+	result.AgreementId = req.Form.Get("agreement_no")
+	if req.Form.Get("notify_type") == k_ALIPAY_NOTIFY_TYPE_AGREEMENT_SIGN {
+		result.NotifyType = K_NOTIFY_TYPE_AGREEMENT_SIGN
+	} else {
+		result.NotifyType = K_NOTIFY_TYPE_AGREEMENT_UNSIGN
+	}
+	return result, nil
+}
@@ -0,0 +1,177 @@
+package payment
+
+import (
+	"errors"
+	"github.com/smartwalle/alipay"
+	"github.com/smartwalle/ngx"
+)
+
+const (
+	k_ALIPAY_PRODUCT_CODE_PRE_AUTH_ONLINE = "PRE_AUTH_ONLINE"
+)
+
+// Authorize 通过资金授权冻结用户的资金，目前只支持 App 方式（alipay.fund.auth.order.app.freeze），返回的是供 App SDK 使用的参数，
+// 订单编号会同时作为 out_order_no 和 out_request_no 使用，冻结成功之后可以通过 GetAuthorizationWithOrderNo 获取 auth_no
+func (this *AliPay) Authorize(order *Order) (url string, err error) {
+	if order.TradeMethod != K_TRADE_METHOD_APP {
+		return "", ErrAliPayNotAllowed
+	}
+	// 资金授权只支持人民币
+	if order.Currency != "" && order.Currency != K_CURRENCY_CNY {
+		return "", ErrCurrencyNotSupported
+	}
+
+	var subject, amount = this.subjectAndAmount(order)
+
+	var p = alipay.AliPayFundAuthOrderAppFreeze{}
+	p.OutOrderNo = order.OrderNo
+	p.OutRequestNo = order.OrderNo
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", order.OrderNo)
+	p.NotifyURL = notifyURL.String()
+
+	p.OrderTitle = subject
+	p.Amount = amount
+	p.ProductCode = k_ALIPAY_PRODUCT_CODE_PRE_AUTH_ONLINE
+	if p.PayTimeout, err = this.timeoutExpress(order); err != nil {
+		return "", err
+	}
+	return this.client.FundAuthOrderAppFreeze(p)
+}
+
+func (this *AliPay) getAuthorization(authNo, orderNo string) (result *Authorization, rest string, err error) {
+	var p = alipay.AliPayFundAuthOperationDetailQuery{}
+	p.AuthNo = authNo
+	p.OutOrderNo = orderNo
+	p.OutRequestNo = orderNo
+
+	rsp, err := this.client.FundAuthOperationDetailQuery(p)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var detail = rsp.AliPayFundAuthOperationDetailQueryResponse
+	if detail.Code != alipay.K_SUCCESS_CODE {
+		return nil, "", errors.New(detail.SubMsg)
+	}
+
+	result = &Authorization{}
+	result.Channel = this.Identifier()
+	result.RawAuthorization = rsp
+	result.OrderNo = detail.OutOrderNo
+	result.AuthorizationId = detail.AuthNo
+	result.Status = detail.OrderStatus
+	result.TotalAmount = detail.TotalFreezeAmount
+	result.PayerId = detail.PayerUserId
+	if detail.OrderStatus == alipay.K_FUND_AUTH_ORDER_STATUS_AUTHORIZED {
+		result.Authorized = true
+	}
+	return result, detail.RestAmount, nil
+}
+
+func (this *AliPay) GetAuthorization(authorizationId string) (result *Authorization, err error) {
+	result, _, err = this.getAuthorization(authorizationId, "")
+	return result, err
+}
+
+func (this *AliPay) GetAuthorizationWithOrderNo(orderNo string) (result *Authorization, err error) {
+	result, _, err = this.getAuthorization("", orderNo)
+	return result, err
+}
+
+// Capture 通过 alipay.trade.pay 将冻结的资金转为支付，每次扣款都需要使用不同的 OrderNo
+func (this *AliPay) Capture(param *CaptureParam) (result *Capture, err error) {
+	if param.OrderNo == "" {
+		return nil, ErrUnknownOrderNo
+	}
+
+	// 预授权转支付时需要传递付款用户的 buyer_id
+	auth, rest, err := this.getAuthorization(param.AuthorizationId, "")
+	if err != nil {
+		return nil, err
+	}
+	if auth.Authorized == false {
+		return nil, ErrUnknownAuthorization
+	}
+
+	var p = alipay.AliPayTradePay{}
+	p.OutTradeNo = param.OrderNo
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", param.OrderNo)
+	p.NotifyURL = notifyURL.String()
+
+	p.AuthNo = param.AuthorizationId
+	p.ProductCode = k_ALIPAY_PRODUCT_CODE_PRE_AUTH_ONLINE
+	p.BuyerId = auth.PayerId
+	p.Subject = param.Subject
+	if p.Subject == "" {
+		p.Subject = param.OrderNo
+	}
+
+	// COMPLETE 表示扣款之后解冻剩余的资金
+	p.AuthConfirmMode = "NOT_COMPLETE"
+	if param.Amount > 0 {
+		p.TotalAmount = FormatAmount(K_CURRENCY_CNY, param.Amount)
+		if param.IsFinal {
+			p.AuthConfirmMode = "COMPLETE"
+		}
+	} else {
+		p.TotalAmount = rest
+		p.AuthConfirmMode = "COMPLETE"
+	}
+
+	rsp, err := this.client.TradePay(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.AliPayTradePay.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(rsp.AliPayTradePay.SubMsg)
+	}
+
+	result = &Capture{}
+	result.Channel = this.Identifier()
+	result.RawCapture = rsp
+	result.OrderNo = rsp.AliPayTradePay.OutTradeNo
+	result.AuthorizationId = param.AuthorizationId
+	result.CaptureId = rsp.AliPayTradePay.TradeNo
+	result.Status = alipay.K_TRADE_STATUS_TRADE_SUCCESS
+	result.CaptureSuccess = true
+	result.Amount = rsp.AliPayTradePay.TotalAmount
+	return result, nil
+}
+
+// Void 通过 alipay.fund.auth.order.unfreeze 解冻剩余的全部资金
+func (this *AliPay) Void(authorizationId string) (err error) {
+	auth, rest, err := this.getAuthorization(authorizationId, "")
+	if err != nil {
+		return err
+	}
+	if auth.Authorized == false {
+		return ErrUnknownAuthorization
+	}
+
+	var p = alipay.AliPayFundAuthOrderUnfreeze{}
+	p.AuthNo = authorizationId
+	// 同一个预授权只会解冻一次剩余的资金，使用固定的 out_request_no 保证重试时不会重复解冻
+	p.OutRequestNo = authorizationId + "V"
+	p.Amount = rest
+	p.Remark = "撤销预授权"
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", auth.OrderNo)
+	p.NotifyURL = notifyURL.String()
+
+	rsp, err := this.client.FundAuthOrderUnfreeze(p)
+	if err != nil {
+		return err
+	}
+	if rsp.AliPayFundAuthOrderUnfreezeResponse.Code != alipay.K_SUCCESS_CODE {
+		return errors.New(rsp.AliPayFundAuthOrderUnfreezeResponse.SubMsg)
+	}
+	return nil
+}
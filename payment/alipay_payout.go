@@ -0,0 +1,119 @@
+package payment
+
+import (
+	"errors"
+	"github.com/smartwalle/alipay"
+	"strings"
+)
+
+const (
+	k_ALIPAY_PRODUCT_CODE_TRANS_ACCOUNT_NO_PWD = "TRANS_ACCOUNT_NO_PWD"
+	k_ALIPAY_BIZ_SCENE_DIRECT_TRANSFER         = "DIRECT_TRANSFER"
+
+	k_ALIPAY_IDENTITY_TYPE_USER_ID  = "ALIPAY_USER_ID"
+	k_ALIPAY_IDENTITY_TYPE_LOGON_ID = "ALIPAY_LOGON_ID"
+)
+
+// Payout 通过 alipay.fund.trans.uni.transfer 转账到支付宝账户，PayeeAccount 为 2088 开头的 16 位数字时作为支付宝用户 ID 使用，
+// 否则作为支付宝登录账号使用，使用登录账号时必须设置 PayeeName
+func (this *AliPay) Payout(payout *Payout) (result *PayoutResult, err error) {
+	if payout.Currency != "" && payout.Currency != K_CURRENCY_CNY {
+		return nil, ErrCurrencyNotSupported
+	}
+
+	var p = alipay.AliPayFundTransUniTransfer{}
+	p.OutBizNo = payout.PayoutNo
+	p.TransAmount = FormatAmount(K_CURRENCY_CNY, payout.Amount)
+	p.ProductCode = k_ALIPAY_PRODUCT_CODE_TRANS_ACCOUNT_NO_PWD
+	p.BizScene = k_ALIPAY_BIZ_SCENE_DIRECT_TRANSFER
+	p.OrderTitle = strings.TrimSpace(payout.Remark)
+	if p.OrderTitle == "" {
+		p.OrderTitle = payout.PayoutNo
+	}
+	p.Remark = payout.Remark
+
+	p.PayeeInfo = &alipay.AliPayPayeeInfo{}
+	p.PayeeInfo.Identity = payout.PayeeAccount
+	p.PayeeInfo.Name = payout.PayeeName
+	p.PayeeInfo.IdentityType = k_ALIPAY_IDENTITY_TYPE_LOGON_ID
+	if isAliPayUserId(payout.PayeeAccount) {
+		p.PayeeInfo.IdentityType = k_ALIPAY_IDENTITY_TYPE_USER_ID
+	}
+
+	rsp, err := this.client.FundTransUniTransfer(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var content = rsp.AliPayFundTransUniTransferResponse
+	if content.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(content.SubMsg)
+	}
+
+	result = &PayoutResult{}
+	result.Channel = this.Identifier()
+	result.RawPayout = rsp
+	result.PayoutNo = content.OutBizNo
+	result.PayoutId = content.OrderId
+	result.RawStatus = content.Status
+	result.Status = this.payoutStatus(content.Status)
+	result.Amount = p.TransAmount
+	return result, nil
+}
+
+// BatchPayout 支付宝会逐笔转账
+func (this *AliPay) BatchPayout(batchNo string, payouts []*Payout) (results []*PayoutResult, err error) {
+	return batchPayout(this.Identifier(), batchNo, payouts, this.Payout), nil
+}
+
+func (this *AliPay) getPayout(payoutId, payoutNo string) (result *PayoutResult, err error) {
+	var p = alipay.AliPayFundTransCommonQuery{}
+	p.ProductCode = k_ALIPAY_PRODUCT_CODE_TRANS_ACCOUNT_NO_PWD
+	p.BizScene = k_ALIPAY_BIZ_SCENE_DIRECT_TRANSFER
+	p.OrderId = payoutId
+	p.OutBizNo = payoutNo
+
+	rsp, err := this.client.FundTransCommonQuery(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var content = rsp.AliPayFundTransCommonQueryResponse
+	if content.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(content.SubMsg)
+	}
+
+	result = &PayoutResult{}
+	result.Channel = this.Identifier()
+	result.RawPayout = rsp
+	result.PayoutNo = content.OutBizNo
+	result.PayoutId = content.OrderId
+	result.RawStatus = content.Status
+	result.Status = this.payoutStatus(content.Status)
+	result.Amount = content.TransAmount
+	result.FailReason = content.FailReason
+	return result, nil
+}
+
+func (this *AliPay) GetPayout(payoutId string) (result *PayoutResult, err error) {
+	return this.getPayout(payoutId, "")
+}
+
+func (this *AliPay) GetPayoutWithPayoutNo(payoutNo string) (result *PayoutResult, err error) {
+	return this.getPayout("", payoutNo)
+}
+
+func (this *AliPay) payoutStatus(status string) string {
+	switch status {
+	case alipay.K_FUND_TRANS_STATUS_SUCCESS:
+		return K_PAYOUT_STATUS_SUCCESS
+	case alipay.K_FUND_TRANS_STATUS_FAIL, alipay.K_FUND_TRANS_STATUS_REFUND:
+		return K_PAYOUT_STATUS_FAILED
+	}
+	return K_PAYOUT_STATUS_PROCESSING
+}
+
+// isAliPayUserId 判断账号是否为支付宝用户 ID，支付宝用户 ID 为 2088 开头的 16 位数字
+func isAliPayUserId(account string) bool {
+	return len(account) == 16 && strings.HasPrefix(account, "2088")
+}
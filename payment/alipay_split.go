@@ -0,0 +1,150 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smartwalle/alipay"
+	"time"
+)
+
+const (
+	k_ALIPAY_ROYALTY_OPERATION_TYPE_TRANSFER = "transfer"
+)
+
+func (this *AliPay) transInType(account string) string {
+	if isAliPayUserId(account) {
+		return alipay.K_ROYALTY_TRANS_IN_TYPE_USER_ID
+	}
+	return alipay.K_ROYALTY_TRANS_IN_TYPE_LOGIN_NAME
+}
+
+// AddSplitReceiver 通过 alipay.trade.royalty.relation.bind 绑定分账关系
+func (this *AliPay) AddSplitReceiver(receiver *SplitReceiver) (err error) {
+	var r = &alipay.AliPayRoyaltyReceiver{}
+	r.Type = this.transInType(receiver.Account)
+	r.Account = receiver.Account
+	r.Name = receiver.Name
+	r.Memo = receiver.Remark
+
+	var p = alipay.AliPayTradeRoyaltyRelationBind{}
+	p.OutRequestNo = fmt.Sprintf("%d", time.Now().UnixNano())
+	p.ReceiverList = []*alipay.AliPayRoyaltyReceiver{r}
+
+	rsp, err := this.client.TradeRoyaltyRelationBind(p)
+	if err != nil {
+		return err
+	}
+	if rsp.AliPayTradeRoyaltyRelationBindResponse.Code != alipay.K_SUCCESS_CODE {
+		return errors.New(rsp.AliPayTradeRoyaltyRelationBindResponse.SubMsg)
+	}
+	return nil
+}
+
+// Split 通过 alipay.trade.order.settle 分账，Finish 为 true 时会同时完结分账
+func (this *AliPay) Split(param *SplitParam) (result *SplitResult, err error) {
+	var p = alipay.AliPayTradeOrderSettle{}
+	p.OutRequestNo = param.SplitNo
+	p.TradeNo = param.TradeNo
+	for _, r := range param.Receivers {
+		var royalty = &alipay.AliPayRoyaltyParameter{}
+		royalty.TransInType = this.transInType(r.Account)
+		royalty.TransIn = r.Account
+		royalty.Amount = FormatAmount(K_CURRENCY_CNY, r.Amount)
+		royalty.Desc = r.Remark
+		p.RoyaltyParameters = append(p.RoyaltyParameters, royalty)
+	}
+	if param.Finish {
+		p.ExtendParams = &alipay.AliPaySettleExtendParams{}
+		p.ExtendParams.RoyaltyFinish = "true"
+	}
+
+	rsp, err := this.client.TradeOrderSettle(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.AliPayTradeOrderSettleResponse.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(rsp.AliPayTradeOrderSettleResponse.SubMsg)
+	}
+
+	result = &SplitResult{}
+	result.Channel = this.Identifier()
+	result.RawSplit = rsp
+	result.TradeNo = rsp.AliPayTradeOrderSettleResponse.TradeNo
+	result.SplitNo = param.SplitNo
+	result.SplitId = rsp.AliPayTradeOrderSettleResponse.SettleNo
+	result.Status = K_SPLIT_STATUS_SUCCESS
+	for _, r := range param.Receivers {
+		var receiver = &SplitReceiverResult{}
+		receiver.Type = r.Type
+		receiver.Account = r.Account
+		receiver.Amount = FormatAmount(K_CURRENCY_CNY, r.Amount)
+		receiver.Status = K_SPLIT_STATUS_SUCCESS
+		result.Receivers = append(result.Receivers, receiver)
+	}
+	return result, nil
+}
+
+func (this *AliPay) GetSplit(tradeNo, splitNo string) (result *SplitResult, err error) {
+	var p = alipay.AliPayTradeOrderSettleQuery{}
+	p.TradeNo = tradeNo
+	p.OutRequestNo = splitNo
+
+	rsp, err := this.client.TradeOrderSettleQuery(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var content = rsp.AliPayTradeOrderSettleQueryResponse
+	if content.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(content.SubMsg)
+	}
+
+	result = &SplitResult{}
+	result.Channel = this.Identifier()
+	result.RawSplit = rsp
+	result.TradeNo = tradeNo
+	result.SplitNo = content.OutRequestNo
+	result.Status = K_SPLIT_STATUS_SUCCESS
+
+	for _, detail := range content.RoyaltyDetailList {
+		if detail.OperationType != k_ALIPAY_ROYALTY_OPERATION_TYPE_TRANSFER {
+			continue
+		}
+
+		var receiver = &SplitReceiverResult{}
+		receiver.Type = K_RECEIVER_TYPE_PERSONAL
+		if detail.TransInType == alipay.K_ROYALTY_TRANS_IN_TYPE_USER_ID {
+			receiver.Type = K_RECEIVER_TYPE_MERCHANT
+		}
+		receiver.Account = detail.TransIn
+		receiver.Amount = detail.Amount
+		receiver.FailReason = detail.ErrorDesc
+		switch detail.State {
+		case alipay.K_ROYALTY_STATE_SUCCESS:
+			receiver.Status = K_SPLIT_STATUS_SUCCESS
+		case alipay.K_ROYALTY_STATE_FAIL:
+			receiver.Status = K_SPLIT_STATUS_FAILED
+		default:
+			receiver.Status = K_SPLIT_STATUS_PROCESSING
+		}
+		result.Receivers = append(result.Receivers, receiver)
+
+		// 有一个接收方失败则整个分账失败，否则有一个接收方处理中则整个分账处理中
+		if receiver.Status == K_SPLIT_STATUS_FAILED {
+			result.Status = K_SPLIT_STATUS_FAILED
+		} else if receiver.Status == K_SPLIT_STATUS_PROCESSING && result.Status != K_SPLIT_STATUS_FAILED {
+			result.Status = K_SPLIT_STATUS_PROCESSING
+		}
+	}
+	return result, nil
+}
+
+// ReturnSplit 支付宝的分账回退需要在退款时指定，暂时不支持
+func (this *AliPay) ReturnSplit(param *SplitReturnParam) (result *SplitReturn, err error) {
+	return nil, ErrAliPayNotAllowed
+}
+
+// FinishSplit 支付宝需要在最后一次分账时将 SplitParam 的 Finish 设置为 true 完结分账
+func (this *AliPay) FinishSplit(tradeNo, splitNo string) (err error) {
+	return ErrAliPayNotAllowed
+}
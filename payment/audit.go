@@ -0,0 +1,333 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 审计记录的类型
+const (
+	K_AUDIT_KIND_REQUEST  = "request"  // 发送给支付渠道的请求
+	K_AUDIT_KIND_RESPONSE = "response" // 支付渠道的响应
+	K_AUDIT_KIND_RETURN   = "return"   // 用户支付完成之后跳转回来的请求
+	K_AUDIT_KIND_CANCEL   = "cancel"   // 用户取消付款之后跳转回来的请求
+	K_AUDIT_KIND_NOTIFY   = "notify"   // 支付渠道的异步通知
+)
+
+// AuditRecord 一条审计记录，URL、Header 和 Body 都已经脱敏，
+// 同一次请求的 request 和 response 记录 Id 相同
+type AuditRecord struct {
+	Id        string        `json:"id"`
+	Time      time.Time     `json:"time"`
+	Kind      string        `json:"kind"`
+	Channel   string        `json:"channel"`
+	AccountId string        `json:"account_id,omitempty"`
+	OrderNo   string        `json:"order_no,omitempty"` // 只有回调才有
+	TradeNo   string        `json:"trade_no,omitempty"` // 只有回调才有
+	Method    string        `json:"method,omitempty"`
+	URL       string        `json:"url,omitempty"`
+	Status    int           `json:"status,omitempty"`
+	Header    http.Header   `json:"header,omitempty"`
+	Body      string        `json:"body,omitempty"`
+	Duration  time.Duration `json:"duration,omitempty"` // 只有 response 才有
+	Error     string        `json:"error,omitempty"`
+}
+
+// AuditSink 接收审计记录，实现需要保证并发安全，返回的错误会被忽略，不会影响支付流程
+type AuditSink interface {
+	Audit(record *AuditRecord) error
+}
+
+var auditSeq uint64
+
+func newAuditId(now time.Time) string {
+	return strconv.FormatInt(now.UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&auditSeq, 1), 36)
+}
+
+// DefaultRedactKeys 默认需要脱敏的字段，包括密钥、签名、用户的个人信息以及银行卡信息
+var DefaultRedactKeys = []string{
+	// 密钥和签名
+	"key", "secret", "client_secret", "private_key", "access_token", "refresh_token", "authorization",
+	"sign", "signature", "paysign", "cert_id",
+	// 用户的个人信息
+	"openid", "sub_openid", "buyer_logon_id", "buyer_user_id", "buyer_id", "payer_email", "email", "email_address",
+	"phone", "phone_number", "mobile", "given_name", "surname", "cert_no", "identity",
+	// 银行卡信息
+	"card_number", "number", "cvv", "cvv2", "expire_month", "expire_year", "bank_card_no", "enc_bank_no", "enc_true_name",
+}
+
+// Redactor 对审计记录进行脱敏，Keys 中的字段在 JSON、XML、表单、URL 参数以及 Header 中的值都会被替换为 Mask，字段名不区分大小写
+type Redactor struct {
+	Keys []string
+	Mask string // 为空时使用 ***
+}
+
+// DefaultRedactor 返回使用 DefaultRedactKeys 的 Redactor
+func DefaultRedactor() *Redactor {
+	return &Redactor{Keys: append([]string(nil), DefaultRedactKeys...)}
+}
+
+func (this *Redactor) mask() string {
+	if this.Mask == "" {
+		return "***"
+	}
+	return this.Mask
+}
+
+func (this *Redactor) match(key string) bool {
+	for _, k := range this.Keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactHeader 返回脱敏之后的 Header，不会修改传入的 Header
+func (this *Redactor) RedactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	var result = make(http.Header, len(header))
+	for key, values := range header {
+		if this.match(key) {
+			result[key] = []string{this.mask()}
+			continue
+		}
+		result[key] = append([]string(nil), values...)
+	}
+	return result
+}
+
+// RedactURL 对 URL 中的参数进行脱敏
+func (this *Redactor) RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+	u.RawQuery = this.redactForm(u.RawQuery)
+	return u.String()
+}
+
+// RedactBody 根据内容识别 JSON、XML 和表单格式并进行脱敏，无法识别的内容原样返回
+func (this *Redactor) RedactBody(body string) string {
+	var trimmed = strings.TrimSpace(body)
+	switch {
+	case trimmed == "":
+		return body
+	case strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "["):
+		return this.redactJSON(body)
+	case strings.HasPrefix(trimmed, "<"):
+		return this.redactXML(body)
+	case strings.Contains(trimmed, "="):
+		return this.redactForm(body)
+	}
+	return body
+}
+
+func (this *Redactor) redactJSON(body string) string {
+	var decoder = json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return body
+	}
+	data, err := json.Marshal(this.redactValue(v))
+	if err != nil {
+		return body
+	}
+	return string(data)
+}
+
+func (this *Redactor) redactValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			if this.match(key) {
+				value[key] = this.mask()
+			} else {
+				value[key] = this.redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = this.redactValue(item)
+		}
+	}
+	return v
+}
+
+func (this *Redactor) redactXML(body string) string {
+	var mask = strings.Replace(this.mask(), "$", "$$", -1)
+	for _, key := range this.Keys {
+		var re, err = regexp.Compile(`(?is)(<` + regexp.QuoteMeta(key) + `>).*?(</` + regexp.QuoteMeta(key) + `>)`)
+		if err != nil {
+			continue
+		}
+		body = re.ReplaceAllString(body, "${1}"+mask+"${2}")
+	}
+	return body
+}
+
+// redactForm 对表单进行脱敏，值为 JSON 的参数（例如支付宝的 biz_content）也会进行脱敏
+func (this *Redactor) redactForm(body string) string {
+	values, err := url.ParseQuery(body)
+	if err != nil {
+		return body
+	}
+	for key, items := range values {
+		for i, item := range items {
+			if this.match(key) {
+				items[i] = this.mask()
+			} else if strings.HasPrefix(strings.TrimSpace(item), "{") {
+				items[i] = this.redactJSON(item)
+			}
+		}
+	}
+	return values.Encode()
+}
+
+// auditTransport 记录发送给支付渠道的请求以及支付渠道的响应
+type auditTransport struct {
+	next      http.RoundTripper
+	sink      AuditSink
+	redactor  *Redactor
+	channel   string
+	accountId string
+	now       func() time.Time
+}
+
+func (this *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var next = this.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	var start = this.now()
+	var record = &AuditRecord{}
+	record.Id = newAuditId(start)
+	record.Time = start
+	record.Kind = K_AUDIT_KIND_REQUEST
+	record.Channel = this.channel
+	record.AccountId = this.accountId
+	record.Method = req.Method
+	record.URL = this.redactor.RedactURL(req.URL.String())
+	record.Header = this.redactor.RedactHeader(req.Header)
+	if req.Body != nil {
+		// RoundTrip 不能修改传入的请求，优先使用 GetBody 读取请求内容，否则复制一个新的请求
+		var body = req.Body
+		if req.GetBody != nil {
+			if b, err := req.GetBody(); err == nil {
+				body = b
+			}
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if body == req.Body {
+			var r = new(http.Request)
+			*r = *req
+			r.Body = ioutil.NopCloser(bytes.NewReader(data))
+			req = r
+		}
+		record.Body = this.redactor.RedactBody(string(data))
+	}
+	this.sink.Audit(record)
+
+	rsp, err := next.RoundTrip(req)
+
+	var result = &AuditRecord{}
+	result.Id = record.Id
+	result.Time = this.now()
+	result.Kind = K_AUDIT_KIND_RESPONSE
+	result.Channel = this.channel
+	result.AccountId = this.accountId
+	result.Method = record.Method
+	result.URL = record.URL
+	result.Duration = result.Time.Sub(start)
+	if err != nil {
+		result.Error = err.Error()
+		this.sink.Audit(result)
+		return nil, err
+	}
+
+	result.Status = rsp.StatusCode
+	result.Header = this.redactor.RedactHeader(rsp.Header)
+	data, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		result.Error = err.Error()
+		this.sink.Audit(result)
+		return nil, err
+	}
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	result.Body = this.redactor.RedactBody(string(data))
+	this.sink.Audit(result)
+	return rsp, nil
+}
+
+// AuditMiddleware 记录用户跳转回来的请求以及支付渠道的异步通知，redactor 为 nil 时使用 DefaultRedactor，
+// 发送给支付渠道的请求需要在创建支付渠道时通过 WithAudit 记录
+func AuditMiddleware(sink AuditSink, redactor *Redactor) Middleware {
+	if redactor == nil {
+		redactor = DefaultRedactor()
+	}
+	return func(next Operation) Operation {
+		return func(call *Call) error {
+			var kind string
+			switch call.Operation {
+			case K_OPERATION_RETURN:
+				kind = K_AUDIT_KIND_RETURN
+			case K_OPERATION_CANCEL:
+				kind = K_AUDIT_KIND_CANCEL
+			case K_OPERATION_NOTIFY:
+				kind = K_AUDIT_KIND_NOTIFY
+			default:
+				return next(call)
+			}
+
+			var start = time.Now()
+			var record = &AuditRecord{}
+			record.Id = newAuditId(start)
+			record.Time = start
+			record.Kind = kind
+			record.Method = call.Request.Method
+			record.URL = redactor.RedactURL(call.Request.URL.String())
+			record.Header = redactor.RedactHeader(call.Request.Header)
+			if call.Request.Body != nil {
+				data, err := ioutil.ReadAll(call.Request.Body)
+				call.Request.Body.Close()
+				call.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+				if err != nil {
+					return err
+				}
+				record.Body = redactor.RedactBody(string(data))
+			}
+
+			var err = next(call)
+			record.Channel, _ = splitChannelKey(call.Channel)
+			record.AccountId = call.AccountId
+			if record.AccountId == "" {
+				record.AccountId = call.Request.URL.Query().Get("account")
+			}
+			record.OrderNo = call.OrderNo
+			record.TradeNo = call.TradeNo
+			if err != nil {
+				record.Error = err.Error()
+			}
+			sink.Audit(record)
+			return err
+		}
+	}
+}
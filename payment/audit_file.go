@@ -0,0 +1,53 @@
+package payment
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONLinesAuditSink 将审计记录以 JSON Lines 格式（每行一条 JSON）写入 io.Writer
+type JSONLinesAuditSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	var s = &JSONLinesAuditSink{}
+	s.w = w
+	return s
+}
+
+// OpenAuditFile 以追加的方式打开审计文件，文件不存在时会创建，文件中包含交易信息，所以只有当前用户可以读写
+func OpenAuditFile(filename string) (*JSONLinesAuditSink, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var s = NewJSONLinesAuditSink(f)
+	s.closer = f
+	return s, nil
+}
+
+func (this *JSONLinesAuditSink) Audit(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	_, err = this.w.Write(data)
+	return err
+}
+
+// Close 关闭通过 OpenAuditFile 打开的文件
+func (this *JSONLinesAuditSink) Close() error {
+	if this.closer == nil {
+		return nil
+	}
+	return this.closer.Close()
+}
@@ -0,0 +1,45 @@
+package payment_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"strings"
+	"testing"
+)
+
+func TestService_Audit(t *testing.T) {
+	var f = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(f)
+
+	var buf = &bytes.Buffer{}
+	s.Use(payment.AuditMiddleware(payment.NewJSONLinesAuditSink(buf), &payment.Redactor{Keys: []string{"payer_id"}}))
+
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("o1")); err != nil {
+		t.Fatal(err)
+	}
+	f.Pay("o1", "payer1")
+	req, _ := f.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	req.URL.RawQuery += "&payer_id=payer1"
+	noti, err := s.NotifyURLHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("只有回调需要记录，实际为 %d 条", len(lines))
+	}
+	var record = &payment.AuditRecord{}
+	if err = json.Unmarshal([]byte(lines[0]), record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Kind != payment.K_AUDIT_KIND_NOTIFY || record.Channel != paymenttest.K_CHANNEL_FAKE || record.OrderNo != "o1" || record.TradeNo != noti.TradeNo {
+		t.Fatalf("审计记录错误: %+v", record)
+	}
+	if strings.Contains(record.URL, "payer1") {
+		t.Fatalf("审计记录没有脱敏: %s", record.URL)
+	}
+}
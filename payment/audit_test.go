@@ -0,0 +1,86 @@
+package payment
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	var r = DefaultRedactor()
+
+	var tests = []struct {
+		body   string
+		expect string
+	}{
+		{`{"payer":{"email_address":"a@b.com","payer_id":"P1"},"cards":[{"number":"4111111111111111","cvv2":"123"}],"amount":10.50}`,
+			`{"amount":10.50,"cards":[{"cvv2":"***","number":"***"}],"payer":{"email_address":"***","payer_id":"P1"}}`},
+		{`<xml><openid><![CDATA[o123]]></openid><SIGN>ABC</SIGN><total_fee>1</total_fee></xml>`,
+			`<xml><openid>***</openid><SIGN>***</SIGN><total_fee>1</total_fee></xml>`},
+		{`app_id=1&biz_content=%7B%22buyer_logon_id%22%3A%22a%40b.com%22%7D&sign=abc`,
+			`app_id=1&biz_content=%7B%22buyer_logon_id%22%3A%22%2A%2A%2A%22%7D&sign=%2A%2A%2A`},
+		{`plain text`, `plain text`},
+	}
+	for _, test := range tests {
+		if actual := r.RedactBody(test.body); actual != test.expect {
+			t.Fatalf("脱敏结果错误，期望 %s，实际为 %s", test.expect, actual)
+		}
+	}
+
+	if u := r.RedactURL("https://example.com/notify?channel=alipay&sign=abc"); u != "https://example.com/notify?channel=alipay&sign=%2A%2A%2A" {
+		t.Fatalf("URL 脱敏错误: %s", u)
+	}
+
+	var header = http.Header{"Authorization": {"Bearer token"}, "Content-Type": {"application/json"}}
+	if h := r.RedactHeader(header); h.Get("Authorization") != "***" || h.Get("Content-Type") != "application/json" || header.Get("Authorization") != "Bearer token" {
+		t.Fatalf("Header 脱敏错误: %v", h)
+	}
+}
+
+func TestAuditTransport(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		w.Write([]byte(`<xml><return_code>SUCCESS</return_code><openid>o123</openid><echo>` + string(data) + `</echo></xml>`))
+	}))
+	defer server.Close()
+
+	var buf = &bytes.Buffer{}
+	var o = newOptions(K_CHANNEL_WXPAY, WithAccountId("hk"), WithAudit(NewJSONLinesAuditSink(buf), nil))
+
+	rsp, err := o.httpClient.Post(server.URL+"/pay/unifiedorder", "text/xml", strings.NewReader("<xml><sign>abc</sign></xml>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if strings.Contains(string(data), "o123") == false {
+		t.Fatal("审计不能修改支付渠道的响应")
+	}
+
+	var records []*AuditRecord
+	var scanner = bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record = &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("应该有 2 条审计记录，实际为 %d", len(records))
+	}
+
+	var req, res = records[0], records[1]
+	if req.Kind != K_AUDIT_KIND_REQUEST || req.Channel != K_CHANNEL_WXPAY || req.AccountId != "hk" || req.Body != "<xml><sign>***</sign></xml>" {
+		t.Fatalf("请求的审计记录错误: %+v", req)
+	}
+	if res.Kind != K_AUDIT_KIND_RESPONSE || res.Id != req.Id || res.Status != http.StatusOK ||
+		strings.Contains(res.Body, "o123") || strings.Contains(res.Body, "abc") {
+		t.Fatalf("响应的审计记录错误: %+v", res)
+	}
+}
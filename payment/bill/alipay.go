@@ -0,0 +1,148 @@
+package bill
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"github.com/smartwalle/m4go/payment"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	k_ALIPAY_BILL_DETAIL_SUFFIX = "业务明细.csv"
+
+	k_ALIPAY_TRADE_NO        = "支付宝交易号"
+	k_ALIPAY_ORDER_NO        = "商户订单号"
+	k_ALIPAY_BIZ_TYPE        = "业务类型"
+	k_ALIPAY_FINISH_TIME     = "完成时间"
+	k_ALIPAY_AMOUNT          = "订单金额（元）"
+	k_ALIPAY_SERVICE_FEE     = "服务费（元）"
+	k_ALIPAY_BIZ_TYPE_REFUND = "退款"
+)
+
+// ParseAliPay 解析支付宝的交易账单，data 为支付宝提供的 zip 压缩包，其中的 csv 文件为 GBK 编码
+func ParseAliPay(data []byte) (result []*BillRecord, err error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range zr.File {
+		// 压缩包中还包含一份汇总文件，只需要处理业务明细
+		if strings.HasSuffix(decodeGBK(f.Name), k_ALIPAY_BILL_DETAIL_SUFFIX) == false {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(simplifiedchinese.GBK.NewDecoder().Reader(rc))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		return parseAliPayDetail(content)
+	}
+	return nil, ErrBillNotFound
+}
+
+// decodeGBK 压缩包中的文件名没有设置 UTF-8 标识时，使用的是 GBK 编码
+func decodeGBK(s string) string {
+	r, err := simplifiedchinese.GBK.NewDecoder().String(s)
+	if err != nil {
+		return s
+	}
+	return r
+}
+
+func parseAliPayDetail(content []byte) (result []*BillRecord, err error) {
+	// 文件的头部和尾部为 # 开头的说明信息
+	var lines = make([]string, 0, 0)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	var r = csv.NewReader(strings.NewReader(strings.Join(lines, "\n")))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	header, err := r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, ErrBillNotFound
+		}
+		return nil, err
+	}
+	var index = headerIndex(header)
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var record = &BillRecord{}
+		record.Channel = payment.K_CHANNEL_ALIPAY
+		record.TradeNo = index.value(row, k_ALIPAY_TRADE_NO)
+		record.OrderNo = index.value(row, k_ALIPAY_ORDER_NO)
+		record.Time = parseTime(index.value(row, k_ALIPAY_FINISH_TIME))
+
+		var amount = parseAmount(index.value(row, k_ALIPAY_AMOUNT))
+		// 支付宝账单中收取的服务费为负数，退还的服务费为正数
+		record.Fee = -parseAmount(index.value(row, k_ALIPAY_SERVICE_FEE))
+
+		if index.value(row, k_ALIPAY_BIZ_TYPE) == k_ALIPAY_BIZ_TYPE_REFUND {
+			record.Refund = math.Abs(amount)
+		} else {
+			record.Amount = amount
+		}
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+type columnIndex map[string]int
+
+func headerIndex(header []string) columnIndex {
+	var index = make(columnIndex)
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	return index
+}
+
+func (this columnIndex) value(row []string, name string) string {
+	var i, ok = this[name]
+	if ok == false || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+// first 返回第一个存在的列的值
+func (this columnIndex) first(row []string, names ...string) string {
+	for _, name := range names {
+		if _, ok := this[name]; ok {
+			return this.value(row, name)
+		}
+	}
+	return ""
+}
+
+func parseAmount(s string) float64 {
+	v, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return v
+}
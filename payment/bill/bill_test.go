@@ -0,0 +1,86 @@
+package bill
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func loadRecords(t *testing.T, file string, parser func([]byte) ([]*BillRecord, error)) []*BillRecord {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := parser(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestParseAliPay(t *testing.T) {
+	var records = loadRecords(t, "testdata/alipay_trade_20180801.zip", ParseAliPay)
+	if len(records) != 4 {
+		t.Fatalf("期望解析出 4 条记录，实际为 %d 条", len(records))
+	}
+
+	var r = records[0]
+	if r.OrderNo != "A1001" || r.TradeNo != "2018080121001004500200566701" || r.Amount != 100 || r.Fee != 0.6 || r.Refund != 0 {
+		t.Fatalf("第 1 条记录解析错误: %+v", r)
+	}
+	if r.Time.Equal(time.Date(2018, 8, 1, 2, 1, 20, 0, time.UTC)) == false {
+		t.Fatalf("完成时间解析错误: %s", r.Time)
+	}
+
+	r = records[2]
+	if r.OrderNo != "A1002" || r.Amount != 0 || r.Refund != 20 || r.Fee != -0.12 {
+		t.Fatalf("退款记录解析错误: %+v", r)
+	}
+}
+
+func TestParseWXPay(t *testing.T) {
+	var records = loadRecords(t, "testdata/wxpay_all_20180801.csv", ParseWXPay)
+	if len(records) != 3 {
+		t.Fatalf("期望解析出 3 条记录，实际为 %d 条", len(records))
+	}
+
+	var r = records[0]
+	if r.OrderNo != "W2001" || r.TradeNo != "4200000162201808011234567801" || r.Amount != 30 || r.Fee != 0.18 {
+		t.Fatalf("第 1 条记录解析错误: %+v", r)
+	}
+
+	r = records[2]
+	if r.OrderNo != "W2002" || r.Amount != 0 || r.Refund != 12.5 || r.Fee != -0.08 {
+		t.Fatalf("退款记录解析错误: %+v", r)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var records = loadRecords(t, "testdata/alipay_trade_20180801.zip", ParseAliPay)
+
+	var local = []*BillRecord{
+		{OrderNo: "A1001", Amount: 100},
+		{OrderNo: "A1002", Amount: 50, Refund: 10},
+		{OrderNo: "A1004", Amount: 1},
+	}
+
+	var result = Diff(records, local)
+	if result.Balanced() {
+		t.Fatal("对账结果不应该一致")
+	}
+	if len(result.Missing) != 1 || result.Missing[0].OrderNo != "A1003" {
+		t.Fatalf("Missing 错误: %+v", result.Missing)
+	}
+	if len(result.Extra) != 1 || result.Extra[0].OrderNo != "A1004" {
+		t.Fatalf("Extra 错误: %+v", result.Extra)
+	}
+	if len(result.Mismatch) != 1 || result.Mismatch[0].OrderNo != "A1002" || result.Mismatch[0].Bill.Refund != 20 {
+		t.Fatalf("Mismatch 错误: %+v", result.Mismatch)
+	}
+
+	local[1].Refund = 20
+	local = append(local[:2], &BillRecord{OrderNo: "A1003", Amount: 8.88})
+	if result = Diff(records, local); result.Balanced() == false {
+		t.Fatalf("对账结果应该一致: %+v", result)
+	}
+}
@@ -0,0 +1,87 @@
+package bill
+
+import (
+	"github.com/smartwalle/math4go"
+)
+
+// Mismatch 金额不一致的交易
+type Mismatch struct {
+	OrderNo string      `json:"order_no"`
+	Bill    *BillRecord `json:"bill"`  // 根据渠道账单汇总之后的记录
+	Local   *BillRecord `json:"local"` // 根据本地记录汇总之后的记录
+}
+
+// DiffResult 对账结果
+type DiffResult struct {
+	Missing  []*BillRecord `json:"missing"`  // 渠道账单中存在，本地记录中缺失的交易
+	Extra    []*BillRecord `json:"extra"`    // 本地记录中存在，渠道账单中没有的交易
+	Mismatch []*Mismatch   `json:"mismatch"` // 支付金额或者退款金额不一致的交易
+}
+
+// Balanced 对账结果是否一致
+func (this *DiffResult) Balanced() bool {
+	return len(this.Missing) == 0 && len(this.Extra) == 0 && len(this.Mismatch) == 0
+}
+
+// Diff 比较渠道账单和本地记录，同一订单的多条记录（如支付和退款）会先按商户订单号进行汇总
+func Diff(bill, local []*BillRecord) (result *DiffResult) {
+	result = &DiffResult{}
+
+	var billKeys, billMap = summarize(bill)
+	var localKeys, localMap = summarize(local)
+
+	for _, key := range billKeys {
+		var b = billMap[key]
+		var l = localMap[key]
+		if l == nil {
+			result.Missing = append(result.Missing, b)
+			continue
+		}
+		if equalAmount(b.Amount, l.Amount) == false || equalAmount(b.Refund, l.Refund) == false {
+			result.Mismatch = append(result.Mismatch, &Mismatch{OrderNo: b.OrderNo, Bill: b, Local: l})
+		}
+	}
+
+	for _, key := range localKeys {
+		if billMap[key] == nil {
+			result.Extra = append(result.Extra, localMap[key])
+		}
+	}
+	return result
+}
+
+// summarize 按商户订单号汇总记录，没有商户订单号的记录使用渠道交易号，返回的 keys 保持记录原有的顺序
+func summarize(records []*BillRecord) (keys []string, result map[string]*BillRecord) {
+	result = make(map[string]*BillRecord)
+	for _, r := range records {
+		if r == nil {
+			continue
+		}
+		var key = r.OrderNo
+		if key == "" {
+			key = r.TradeNo
+		}
+
+		var s = result[key]
+		if s == nil {
+			s = &BillRecord{}
+			s.Channel = r.Channel
+			s.OrderNo = r.OrderNo
+			s.TradeNo = r.TradeNo
+			s.Time = r.Time
+			result[key] = s
+			keys = append(keys, key)
+		}
+		if s.TradeNo == "" {
+			s.TradeNo = r.TradeNo
+		}
+		s.Amount = math4go.Round(s.Amount+r.Amount, 2)
+		s.Fee = math4go.Round(s.Fee+r.Fee, 6)
+		s.Refund = math4go.Round(s.Refund+r.Refund, 2)
+	}
+	return keys, result
+}
+
+func equalAmount(a, b float64) bool {
+	return math4go.Round(a, 2) == math4go.Round(b, 2)
+}
@@ -0,0 +1,65 @@
+package bill
+
+import (
+	"errors"
+	"github.com/smartwalle/m4go/payment"
+	"time"
+)
+
+var (
+	ErrUnknownChannel = errors.New("不支持下载该渠道的账单")
+	ErrBillNotFound   = errors.New("账单文件中没有找到业务明细")
+)
+
+// BillRecord 对账单中的一条记录，各渠道的账单都会转换为该结构
+type BillRecord struct {
+	Channel string    `json:"channel"`
+	OrderNo string    `json:"order_no"` // 商户订单号
+	TradeNo string    `json:"trade_no"` // 渠道交易号
+	Amount  float64   `json:"amount"`   // 支付金额，退款记录为 0
+	Fee     float64   `json:"fee"`      // 手续费，退款时渠道退还的手续费为负数
+	Refund  float64   `json:"refund"`   // 退款金额
+	Time    time.Time `json:"time"`     // 交易完成时间
+}
+
+// Downloader 支持下载对账单的支付渠道（支付宝、微信支付）
+type Downloader interface {
+	Identifier() string
+	DownloadBill(billDate time.Time) (data []byte, err error)
+}
+
+// Fetch 下载指定日期的对账单，并解析为 BillRecord 列表
+func Fetch(d Downloader, billDate time.Time) (result []*BillRecord, err error) {
+	var parser func(data []byte) ([]*BillRecord, error)
+
+	switch d.Identifier() {
+	case payment.K_CHANNEL_ALIPAY:
+		parser = ParseAliPay
+	case payment.K_CHANNEL_WXPAY:
+		parser = ParseWXPay
+	default:
+		return nil, ErrUnknownChannel
+	}
+
+	data, err := d.DownloadBill(billDate)
+	if err != nil {
+		return nil, err
+	}
+	return parser(data)
+}
+
+var location = loadLocation()
+
+// loadLocation 账单中的时间均为北京时间
+func loadLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		loc = time.FixedZone("CST", 8*60*60)
+	}
+	return loc
+}
+
+func parseTime(s string) time.Time {
+	t, _ := time.ParseInLocation("2006-01-02 15:04:05", s, location)
+	return t
+}
@@ -0,0 +1,75 @@
+package bill
+
+import (
+	"encoding/csv"
+	"github.com/smartwalle/m4go/payment"
+	"io"
+	"strings"
+)
+
+const (
+	k_WXPAY_TRADE_TIME    = "交易时间"
+	k_WXPAY_TRADE_NO      = "微信订单号"
+	k_WXPAY_ORDER_NO      = "商户订单号"
+	k_WXPAY_TRADE_STATE   = "交易状态"
+	k_WXPAY_TOTAL_FEE     = "总金额"
+	k_WXPAY_ORDER_FEE     = "订单金额" // 新版账单使用订单金额代替总金额
+	k_WXPAY_REFUND_FEE    = "退款金额"
+	k_WXPAY_SERVICE_FEE   = "手续费"
+	k_WXPAY_SUMMARY_TITLE = "总交易单数"
+
+	k_WXPAY_TRADE_STATE_REFUND = "REFUND"
+)
+
+// ParseWXPay 解析微信支付的对账单，账单中每个字段都以 ` 开头
+func ParseWXPay(data []byte) (result []*BillRecord, err error) {
+	var content = strings.TrimPrefix(string(data), "\ufeff")
+
+	var r = csv.NewReader(strings.NewReader(content))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	header, err := r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, ErrBillNotFound
+		}
+		return nil, err
+	}
+	var index = headerIndex(header)
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range row {
+			row[i] = strings.TrimPrefix(strings.TrimSpace(row[i]), "`")
+		}
+
+		// 明细之后为汇总信息
+		if len(row) > 0 && row[0] == k_WXPAY_SUMMARY_TITLE {
+			break
+		}
+
+		var record = &BillRecord{}
+		record.Channel = payment.K_CHANNEL_WXPAY
+		record.TradeNo = index.value(row, k_WXPAY_TRADE_NO)
+		record.OrderNo = index.value(row, k_WXPAY_ORDER_NO)
+		record.Time = parseTime(index.value(row, k_WXPAY_TRADE_TIME))
+		record.Fee = parseAmount(index.value(row, k_WXPAY_SERVICE_FEE))
+
+		// 退款记录中的总金额为原订单的金额
+		if index.value(row, k_WXPAY_TRADE_STATE) == k_WXPAY_TRADE_STATE_REFUND {
+			record.Refund = parseAmount(index.value(row, k_WXPAY_REFUND_FEE))
+		} else {
+			record.Amount = parseAmount(index.first(row, k_WXPAY_TOTAL_FEE, k_WXPAY_ORDER_FEE))
+		}
+		result = append(result, record)
+	}
+	return result, nil
+}
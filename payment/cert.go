@@ -0,0 +1,45 @@
+package payment
+
+import (
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/crypto/pkcs12"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// LoadClientCert 从 PEM 格式的证书文件和私钥文件中加载客户端证书，例如微信支付的 apiclient_cert.pem 和 apiclient_key.pem
+func LoadClientCert(certFile, keyFile string) (cert tls.Certificate, err error) {
+	if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return cert, fmt.Errorf("加载客户端证书 %s 失败: %v", certFile, err)
+	}
+	return cert, nil
+}
+
+// LoadPKCS12ClientCert 从 PKCS#12 格式（.p12 或者 .pfx）的文件中加载客户端证书，例如微信支付的 apiclient_cert.p12，
+// 微信支付证书的密码默认为商户号
+func LoadPKCS12ClientCert(file, password string) (cert tls.Certificate, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return cert, err
+	}
+
+	key, leaf, err := pkcs12.Decode(data, password)
+	if err != nil {
+		return cert, fmt.Errorf("加载客户端证书 %s 失败: %v", file, err)
+	}
+	cert.Certificate = [][]byte{leaf.Raw}
+	cert.PrivateKey = key
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+// IsPKCS12File 根据文件的扩展名判断是否为 PKCS#12 格式的证书
+func IsPKCS12File(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".p12", ".pfx":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// payctl 支付调试工具，用于重放记录的异步通知、生成模拟的异步通知以及查询交易：
+//
+//	payctl replay -url http://127.0.0.1:5000/pay/notify notify.txt
+//	payctl notify -channel wxpay -config sandbox.json -key <测试 API 密钥> -order o1 -amount 20.00 > notify.txt
+//	payctl query -channel alipay -config payment.json -order o1
+//
+// 没有设置 -config 时从 PAYMENT_ 开头的环境变量中加载配置
+package main
+
+import (
+	"fmt"
+	"github.com/smartwalle/m4go/payment/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"sort"
+	"strings"
+)
+
+var commands = map[string]struct {
+	run   func(args []string) error
+	usage string
+}{
+	"replay": {replay, "将记录的原始通知重新发送到 NotifyURLHandler"},
+	"notify": {notify, "生成签名的模拟通知，并输出或者发送到 NotifyURLHandler"},
+	"query":  {query, "使用配置文件中的商户信息查询交易"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var cmd, ok = commands[os.Args[1]]
+	if ok == false {
+		fmt.Fprintf(os.Stderr, "payctl: 未知的命令 %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "payctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	var names = make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "用法: payctl <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "使用 payctl <command> -h 查看命令的参数")
+}
+
+// loadConfig filename 为空时从环境变量中加载配置
+func loadConfig(filename string) (*config.Config, error) {
+	if filename == "" {
+		return config.LoadEnv("PAYMENT"), nil
+	}
+	return config.LoadFile(filename)
+}
+
+// readKey 如果 value 是 PEM 格式的内容则直接返回，否则将 value 作为文件路径读取
+func readKey(value string) (string, error) {
+	if value == "" || strings.Contains(value, "-----BEGIN") {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// send 发送请求并输出响应的状态和内容，响应的状态不是 2xx 时返回错误
+func send(req *http.Request) error {
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := httputil.DumpResponse(rsp, true)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(data)
+	fmt.Println()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("%s 返回 %s", req.URL, rsp.Status)
+	}
+	return nil
+}
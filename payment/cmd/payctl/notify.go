@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/config"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+)
+
+func notify(args []string) error {
+	var fs = flag.NewFlagSet("notify", flag.ExitOnError)
+	var channel = fs.String("channel", "", "支付渠道：alipay、wxpay 或者 paypal")
+	var configFile = fs.String("config", "", "配置文件，用于获取应用 ID 和商户号，只能使用测试环境（sandbox）的配置")
+	var key = fs.String("key", "", "通知的签名密钥，只能使用测试密钥：支付宝为与配置中的支付宝公钥对应的私钥（PEM 内容或者文件路径），微信支付为 API 密钥")
+	var signType = fs.String("sign-type", "", "微信支付的签名方式：MD5 或者 HMAC-SHA256，默认为 MD5")
+	var target = fs.String("url", "http://127.0.0.1:5000/pay/notify", "接收通知的 URL")
+	var orderNo = fs.String("order", "", "订单号")
+	var tradeNo = fs.String("trade", "", "交易号，为空时自动生成")
+	var amount = fs.String("amount", "0.01", "交易金额")
+	var currency = fs.String("currency", "", "货币代码，为空时使用支付渠道默认的货币")
+	var payerId = fs.String("payer", "", "付款人的 ID，例如微信支付的 openid")
+	var account = fs.String("account", "", "商户账号")
+	var event = fs.String("event", paymenttest.K_PAYPAL_EVENT_SALE_COMPLETED, "PayPal 的事件类型")
+	var post = fs.Bool("send", false, "将通知发送到 -url，默认只输出原始的 HTTP 请求，可以保存之后使用 payctl replay 发送")
+	fs.Parse(args)
+
+	if *orderNo == "" {
+		return errors.New("缺少 -order")
+	}
+	totalAmount, err := strconv.ParseFloat(*amount, 64)
+	if err != nil || totalAmount <= 0 {
+		return fmt.Errorf("无效的金额 %s", *amount)
+	}
+
+	var n = &paymenttest.SampleNotification{}
+	n.NotifyURL = *target
+	n.AccountId = *account
+	n.OrderNo = *orderNo
+	n.TradeNo = *tradeNo
+	n.TotalAmount = totalAmount
+	n.Currency = *currency
+	n.PayerId = *payerId
+	n.EventType = *event
+
+	var req *http.Request
+	switch *channel {
+	case payment.K_CHANNEL_ALIPAY:
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		if c.AliPay == nil {
+			return errors.New("配置中没有支付宝")
+		}
+		if err = checkSandbox(c, c.AliPay.Environment); err != nil {
+			return err
+		}
+		privateKey, err := readKey(*key)
+		if err != nil {
+			return err
+		}
+		if privateKey == "" {
+			return errors.New("缺少 -key")
+		}
+		if req, err = paymenttest.NewAliPayNotification(c.AliPay.AppId, privateKey, n); err != nil {
+			return err
+		}
+	case payment.K_CHANNEL_WXPAY:
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			return err
+		}
+		if c.WXPay == nil {
+			return errors.New("配置中没有微信支付")
+		}
+		if err = checkSandbox(c, c.WXPay.Environment); err != nil {
+			return err
+		}
+		// 不使用配置中的 API 密钥，避免使用真实的密钥伪造通知
+		if *key == "" {
+			return errors.New("缺少 -key")
+		}
+		if req, err = paymenttest.NewWXPayNotification(c.WXPay.AppId, c.WXPay.MchId, *key, *signType, n); err != nil {
+			return err
+		}
+	case payment.K_CHANNEL_PAYPAL:
+		if req, err = paymenttest.NewPayPalNotification(n); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("未知的支付渠道 %s", *channel)
+	}
+
+	if *post {
+		return send(req)
+	}
+	data, err := httputil.DumpRequest(req, true)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(data)
+	return nil
+}
+
+// checkSandbox 模拟通知只能使用测试环境的配置，env 为支付渠道的环境，为空时使用配置的默认环境
+func checkSandbox(c *config.Config, env string) error {
+	if env == "" {
+		env = c.Environment
+	}
+	if env == config.K_ENVIRONMENT_PRODUCTION {
+		return errors.New("不能使用生产环境的配置生成模拟通知")
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNotify_Sandbox(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "payctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var write = func(name, environment string) string {
+		var filename = filepath.Join(dir, name)
+		var data = `{"environment": "` + environment + `", "wxpay": {"app_id": "wx1", "mch_id": "mch1", "api_key": "key1"}}`
+		if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	var sandbox = write("sandbox.json", "sandbox")
+	var production = write("production.json", "production")
+
+	var tests = []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-config", sandbox}, "缺少 -key"},
+		{[]string{"-config", production, "-key", "test"}, "生产环境"},
+	}
+	for _, test := range tests {
+		var args = append([]string{"-channel", "wxpay", "-order", "o1"}, test.args...)
+		if err := notify(args); err == nil || strings.Contains(err.Error(), test.err) == false {
+			t.Errorf("%v 期望的错误信息包含 %s，实际为 %v", test.args, test.err, err)
+		}
+	}
+}
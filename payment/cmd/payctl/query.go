@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/config"
+	"os"
+)
+
+func query(args []string) error {
+	var fs = flag.NewFlagSet("query", flag.ExitOnError)
+	var channel = fs.String("channel", "", "支付渠道：alipay、wxpay 或者 paypal")
+	var configFile = fs.String("config", "", "配置文件")
+	var orderNo = fs.String("order", "", "订单号")
+	var tradeNo = fs.String("trade", "", "交易号，设置之后忽略 -order")
+	fs.Parse(args)
+
+	if *orderNo == "" && *tradeNo == "" {
+		return errors.New("缺少 -order 或者 -trade")
+	}
+
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	s, err := config.NewService(c)
+	if err != nil {
+		return err
+	}
+
+	var trade *payment.Trade
+	if *tradeNo != "" {
+		trade, err = s.GetTrade(*channel, *tradeNo)
+	} else {
+		trade, err = s.GetTradeWithOrderNo(*channel, *orderNo)
+	}
+	if err != nil {
+		return err
+	}
+
+	var encoder = json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(trade)
+}
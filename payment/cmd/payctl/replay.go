@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/smartwalle/m4go/payment"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// requestLine 原始 HTTP 请求的第一行，例如 POST /pay/notify?channel=alipay HTTP/1.1
+var requestLine = regexp.MustCompile(`^[A-Z]+ \S+ HTTP/\d\.\d\r?\n`)
+
+func replay(args []string) error {
+	var fs = flag.NewFlagSet("replay", flag.ExitOnError)
+	var target = fs.String("url", "http://127.0.0.1:5000/pay/notify", "接收通知的 URL，会替换记录中的地址，记录中的 URL 参数会保留")
+	var channel = fs.String("channel", "", "支付渠道，文件中只有通知的内容时必须设置")
+	var account = fs.String("account", "", "商户账号，文件中只有通知的内容时使用")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法: payctl replay [flags] file...")
+		fmt.Fprintln(fs.Output(), "")
+		fmt.Fprintln(fs.Output(), "file 可以是原始的 HTTP 请求（例如 payctl notify 的输出），也可以只有通知的内容（需要设置 -channel）")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("缺少通知文件")
+	}
+
+	for _, filename := range fs.Args() {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		req, err := replayRequest(data, *target, *channel, *account)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if err = send(req); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return nil
+}
+
+// replayRequest 根据记录的通知生成发送到 target 的请求，data 为原始的 HTTP 请求时保留请求的方法、URL 参数和 Header，
+// 否则将 data 作为通知的内容，并根据 channel 添加 URL 参数和 Content-Type
+func replayRequest(data []byte, target, channel, accountId string) (*http.Request, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if requestLine.Match(data) {
+		return parseRawRequest(data, u)
+	}
+
+	if channel == "" {
+		return nil, errors.New("文件中只有通知的内容，需要设置 -channel")
+	}
+
+	var query = u.Query()
+	query.Set("channel", channel)
+	if accountId != "" {
+		query.Set("account", accountId)
+	}
+	if channel == payment.K_CHANNEL_WXPAY && query.Get("notify_type") == "" {
+		query.Set("notify_type", "trade")
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType(data))
+	return req, nil
+}
+
+// parseRawRequest 解析原始的 HTTP 请求，请求头和内容之间使用空行分隔，内容的长度以实际的内容为准
+func parseRawRequest(data []byte, target *url.URL) (*http.Request, error) {
+	var head, body = data, []byte(nil)
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(data, []byte(sep)); i >= 0 {
+			head, body = data[:i+len(sep)], data[i+len(sep):]
+			break
+		}
+	}
+
+	raw, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, err
+	}
+
+	var u = *target
+	if raw.URL.RawQuery != "" {
+		u.RawQuery = raw.URL.RawQuery
+	}
+
+	req, err := http.NewRequest(raw.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range raw.Header {
+		if key == "Content-Length" {
+			continue
+		}
+		req.Header[key] = values
+	}
+	return req, nil
+}
+
+func contentType(data []byte) string {
+	var content = strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(content, "<"):
+		return "text/xml"
+	case strings.HasPrefix(content, "{"):
+		return "application/json"
+	}
+	return "application/x-www-form-urlencoded"
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"io/ioutil"
+	"net/http/httputil"
+	"strings"
+	"testing"
+)
+
+func TestReplayRequest(t *testing.T) {
+	sample, err := paymenttest.NewWXPayNotification("wx1", "mch1", "key1", "", &paymenttest.SampleNotification{NotifyURL: "http://pay.example.com/notify", OrderNo: "o1", TotalAmount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := httputil.DumpRequest(sample, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampleBody, _ := ioutil.ReadAll(sample.Body)
+
+	// 原始的 HTTP 请求，保留 URL 参数和 Header，地址替换为 target
+	req, err := replayRequest(raw, "http://127.0.0.1:5000/pay/notify", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.URL.Host != "127.0.0.1:5000" || req.URL.Query().Get("channel") != "wxpay" || req.URL.Query().Get("order_no") != "o1" {
+		t.Fatalf("请求的 URL 错误: %s", req.URL)
+	}
+	if req.Header.Get("Content-Type") != "text/xml" || string(body) != string(sampleBody) {
+		t.Fatalf("请求的内容错误: %v %s", req.Header, body)
+	}
+
+	// 只有通知的内容
+	if _, err = replayRequest([]byte("<xml></xml>"), "http://127.0.0.1:5000/pay/notify", "", ""); err == nil {
+		t.Fatal("没有设置支付渠道时应该返回错误")
+	}
+	req, err = replayRequest([]byte("trade_no=1&sign=abc"), "http://127.0.0.1:5000/pay/notify", "alipay", "hk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.RawQuery != "account=hk&channel=alipay" || strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") == false {
+		t.Fatalf("请求错误: %s %v", req.URL, req.Header)
+	}
+}
@@ -0,0 +1,391 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/smartwalle/m4go/payment"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	K_ENVIRONMENT_SANDBOX    = "sandbox"
+	K_ENVIRONMENT_PRODUCTION = "production"
+)
+
+// Config 支付服务的配置信息，NotifyURL、ReturnURL、CancelURL、Environment 为各支付渠道的默认值，
+// 支付渠道可以单独设置这些值进行覆盖
+type Config struct {
+	Environment string `json:"environment"` // sandbox 或者 production，默认为 sandbox
+	NotifyURL   string `json:"notify_url"`
+	ReturnURL   string `json:"return_url"`
+	CancelURL   string `json:"cancel_url"`
+	Timeout     string `json:"timeout"` // 请求支付渠道接口的超时时间，例如 10s
+
+	AliPay *AliPayConfig `json:"alipay"`
+	WXPay  *WXPayConfig  `json:"wxpay"`
+	PayPal *PayPalConfig `json:"paypal"`
+
+	// PayPalV2 使用 PayPal Orders v2 接口的支付渠道，可以与 PayPal 同时配置，ExperienceProfileId 不生效
+	PayPalV2 *PayPalConfig `json:"paypal_v2"`
+}
+
+// AliPayConfig 支付宝配置，PublicKey 和 PrivateKey 可以是 PEM 格式的字符串，也可以是密钥文件的路径
+type AliPayConfig struct {
+	AppId       string `json:"app_id"`
+	PartnerId   string `json:"partner_id"`
+	PublicKey   string `json:"public_key"`  // 支付宝公钥
+	PrivateKey  string `json:"private_key"` // 应用私钥
+	Environment string `json:"environment"`
+	NotifyURL   string `json:"notify_url"`
+	ReturnURL   string `json:"return_url"`
+	CancelURL   string `json:"cancel_url"`
+	BaseURL     string `json:"base_url"`
+}
+
+// WXPayConfig 微信支付配置，Cert 和 Key 为商户证书（退款等接口需要），可以是 PEM 格式的字符串，也可以是文件的路径，
+// Cert 为 PKCS#12 格式的文件（apiclient_cert.p12）时不需要配置 Key，证书的密码为商户号
+type WXPayConfig struct {
+	AppId       string `json:"app_id"`
+	MchId       string `json:"mch_id"`
+	APIKey      string `json:"api_key"`
+	Cert        string `json:"cert"`
+	Key         string `json:"key"`
+	Environment string `json:"environment"`
+	NotifyURL   string `json:"notify_url"`
+	BaseURL     string `json:"base_url"`
+}
+
+// PayPalConfig PayPal 配置
+type PayPalConfig struct {
+	ClientId            string `json:"client_id"`
+	Secret              string `json:"secret"`
+	WebHookId           string `json:"webhook_id"`
+	ExperienceProfileId string `json:"experience_profile_id"`
+	Environment         string `json:"environment"`
+	ReturnURL           string `json:"return_url"`
+	CancelURL           string `json:"cancel_url"`
+	BaseURL             string `json:"base_url"`
+}
+
+// LoadFile 从 JSON 文件中加载配置信息
+func LoadFile(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var c = &Config{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("config: 解析配置文件 %s 失败: %v", filename, err)
+	}
+	return c, nil
+}
+
+// NewService 根据配置信息创建 Service，并注册配置中包含的支付渠道，opts 会应用到所有的支付渠道上
+func NewService(c *Config, opts ...payment.Option) (*payment.Service, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	if c.Timeout != "" {
+		timeout, _ := time.ParseDuration(c.Timeout)
+		opts = append([]payment.Option{payment.WithTimeout(timeout)}, opts...)
+	}
+
+	var s = payment.NewService()
+
+	if c.AliPay != nil {
+		ap, err := c.newAliPay(opts...)
+		if err != nil {
+			return nil, err
+		}
+		s.RegisterChannel(ap)
+	}
+
+	if c.WXPay != nil {
+		wp, err := c.newWXPay(opts...)
+		if err != nil {
+			return nil, err
+		}
+		s.RegisterChannel(wp)
+	}
+
+	if c.PayPal != nil {
+		s.RegisterChannel(c.newPayPal(opts...))
+	}
+
+	if c.PayPalV2 != nil {
+		s.RegisterChannel(c.newPayPalV2(opts...))
+	}
+
+	return s, nil
+}
+
+func (this *Config) newAliPay(opts ...payment.Option) (*payment.AliPay, error) {
+	var ac = this.AliPay
+	publicKey, err := loadPEM(ac.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := loadPEM(ac.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if ac.BaseURL != "" {
+		opts = append(opts, payment.WithBaseURL(ac.BaseURL))
+	}
+
+	var ap = payment.NewAliPay(ac.AppId, ac.PartnerId, publicKey, privateKey, this.isProduction(ac.Environment), opts...)
+	ap.NotifyURL = firstOf(ac.NotifyURL, this.NotifyURL)
+	ap.ReturnURL = firstOf(ac.ReturnURL, this.ReturnURL)
+	ap.CancelURL = firstOf(ac.CancelURL, this.CancelURL)
+	return ap, nil
+}
+
+func (this *Config) newWXPay(opts ...payment.Option) (*payment.WXPay, error) {
+	var wc = this.WXPay
+	if payment.IsPKCS12File(wc.Cert) {
+		pair, err := payment.LoadPKCS12ClientCert(wc.Cert, wc.MchId)
+		if err != nil {
+			return nil, fmt.Errorf("config: 加载微信支付商户证书失败: %v", err)
+		}
+		opts = append(opts, payment.WithClientCert(pair))
+	} else if wc.Cert != "" {
+		cert, err := loadPEM(wc.Cert)
+		if err != nil {
+			return nil, err
+		}
+		key, err := loadPEM(wc.Key)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("config: 加载微信支付商户证书失败: %v", err)
+		}
+		opts = append(opts, payment.WithClientCert(pair))
+	}
+	if wc.BaseURL != "" {
+		opts = append(opts, payment.WithBaseURL(wc.BaseURL))
+	}
+
+	var wp = payment.NewWXPal(wc.AppId, wc.APIKey, wc.MchId, this.isProduction(wc.Environment), opts...)
+	wp.NotifyURL = firstOf(wc.NotifyURL, this.NotifyURL)
+	return wp, nil
+}
+
+func (this *Config) newPayPal(opts ...payment.Option) *payment.PayPal {
+	var pc = this.PayPal
+	if pc.BaseURL != "" {
+		opts = append(opts, payment.WithBaseURL(pc.BaseURL))
+	}
+
+	var pp = payment.NewPayPal(pc.ClientId, pc.Secret, this.isProduction(pc.Environment), opts...)
+	pp.ReturnURL = firstOf(pc.ReturnURL, this.ReturnURL)
+	pp.CancelURL = firstOf(pc.CancelURL, this.CancelURL)
+	pp.WebHookId = pc.WebHookId
+	pp.ExperienceProfileId = pc.ExperienceProfileId
+	return pp
+}
+
+func (this *Config) newPayPalV2(opts ...payment.Option) *payment.PayPalV2 {
+	var pc = this.PayPalV2
+	if pc.BaseURL != "" {
+		opts = append(opts, payment.WithBaseURL(pc.BaseURL))
+	}
+
+	var pp = payment.NewPayPalV2(pc.ClientId, pc.Secret, this.isProduction(pc.Environment), opts...)
+	pp.ReturnURL = firstOf(pc.ReturnURL, this.ReturnURL)
+	pp.CancelURL = firstOf(pc.CancelURL, this.CancelURL)
+	pp.WebHookId = pc.WebHookId
+	return pp
+}
+
+func (this *Config) isProduction(env string) bool {
+	return firstOf(env, this.Environment) == K_ENVIRONMENT_PRODUCTION
+}
+
+// Validate 验证配置信息，返回的错误信息中包含出错的配置项
+func (this *Config) Validate() error {
+	if err := checkEnvironment("environment", this.Environment); err != nil {
+		return err
+	}
+	if this.Timeout != "" {
+		if d, err := time.ParseDuration(this.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("config: timeout 无效: %s", this.Timeout)
+		}
+	}
+	if err := checkURLs(map[string]string{"notify_url": this.NotifyURL, "return_url": this.ReturnURL, "cancel_url": this.CancelURL}); err != nil {
+		return err
+	}
+
+	if this.AliPay == nil && this.WXPay == nil && this.PayPal == nil && this.PayPalV2 == nil {
+		return fmt.Errorf("config: 至少需要配置一个支付渠道")
+	}
+
+	if ac := this.AliPay; ac != nil {
+		if err := checkRequired(map[string]string{"alipay.app_id": ac.AppId, "alipay.public_key": ac.PublicKey, "alipay.private_key": ac.PrivateKey}); err != nil {
+			return err
+		}
+		if err := checkEnvironment("alipay.environment", ac.Environment); err != nil {
+			return err
+		}
+		if err := checkRSAKey("alipay.public_key", ac.PublicKey, false); err != nil {
+			return err
+		}
+		if err := checkRSAKey("alipay.private_key", ac.PrivateKey, true); err != nil {
+			return err
+		}
+		if err := checkURLs(map[string]string{"alipay.notify_url": ac.NotifyURL, "alipay.return_url": ac.ReturnURL, "alipay.cancel_url": ac.CancelURL, "alipay.base_url": ac.BaseURL}); err != nil {
+			return err
+		}
+		if firstOf(ac.NotifyURL, this.NotifyURL) == "" {
+			return fmt.Errorf("config: alipay.notify_url 不能为空")
+		}
+	}
+
+	if wc := this.WXPay; wc != nil {
+		if err := checkRequired(map[string]string{"wxpay.app_id": wc.AppId, "wxpay.mch_id": wc.MchId, "wxpay.api_key": wc.APIKey}); err != nil {
+			return err
+		}
+		if err := checkEnvironment("wxpay.environment", wc.Environment); err != nil {
+			return err
+		}
+		if (wc.Cert == "") != (wc.Key == "") && payment.IsPKCS12File(wc.Cert) == false {
+			return fmt.Errorf("config: wxpay.cert 和 wxpay.key 需要同时配置")
+		}
+		if err := checkURLs(map[string]string{"wxpay.notify_url": wc.NotifyURL, "wxpay.base_url": wc.BaseURL}); err != nil {
+			return err
+		}
+		if firstOf(wc.NotifyURL, this.NotifyURL) == "" {
+			return fmt.Errorf("config: wxpay.notify_url 不能为空")
+		}
+	}
+
+	if err := this.checkPayPal("paypal", this.PayPal); err != nil {
+		return err
+	}
+	if err := this.checkPayPal("paypal_v2", this.PayPalV2); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkPayPal 验证 PayPal 的配置，name 为配置项的前缀
+func (this *Config) checkPayPal(name string, pc *PayPalConfig) error {
+	if pc == nil {
+		return nil
+	}
+	if err := checkRequired(map[string]string{name + ".client_id": pc.ClientId, name + ".secret": pc.Secret}); err != nil {
+		return err
+	}
+	if err := checkEnvironment(name+".environment", pc.Environment); err != nil {
+		return err
+	}
+	if err := checkURLs(map[string]string{name + ".return_url": pc.ReturnURL, name + ".cancel_url": pc.CancelURL, name + ".base_url": pc.BaseURL}); err != nil {
+		return err
+	}
+	if firstOf(pc.ReturnURL, this.ReturnURL) == "" || firstOf(pc.CancelURL, this.CancelURL) == "" {
+		return fmt.Errorf("config: %s.return_url 和 %s.cancel_url 不能为空", name, name)
+	}
+	return nil
+}
+
+func checkEnvironment(name, env string) error {
+	switch env {
+	case "", K_ENVIRONMENT_SANDBOX, K_ENVIRONMENT_PRODUCTION:
+		return nil
+	}
+	return fmt.Errorf("config: %s 只能为 %s 或者 %s，当前为 %s", name, K_ENVIRONMENT_SANDBOX, K_ENVIRONMENT_PRODUCTION, env)
+}
+
+func checkRequired(values map[string]string) error {
+	for _, name := range sortedKeys(values) {
+		if strings.TrimSpace(values[name]) == "" {
+			return fmt.Errorf("config: %s 不能为空", name)
+		}
+	}
+	return nil
+}
+
+func checkURLs(values map[string]string) error {
+	for _, name := range sortedKeys(values) {
+		var value = values[name]
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("config: %s 不是有效的 URL: %s", name, value)
+		}
+	}
+	return nil
+}
+
+func checkRSAKey(name, value string, isPrivate bool) error {
+	data, err := loadPEM(value)
+	if err != nil {
+		return fmt.Errorf("config: 读取 %s 失败: %v", name, err)
+	}
+
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return fmt.Errorf("config: %s 不是有效的 PEM 格式", name)
+	}
+
+	var key interface{}
+	if isPrivate {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s 解析失败: %v", name, err)
+	}
+
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return nil
+	}
+	return fmt.Errorf("config: %s 不是 RSA 密钥", name)
+}
+
+// loadPEM 如果 value 是 PEM 格式的内容则直接返回，否则将 value 作为文件路径读取文件内容
+func loadPEM(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "-----BEGIN") {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// LoadEnv 从环境变量中加载配置信息，prefix 为环境变量的前缀，例如 prefix 为 PAYMENT 时：
+//
+// PAYMENT_ENVIRONMENT、PAYMENT_NOTIFY_URL、PAYMENT_RETURN_URL、PAYMENT_CANCEL_URL、PAYMENT_TIMEOUT
+//
+// PAYMENT_ALIPAY_APP_ID、PAYMENT_ALIPAY_PARTNER_ID、PAYMENT_ALIPAY_PUBLIC_KEY、PAYMENT_ALIPAY_PRIVATE_KEY、
+// PAYMENT_ALIPAY_ENVIRONMENT、PAYMENT_ALIPAY_NOTIFY_URL、PAYMENT_ALIPAY_RETURN_URL、PAYMENT_ALIPAY_CANCEL_URL、PAYMENT_ALIPAY_BASE_URL
+//
+// PAYMENT_WXPAY_APP_ID、PAYMENT_WXPAY_MCH_ID、PAYMENT_WXPAY_API_KEY、PAYMENT_WXPAY_CERT、PAYMENT_WXPAY_KEY、
+// PAYMENT_WXPAY_ENVIRONMENT、PAYMENT_WXPAY_NOTIFY_URL、PAYMENT_WXPAY_BASE_URL
+//
+// PAYMENT_PAYPAL_CLIENT_ID、PAYMENT_PAYPAL_SECRET、PAYMENT_PAYPAL_WEBHOOK_ID、PAYMENT_PAYPAL_EXPERIENCE_PROFILE_ID、
+// PAYMENT_PAYPAL_ENVIRONMENT、PAYMENT_PAYPAL_RETURN_URL、PAYMENT_PAYPAL_CANCEL_URL、PAYMENT_PAYPAL_BASE_URL
+//
+// PAYMENT_PAYPAL_V2_CLIENT_ID、PAYMENT_PAYPAL_V2_SECRET、PAYMENT_PAYPAL_V2_WEBHOOK_ID、
+// PAYMENT_PAYPAL_V2_ENVIRONMENT、PAYMENT_PAYPAL_V2_RETURN_URL、PAYMENT_PAYPAL_V2_CANCEL_URL、PAYMENT_PAYPAL_V2_BASE_URL
+//
+// 只有设置了 ALIPAY_APP_ID、WXPAY_APP_ID、PAYPAL_CLIENT_ID、PAYPAL_V2_CLIENT_ID 的支付渠道才会被加载
+func LoadEnv(prefix string) *Config {
+	var env = func(name string) string {
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		return strings.TrimSpace(os.Getenv(name))
+	}
+
+	var c = &Config{}
+	c.Environment = env("ENVIRONMENT")
+	c.NotifyURL = env("NOTIFY_URL")
+	c.ReturnURL = env("RETURN_URL")
+	c.CancelURL = env("CANCEL_URL")
+	c.Timeout = env("TIMEOUT")
+
+	if appId := env("ALIPAY_APP_ID"); appId != "" {
+		var ac = &AliPayConfig{}
+		ac.AppId = appId
+		ac.PartnerId = env("ALIPAY_PARTNER_ID")
+		ac.PublicKey = env("ALIPAY_PUBLIC_KEY")
+		ac.PrivateKey = env("ALIPAY_PRIVATE_KEY")
+		ac.Environment = env("ALIPAY_ENVIRONMENT")
+		ac.NotifyURL = env("ALIPAY_NOTIFY_URL")
+		ac.ReturnURL = env("ALIPAY_RETURN_URL")
+		ac.CancelURL = env("ALIPAY_CANCEL_URL")
+		ac.BaseURL = env("ALIPAY_BASE_URL")
+		c.AliPay = ac
+	}
+
+	if appId := env("WXPAY_APP_ID"); appId != "" {
+		var wc = &WXPayConfig{}
+		wc.AppId = appId
+		wc.MchId = env("WXPAY_MCH_ID")
+		wc.APIKey = env("WXPAY_API_KEY")
+		wc.Cert = env("WXPAY_CERT")
+		wc.Key = env("WXPAY_KEY")
+		wc.Environment = env("WXPAY_ENVIRONMENT")
+		wc.NotifyURL = env("WXPAY_NOTIFY_URL")
+		wc.BaseURL = env("WXPAY_BASE_URL")
+		c.WXPay = wc
+	}
+
+	if clientId := env("PAYPAL_CLIENT_ID"); clientId != "" {
+		var pc = &PayPalConfig{}
+		pc.ClientId = clientId
+		pc.Secret = env("PAYPAL_SECRET")
+		pc.WebHookId = env("PAYPAL_WEBHOOK_ID")
+		pc.ExperienceProfileId = env("PAYPAL_EXPERIENCE_PROFILE_ID")
+		pc.Environment = env("PAYPAL_ENVIRONMENT")
+		pc.ReturnURL = env("PAYPAL_RETURN_URL")
+		pc.CancelURL = env("PAYPAL_CANCEL_URL")
+		pc.BaseURL = env("PAYPAL_BASE_URL")
+		c.PayPal = pc
+	}
+
+	if clientId := env("PAYPAL_V2_CLIENT_ID"); clientId != "" {
+		var pc = &PayPalConfig{}
+		pc.ClientId = clientId
+		pc.Secret = env("PAYPAL_V2_SECRET")
+		pc.WebHookId = env("PAYPAL_V2_WEBHOOK_ID")
+		pc.Environment = env("PAYPAL_V2_ENVIRONMENT")
+		pc.ReturnURL = env("PAYPAL_V2_RETURN_URL")
+		pc.CancelURL = env("PAYPAL_V2_CANCEL_URL")
+		pc.BaseURL = env("PAYPAL_V2_BASE_URL")
+		c.PayPalV2 = pc
+	}
+
+	return c
+}
@@ -0,0 +1,96 @@
+package payment
+
+import (
+	"math"
+	"strconv"
+)
+
+const (
+	K_CURRENCY_CNY = "CNY"
+	K_CURRENCY_USD = "USD"
+)
+
+// currencies ISO-4217 中现行的货币代码以及对应的小数位数，不包括贵金属（XAU 等）、测试代码（XTS）
+// 等没有小数位数的代码
+var currencies = map[string]int{
+	"AED": 2, "AFN": 2, "ALL": 2, "AMD": 2, "ANG": 2, "AOA": 2, "ARS": 2, "AUD": 2,
+	"AWG": 2, "AZN": 2, "BAM": 2, "BBD": 2, "BDT": 2, "BGN": 2, "BHD": 3, "BIF": 0,
+	"BMD": 2, "BND": 2, "BOB": 2, "BOV": 2, "BRL": 2, "BSD": 2, "BTN": 2, "BWP": 2,
+	"BYN": 2, "BZD": 2, "CAD": 2, "CDF": 2, "CHE": 2, "CHF": 2, "CHW": 2, "CLF": 4,
+	"CLP": 0, "CNY": 2, "COP": 2, "COU": 2, "CRC": 2, "CUC": 2, "CUP": 2, "CVE": 2,
+	"CZK": 2, "DJF": 0, "DKK": 2, "DOP": 2, "DZD": 2, "EGP": 2, "ERN": 2, "ETB": 2,
+	"EUR": 2, "FJD": 2, "FKP": 2, "GBP": 2, "GEL": 2, "GHS": 2, "GIP": 2, "GMD": 2,
+	"GNF": 0, "GTQ": 2, "GYD": 2, "HKD": 2, "HNL": 2, "HTG": 2, "HUF": 2, "IDR": 2,
+	"ILS": 2, "INR": 2, "IQD": 3, "IRR": 2, "ISK": 0, "JMD": 2, "JOD": 3, "JPY": 0,
+	"KES": 2, "KGS": 2, "KHR": 2, "KMF": 0, "KPW": 2, "KRW": 0, "KWD": 3, "KYD": 2,
+	"KZT": 2, "LAK": 2, "LBP": 2, "LKR": 2, "LRD": 2, "LSL": 2, "LYD": 3, "MAD": 2,
+	"MDL": 2, "MGA": 2, "MKD": 2, "MMK": 2, "MNT": 2, "MOP": 2, "MRU": 2, "MUR": 2,
+	"MVR": 2, "MWK": 2, "MXN": 2, "MXV": 2, "MYR": 2, "MZN": 2, "NAD": 2, "NGN": 2,
+	"NIO": 2, "NOK": 2, "NPR": 2, "NZD": 2, "OMR": 3, "PAB": 2, "PEN": 2, "PGK": 2,
+	"PHP": 2, "PKR": 2, "PLN": 2, "PYG": 0, "QAR": 2, "RON": 2, "RSD": 2, "RUB": 2,
+	"RWF": 0, "SAR": 2, "SBD": 2, "SCR": 2, "SDG": 2, "SEK": 2, "SGD": 2, "SHP": 2,
+	"SLE": 2, "SLL": 2, "SOS": 2, "SRD": 2, "SSP": 2, "STN": 2, "SVC": 2, "SYP": 2,
+	"SZL": 2, "THB": 2, "TJS": 2, "TMT": 2, "TND": 3, "TOP": 2, "TRY": 2, "TTD": 2,
+	"TWD": 2, "TZS": 2, "UAH": 2, "UGX": 0, "USD": 2, "USN": 2, "UYI": 0, "UYU": 2,
+	"UYW": 4, "UZS": 2, "VED": 2, "VES": 2, "VND": 0, "VUV": 0, "WST": 2, "XAF": 0,
+	"XCD": 2, "XOF": 0, "XPF": 0, "YER": 2, "ZAR": 2, "ZMW": 2, "ZWL": 2,
+}
+
+// 各支付渠道支持的货币，订单的货币为空时支付宝和微信支付使用人民币
+var (
+	alipayCurrencies = []string{"CNY", "AUD", "CAD", "CHF", "DKK", "EUR", "GBP", "HKD", "JPY", "KRW", "NOK", "NZD", "SEK", "SGD", "THB", "USD"}
+	wxpayCurrencies  = []string{"CNY", "AUD", "CAD", "CHF", "DKK", "EUR", "GBP", "HKD", "JPY", "KRW", "NOK", "NZD", "SEK", "SGD", "USD"}
+	paypalCurrencies = []string{"AUD", "BRL", "CAD", "CHF", "CNY", "CZK", "DKK", "EUR", "GBP", "HKD", "HUF", "ILS", "JPY", "MXN", "MYR", "NOK", "NZD", "PHP", "PLN", "RUB", "SEK", "SGD", "THB", "TWD", "USD"}
+)
+
+// PayPal 不支持小数的货币
+var paypalZeroDecimalCurrencies = map[string]bool{"HUF": true, "JPY": true, "TWD": true}
+
+// IsValidCurrency 验证是否为 ISO-4217 中的货币代码，货币代码需要大写，例如 CNY、USD
+func IsValidCurrency(currency string) bool {
+	_, ok := currencies[currency]
+	return ok
+}
+
+// CurrencyDecimals 返回货币的小数位数，例如 CNY 为 2，JPY 为 0，未知的货币返回 2
+func CurrencyDecimals(currency string) int {
+	if d, ok := currencies[currency]; ok {
+		return d
+	}
+	return 2
+}
+
+// FormatAmount 按照货币的小数位数将金额格式化为字符串，金额会四舍五入
+func FormatAmount(currency string, amount float64) string {
+	var d = CurrencyDecimals(currency)
+	return strconv.FormatFloat(roundAmount(amount, d), 'f', d, 64)
+}
+
+// ToMinorUnit 将金额转换为货币的最小单位，例如 CNY 的 12.34 为 1234 分，JPY 的 1234 为 1234 日元
+func ToMinorUnit(currency string, amount float64) int {
+	return int(roundAmount(amount*math.Pow10(CurrencyDecimals(currency)), 0))
+}
+
+// FromMinorUnit 将货币最小单位表示的金额转换为字符串，是 ToMinorUnit 的逆操作
+func FromMinorUnit(currency string, amount int) string {
+	var d = CurrencyDecimals(currency)
+	return strconv.FormatFloat(float64(amount)/math.Pow10(d), 'f', d, 64)
+}
+
+// roundAmount 四舍五入，0.000001 用于修正浮点数的误差，例如 1.005 * 100 的结果为 100.49999999999999
+func roundAmount(amount float64, decimals int) float64 {
+	var p = math.Pow10(decimals)
+	if amount < 0 {
+		return -math.Floor(-amount*p+0.5+0.000001) / p
+	}
+	return math.Floor(amount*p+0.5+0.000001) / p
+}
+
+func containsCurrency(list []string, currency string) bool {
+	for _, c := range list {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package payment
+
+import "testing"
+
+func TestFormatAmount(t *testing.T) {
+	var tests = []struct {
+		currency string
+		amount   float64
+		expect   string
+		minor    int
+	}{
+		{"CNY", 0.29, "0.29", 29},
+		{"CNY", 1.005, "1.01", 101},
+		{"CNY", 19.999, "20.00", 2000},
+		{"", 12.3, "12.30", 1230},
+		{"JPY", 1234, "1234", 1234},
+		{"JPY", 1234.5, "1235", 1235},
+		{"BHD", 1.2345, "1.235", 1235},
+		{"USD", -3.455, "-3.46", -346},
+		{"XOF", 1234.5, "1235", 1235},
+		{"IQD", 1.2345, "1.235", 1235},
+	}
+
+	for _, test := range tests {
+		if s := FormatAmount(test.currency, test.amount); s != test.expect {
+			t.Fatalf("%s %v 格式化的结果应该为 %s，实际为 %s", test.currency, test.amount, test.expect, s)
+		}
+		if m := ToMinorUnit(test.currency, test.amount); m != test.minor {
+			t.Fatalf("%s %v 的最小单位金额应该为 %d，实际为 %d", test.currency, test.amount, test.minor, m)
+		}
+		if s := FromMinorUnit(test.currency, test.minor); s != test.expect {
+			t.Fatalf("%s %d 转换的结果应该为 %s，实际为 %s", test.currency, test.minor, test.expect, s)
+		}
+	}
+}
+
+func TestIsValidCurrency(t *testing.T) {
+	for _, currency := range []string{"CNY", "USD", "XOF", "IQD", "CLF"} {
+		if IsValidCurrency(currency) == false {
+			t.Fatalf("%s 是有效的货币代码", currency)
+		}
+	}
+	for _, currency := range []string{"", "usd", "XXX", "XAU", "RMB"} {
+		if IsValidCurrency(currency) {
+			t.Fatalf("%s 不是有效的货币代码", currency)
+		}
+	}
+}
+
+func TestService_CreatePaymentCurrency(t *testing.T) {
+	var s = NewService()
+	s.RegisterChannel(&WXPay{})
+	s.RegisterChannel(&PayPal{})
+
+	var tests = []struct {
+		channel  string
+		method   string
+		currency string
+		expect   error
+	}{
+		{K_CHANNEL_WXPAY, K_TRADE_METHOD_APP, "usd", ErrInvalidCurrency},
+		{K_CHANNEL_WXPAY, K_TRADE_METHOD_APP, "XXX", ErrInvalidCurrency},
+		{K_CHANNEL_WXPAY, K_TRADE_METHOD_WAP, "USD", ErrCurrencyNotSupported},
+		{K_CHANNEL_WXPAY, K_TRADE_METHOD_APP, "BRL", ErrCurrencyNotSupported},
+		{K_CHANNEL_PAYPAL, "", "", ErrCurrencyNotSupported},
+		{K_CHANNEL_PAYPAL, "", "KWD", ErrCurrencyNotSupported},
+	}
+
+	for _, test := range tests {
+		var order = &Order{OrderNo: "o1", TradeMethod: test.method, Currency: test.currency}
+		if _, err := s.CreatePayment(test.channel, order); err != test.expect {
+			t.Fatalf("%s %s %q 应该返回 %v，实际为 %v", test.channel, test.method, test.currency, test.expect, err)
+		}
+	}
+}
@@ -3,9 +3,34 @@ package payment
 import "errors"
 
 var (
-	ErrUnknownChannel      = errors.New("未知的支付渠道")
-	ErrUnknownNotification = errors.New("未知的通知")
-	ErrUnknownTradeNo      = errors.New("未知的交易号")
+	ErrUnknownChannel       = errors.New("未知的支付渠道")
+	ErrUnknownAccount       = errors.New("未知的商户账号")
+	ErrUnknownNotification  = errors.New("未知的通知")
+	ErrUnknownTradeNo       = errors.New("未知的交易号")
+	ErrUnknownOrderNo       = errors.New("未知的订单号")
+	ErrInvalidSignature     = errors.New("签名验证失败")
+	ErrTradeMismatch        = errors.New("交易信息与订单不匹配")
+	ErrPayerNotApproved     = errors.New("用户没有确认付款")
+	ErrOrderExpired         = errors.New("订单已经过期")
+	ErrRefundNotAllowed     = errors.New("该支付渠道不支持退款")
+	ErrUnknownRefund        = errors.New("未知的退款")
+	ErrAuthorizeNotAllowed  = errors.New("该支付渠道不支持预授权")
+	ErrUnknownAuthorization = errors.New("未知的预授权")
+	ErrAgreementNotAllowed  = errors.New("该支付渠道不支持签约代扣")
+	ErrUnknownAgreement     = errors.New("未知的签约协议")
+	ErrPayoutNotAllowed     = errors.New("该支付渠道不支持付款")
+	ErrUnknownPayout        = errors.New("未知的付款")
+	ErrSplitNotAllowed      = errors.New("该支付渠道不支持分账")
+	ErrInvalidSplit         = errors.New("分账信息错误")
+	ErrSplitAmountExceeded  = errors.New("分账总额超过交易金额")
+	ErrDisputeNotAllowed    = errors.New("该支付渠道不支持争议处理")
+	ErrUnknownDispute       = errors.New("未知的争议")
+	ErrInvalidCurrency      = errors.New("无效的货币")
+	ErrInvalidAmount        = errors.New("无效的金额")
+	ErrCurrencyNotSupported = errors.New("该支付渠道不支持此货币")
+	ErrCurrencyMismatch     = errors.New("货币不一致")
+	ErrChannelUnavailable   = errors.New("支付渠道暂时不可用")
+	ErrClientCertNotApplied = errors.New("自定义的 http.RoundTripper 无法设置客户端证书")
 
 	ErrAliPayNotAllowed = errors.New("支付宝 暂时不支持")
 	ErrWXPayNotAllowed  = errors.New("微信支付 暂时不支持")
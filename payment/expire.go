@@ -0,0 +1,36 @@
+package payment
+
+import "time"
+
+// beijing 支付宝和微信支付接口中的时间均为北京时间，容器中可能没有时区数据，
+// 所以加载失败时使用固定的 UTC+8，中国没有夏令时，两者是等价的
+var beijing = loadBeijingLocation()
+
+func loadBeijingLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		loc = time.FixedZone("CST", 8*60*60)
+	}
+	return loc
+}
+
+// expireIn 返回订单距离过期时间还有多久，订单没有设置过期时间时返回 0，已经过期时返回 ErrOrderExpired
+func expireIn(order *Order, now time.Time) (time.Duration, error) {
+	if order.ExpireAt.IsZero() {
+		return 0, nil
+	}
+	var d = order.ExpireAt.Sub(now)
+	if d <= 0 {
+		return 0, ErrOrderExpired
+	}
+	return d, nil
+}
+
+// expireMinutes 将订单的过期时间转换为相对的分钟数，不足一分钟的部分按一分钟计算，订单没有设置过期时间时返回 0
+func expireMinutes(order *Order, now time.Time) (int, error) {
+	d, err := expireIn(order, now)
+	if err != nil || d == 0 {
+		return 0, err
+	}
+	return int((d + time.Minute - 1) / time.Minute), nil
+}
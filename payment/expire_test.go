@@ -0,0 +1,57 @@
+package payment
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	// 容器中没有时区数据时 time.Local 为 UTC，过期时间需要按照北京时间计算
+	var now = time.Date(2018, 8, 1, 23, 50, 20, 0, time.UTC)
+	var clock = func() time.Time { return now }
+
+	var ap = NewAliPay("", "", "", "", false, WithClock(clock))
+	var wp = NewWXPal("", "", "", false, WithClock(clock))
+
+	var order = &Order{OrderNo: "o1", ExpireAt: now.Add(time.Minute*15 + time.Second*10)}
+
+	if s, err := wp.timeExpire(order); err != nil || s != "20180802080530" {
+		t.Fatalf("微信支付的过期时间应该为 20180802080530，实际为 %s, %v", s, err)
+	}
+	if s, err := ap.timeExpire(order); err != nil || s != "2018-08-02 08:06" {
+		t.Fatalf("支付宝的过期时间应该为 2018-08-02 08:06，实际为 %s, %v", s, err)
+	}
+	if s, err := ap.timeoutExpress(order); err != nil || s != "16m" {
+		t.Fatalf("支付宝的相对过期时间应该为 16m，实际为 %s, %v", s, err)
+	}
+
+	// 不到一分钟之后过期的订单不能被截断到当前时间之前
+	order.ExpireAt = now.Add(time.Second * 30)
+	if s, err := ap.timeExpire(order); err != nil || s != "2018-08-02 07:51" {
+		t.Fatalf("支付宝的过期时间应该为 2018-08-02 07:51，实际为 %s, %v", s, err)
+	}
+	// 微信支付要求过期时间距离下单时间至少 1 分钟
+	if s, err := wp.timeExpire(order); err != nil || s != "20180802075120" {
+		t.Fatalf("微信支付的过期时间应该为 20180802075120，实际为 %s, %v", s, err)
+	}
+	order.ExpireAt = time.Date(2018, 8, 1, 23, 55, 0, 0, time.UTC)
+	if s, err := ap.timeExpire(order); err != nil || s != "2018-08-02 07:55" {
+		t.Fatalf("支付宝的过期时间应该为 2018-08-02 07:55，实际为 %s, %v", s, err)
+	}
+
+	order.ExpireAt = time.Time{}
+	if s, err := wp.timeExpire(order); err != nil || s != "" {
+		t.Fatalf("没有设置过期时间时应该为空，实际为 %s, %v", s, err)
+	}
+	if s, err := ap.timeoutExpress(order); err != nil || s != "" {
+		t.Fatalf("没有设置过期时间时应该为空，实际为 %s, %v", s, err)
+	}
+
+	order.ExpireAt = now.Add(-time.Second)
+	if _, err := wp.timeExpire(order); err != ErrOrderExpired {
+		t.Fatalf("期望返回 ErrOrderExpired，实际为 %v", err)
+	}
+	if _, err := ap.CreateTradeOrder(order); err != ErrOrderExpired {
+		t.Fatalf("期望返回 ErrOrderExpired，实际为 %v", err)
+	}
+}
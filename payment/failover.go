@@ -0,0 +1,25 @@
+package payment
+
+// FailoverPolicy 支付渠道（商户账号）熔断时为订单提供备用的支付渠道或者商户账号，
+// key 为熔断的 ChannelKey，返回按优先级排列的 ChannelKey
+type FailoverPolicy interface {
+	Alternates(key string, order *Order) []string
+}
+
+type FailoverFunc func(key string, order *Order) []string
+
+func (this FailoverFunc) Alternates(key string, order *Order) []string {
+	return this(key, order)
+}
+
+// FailoverList 使用固定的备用列表，alternates 的 key 可以是 ChannelKey 或者支付渠道，优先使用 ChannelKey 匹配，
+// 例如 {"alipay": {"alipay:brand_b", "wxpay"}}
+func FailoverList(alternates map[string][]string) FailoverPolicy {
+	return FailoverFunc(func(key string, order *Order) []string {
+		if list, ok := alternates[key]; ok {
+			return list
+		}
+		var channel, _ = splitChannelKey(key)
+		return alternates[channel]
+	})
+}
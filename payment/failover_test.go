@@ -0,0 +1,71 @@
+package payment_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"testing"
+)
+
+func TestService_Failover(t *testing.T) {
+	var fa = paymenttest.NewFakeAccount("", "brand_a")
+	var fb = paymenttest.NewFakeAccount("", "brand_b")
+	var s = payment.NewService()
+	s.RegisterChannel(fa)
+	s.RegisterChannel(fb)
+	s.SetHealthTracker(payment.NewHealthTracker(&payment.HealthConfig{ConsecutiveFailures: 2}))
+
+	var errUpstream = errors.New("upstream")
+	fa.SetError(paymenttest.K_OPERATION_CREATE_TRADE_ORDER, errUpstream)
+	for i := 0; i < 2; i++ {
+		if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder(fmt.Sprintf("f%d", i))); err != errUpstream {
+			t.Fatalf("期望返回 %v，实际为 %v", errUpstream, err)
+		}
+	}
+	if s.Available(payment.ChannelKey(paymenttest.K_CHANNEL_FAKE, "brand_a")) || s.Available(paymenttest.K_CHANNEL_FAKE) == false {
+		t.Fatal("brand_a 应该熔断，支付渠道仍然可用")
+	}
+
+	// brand_a 熔断之后自动切换到 brand_b
+	var order = newOrder("o1")
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != nil {
+		t.Fatal(err)
+	}
+	if order.AccountId != "brand_b" || len(fb.Orders()) != 1 {
+		t.Fatalf("应该使用 brand_b 创建交易，实际为 %s", order.AccountId)
+	}
+
+	// 切换之后使用 brand_b 的风控规则
+	s.SetRiskChecker(payment.NewRuleRiskChecker(&payment.RiskRules{
+		AmountCeiling: map[string]float64{payment.ChannelKey(paymenttest.K_CHANNEL_FAKE, "brand_b"): 10},
+	}))
+	_, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("r1"))
+	if riskErr, ok := err.(*payment.RiskError); ok == false || riskErr.AccountId != "brand_b" || len(fb.Orders()) != 1 {
+		t.Fatalf("应该使用 brand_b 的风控规则，实际为 %v", err)
+	}
+	s.SetRiskChecker(nil)
+
+	// 指定了账号时不会切换
+	order = newOrder("o2")
+	order.AccountId = "brand_a"
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != payment.ErrChannelUnavailable {
+		t.Fatalf("期望返回 ErrChannelUnavailable，实际为 %v", err)
+	}
+
+	// 设置备用策略之后可以获取其它支付渠道
+	var other = paymenttest.NewFakeChannel("other")
+	s.RegisterChannel(other)
+	s.SetFailover(payment.FailoverList(map[string][]string{paymenttest.K_CHANNEL_FAKE: {payment.ChannelKey(paymenttest.K_CHANNEL_FAKE, "brand_a"), "other"}}))
+	if alts := s.Alternatives(payment.ChannelKey(paymenttest.K_CHANNEL_FAKE, "brand_b"), newOrder("o3")); len(alts) != 1 || alts[0] != "other" {
+		t.Fatalf("备用支付渠道错误: %v", alts)
+	}
+
+	var list = s.Health(paymenttest.K_CHANNEL_FAKE)
+	if len(list) != 2 || list[0].State != payment.K_HEALTH_STATE_OPEN || list[0].Failures != 2 || list[1].Requests != 1 {
+		t.Fatalf("健康状态错误: %+v", list)
+	}
+	if len(s.HealthList()) != 3 {
+		t.Fatalf("健康状态列表错误: %+v", s.HealthList())
+	}
+}
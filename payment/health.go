@@ -0,0 +1,275 @@
+package payment
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// 熔断器的状态
+const (
+	K_HEALTH_STATE_CLOSED    = "closed"    // 正常
+	K_HEALTH_STATE_OPEN      = "open"      // 熔断，不会再使用该支付渠道创建交易
+	K_HEALTH_STATE_HALF_OPEN = "half_open" // 熔断超时之后只允许一个请求尝试创建交易，成功之后恢复正常，失败之后重新熔断
+)
+
+// HealthConfig 健康检查和熔断的参数，值为零时使用默认值
+type HealthConfig struct {
+	Window              time.Duration // 统计错误率和延迟的时间窗口，默认为 1 分钟
+	MinRequests         int           // 按错误率熔断时时间窗口内最少的请求数，默认为 10
+	ErrorRate           float64       // 时间窗口内的错误率达到该值时熔断，默认为 0.5
+	ConsecutiveFailures int           // 连续失败的次数达到该值时熔断，默认为 5
+	OpenTimeout         time.Duration // 熔断的持续时间，默认为 30 秒
+
+	// IsFailure 判断请求的错误是否为支付渠道的故障，默认参数错误、订单过期等本地产生的错误不算故障
+	IsFailure func(err error) bool
+	Now       func() time.Time
+}
+
+// Health 支付渠道（商户账号）的健康状态
+type Health struct {
+	Channel    string        `json:"channel"`
+	AccountId  string        `json:"account_id,omitempty"`
+	State      string        `json:"state"`
+	Available  bool          `json:"available"` // 是否可以用于创建交易
+	Requests   int           `json:"requests"`  // 时间窗口内的请求数
+	Failures   int           `json:"failures"`  // 时间窗口内的失败数
+	ErrorRate  float64       `json:"error_rate"`
+	AvgLatency time.Duration `json:"avg_latency"`
+	OpenedAt   time.Time     `json:"opened_at,omitempty"` // 最近一次熔断的时间
+}
+
+// HealthTracker 统计各支付渠道创建交易和查询交易的错误率和延迟，并在支付渠道持续出错时熔断，
+// key 为 ChannelKey，同一个支付渠道的不同商户账号分别统计
+type HealthTracker struct {
+	mu       sync.Mutex
+	config   HealthConfig
+	channels map[string]*channelHealth
+}
+
+type channelHealth struct {
+	samples             []healthSample
+	consecutiveFailures int
+	state               string
+	openedAt            time.Time
+	probeAt             time.Time // 半开状态下正在尝试的请求开始的时间，为零值时没有请求在尝试
+}
+
+type healthSample struct {
+	at      time.Time
+	latency time.Duration
+	failed  bool
+}
+
+func NewHealthTracker(config *HealthConfig) *HealthTracker {
+	var t = &HealthTracker{}
+	if config != nil {
+		t.config = *config
+	}
+	if t.config.Window <= 0 {
+		t.config.Window = time.Minute
+	}
+	if t.config.MinRequests <= 0 {
+		t.config.MinRequests = 10
+	}
+	if t.config.ErrorRate <= 0 {
+		t.config.ErrorRate = 0.5
+	}
+	if t.config.ConsecutiveFailures <= 0 {
+		t.config.ConsecutiveFailures = 5
+	}
+	if t.config.OpenTimeout <= 0 {
+		t.config.OpenTimeout = time.Second * 30
+	}
+	if t.config.IsFailure == nil {
+		t.config.IsFailure = isUpstreamFailure
+	}
+	if t.config.Now == nil {
+		t.config.Now = time.Now
+	}
+	t.channels = make(map[string]*channelHealth)
+	return t
+}
+
+// isUpstreamFailure 本地校验产生的错误不是支付渠道的故障
+func isUpstreamFailure(err error) bool {
+	switch err {
+	case nil, ErrUnknownTradeNo, ErrUnknownOrderNo, ErrTradeMismatch, ErrOrderExpired,
+		ErrInvalidCurrency, ErrCurrencyNotSupported, ErrCurrencyMismatch,
+		ErrAliPayNotAllowed, ErrWXPayNotAllowed, ErrPayPalNotAllowed:
+		return false
+	}
+	return true
+}
+
+func (this *HealthTracker) channel(key string) *channelHealth {
+	var c = this.channels[key]
+	if c == nil {
+		c = &channelHealth{state: K_HEALTH_STATE_CLOSED}
+		this.channels[key] = c
+	}
+	return c
+}
+
+// Record 记录一次请求的结果
+func (this *HealthTracker) Record(key string, latency time.Duration, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var now = this.config.Now()
+	var failed = this.config.IsFailure(err)
+	var c = this.channel(key)
+	c.prune(now.Add(-this.config.Window))
+	c.samples = append(c.samples, healthSample{at: now, latency: latency, failed: failed})
+
+	if failed {
+		c.consecutiveFailures++
+	} else {
+		c.consecutiveFailures = 0
+	}
+
+	switch c.currentState(now, this.config.OpenTimeout) {
+	case K_HEALTH_STATE_HALF_OPEN:
+		if failed {
+			c.open(now)
+		} else {
+			// 恢复之后重新统计，避免熔断之前的错误导致再次熔断
+			c.state = K_HEALTH_STATE_CLOSED
+			c.samples = c.samples[:0]
+			c.probeAt = time.Time{}
+		}
+	case K_HEALTH_STATE_CLOSED:
+		var requests, failures = c.count()
+		if c.consecutiveFailures >= this.config.ConsecutiveFailures ||
+			(requests >= this.config.MinRequests && float64(failures)/float64(requests) >= this.config.ErrorRate) {
+			c.open(now)
+		}
+	}
+}
+
+// Available 返回是否可以使用该支付渠道创建交易，熔断期间以及半开状态下已经有请求在尝试时返回 false，不会占用半开状态下尝试的机会
+func (this *HealthTracker) Available(key string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var c = this.channels[key]
+	if c == nil {
+		return true
+	}
+	return c.available(this.config.Now(), this.config.OpenTimeout)
+}
+
+// Allow 与 Available 相同，但是半开状态下会占用唯一的尝试机会，直到通过 Record 记录了请求的结果，
+// 占用之后超过 OpenTimeout 仍然没有记录结果时，允许其它请求重新尝试
+func (this *HealthTracker) Allow(key string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var c = this.channels[key]
+	if c == nil {
+		return true
+	}
+	var now = this.config.Now()
+	if c.available(now, this.config.OpenTimeout) == false {
+		return false
+	}
+	if c.currentState(now, this.config.OpenTimeout) == K_HEALTH_STATE_HALF_OPEN {
+		c.probeAt = now
+	}
+	return true
+}
+
+// Health 返回支付渠道的健康状态，没有记录过请求的支付渠道返回 nil
+func (this *HealthTracker) Health(key string) *Health {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var c = this.channels[key]
+	if c == nil {
+		return nil
+	}
+	return this.health(key, c)
+}
+
+// HealthList 返回所有支付渠道的健康状态，按照 key 排序
+func (this *HealthTracker) HealthList() []*Health {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var keys = make([]string, 0, len(this.channels))
+	for key := range this.channels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var results = make([]*Health, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, this.health(key, this.channels[key]))
+	}
+	return results
+}
+
+func (this *HealthTracker) health(key string, c *channelHealth) *Health {
+	var now = this.config.Now()
+	c.prune(now.Add(-this.config.Window))
+
+	var h = &Health{}
+	h.Channel, h.AccountId = splitChannelKey(key)
+	h.State = c.currentState(now, this.config.OpenTimeout)
+	h.Available = c.available(now, this.config.OpenTimeout)
+	h.Requests, h.Failures = c.count()
+	h.OpenedAt = c.openedAt
+	if h.Requests > 0 {
+		h.ErrorRate = float64(h.Failures) / float64(h.Requests)
+
+		var latency time.Duration
+		for _, s := range c.samples {
+			latency += s.latency
+		}
+		h.AvgLatency = latency / time.Duration(h.Requests)
+	}
+	return h
+}
+
+func (this *channelHealth) prune(before time.Time) {
+	var i = 0
+	for i < len(this.samples) && this.samples[i].at.Before(before) {
+		i++
+	}
+	if i > 0 {
+		this.samples = append(this.samples[:0], this.samples[i:]...)
+	}
+}
+
+func (this *channelHealth) count() (requests, failures int) {
+	for _, s := range this.samples {
+		if s.failed {
+			failures++
+		}
+	}
+	return len(this.samples), failures
+}
+
+func (this *channelHealth) currentState(now time.Time, openTimeout time.Duration) string {
+	if this.state == K_HEALTH_STATE_OPEN && now.Sub(this.openedAt) >= openTimeout {
+		return K_HEALTH_STATE_HALF_OPEN
+	}
+	return this.state
+}
+
+func (this *channelHealth) available(now time.Time, openTimeout time.Duration) bool {
+	switch this.currentState(now, openTimeout) {
+	case K_HEALTH_STATE_OPEN:
+		return false
+	case K_HEALTH_STATE_HALF_OPEN:
+		return this.probeAt.IsZero() || now.Sub(this.probeAt) >= openTimeout
+	}
+	return true
+}
+
+func (this *channelHealth) open(now time.Time) {
+	this.state = K_HEALTH_STATE_OPEN
+	this.openedAt = now
+	this.consecutiveFailures = 0
+	this.probeAt = time.Time{}
+}
@@ -0,0 +1,86 @@
+package payment
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthTracker(t *testing.T) {
+	var now = time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	var tracker = NewHealthTracker(&HealthConfig{
+		MinRequests:         4,
+		ErrorRate:           0.5,
+		ConsecutiveFailures: 3,
+		OpenTimeout:         time.Minute,
+		Now:                 func() time.Time { return now },
+	})
+	var errUpstream = errors.New("upstream")
+
+	if tracker.Health("alipay") != nil || tracker.Available("alipay") == false || len(tracker.HealthList()) != 0 {
+		t.Fatal("没有记录过请求的支付渠道不应该有健康状态")
+	}
+
+	// 本地校验产生的错误不算故障
+	for i := 0; i < 5; i++ {
+		tracker.Record("alipay", time.Millisecond, ErrOrderExpired)
+	}
+	if h := tracker.Health("alipay"); h.State != K_HEALTH_STATE_CLOSED || h.Failures != 0 || h.Requests != 5 {
+		t.Fatalf("健康状态错误: %+v", h)
+	}
+
+	// 错误率达到阈值时熔断
+	tracker.Record("alipay", time.Millisecond*3, errUpstream)
+	tracker.Record("alipay", time.Millisecond*3, nil)
+	tracker.Record("alipay", time.Millisecond*3, errUpstream)
+	if tracker.Available("alipay") == false {
+		t.Fatal("错误率没有达到阈值，不应该熔断")
+	}
+	now = now.Add(time.Minute * 2)
+	tracker.Record("alipay", time.Millisecond, errUpstream)
+	tracker.Record("alipay", time.Millisecond, nil)
+	tracker.Record("alipay", time.Millisecond, errUpstream)
+	tracker.Record("alipay", time.Millisecond, nil)
+	var h = tracker.Health("alipay")
+	if h.State != K_HEALTH_STATE_OPEN || h.Available || h.ErrorRate != 0.5 || h.AvgLatency != time.Millisecond {
+		t.Fatalf("健康状态错误: %+v", h)
+	}
+
+	// 熔断超时之后半开，失败时重新熔断，成功时恢复
+	now = now.Add(time.Minute)
+	if tracker.Available("alipay") == false || tracker.Health("alipay").State != K_HEALTH_STATE_HALF_OPEN {
+		t.Fatal("熔断超时之后应该半开")
+	}
+	tracker.Record("alipay", time.Millisecond, errUpstream)
+	if tracker.Available("alipay") {
+		t.Fatal("半开时失败应该重新熔断")
+	}
+
+	// 半开时只允许一个请求尝试，尝试的请求超过 OpenTimeout 没有结果时允许其它请求重新尝试
+	now = now.Add(time.Minute)
+	if tracker.Allow("alipay") == false {
+		t.Fatal("半开时应该允许一个请求尝试")
+	}
+	if tracker.Allow("alipay") || tracker.Available("alipay") || tracker.Health("alipay").Available {
+		t.Fatal("半开时已经有请求在尝试，不应该再允许其它请求")
+	}
+	now = now.Add(time.Minute)
+	if tracker.Allow("alipay") == false || tracker.Allow("alipay") {
+		t.Fatal("尝试的请求超时之后应该允许一个请求重新尝试")
+	}
+	tracker.Record("alipay", time.Millisecond, nil)
+	if h := tracker.Health("alipay"); h.State != K_HEALTH_STATE_CLOSED || h.Requests != 0 {
+		t.Fatalf("半开时成功应该恢复: %+v", h)
+	}
+
+	// 连续失败时熔断
+	for i := 0; i < 3; i++ {
+		tracker.Record("wxpay:hk", time.Millisecond, errUpstream)
+	}
+	if tracker.Available("wxpay:hk") {
+		t.Fatal("连续失败应该熔断")
+	}
+	if list := tracker.HealthList(); len(list) != 2 || list[1].Channel != "wxpay" || list[1].AccountId != "hk" {
+		t.Fatalf("健康状态列表错误: %+v", list)
+	}
+}
@@ -0,0 +1,281 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"github.com/smartwalle/m4go/payment"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Handler 提供创建支付、同步返回、取消付款以及异步通知的 HTTP 接口
+type Handler struct {
+	service *payment.Service
+
+	// LookupOrder 根据创建支付的请求获取订单信息，订单不存在时应该返回 ErrOrderNotFound，必须设置
+	LookupOrder func(req *http.Request, param *CreatePaymentRequest) (*payment.Order, error)
+
+	// OnNotify 收到支付渠道的异步通知之后调用，返回 error 时支付渠道会重新发送通知
+	OnNotify func(req *http.Request, noti *payment.Notification) error
+
+	// NotifyOptions 处理异步通知时传给 Service.NotifyURLHandler 的参数，例如 payment.WithFetchTrade()
+	NotifyOptions []payment.NotifyOption
+
+	// OnReturn 用户支付完成跳转回来之后调用，redirectURL 不为空时会将用户重定向到该地址，否则返回交易信息（TradeResponse）
+	OnReturn func(req *http.Request, trade *payment.Trade) (redirectURL string, err error)
+
+	// OnCancel 用户取消付款跳转回来之后调用，redirectURL 不为空时会将用户重定向到该地址，否则返回取消的订单信息
+	OnCancel func(req *http.Request, cancel *payment.Cancellation) (redirectURL string, err error)
+
+	// TrustedProxies 可信的反向代理，IP 或者 CIDR，例如 10.0.0.0/8，只有请求来自可信的代理时才会读取
+	// X-Forwarded-For 和 X-Real-Ip 获取用户端 IP，否则使用 RemoteAddr，避免用户伪造 IP 绕过风控
+	TrustedProxies []string
+}
+
+func New(s *payment.Service) *Handler {
+	var h = &Handler{}
+	h.service = s
+	return h
+}
+
+// Mount 在 mux 上注册以下路由，prefix 为空时使用 /pay：
+//
+// POST {prefix}         创建支付
+// GET  {prefix}/return  同步返回
+// GET  {prefix}/cancel  取消付款
+// POST {prefix}/notify  异步通知
+// GET  {prefix}/health  支付渠道的健康状态，收银台可以据此隐藏暂时不可用的支付方式
+func (this *Handler) Mount(mux *http.ServeMux, prefix string) {
+	if prefix == "" {
+		prefix = "/pay"
+	}
+	prefix = "/" + strings.Trim(prefix, "/")
+
+	mux.HandleFunc(prefix, this.CreatePayment)
+	mux.HandleFunc(prefix+"/return", this.Return)
+	mux.HandleFunc(prefix+"/cancel", this.Cancel)
+	mux.HandleFunc(prefix+"/notify", this.Notify)
+	mux.HandleFunc(prefix+"/health", this.Health)
+}
+
+func (this *Handler) CreatePayment(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, K_ERROR_CODE_INVALID_REQUEST, "只支持 POST 请求")
+		return
+	}
+
+	var param = &CreatePaymentRequest{}
+	if err := json.NewDecoder(req.Body).Decode(param); err != nil {
+		writeError(w, http.StatusBadRequest, K_ERROR_CODE_INVALID_REQUEST, "请求内容不是有效的 JSON")
+		return
+	}
+	if param.Channel == "" || param.OrderNo == "" {
+		writeError(w, http.StatusBadRequest, K_ERROR_CODE_INVALID_REQUEST, "channel 和 order_no 不能为空")
+		return
+	}
+
+	if this.LookupOrder == nil {
+		writeError(w, http.StatusNotImplemented, K_ERROR_CODE_CALLBACK_FAILED, "没有设置 LookupOrder")
+		return
+	}
+
+	order, err := this.LookupOrder(req, param)
+	if err == ErrOrderNotFound || (err == nil && order == nil) {
+		writeError(w, http.StatusNotFound, K_ERROR_CODE_ORDER_NOT_FOUND, ErrOrderNotFound.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, K_ERROR_CODE_CALLBACK_FAILED, err.Error())
+		return
+	}
+
+	if order.OrderNo == "" {
+		order.OrderNo = param.OrderNo
+	}
+	if param.TradeMethod != "" {
+		order.TradeMethod = param.TradeMethod
+	}
+	if param.AuthCode != "" {
+		order.AuthCode = param.AuthCode
+	}
+	if order.IP == "" {
+		order.IP = this.clientIP(req)
+	}
+
+	url, err := this.service.CreatePayment(param.Channel, order)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	var rsp = &CreatePaymentResponse{}
+	rsp.Channel = param.Channel
+	rsp.AccountId = order.AccountId
+	rsp.TradeMethod = order.TradeMethod
+	rsp.OrderNo = order.OrderNo
+	rsp.URL = url
+	writeJSON(w, http.StatusOK, rsp)
+}
+
+func (this *Handler) Return(w http.ResponseWriter, req *http.Request) {
+	trade, err := this.service.ReturnURLHandler(req)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	var redirectURL string
+	if this.OnReturn != nil {
+		if redirectURL, err = this.OnReturn(req, trade); err != nil {
+			writeError(w, http.StatusInternalServerError, K_ERROR_CODE_CALLBACK_FAILED, err.Error())
+			return
+		}
+	}
+
+	if redirectURL != "" {
+		http.Redirect(w, req, redirectURL, http.StatusFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, newTradeResponse(trade))
+}
+
+func (this *Handler) Cancel(w http.ResponseWriter, req *http.Request) {
+	cancel, err := this.service.CancelURLHandler(req)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	var redirectURL string
+	if this.OnCancel != nil {
+		if redirectURL, err = this.OnCancel(req, cancel); err != nil {
+			writeError(w, http.StatusInternalServerError, K_ERROR_CODE_CALLBACK_FAILED, err.Error())
+			return
+		}
+	}
+
+	if redirectURL != "" {
+		http.Redirect(w, req, redirectURL, http.StatusFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, cancel)
+}
+
+func (this *Handler) Notify(w http.ResponseWriter, req *http.Request) {
+	var channel = req.URL.Query().Get("channel")
+
+	noti, err := this.service.NotifyURLHandler(req, this.NotifyOptions...)
+	if err != nil {
+		ackNotify(w, channel, err)
+		return
+	}
+
+	if this.OnNotify != nil {
+		err = this.OnNotify(req, noti)
+	}
+	ackNotify(w, channel, err)
+}
+
+// Health 返回所有支付渠道的健康状态，Service 没有设置健康检查时返回空列表
+func (this *Handler) Health(w http.ResponseWriter, req *http.Request) {
+	var results = this.service.HealthList()
+	if results == nil {
+		results = []*payment.Health{}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// ackNotify 按照各支付渠道的要求响应异步通知，处理失败时支付渠道会重新发送通知
+func ackNotify(w http.ResponseWriter, channel string, err error) {
+	switch channel {
+	case payment.K_CHANNEL_WXPAY:
+		w.Header().Set("Content-Type", "text/xml")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("<xml><return_code><![CDATA[FAIL]]></return_code><return_msg><![CDATA[" + err.Error() + "]]></return_msg></xml>"))
+			return
+		}
+		w.Write([]byte("<xml><return_code><![CDATA[SUCCESS]]></return_code><return_msg><![CDATA[OK]]></return_msg></xml>"))
+	default:
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("success"))
+	}
+}
+
+func writeServiceError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*payment.RiskError); ok {
+		writeError(w, http.StatusForbidden, K_ERROR_CODE_RISK_DENIED, err.Error())
+		return
+	}
+
+	switch err {
+	case payment.ErrUnknownChannel, payment.ErrUnknownAccount:
+		writeError(w, http.StatusBadRequest, K_ERROR_CODE_UNKNOWN_CHANNEL, err.Error())
+	case payment.ErrUnknownTradeNo, payment.ErrUnknownOrderNo, payment.ErrPayerNotApproved,
+		payment.ErrInvalidCurrency, payment.ErrCurrencyNotSupported, payment.ErrCurrencyMismatch, payment.ErrOrderExpired:
+		writeError(w, http.StatusBadRequest, K_ERROR_CODE_INVALID_REQUEST, err.Error())
+	case payment.ErrChannelUnavailable:
+		writeError(w, http.StatusServiceUnavailable, K_ERROR_CODE_CHANNEL_UNAVAILABLE, err.Error())
+	case payment.ErrInvalidSignature, payment.ErrTradeMismatch:
+		writeError(w, http.StatusBadRequest, K_ERROR_CODE_VERIFY_FAILED, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, K_ERROR_CODE_PAYMENT_FAILED, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, &ErrorResponse{Code: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// clientIP 请求来自可信的代理时，从右往左跳过 X-Forwarded-For 中可信的代理，第一个不可信的 IP 为用户端 IP
+func (this *Handler) clientIP(req *http.Request) string {
+	var ip, _, err = net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if this.trusted(ip) == false {
+		return ip
+	}
+
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		var ips = strings.Split(forwarded, ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip = strings.TrimSpace(ips[i])
+			if ip != "" && this.trusted(ip) == false {
+				return ip
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-Ip")); realIP != "" {
+		return realIP
+	}
+	return ip
+}
+
+func (this *Handler) trusted(ip string) bool {
+	var addr = net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, proxy := range this.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(addr) {
+				return true
+			}
+		} else if p := net.ParseIP(proxy); p != nil && p.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *Handler, *paymenttest.FakeChannel) {
+	var fc = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	var h = New(s)
+	h.LookupOrder = func(req *http.Request, param *CreatePaymentRequest) (*payment.Order, error) {
+		if param.OrderNo != "o1" {
+			return nil, ErrOrderNotFound
+		}
+		var order = &payment.Order{}
+		order.Subject = "test"
+		order.AddProduct("test", "sku001", 1, 9.9, 0)
+		return order, nil
+	}
+
+	var mux = http.NewServeMux()
+	h.Mount(mux, "")
+	var server = httptest.NewServer(mux)
+	fc.NotifyURL = server.URL + "/pay/notify"
+	return server, h, fc
+}
+
+func post(t *testing.T, url, body string, result interface{}) int {
+	rsp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	if result != nil {
+		json.NewDecoder(rsp.Body).Decode(result)
+	}
+	return rsp.StatusCode
+}
+
+func TestHandler_CreatePayment(t *testing.T) {
+	var server, h, fc = newTestServer(t)
+	defer server.Close()
+
+	var rsp = &CreatePaymentResponse{}
+	if status := post(t, server.URL+"/pay", `{"channel":"fake","trade_method":"qr_code","order_no":"o1"}`, rsp); status != http.StatusOK {
+		t.Fatalf("期望的状态码为 200，实际为 %d", status)
+	}
+	if rsp.URL == "" || rsp.OrderNo != "o1" || rsp.TradeMethod != payment.K_TRADE_METHOD_QRCODE {
+		t.Fatalf("响应信息错误: %+v", rsp)
+	}
+	if orders := fc.Orders(); len(orders) != 1 || orders[0].IP != "127.0.0.1" {
+		t.Fatalf("订单信息错误: %+v", orders)
+	}
+
+	var tests = []struct {
+		body   string
+		status int
+		code   string
+	}{
+		{`{"channel":"fake"`, http.StatusBadRequest, K_ERROR_CODE_INVALID_REQUEST},
+		{`{"channel":"fake"}`, http.StatusBadRequest, K_ERROR_CODE_INVALID_REQUEST},
+		{`{"channel":"unknown","order_no":"o1"}`, http.StatusBadRequest, K_ERROR_CODE_UNKNOWN_CHANNEL},
+		{`{"channel":"fake","order_no":"o2"}`, http.StatusNotFound, K_ERROR_CODE_ORDER_NOT_FOUND},
+	}
+	for _, test := range tests {
+		var errRsp = &ErrorResponse{}
+		if status := post(t, server.URL+"/pay", test.body, errRsp); status != test.status || errRsp.Code != test.code {
+			t.Errorf("%s: 期望 %d %s，实际为 %d %s", test.body, test.status, test.code, status, errRsp.Code)
+		}
+	}
+
+	fc.SetError(paymenttest.K_OPERATION_CREATE_TRADE_ORDER, errors.New("gateway timeout"))
+	var errRsp = &ErrorResponse{}
+	if status := post(t, server.URL+"/pay", `{"channel":"fake","order_no":"o1"}`, errRsp); status != http.StatusBadGateway || errRsp.Code != K_ERROR_CODE_PAYMENT_FAILED {
+		t.Fatalf("支付渠道出错时应该返回 502，实际为 %d %+v", status, errRsp)
+	}
+
+	fc.SetError(paymenttest.K_OPERATION_CREATE_TRADE_ORDER, nil)
+	h.service.SetRiskChecker(payment.NewRuleRiskChecker(&payment.RiskRules{DenyIPs: []string{"127.0.0.1"}}))
+	if status := post(t, server.URL+"/pay", `{"channel":"fake","order_no":"o1"}`, errRsp); status != http.StatusForbidden || errRsp.Code != K_ERROR_CODE_RISK_DENIED {
+		t.Fatalf("风控拒绝时应该返回 403，实际为 %d %+v", status, errRsp)
+	}
+}
+
+func TestHandler_Notify(t *testing.T) {
+	var server, h, fc = newTestServer(t)
+	defer server.Close()
+
+	var received *payment.Notification
+	h.OnNotify = func(req *http.Request, noti *payment.Notification) error {
+		received = noti
+		return nil
+	}
+
+	post(t, server.URL+"/pay", `{"channel":"fake","order_no":"o1"}`, nil)
+	fc.Pay("o1", "payer1")
+
+	req, err := fc.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || received == nil || received.OrderNo != "o1" {
+		t.Fatalf("处理通知失败: %d %+v", rsp.StatusCode, received)
+	}
+
+	// 回调返回错误时，需要让支付渠道重新发送通知
+	h.OnNotify = func(req *http.Request, noti *payment.Notification) error {
+		return errors.New("database unavailable")
+	}
+	req, _ = fc.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	rsp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("回调出错时应该返回 500，实际为 %d", rsp.StatusCode)
+	}
+}
+
+func TestHandler_Return(t *testing.T) {
+	var server, _, fc = newTestServer(t)
+	defer server.Close()
+
+	post(t, server.URL+"/pay", `{"channel":"fake","order_no":"o1"}`, nil)
+	fc.Pay("o1", "payer1")
+
+	req, err := fc.ReturnRequest("o1", server.URL+"/pay/return")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	// 返回给浏览器的交易信息不能包含付款人信息和原始数据
+	var result map[string]interface{}
+	json.NewDecoder(rsp.Body).Decode(&result)
+	if rsp.StatusCode != http.StatusOK || result["order_no"] != "o1" || result["paid_success"] != true {
+		t.Fatalf("同步返回失败: %d %+v", rsp.StatusCode, result)
+	}
+	for _, key := range []string{"raw_trade", "payer_id", "payer_email"} {
+		if _, ok := result[key]; ok {
+			t.Fatalf("交易信息不应该包含 %s: %+v", key, result)
+		}
+	}
+}
+
+func TestHandler_Cancel(t *testing.T) {
+	var server, h, _ = newTestServer(t)
+	defer server.Close()
+
+	var cancelled string
+	h.OnCancel = func(req *http.Request, cancel *payment.Cancellation) (string, error) {
+		cancelled = cancel.OrderNo
+		return "", nil
+	}
+
+	rsp, err := http.Get(server.URL + "/pay/cancel?channel=fake&order_no=o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK || cancelled != "o1" {
+		t.Fatalf("取消付款失败: %d %s", rsp.StatusCode, cancelled)
+	}
+
+	h.OnCancel = func(req *http.Request, cancel *payment.Cancellation) (string, error) {
+		return "/cart", nil
+	}
+	var client = &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	rsp, err = client.Get(server.URL + "/pay/cancel?channel=fake&order_no=o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusFound || rsp.Header.Get("Location") != "/cart" {
+		t.Fatalf("应该重定向到 /cart，实际为 %d %s", rsp.StatusCode, rsp.Header.Get("Location"))
+	}
+
+	rsp, err = http.Get(server.URL + "/pay/cancel?channel=unknown&order_no=o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("未知的支付渠道应该返回 400，实际为 %d", rsp.StatusCode)
+	}
+}
+
+func TestHandler_ClientIP(t *testing.T) {
+	var h = New(payment.NewService())
+	var tests = []struct {
+		trusted    []string
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		// 没有设置可信的代理时不读取 X-Forwarded-For
+		{nil, "203.0.113.1:1234", "198.51.100.1", "203.0.113.1"},
+		{[]string{"10.0.0.0/8"}, "203.0.113.1:1234", "198.51.100.1", "203.0.113.1"},
+		{[]string{"10.0.0.0/8"}, "10.0.0.2:1234", "198.51.100.1", "198.51.100.1"},
+		// 用户伪造的 IP 在最左边，从右往左跳过可信的代理
+		{[]string{"10.0.0.0/8", "192.0.2.1"}, "10.0.0.2:1234", "1.1.1.1, 198.51.100.1, 192.0.2.1", "198.51.100.1"},
+	}
+	for _, test := range tests {
+		h.TrustedProxies = test.trusted
+		var req = httptest.NewRequest(http.MethodPost, "/pay", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("X-Forwarded-For", test.forwarded)
+		if ip := h.clientIP(req); ip != test.ip {
+			t.Errorf("%v %s %s 期望的 IP 为 %s，实际为 %s", test.trusted, test.remoteAddr, test.forwarded, test.ip, ip)
+		}
+	}
+}
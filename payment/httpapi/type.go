@@ -0,0 +1,70 @@
+package httpapi
+
+import (
+	"errors"
+	"github.com/smartwalle/m4go/payment"
+)
+
+var (
+	ErrOrderNotFound = errors.New("订单不存在")
+)
+
+const (
+	K_ERROR_CODE_INVALID_REQUEST     = "invalid_request"
+	K_ERROR_CODE_UNKNOWN_CHANNEL     = "unknown_channel"
+	K_ERROR_CODE_CHANNEL_UNAVAILABLE = "channel_unavailable"
+	K_ERROR_CODE_ORDER_NOT_FOUND     = "order_not_found"
+	K_ERROR_CODE_PAYMENT_FAILED      = "payment_failed"
+	K_ERROR_CODE_VERIFY_FAILED       = "verify_failed"
+	K_ERROR_CODE_CALLBACK_FAILED     = "callback_failed"
+	K_ERROR_CODE_RISK_DENIED         = "risk_denied"
+)
+
+// CreatePaymentRequest 创建支付的请求
+type CreatePaymentRequest struct {
+	Channel     string `json:"channel"`
+	TradeMethod string `json:"trade_method"`
+	OrderNo     string `json:"order_no"`
+	AuthCode    string `json:"auth_code,omitempty"` // 用户付款码（支付宝当面付）
+}
+
+// CreatePaymentResponse 创建支付的响应，URL 的含义由支付方式决定，例如支付页面的 URL、二维码的内容或者 App 的支付参数
+type CreatePaymentResponse struct {
+	Channel     string `json:"channel"`
+	AccountId   string `json:"account_id,omitempty"` // 创建交易使用的商户账号，同一个支付渠道注册了多个账号时才有
+	TradeMethod string `json:"trade_method"`
+	OrderNo     string `json:"order_no"`
+	URL         string `json:"url"`
+}
+
+// TradeResponse 同步返回的交易信息，不包含付款人信息和支付渠道返回的原始数据（Trade.RawTrade），
+// 原始数据中有付款人的邮箱、openid 和买家账号等信息，不能返回给浏览器
+type TradeResponse struct {
+	Channel      string `json:"channel"`
+	AccountId    string `json:"account_id,omitempty"`
+	OrderNo      string `json:"order_no"`
+	TradeNo      string `json:"trade_no"`
+	Status       string `json:"status"`
+	TradeSuccess bool   `json:"paid_success"`
+	TotalAmount  string `json:"total_amount"`
+	Currency     string `json:"currency,omitempty"`
+}
+
+func newTradeResponse(trade *payment.Trade) *TradeResponse {
+	var rsp = &TradeResponse{}
+	rsp.Channel = trade.Channel
+	rsp.AccountId = trade.AccountId
+	rsp.OrderNo = trade.OrderNo
+	rsp.TradeNo = trade.TradeNo
+	rsp.Status = trade.Status
+	rsp.TradeSuccess = trade.TradeSuccess
+	rsp.TotalAmount = trade.TotalAmount
+	rsp.Currency = trade.Currency
+	return rsp
+}
+
+// ErrorResponse 请求出错时的响应
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
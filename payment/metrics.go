@@ -0,0 +1,69 @@
+package payment
+
+import "time"
+
+// 监控指标的名称，标签如下：
+//
+// payment_created_total               channel, account, trade_method, outcome
+// payment_notifications_total         channel, account, notify_type, outcome
+// payment_verify_failures_total       channel, operation
+// payment_operation_duration_seconds  channel, operation, trade_method, outcome（直方图，只有 CreatePayment 才有 trade_method）
+const (
+	K_METRIC_PAYMENTS_CREATED   = "payment_created_total"
+	K_METRIC_NOTIFICATIONS      = "payment_notifications_total"
+	K_METRIC_VERIFY_FAILURES    = "payment_verify_failures_total"
+	K_METRIC_OPERATION_DURATION = "payment_operation_duration_seconds"
+	K_METRIC_OUTCOME_SUCCESS    = "success"
+	K_METRIC_OUTCOME_FAILURE    = "failure"
+)
+
+// Metrics 监控指标的接口，用于适配 Prometheus、expvar 或者 OpenTelemetry，实现需要保证并发安全
+type Metrics interface {
+	// IncCounter 计数器加 1
+	IncCounter(name string, labels map[string]string)
+
+	// Observe 在直方图中记录一个值
+	Observe(name string, value float64, labels map[string]string)
+}
+
+// MetricsMiddleware 统计创建支付、异步通知、验签失败的次数以及各操作的耗时
+func MetricsMiddleware(m Metrics) Middleware {
+	return func(next Operation) Operation {
+		return func(call *Call) error {
+			var start = time.Now()
+			var err = next(call)
+			var duration = time.Since(start)
+
+			var channel, accountId = splitChannelKey(call.Channel)
+			if call.AccountId != "" {
+				accountId = call.AccountId
+			}
+			var outcome = K_METRIC_OUTCOME_SUCCESS
+			if err != nil {
+				outcome = K_METRIC_OUTCOME_FAILURE
+			}
+			var tradeMethod string
+			if call.Order != nil {
+				tradeMethod = call.Order.TradeMethod
+			}
+
+			switch call.Operation {
+			case K_OPERATION_CREATE_PAYMENT:
+				m.IncCounter(K_METRIC_PAYMENTS_CREATED, map[string]string{"channel": channel, "account": accountId, "trade_method": tradeMethod, "outcome": outcome})
+			case K_OPERATION_NOTIFY:
+				var notifyType string
+				if noti, ok := call.Result.(*Notification); ok {
+					notifyType = noti.NotifyType
+				}
+				m.IncCounter(K_METRIC_NOTIFICATIONS, map[string]string{"channel": channel, "account": accountId, "notify_type": notifyType, "outcome": outcome})
+			}
+
+			if err == ErrInvalidSignature || err == ErrTradeMismatch {
+				m.IncCounter(K_METRIC_VERIFY_FAILURES, map[string]string{"channel": channel, "operation": call.Operation})
+			}
+
+			m.Observe(K_METRIC_OPERATION_DURATION, duration.Seconds(), map[string]string{"channel": channel, "operation": call.Operation, "trade_method": tradeMethod, "outcome": outcome})
+			return err
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package payment
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultBuckets 直方图默认的分桶（秒）
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// ExpvarMetrics 使用标准库 expvar 实现的 Metrics，指标的 key 为 Prometheus 的文本格式，例如
+// payment_created_total{channel="alipay",outcome="success"}，直方图会生成 _bucket、_sum 和 _count 三类指标
+type ExpvarMetrics struct {
+	vars    *expvar.Map
+	buckets []float64
+}
+
+// NewExpvarMetrics name 不为空时会将指标发布到 expvar（/debug/vars），同一个 name 只能发布一次，
+// buckets 为空时使用 DefaultBuckets
+func NewExpvarMetrics(name string, buckets ...float64) *ExpvarMetrics {
+	var m = &ExpvarMetrics{}
+	if name != "" {
+		m.vars = expvar.NewMap(name)
+	} else {
+		m.vars = new(expvar.Map).Init()
+	}
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	m.buckets = append([]float64(nil), buckets...)
+	sort.Float64s(m.buckets)
+	return m
+}
+
+func (this *ExpvarMetrics) IncCounter(name string, labels map[string]string) {
+	this.vars.Add(metricKey(name, labels, ""), 1)
+}
+
+func (this *ExpvarMetrics) Observe(name string, value float64, labels map[string]string) {
+	for _, bucket := range this.buckets {
+		if value <= bucket {
+			this.vars.Add(metricKey(name+"_bucket", labels, strconv.FormatFloat(bucket, 'g', -1, 64)), 1)
+		}
+	}
+	this.vars.Add(metricKey(name+"_bucket", labels, "+Inf"), 1)
+	this.vars.AddFloat(metricKey(name+"_sum", labels, ""), value)
+	this.vars.Add(metricKey(name+"_count", labels, ""), 1)
+}
+
+// Get 返回指标的值，key 为 Prometheus 的文本格式，指标不存在时返回 nil
+func (this *ExpvarMetrics) Get(key string) expvar.Var {
+	return this.vars.Get(key)
+}
+
+// Vars 返回所有的指标
+func (this *ExpvarMetrics) Vars() *expvar.Map {
+	return this.vars
+}
+
+// metricKey 按照标签名排序生成指标的 key，le 不为空时添加直方图分桶的标签
+func metricKey(name string, labels map[string]string, le string) string {
+	var names = make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var pairs = make([]string, 0, len(names)+1)
+	for _, k := range names {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	if le != "" {
+		pairs = append(pairs, "le="+strconv.Quote(le))
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,51 @@
+package payment_test
+
+import (
+	"errors"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"testing"
+)
+
+func TestService_Metrics(t *testing.T) {
+	var f = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(f)
+
+	var m = payment.NewExpvarMetrics("")
+	s.Use(payment.MetricsMiddleware(m))
+
+	var order = newOrder("o1")
+	order.TradeMethod = payment.K_TRADE_METHOD_WEB
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != nil {
+		t.Fatal(err)
+	}
+	f.SetError(paymenttest.K_OPERATION_CREATE_TRADE_ORDER, errors.New("upstream"))
+	s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("o2"))
+
+	f.Pay("o1", "payer1")
+	req, _ := f.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	if _, err := s.NotifyURLHandler(req); err != nil {
+		t.Fatal(err)
+	}
+	f.SetError(paymenttest.K_OPERATION_NOTIFY_HANDLER, payment.ErrInvalidSignature)
+	req, _ = f.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	s.NotifyURLHandler(req)
+
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{`payment_created_total{account="",channel="fake",outcome="success",trade_method="web"}`, "1"},
+		{`payment_created_total{account="",channel="fake",outcome="failure",trade_method=""}`, "1"},
+		{`payment_notifications_total{account="",channel="fake",notify_type="trade",outcome="success"}`, "1"},
+		{`payment_notifications_total{account="",channel="fake",notify_type="",outcome="failure"}`, "1"},
+		{`payment_verify_failures_total{channel="fake",operation="NotifyURLHandler"}`, "1"},
+		{`payment_operation_duration_seconds_count{channel="fake",operation="CreatePayment",outcome="success",trade_method="web"}`, "1"},
+	}
+	for _, test := range tests {
+		if v := m.Get(test.key); v == nil || v.String() != test.expect {
+			t.Fatalf("%s 应该为 %s，实际为 %v", test.key, test.expect, v)
+		}
+	}
+}
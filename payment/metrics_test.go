@@ -0,0 +1,36 @@
+package payment
+
+import "testing"
+
+func TestExpvarMetrics(t *testing.T) {
+	var m = NewExpvarMetrics("", 0.1, 1)
+	m.IncCounter(K_METRIC_PAYMENTS_CREATED, map[string]string{"outcome": "success", "channel": "alipay"})
+	m.IncCounter(K_METRIC_PAYMENTS_CREATED, map[string]string{"channel": "alipay", "outcome": "success"})
+	m.Observe(K_METRIC_OPERATION_DURATION, 0.5, map[string]string{"channel": "alipay"})
+	m.Observe(K_METRIC_OPERATION_DURATION, 2, map[string]string{"channel": "alipay"})
+
+	var tests = []struct {
+		key    string
+		expect string
+	}{
+		{`payment_created_total{channel="alipay",outcome="success"}`, "2"},
+		{`payment_operation_duration_seconds_bucket{channel="alipay",le="0.1"}`, ""},
+		{`payment_operation_duration_seconds_bucket{channel="alipay",le="1"}`, "1"},
+		{`payment_operation_duration_seconds_bucket{channel="alipay",le="+Inf"}`, "2"},
+		{`payment_operation_duration_seconds_sum{channel="alipay"}`, "2.5"},
+		{`payment_operation_duration_seconds_count{channel="alipay"}`, "2"},
+	}
+
+	for _, test := range tests {
+		var v = m.Get(test.key)
+		if test.expect == "" {
+			if v != nil {
+				t.Fatalf("%s 应该不存在，实际为 %s", test.key, v)
+			}
+			continue
+		}
+		if v == nil || v.String() != test.expect {
+			t.Fatalf("%s 应该为 %s，实际为 %v", test.key, test.expect, v)
+		}
+	}
+}
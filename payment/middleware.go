@@ -0,0 +1,147 @@
+package payment
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Service 中经过中间件处理的操作
+const (
+	K_OPERATION_CREATE_PAYMENT          = "CreatePayment"
+	K_OPERATION_GET_TRADE               = "GetTrade"
+	K_OPERATION_GET_TRADE_WITH_ORDER_NO = "GetTradeWithOrderNo"
+	K_OPERATION_RETURN                  = "ReturnURLHandler"
+	K_OPERATION_CANCEL                  = "CancelURLHandler"
+	K_OPERATION_NOTIFY                  = "NotifyURLHandler"
+	K_OPERATION_REFUND                  = "Refund"
+	K_OPERATION_CAPTURE                 = "Capture"
+	K_OPERATION_VOID                    = "Void"
+	K_OPERATION_CHARGE_AGREEMENT        = "ChargeAgreement"
+	K_OPERATION_PAYOUT                  = "Payout"
+	K_OPERATION_BATCH_PAYOUT            = "BatchPayout"
+	K_OPERATION_SPLIT                   = "Split"
+
+	K_OPERATION_CREATE_AGREEMENT          = "CreateAgreement"
+	K_OPERATION_CANCEL_AGREEMENT          = "CancelAgreement"
+	K_OPERATION_GET_PAYOUT                = "GetPayout"
+	K_OPERATION_GET_PAYOUT_WITH_PAYOUT_NO = "GetPayoutWithPayoutNo"
+	K_OPERATION_ADD_SPLIT_RECEIVER        = "AddSplitReceiver"
+	K_OPERATION_RETURN_SPLIT              = "ReturnSplit"
+	K_OPERATION_FINISH_SPLIT              = "FinishSplit"
+	K_OPERATION_LIST_DISPUTES             = "ListDisputes"
+	K_OPERATION_GET_DISPUTE               = "GetDispute"
+	K_OPERATION_ACCEPT_DISPUTE            = "AcceptDispute"
+	K_OPERATION_PROVIDE_DISPUTE_EVIDENCE  = "ProvideDisputeEvidence"
+	K_OPERATION_SEND_DISPUTE_MESSAGE      = "SendDisputeMessage"
+	K_OPERATION_ESCALATE_DISPUTE          = "EscalateDispute"
+)
+
+// Call 一次 Service 操作的信息，中间件可以在调用 next 之前修改参数，在调用 next 之后读取结果
+type Call struct {
+	Operation string
+	Channel   string        // 调用时传入的 channel，回调时为回调 URL 中的支付渠道
+	AccountId string        // 实际使用的商户账号，操作完成之后设置
+	Order     *Order        // 只有 CreatePayment 才有
+	OrderNo   string        // 订单号，查询交易和回调在操作完成之后从结果中设置，付款为付款单号，批量付款为批次号
+	TradeNo   string        // 交易号，查询交易和回调在操作完成之后从结果中设置
+	Request   *http.Request // 只有回调才有
+	Risk      *RiskDecision // 风控检查的结果，只有 CreatePayment 并且设置了 RiskChecker 才有
+
+	// Param 操作的参数，Refund 为 *RefundParam，Capture 为 *CaptureParam，Void 为预授权编号（string），
+	// CreateAgreement 为 *Agreement，ChargeAgreement 为 *AgreementChargeParam，CancelAgreement 为签约协议号（string），
+	// Payout 为 *Payout，BatchPayout 为 []*Payout，GetPayout 为支付渠道的付款单号（string），
+	// Split 为 *SplitParam，AddSplitReceiver 为 *SplitReceiver，ReturnSplit 为 *SplitReturnParam，FinishSplit 为分账单号（string），
+	// ListDisputes 为 since（time.Time），其它争议操作为争议编号（string）
+	Param interface{}
+
+	// Result 操作的结果，CreatePayment 和 CreateAgreement 为 url（string），查询交易、ReturnURLHandler 和 ChargeAgreement 为 *Trade，
+	// CancelURLHandler 为 *Cancellation，NotifyURLHandler 为 *Notification，Refund 为 *Refund，Capture 为 *Capture，
+	// Payout、GetPayout 和 GetPayoutWithPayoutNo 为 *PayoutResult，BatchPayout 为 []*PayoutResult，Split 为 *SplitResult，
+	// ReturnSplit 为 *SplitReturn，ListDisputes 为 []*Dispute，GetDispute 为 *Dispute，其它操作没有结果
+	Result interface{}
+
+	values map[string]interface{}
+}
+
+// Set 保存中间件之间需要传递的数据，例如租户标识
+func (this *Call) Set(key string, value interface{}) {
+	if this.values == nil {
+		this.values = make(map[string]interface{})
+	}
+	this.values[key] = value
+}
+
+func (this *Call) Get(key string) interface{} {
+	return this.values[key]
+}
+
+func (this *Call) setTrade(trade *Trade) {
+	if trade == nil {
+		return
+	}
+	this.Result = trade
+	this.AccountId = trade.AccountId
+	this.OrderNo = trade.OrderNo
+	this.TradeNo = trade.TradeNo
+}
+
+func (this *Call) setPayout(result *PayoutResult) {
+	if result == nil {
+		return
+	}
+	this.Result = result
+	this.OrderNo = result.PayoutNo
+}
+
+type Operation func(call *Call) error
+
+// Middleware 包装 Service 的操作，用于审计日志、监控、链路追踪以及风控等通用的处理
+type Middleware func(next Operation) Operation
+
+// LogEntry 一次操作的结构化日志
+type LogEntry struct {
+	Operation string        `json:"operation"`
+	Channel   string        `json:"channel"`
+	AccountId string        `json:"account_id,omitempty"`
+	OrderNo   string        `json:"order_no,omitempty"`
+	TradeNo   string        `json:"trade_no,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// LoggingMiddleware 每次操作完成之后输出一条日志，write 为 nil 时使用标准库的 log 输出 JSON
+func LoggingMiddleware(write func(entry *LogEntry)) Middleware {
+	if write == nil {
+		write = func(entry *LogEntry) {
+			data, _ := json.Marshal(entry)
+			log.Println(string(data))
+		}
+	}
+	return TimingMiddleware(func(call *Call, duration time.Duration, err error) {
+		var entry = &LogEntry{}
+		entry.Operation = call.Operation
+		entry.Channel = call.Channel
+		entry.AccountId = call.AccountId
+		entry.OrderNo = call.OrderNo
+		entry.TradeNo = call.TradeNo
+		entry.Duration = duration
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		write(entry)
+	})
+}
+
+// TimingMiddleware 每次操作完成之后调用 observe，duration 为包括后续中间件在内的耗时
+func TimingMiddleware(observe func(call *Call, duration time.Duration, err error)) Middleware {
+	return func(next Operation) Operation {
+		return func(call *Call) error {
+			var start = time.Now()
+			var err = next(call)
+			observe(call, time.Since(start), err)
+			return err
+		}
+	}
+}
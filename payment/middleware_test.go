@@ -0,0 +1,402 @@
+package payment_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestService_Middleware(t *testing.T) {
+	var f = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(f)
+
+	var steps []string
+	var entries []*payment.LogEntry
+	var errBlocked = errors.New("blocked")
+	s.Use(
+		payment.LoggingMiddleware(func(entry *payment.LogEntry) {
+			entries = append(entries, entry)
+		}),
+		func(next payment.Operation) payment.Operation {
+			return func(call *payment.Call) error {
+				call.Set("tenant", "t1")
+				if call.Order != nil && call.Order.OrderNo == "blocked" {
+					return errBlocked
+				}
+				steps = append(steps, "before "+call.Operation)
+				var err = next(call)
+				steps = append(steps, "after "+call.Operation)
+				return err
+			}
+		},
+		func(next payment.Operation) payment.Operation {
+			return func(call *payment.Call) error {
+				if call.Get("tenant") != "t1" {
+					t.Fatalf("中间件之间应该可以传递数据")
+				}
+				return next(call)
+			}
+		},
+	)
+
+	url, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("o1"))
+	if err != nil || url == "" {
+		t.Fatalf("创建支付错误: %s, %v", url, err)
+	}
+	if _, err = s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("blocked")); err != errBlocked || len(f.Orders()) != 1 {
+		t.Fatalf("中间件应该可以中断操作，实际为 %v", err)
+	}
+
+	f.Pay("o1", "payer1")
+	req, _ := f.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	noti, err := s.NotifyURLHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetTrade(paymenttest.K_CHANNEL_FAKE, noti.TradeNo); err != nil {
+		t.Fatal(err)
+	}
+
+	var expect = []string{"before CreatePayment", "after CreatePayment", "before NotifyURLHandler", "after NotifyURLHandler", "before GetTrade", "after GetTrade"}
+	if fmt.Sprint(steps) != fmt.Sprint(expect) {
+		t.Fatalf("中间件的调用顺序错误: %v", steps)
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("应该输出 4 条日志，实际为 %d", len(entries))
+	}
+	if entries[1].OrderNo != "blocked" || entries[1].Error != errBlocked.Error() {
+		t.Fatalf("日志错误: %+v", entries[1])
+	}
+	if entries[2].Channel != paymenttest.K_CHANNEL_FAKE || entries[2].OrderNo != "o1" || entries[2].TradeNo != noti.TradeNo {
+		t.Fatalf("日志错误: %+v", entries[2])
+	}
+	if entries[3].Operation != payment.K_OPERATION_GET_TRADE || entries[3].OrderNo != "o1" {
+		t.Fatalf("日志错误: %+v", entries[3])
+	}
+}
+
+// fundChannel 在 paymenttest.FakeChannel 的基础上返回固定的预授权、代扣、付款、分账和争议结果，只用于测试资金操作经过中间件
+type fundChannel struct {
+	*paymenttest.FakeChannel
+}
+
+func (this *fundChannel) Authorize(order *payment.Order) (url string, err error) {
+	return this.CreateTradeOrder(order)
+}
+
+func (this *fundChannel) GetAuthorization(authorizationId string) (result *payment.Authorization, err error) {
+	return nil, payment.ErrUnknownAuthorization
+}
+
+func (this *fundChannel) GetAuthorizationWithOrderNo(orderNo string) (result *payment.Authorization, err error) {
+	return nil, payment.ErrUnknownAuthorization
+}
+
+func (this *fundChannel) Capture(param *payment.CaptureParam) (result *payment.Capture, err error) {
+	result = &payment.Capture{}
+	result.Channel = this.Identifier()
+	result.AuthorizationId = param.AuthorizationId
+	result.OrderNo = param.OrderNo
+	result.CaptureSuccess = true
+	result.Amount = payment.FormatAmount("", param.Amount)
+	return result, nil
+}
+
+func (this *fundChannel) Void(authorizationId string) (err error) {
+	return nil
+}
+
+func (this *fundChannel) CreateAgreement(agreement *payment.Agreement) (url string, err error) {
+	return "", payment.ErrAgreementNotAllowed
+}
+
+func (this *fundChannel) AgreementReturnHandler(req *http.Request) (result *payment.Subscription, err error) {
+	return nil, payment.ErrUnknownAgreement
+}
+
+func (this *fundChannel) GetAgreement(agreementId string) (result *payment.Subscription, err error) {
+	return nil, payment.ErrUnknownAgreement
+}
+
+func (this *fundChannel) ChargeAgreement(param *payment.AgreementChargeParam) (result *payment.Trade, err error) {
+	return nil, payment.ErrUnknownAgreement
+}
+
+func (this *fundChannel) CancelAgreement(agreementId string) (err error) {
+	return payment.ErrUnknownAgreement
+}
+
+func (this *fundChannel) Payout(payout *payment.Payout) (result *payment.PayoutResult, err error) {
+	result = &payment.PayoutResult{}
+	result.Channel = this.Identifier()
+	result.PayoutNo = payout.PayoutNo
+	result.PayoutId = "payout_" + payout.PayoutNo
+	result.Status = payment.K_PAYOUT_STATUS_SUCCESS
+	result.Amount = payment.FormatAmount(payout.Currency, payout.Amount)
+	return result, nil
+}
+
+func (this *fundChannel) BatchPayout(batchNo string, payouts []*payment.Payout) (results []*payment.PayoutResult, err error) {
+	for _, payout := range payouts {
+		var result, _ = this.Payout(payout)
+		result.BatchNo = batchNo
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (this *fundChannel) GetPayout(payoutId string) (result *payment.PayoutResult, err error) {
+	return nil, payment.ErrUnknownPayout
+}
+
+func (this *fundChannel) GetPayoutWithPayoutNo(payoutNo string) (result *payment.PayoutResult, err error) {
+	return nil, payment.ErrUnknownPayout
+}
+
+func (this *fundChannel) AddSplitReceiver(receiver *payment.SplitReceiver) (err error) {
+	return nil
+}
+
+func (this *fundChannel) Split(param *payment.SplitParam) (result *payment.SplitResult, err error) {
+	result = &payment.SplitResult{}
+	result.Channel = this.Identifier()
+	result.TradeNo = param.TradeNo
+	result.SplitNo = param.SplitNo
+	result.Status = payment.K_SPLIT_STATUS_SUCCESS
+	return result, nil
+}
+
+func (this *fundChannel) GetSplit(tradeNo, splitNo string) (result *payment.SplitResult, err error) {
+	return nil, payment.ErrInvalidSplit
+}
+
+func (this *fundChannel) ReturnSplit(param *payment.SplitReturnParam) (result *payment.SplitReturn, err error) {
+	return nil, payment.ErrInvalidSplit
+}
+
+func (this *fundChannel) FinishSplit(tradeNo, splitNo string) (err error) {
+	return nil
+}
+
+func (this *fundChannel) ListDisputes(since time.Time) (results []*payment.Dispute, err error) {
+	var dispute, _ = this.GetDispute("d1")
+	return []*payment.Dispute{dispute}, nil
+}
+
+func (this *fundChannel) GetDispute(disputeId string) (result *payment.Dispute, err error) {
+	if disputeId != "d1" {
+		return nil, payment.ErrUnknownDispute
+	}
+	result = &payment.Dispute{}
+	result.Channel = this.Identifier()
+	result.DisputeId = disputeId
+	result.OrderNo = "o1"
+	result.TradeNo = "t1"
+	result.Status = payment.K_DISPUTE_STATUS_WAITING_MERCHANT
+	return result, nil
+}
+
+func (this *fundChannel) AcceptDispute(disputeId, note string) (err error) {
+	return nil
+}
+
+func (this *fundChannel) ProvideDisputeEvidence(disputeId string, evidences []*payment.DisputeEvidence) (err error) {
+	return nil
+}
+
+func (this *fundChannel) SendDisputeMessage(disputeId, message string) (err error) {
+	return nil
+}
+
+func (this *fundChannel) EscalateDispute(disputeId, note string) (err error) {
+	return nil
+}
+
+func TestService_MiddlewareFundOperations(t *testing.T) {
+	var fc = &fundChannel{paymenttest.NewFakeAccount("", "brand_a")}
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	var entries []*payment.LogEntry
+	var errBlocked = errors.New("blocked")
+	s.Use(
+		payment.LoggingMiddleware(func(entry *payment.LogEntry) {
+			entries = append(entries, entry)
+		}),
+		func(next payment.Operation) payment.Operation {
+			return func(call *payment.Call) error {
+				if payout, ok := call.Param.(*payment.Payout); ok && payout.PayoutNo == "blocked" {
+					return errBlocked
+				}
+				return next(call)
+			}
+		},
+	)
+
+	var order = newOrder("o1")
+	order.DelaySettle = true
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != nil {
+		t.Fatal(err)
+	}
+	fc.Pay("o1", "payer1")
+	trade, err := s.GetTradeWithOrderNo(paymenttest.K_CHANNEL_FAKE, "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Capture(paymenttest.K_CHANNEL_FAKE, &payment.CaptureParam{AuthorizationId: "auth1", OrderNo: "o1-1", Amount: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Void(paymenttest.K_CHANNEL_FAKE, "auth1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Payout(paymenttest.K_CHANNEL_FAKE, &payment.Payout{PayoutNo: "blocked", Amount: 1, PayeeAccount: "seller1"}); err != errBlocked || len(fc.Orders()) != 1 {
+		t.Fatalf("中间件应该可以中断付款，实际为 %v", err)
+	}
+	if _, err = s.Payout(paymenttest.K_CHANNEL_FAKE, &payment.Payout{PayoutNo: "p1", Amount: 1, PayeeAccount: "seller1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.BatchPayout(paymenttest.K_CHANNEL_FAKE, "b1", []*payment.Payout{{PayoutNo: "p2", Amount: 1, PayeeAccount: "seller2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.ChargeAgreement(paymenttest.K_CHANNEL_FAKE, &payment.AgreementChargeParam{AgreementId: "not_exist", OrderNo: "o2", Amount: 1}); err != payment.ErrUnknownAgreement {
+		t.Fatalf("期望返回 ErrUnknownAgreement，实际为 %v", err)
+	}
+	if _, err = s.Split(paymenttest.K_CHANNEL_FAKE, &payment.SplitParam{TradeNo: trade.TradeNo, SplitNo: "s1"}); err != payment.ErrInvalidSplit {
+		t.Fatalf("期望返回 ErrInvalidSplit，实际为 %v", err)
+	}
+
+	var expect = []struct {
+		operation string
+		orderNo   string
+		err       error
+	}{
+		{payment.K_OPERATION_CAPTURE, "o1-1", nil},
+		{payment.K_OPERATION_VOID, "", nil},
+		{payment.K_OPERATION_PAYOUT, "blocked", errBlocked},
+		{payment.K_OPERATION_PAYOUT, "p1", nil},
+		{payment.K_OPERATION_BATCH_PAYOUT, "b1", nil},
+		{payment.K_OPERATION_CHARGE_AGREEMENT, "o2", payment.ErrUnknownAgreement},
+		{payment.K_OPERATION_SPLIT, "", payment.ErrInvalidSplit},
+	}
+	// 前两条日志为 CreatePayment 和 GetTradeWithOrderNo
+	entries = entries[2:]
+	if len(entries) != len(expect) {
+		t.Fatalf("应该输出 %d 条日志，实际为 %d", len(expect), len(entries))
+	}
+	for i, e := range expect {
+		var entry = entries[i]
+		var errText string
+		if e.err != nil {
+			errText = e.err.Error()
+		}
+		if entry.Operation != e.operation || entry.OrderNo != e.orderNo || entry.Error != errText || entry.Channel != paymenttest.K_CHANNEL_FAKE {
+			t.Fatalf("日志错误: %+v", entry)
+		}
+		if e.err != errBlocked && entry.AccountId != "brand_a" {
+			t.Fatalf("日志中应该有实际使用的商户账号: %+v", entry)
+		}
+	}
+	if entries[len(entries)-1].TradeNo != trade.TradeNo {
+		t.Fatalf("分账的日志中应该有交易号: %+v", entries[len(entries)-1])
+	}
+}
+
+func TestService_MiddlewareOtherOperations(t *testing.T) {
+	var fc = &fundChannel{paymenttest.NewFakeAccount("", "brand_a")}
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	var entries []*payment.LogEntry
+	s.Use(payment.LoggingMiddleware(func(entry *payment.LogEntry) {
+		entries = append(entries, entry)
+	}))
+
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, nil); err != payment.ErrUnknownOrderNo {
+		t.Fatalf("期望返回 ErrUnknownOrderNo，实际为 %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("没有订单时不应该执行中间件: %+v", entries)
+	}
+
+	if _, err := s.CreateAgreement(paymenttest.K_CHANNEL_FAKE, &payment.Agreement{AgreementNo: "a1"}); err != payment.ErrAgreementNotAllowed {
+		t.Fatalf("期望返回 ErrAgreementNotAllowed，实际为 %v", err)
+	}
+	if err := s.CancelAgreement(paymenttest.K_CHANNEL_FAKE, "a1"); err != payment.ErrUnknownAgreement {
+		t.Fatalf("期望返回 ErrUnknownAgreement，实际为 %v", err)
+	}
+	if _, err := s.GetPayout(paymenttest.K_CHANNEL_FAKE, "payout_p1"); err != payment.ErrUnknownPayout {
+		t.Fatalf("期望返回 ErrUnknownPayout，实际为 %v", err)
+	}
+	if _, err := s.GetPayoutWithPayoutNo(paymenttest.K_CHANNEL_FAKE, "p1"); err != payment.ErrUnknownPayout {
+		t.Fatalf("期望返回 ErrUnknownPayout，实际为 %v", err)
+	}
+	if err := s.AddSplitReceiver(paymenttest.K_CHANNEL_FAKE, &payment.SplitReceiver{Account: "seller1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReturnSplit(paymenttest.K_CHANNEL_FAKE, &payment.SplitReturnParam{SplitNo: "s1", ReturnNo: "r1", Amount: 1}); err != payment.ErrInvalidSplit {
+		t.Fatalf("期望返回 ErrInvalidSplit，实际为 %v", err)
+	}
+	if err := s.FinishSplit(paymenttest.K_CHANNEL_FAKE, "t1", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if disputes, err := s.ListDisputes(paymenttest.K_CHANNEL_FAKE, time.Now()); err != nil || len(disputes) != 1 {
+		t.Fatalf("争议列表错误: %v %+v", err, disputes)
+	}
+	if _, err := s.GetDispute(paymenttest.K_CHANNEL_FAKE, "d1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AcceptDispute(paymenttest.K_CHANNEL_FAKE, "", ""); err != payment.ErrUnknownDispute {
+		t.Fatalf("期望返回 ErrUnknownDispute，实际为 %v", err)
+	}
+	if err := s.ProvideDisputeEvidence(paymenttest.K_CHANNEL_FAKE, "d1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendDisputeMessage(paymenttest.K_CHANNEL_FAKE, "d1", "货物已经发出"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EscalateDispute(paymenttest.K_CHANNEL_FAKE, "d1", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var expect = []struct {
+		operation string
+		orderNo   string
+		tradeNo   string
+		err       error
+	}{
+		{payment.K_OPERATION_CREATE_AGREEMENT, "a1", "", payment.ErrAgreementNotAllowed},
+		{payment.K_OPERATION_CANCEL_AGREEMENT, "", "", payment.ErrUnknownAgreement},
+		{payment.K_OPERATION_GET_PAYOUT, "", "", payment.ErrUnknownPayout},
+		{payment.K_OPERATION_GET_PAYOUT_WITH_PAYOUT_NO, "p1", "", payment.ErrUnknownPayout},
+		{payment.K_OPERATION_ADD_SPLIT_RECEIVER, "", "", nil},
+		{payment.K_OPERATION_RETURN_SPLIT, "", "", payment.ErrInvalidSplit},
+		{payment.K_OPERATION_FINISH_SPLIT, "", "t1", nil},
+		{payment.K_OPERATION_LIST_DISPUTES, "", "", nil},
+		{payment.K_OPERATION_GET_DISPUTE, "o1", "t1", nil},
+		{payment.K_OPERATION_ACCEPT_DISPUTE, "", "", payment.ErrUnknownDispute},
+		{payment.K_OPERATION_PROVIDE_DISPUTE_EVIDENCE, "", "", nil},
+		{payment.K_OPERATION_SEND_DISPUTE_MESSAGE, "", "", nil},
+		{payment.K_OPERATION_ESCALATE_DISPUTE, "", "", nil},
+	}
+	if len(entries) != len(expect) {
+		t.Fatalf("应该输出 %d 条日志，实际为 %d", len(expect), len(entries))
+	}
+	for i, e := range expect {
+		var entry = entries[i]
+		var errText string
+		if e.err != nil {
+			errText = e.err.Error()
+		}
+		if entry.Operation != e.operation || entry.OrderNo != e.orderNo || entry.TradeNo != e.tradeNo || entry.Error != errText || entry.AccountId != "brand_a" {
+			t.Fatalf("日志错误: %+v", entry)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package payment
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// Option 创建支付渠道时的可选参数
+type Option func(opts *options)
+
+type options struct {
+	httpClient   *http.Client
+	transport    http.RoundTripper
+	timeout      time.Duration
+	certificates []tls.Certificate
+	baseURL      string
+	now          func() time.Time
+	accountId    string
+	auditSink    AuditSink
+	redactor     *Redactor
+}
+
+// newOptions channel 为支付渠道的标识，用于审计记录
+func newOptions(channel string, opts ...Option) *options {
+	var o = &options{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+	if o.now == nil {
+		o.now = time.Now
+	}
+	o.httpClient = o.buildHTTPClient()
+	if o.auditSink != nil {
+		var client = &http.Client{}
+		*client = *o.httpClient
+		client.Transport = &auditTransport{next: client.Transport, sink: o.auditSink, redactor: o.redactor, channel: channel, accountId: o.accountId, now: o.now}
+		o.httpClient = client
+	}
+	return o
+}
+
+// buildHTTPClient 根据参数生成请求支付渠道接口时使用的 http.Client，不会修改通过 WithHTTPClient 传入的 http.Client
+func (this *options) buildHTTPClient() *http.Client {
+	if this.httpClient != nil && this.transport == nil && this.timeout <= 0 && len(this.certificates) == 0 {
+		return this.httpClient
+	}
+
+	var client = &http.Client{}
+	if this.httpClient != nil {
+		*client = *this.httpClient
+	}
+
+	if this.transport != nil {
+		client.Transport = this.transport
+	}
+
+	if this.timeout > 0 {
+		client.Timeout = this.timeout
+	}
+
+	if len(this.certificates) > 0 {
+		var transport *http.Transport
+		switch t := client.Transport.(type) {
+		case nil:
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+		case *http.Transport:
+			transport = t.Clone()
+		}
+
+		// 无法给自定义的 http.RoundTripper 设置证书，所有请求都返回 ErrClientCertNotApplied，避免在没有证书的情况下请求支付渠道
+		if transport == nil {
+			client.Transport = certErrorTransport{}
+			return client
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.Certificates = append(transport.TLSClientConfig.Certificates, this.certificates...)
+		client.Transport = transport
+	}
+	return client
+}
+
+type certErrorTransport struct{}
+
+func (this certErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, ErrClientCertNotApplied
+}
+
+// WithHTTPClient 设置请求支付渠道接口时使用的 http.Client，可用于设置代理等
+func WithHTTPClient(client *http.Client) Option {
+	return func(opts *options) {
+		opts.httpClient = client
+	}
+}
+
+// WithTransport 设置请求支付渠道接口时使用的 http.RoundTripper，可用于记录或者模拟请求，
+// 不是 *http.Transport 时不能与 WithClientCert 同时使用，证书需要在自定义的 http.RoundTripper 中自行设置
+func WithTransport(transport http.RoundTripper) Option {
+	return func(opts *options) {
+		opts.transport = transport
+	}
+}
+
+// WithTimeout 设置请求支付渠道接口的超时时间
+func WithTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.timeout = timeout
+	}
+}
+
+// WithClientCert 设置请求支付渠道接口时使用的客户端证书（微信支付的退款等接口需要使用商户证书），
+// 证书可以通过 LoadClientCert 或者 LoadPKCS12ClientCert 加载，
+// 通过 WithTransport 或者 WithHTTPClient 设置的 http.RoundTripper 不是 *http.Transport 时无法设置证书，所有请求都会失败，返回的 *url.Error 中包含 ErrClientCertNotApplied
+func WithClientCert(cert tls.Certificate) Option {
+	return func(opts *options) {
+		opts.certificates = append(opts.certificates, cert)
+	}
+}
+
+// WithBaseURL 设置支付渠道接口的地址，用于替换默认的正式环境或者沙箱环境地址，例如连接本地的模拟服务器
+func WithBaseURL(baseURL string) Option {
+	return func(opts *options) {
+		opts.baseURL = baseURL
+	}
+}
+
+// WithClock 设置获取当前时间的函数，用于计算订单的过期时间等，默认为 time.Now，主要用于测试
+func WithClock(now func() time.Time) Option {
+	return func(opts *options) {
+		opts.now = now
+	}
+}
+
+// WithAccountId 设置商户账号 ID，同一个支付渠道有多个商户账号时用于区分，账号 ID 会附加在回调 URL 的 account 参数中，
+// PayPal 的 Webhook URL 是在 PayPal 后台配置的，需要自行在 URL 中添加 channel 和 account 参数
+func WithAccountId(accountId string) Option {
+	return func(opts *options) {
+		opts.accountId = accountId
+	}
+}
+
+// WithAudit 记录发送给支付渠道的请求以及支付渠道的响应，redactor 为 nil 时使用 DefaultRedactor，
+// 用户跳转回来的请求和异步通知需要通过 Service.Use(AuditMiddleware(sink, redactor)) 记录
+func WithAudit(sink AuditSink, redactor *Redactor) Option {
+	return func(opts *options) {
+		if redactor == nil {
+			redactor = DefaultRedactor()
+		}
+		opts.auditSink = sink
+		opts.redactor = redactor
+	}
+}
@@ -0,0 +1,71 @@
+package payment
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOptions_HTTPClient(t *testing.T) {
+	var client = &http.Client{}
+	if o := newOptions("", WithHTTPClient(client)); o.httpClient != client {
+		t.Fatal("没有其它参数时应该直接使用传入的 http.Client")
+	}
+
+	var o = newOptions("", WithHTTPClient(client), WithTimeout(time.Second*5), WithClientCert(tls.Certificate{}))
+	if o.httpClient == client || client.Timeout != 0 || client.Transport != nil {
+		t.Fatal("不能修改传入的 http.Client")
+	}
+	if o.httpClient.Timeout != time.Second*5 {
+		t.Fatal("超时时间设置错误")
+	}
+
+	transport, ok := o.httpClient.Transport.(*http.Transport)
+	if ok == false || len(transport.TLSClientConfig.Certificates) != 1 {
+		t.Fatal("客户端证书设置错误")
+	}
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil && len(c.Certificates) != 0 {
+		t.Fatal("不能修改 http.DefaultTransport")
+	}
+}
+
+func TestOptions_ClientCert(t *testing.T) {
+	cert, err := LoadClientCert("testdata/client_cert.pem", "testdata/client_key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := LoadPKCS12ClientCert("testdata/client_cert.p12", "10000100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(cert.Certificate[0], p12.Certificate[0]) == false || p12.PrivateKey == nil {
+		t.Fatal("PKCS#12 格式的证书与 PEM 格式的证书不一致")
+	}
+	if _, err = LoadPKCS12ClientCert("testdata/client_cert.p12", "wrong"); err == nil {
+		t.Fatal("密码错误时应该返回错误")
+	}
+	if IsPKCS12File("testdata/client_cert.P12") == false || IsPKCS12File("testdata/client_cert.pem") {
+		t.Fatal("PKCS#12 格式判断错误")
+	}
+
+	// 自定义的 http.RoundTripper 无法设置证书，请求会失败
+	var called bool
+	var o = newOptions("", WithTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		called = true
+		return nil, errors.New("unreachable")
+	})), WithClientCert(cert))
+	_, err = o.httpClient.Get("https://example.com")
+	if uErr, ok := err.(*url.Error); ok == false || uErr.Err != ErrClientCertNotApplied || called {
+		t.Fatalf("期望返回 ErrClientCertNotApplied，实际为 %v", err)
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (this roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return this(req)
+}
@@ -0,0 +1,317 @@
+package paymenttest
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newAgreement(agreementNo string) *payment.Agreement {
+	var a = &payment.Agreement{}
+	a.AgreementNo = agreementNo
+	a.Subject = "test"
+	a.Amount = 20
+	a.PeriodType = payment.K_AGREEMENT_PERIOD_MONTH
+	a.Period = 1
+	return a
+}
+
+func TestAliPayAgreement(t *testing.T) {
+	merchantKey, merchantPublicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAliPayServer("2016073100129537", merchantPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "success", notifications)
+	defer receiver.Close()
+
+	var ap = payment.NewAliPay("2016073100129537", "2088102169227503", server.PublicKey, merchantKey, false, payment.WithBaseURL(server.URL))
+	ap.NotifyURL = receiver.URL + "/pay/notify"
+	ap.ReturnURL = receiver.URL + "/pay/return"
+	s.RegisterChannel(ap)
+
+	var agreement = newAgreement("AA001")
+	agreement.Currency = "USD"
+	if _, err = s.CreateAgreement(payment.K_CHANNEL_ALIPAY, agreement); err != payment.ErrCurrencyNotSupported {
+		t.Fatalf("期望返回 ErrCurrencyNotSupported，实际为 %v", err)
+	}
+	agreement.Currency = ""
+
+	// 签约页面打开之后才会创建签约协议
+	signURL, err := s.CreateAgreement(payment.K_CHANNEL_ALIPAY, agreement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.Get(signURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+
+	if err = server.Sign("AA001", "2088102175953034"); err != nil {
+		t.Fatal(err)
+	}
+	returnURL, err := server.AgreementReturnURL("AA001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, returnURL, nil)
+	sub, err := s.AgreementReturnHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Active == false || sub.AgreementNo != "AA001" || sub.AgreementId == "" || sub.PayerId != "2088102175953034" {
+		t.Fatalf("签约信息错误: %+v", sub)
+	}
+
+	if err = server.NotifyAgreement("AA001"); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_AGREEMENT_SIGN || noti.AgreementNo != "AA001" || noti.AgreementId != sub.AgreementId {
+		t.Fatalf("签约通知信息错误: %+v", noti)
+	}
+
+	// 扣款金额不能超过签约时约定的每期扣款金额
+	if _, err = s.ChargeAgreement(payment.K_CHANNEL_ALIPAY, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, OrderNo: "AA001-1", Amount: 20.01}); err == nil {
+		t.Fatal("扣款金额超过约定金额时应该返回错误")
+	}
+	if _, err = s.ChargeAgreement(payment.K_CHANNEL_ALIPAY, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, Amount: 20}); err != payment.ErrUnknownOrderNo {
+		t.Fatalf("期望返回 ErrUnknownOrderNo，实际为 %v", err)
+	}
+	trade, err := s.ChargeAgreement(payment.K_CHANNEL_ALIPAY, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, OrderNo: "AA001-1", Amount: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess == false || trade.OrderNo != "AA001-1" || trade.TotalAmount != "20.00" || trade.PayerId != "2088102175953034" {
+		t.Fatalf("扣款信息错误: %+v", trade)
+	}
+	if trade, err = s.GetTradeWithOrderNo(payment.K_CHANNEL_ALIPAY, "AA001-1"); err != nil || trade.TradeSuccess == false {
+		t.Fatalf("交易信息错误: %+v, %v", trade, err)
+	}
+
+	// 解约之后不能再扣款
+	if err = s.CancelAgreement(payment.K_CHANNEL_ALIPAY, sub.AgreementId); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err = s.GetAgreement(payment.K_CHANNEL_ALIPAY, sub.AgreementId); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Active || sub.Status != k_ALIPAY_AGREEMENT_STATUS_STOP {
+		t.Fatalf("签约信息错误: %+v", sub)
+	}
+	if err = server.NotifyAgreement("AA001"); err != nil {
+		t.Fatal(err)
+	}
+	if noti = <-notifications; noti.NotifyType != payment.K_NOTIFY_TYPE_AGREEMENT_UNSIGN || noti.AgreementId != sub.AgreementId {
+		t.Fatalf("解约通知信息错误: %+v", noti)
+	}
+	if _, err = s.ChargeAgreement(payment.K_CHANNEL_ALIPAY, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, OrderNo: "AA001-2", Amount: 20}); err == nil {
+		t.Fatal("解约之后扣款应该返回错误")
+	}
+	if err = s.CancelAgreement(payment.K_CHANNEL_ALIPAY, sub.AgreementId); err == nil {
+		t.Fatal("重复解约应该返回错误")
+	}
+}
+
+func TestWXPayAgreement(t *testing.T) {
+	var server = NewWXPayServer("wx0000000000000001", "10000100", "test-api-key-00000000000000000000")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "<xml><return_code><![CDATA[SUCCESS]]></return_code></xml>", notifications)
+	defer receiver.Close()
+
+	var wp = payment.NewWXPal("wx0000000000000001", "test-api-key-00000000000000000000", "10000100", false, payment.WithBaseURL(server.URL))
+	wp.NotifyURL = receiver.URL + "/pay/notify"
+	s.RegisterChannel(wp)
+
+	// 微信支付的签约必须指定商户平台上配置的模板
+	var agreement = newAgreement("WA001")
+	if _, err := s.CreateAgreement(payment.K_CHANNEL_WXPAY, agreement); err != payment.ErrUnknownAgreement {
+		t.Fatalf("期望返回 ErrUnknownAgreement，实际为 %v", err)
+	}
+	agreement.PlanId = "12535"
+
+	signURL, err := s.CreateAgreement(payment.K_CHANNEL_WXPAY, agreement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.Get(signURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatalf("打开签约页面失败: %d", rsp.StatusCode)
+	}
+
+	var openId = "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"
+	if err = server.SignContract("WA001", openId); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.NotifyContract("WA001"); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_AGREEMENT_SIGN || noti.AgreementNo != "WA001" || noti.AgreementId == "" {
+		t.Fatalf("签约通知信息错误: %+v", noti)
+	}
+
+	// 签约完成之后由页面传递 agreement_no 和 plan_id
+	req, _ := http.NewRequest(http.MethodGet, receiver.URL+"/agreement/return?channel=wxpay&agreement_no=WA001", nil)
+	if _, err = s.AgreementReturnHandler(req); err != payment.ErrUnknownAgreement {
+		t.Fatalf("期望返回 ErrUnknownAgreement，实际为 %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, receiver.URL+"/agreement/return?channel=wxpay&agreement_no=WA001&plan_id=12535", nil)
+	sub, err := s.AgreementReturnHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Active == false || sub.AgreementId != noti.AgreementId || sub.PayerId != openId {
+		t.Fatalf("签约信息错误: %+v", sub)
+	}
+
+	// 委托代扣受理之后异步扣款，扣款结果通过交易通知返回
+	trade, err := s.ChargeAgreement(payment.K_CHANNEL_WXPAY, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, OrderNo: "WA001-1", Amount: 20, IP: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess || trade.Status != payment.K_TRADE_STATUS_PENDING || trade.OrderNo != "WA001-1" {
+		t.Fatalf("扣款信息错误: %+v", trade)
+	}
+	if _, err = s.ChargeAgreement(payment.K_CHANNEL_WXPAY, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, OrderNo: "WA001-1", Amount: 20, IP: "127.0.0.1"}); err == nil {
+		t.Fatal("重复的订单号应该返回错误")
+	}
+	if trade, err = s.GetTradeWithOrderNo(payment.K_CHANNEL_WXPAY, "WA001-1"); err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess || trade.Status != payment.K_TRADE_STATUS_PENDING {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	server.Pay("WA001-1", openId)
+	if err = server.Notify("WA001-1"); err != nil {
+		t.Fatal(err)
+	}
+	if noti = <-notifications; noti.NotifyType != payment.K_NOTIFY_TYPE_TRADE || noti.OrderNo != "WA001-1" || noti.TotalAmount != "20.00" || noti.PayerId != openId {
+		t.Fatalf("扣款通知信息错误: %+v", noti)
+	}
+
+	// 解约之后不能再扣款
+	if err = s.CancelAgreement(payment.K_CHANNEL_WXPAY, sub.AgreementId); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err = s.GetAgreement(payment.K_CHANNEL_WXPAY, sub.AgreementId); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Active || sub.Status != k_WXPAY_CONTRACT_STATE_TERMINATED {
+		t.Fatalf("签约信息错误: %+v", sub)
+	}
+	if err = server.NotifyContract("WA001"); err != nil {
+		t.Fatal(err)
+	}
+	if noti = <-notifications; noti.NotifyType != payment.K_NOTIFY_TYPE_AGREEMENT_UNSIGN || noti.AgreementId != sub.AgreementId {
+		t.Fatalf("解约通知信息错误: %+v", noti)
+	}
+	if _, err = s.ChargeAgreement(payment.K_CHANNEL_WXPAY, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, OrderNo: "WA001-2", Amount: 20, IP: "127.0.0.1"}); err == nil {
+		t.Fatal("解约之后扣款应该返回错误")
+	}
+	if err = s.CancelAgreement(payment.K_CHANNEL_WXPAY, sub.AgreementId); err == nil {
+		t.Fatal("重复解约应该返回错误")
+	}
+}
+
+func TestPayPalAgreement(t *testing.T) {
+	var server = NewPayPalServer("client-id", "secret")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "", notifications)
+	defer receiver.Close()
+	server.WebhookURL = receiver.URL + "/pay/notify?channel=" + payment.K_CHANNEL_PAYPAL
+
+	var pp = payment.NewPayPal("client-id", "secret", false, payment.WithBaseURL(server.URL))
+	pp.ReturnURL = receiver.URL + "/pay/return"
+	pp.CancelURL = receiver.URL + "/pay/cancel"
+	pp.WebHookId = server.WebhookId
+	s.RegisterChannel(pp)
+
+	var agreement = newAgreement("PA001")
+	agreement.Currency = "USD"
+	approvalURL, err := s.CreateAgreement(payment.K_CHANNEL_PAYPAL, agreement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(approvalURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token = u.Query().Get("token")
+
+	// 用户同意之前不能执行签约协议
+	returnURL, err := server.AgreementReturnURL(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, returnURL, nil)
+	if _, err = s.AgreementReturnHandler(req); err == nil {
+		t.Fatal("用户同意之前执行签约协议应该返回错误")
+	}
+
+	if err = server.ApproveAgreement(token, "PAYER1"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := s.AgreementReturnHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Active == false || sub.AgreementNo != "PA001" || sub.AgreementId == "" || sub.PayerId != "PAYER1" {
+		t.Fatalf("签约信息错误: %+v", sub)
+	}
+	if _, err = s.AgreementReturnHandler(req); err == nil {
+		t.Fatal("重复执行签约协议应该返回错误")
+	}
+
+	if err = server.NotifyAgreement(sub.AgreementId, K_PAYPAL_EVENT_SUBSCRIPTION_CREATED); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_AGREEMENT_SIGN || noti.AgreementNo != "PA001" || noti.AgreementId != sub.AgreementId {
+		t.Fatalf("签约通知信息错误: %+v", noti)
+	}
+
+	// PayPal 按照 Billing Plan 自动扣款
+	if _, err = s.ChargeAgreement(payment.K_CHANNEL_PAYPAL, &payment.AgreementChargeParam{AgreementId: sub.AgreementId, OrderNo: "PA001-1", Amount: 20}); err != payment.ErrPayPalNotAllowed {
+		t.Fatalf("期望返回 ErrPayPalNotAllowed，实际为 %v", err)
+	}
+
+	if err = s.CancelAgreement(payment.K_CHANNEL_PAYPAL, sub.AgreementId); err != nil {
+		t.Fatal(err)
+	}
+	if sub, err = s.GetAgreement(payment.K_CHANNEL_PAYPAL, sub.AgreementId); err != nil {
+		t.Fatal(err)
+	}
+	if sub.Active || sub.Status != k_PAYPAL_AGREEMENT_STATE_CANCELLED || sub.AgreementNo != "PA001" {
+		t.Fatalf("签约信息错误: %+v", sub)
+	}
+	if err = server.NotifyAgreement(sub.AgreementId, K_PAYPAL_EVENT_SUBSCRIPTION_CANCELLED); err != nil {
+		t.Fatal(err)
+	}
+	if noti = <-notifications; noti.NotifyType != payment.K_NOTIFY_TYPE_AGREEMENT_UNSIGN || noti.AgreementId != sub.AgreementId {
+		t.Fatalf("解约通知信息错误: %+v", noti)
+	}
+	if err = s.CancelAgreement(payment.K_CHANNEL_PAYPAL, sub.AgreementId); err == nil {
+		t.Fatal("重复解约应该返回错误")
+	}
+}
@@ -0,0 +1,1096 @@
+package paymenttest
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	k_ALIPAY_GATEWAY_PATH = "/gateway.do"
+
+	k_ALIPAY_TRADE_STATUS_WAIT_BUYER_PAY = "WAIT_BUYER_PAY"
+	k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS  = "TRADE_SUCCESS"
+	k_ALIPAY_TRADE_STATUS_TRADE_CLOSED   = "TRADE_CLOSED"
+
+	k_ALIPAY_FUND_AUTH_STATUS_AUTHORIZED = "AUTHORIZED"
+	k_ALIPAY_FUND_AUTH_STATUS_FINISH     = "FINISH"
+
+	k_ALIPAY_AGREEMENT_STATUS_TEMP   = "TEMP"
+	k_ALIPAY_AGREEMENT_STATUS_NORMAL = "NORMAL"
+	k_ALIPAY_AGREEMENT_STATUS_STOP   = "STOP"
+
+	k_ALIPAY_FUND_TRANS_STATUS_SUCCESS = "SUCCESS"
+
+	k_ALIPAY_ROYALTY_STATE_SUCCESS = "SUCCESS"
+	k_ALIPAY_ROYALTY_STATE_FAIL    = "FAIL"
+)
+
+// AliPayServer 模拟支付宝开放平台网关，请求和响应均使用 RSA2 签名
+type AliPayServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	appId       string
+	privateKey  *rsa.PrivateKey // 支付宝私钥，用于对响应和通知进行签名
+	merchantKey *rsa.PublicKey  // 商户公钥，用于验证请求的签名
+	trades      map[string]*aliPayTrade
+	auths       map[string]*aliPayFundAuth  // key 为 auth_no
+	agreements  map[string]*aliPayAgreement // key 为 external_agreement_no
+	transfers   map[string]*aliPayTransfer  // key 为 out_biz_no
+	royalties   map[string]string           // key 为分账接收方的账号，value 为账号类型
+	notifyIds   map[string]struct{}
+	seq         int
+
+	PublicKey string  // 支付宝公钥，创建 AliPay 时作为 aliPublicKey 使用
+	Balance   float64 // 商户账户的可用余额，转账金额超过余额时返回 PAYER_BALANCE_NOT_ENOUGH
+}
+
+type aliPayTrade struct {
+	OutTradeNo   string
+	TradeNo      string
+	Subject      string
+	TotalAmount  string
+	TradeStatus  string
+	NotifyURL    string
+	ReturnURL    string
+	BuyerUserId  string
+	BuyerLogonId string
+	GmtPayment   string
+	RefundFee    float64
+	SettleAmount float64                           // 已经分账的金额
+	SettleFinish bool                              // 分账是否已经完结
+	refunds      map[string]map[string]interface{} // key 为 out_request_no，value 为第一次退款的响应
+	settles      map[string]*aliPaySettle          // key 为 out_request_no
+}
+
+// aliPaySettle 交易分账，没有绑定分账关系的接收方分账失败，其它接收方分账成功
+type aliPaySettle struct {
+	OutRequestNo string
+	SettleNo     string
+	OperationDt  string
+	Details      []map[string]interface{}
+}
+
+// aliPayFundAuth 资金授权订单，冻结的资金可以通过 alipay.trade.pay 转为支付，或者通过 alipay.fund.auth.order.unfreeze 解冻
+type aliPayFundAuth struct {
+	AuthNo       string
+	OutOrderNo   string
+	OutRequestNo string
+	OrderTitle   string
+	OrderStatus  string
+	PayerUserId  string
+	FreezeAmount float64
+	PayAmount    float64
+	RestAmount   float64
+	unfreezes    map[string]map[string]interface{} // key 为 out_request_no，value 为第一次解冻的响应
+}
+
+// aliPayTransfer 单笔转账到支付宝账户，转账会立即成功
+type aliPayTransfer struct {
+	OutBizNo       string
+	OrderId        string
+	PayFundOrderId string
+	TransAmount    string
+	Identity       string
+	IdentityType   string
+	Name           string
+	Status         string
+	PayDate        string
+}
+
+// aliPayAgreement 周期扣款的签约协议，用户签约之前状态为 TEMP
+type aliPayAgreement struct {
+	AgreementNo         string
+	ExternalAgreementNo string
+	PersonalProductCode string
+	SignScene           string
+	Status              string
+	PrincipalId         string
+	SingleAmount        float64
+	SignTime            string
+	InvalidTime         string
+	NotifyURL           string
+	ReturnURL           string
+}
+
+// NewAliPayServer 创建并启动支付宝模拟服务器，merchantPublicKey 为商户应用的公钥
+func NewAliPayServer(appId, merchantPublicKey string) (*AliPayServer, error) {
+	merchantKey, err := parsePublicKey(merchantPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, publicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		return nil, err
+	}
+
+	var s = &AliPayServer{}
+	s.appId = appId
+	s.merchantKey = merchantKey
+	s.privateKey, _ = parsePrivateKey(privateKey)
+	s.PublicKey = publicKey
+	s.trades = make(map[string]*aliPayTrade)
+	s.auths = make(map[string]*aliPayFundAuth)
+	s.agreements = make(map[string]*aliPayAgreement)
+	s.transfers = make(map[string]*aliPayTransfer)
+	s.royalties = make(map[string]string)
+	s.Balance = 10000
+	s.notifyIds = make(map[string]struct{})
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc(k_ALIPAY_GATEWAY_PATH, s.handleGateway)
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// Pay 模拟用户完成支付
+func (this *AliPayServer) Pay(orderNo, buyerId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		return ErrTradeNotExist
+	}
+	trade.TradeStatus = k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS
+	trade.BuyerUserId = buyerId
+	trade.BuyerLogonId = buyerId + "@sandbox.com"
+	trade.GmtPayment = time.Now().Format("2006-01-02 15:04:05")
+	return nil
+}
+
+// Freeze 模拟用户在支付宝 App 中完成资金授权，orderStr 为 alipay.fund.auth.order.app.freeze 生成的参数，
+// 与 App SDK 一样会验证参数的签名
+func (this *AliPayServer) Freeze(orderStr, payerId string) (authNo string, err error) {
+	form, err := url.ParseQuery(orderStr)
+	if err != nil {
+		return "", err
+	}
+	if form.Get("method") != "alipay.fund.auth.order.app.freeze" {
+		return "", errors.New("不是资金授权的参数")
+	}
+	biz, _, subMsg := this.verifyRequest(form)
+	if subMsg != "" {
+		return "", errors.New(subMsg)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, auth := range this.auths {
+		if auth.OutOrderNo == bizValue(biz, "out_order_no") {
+			return "", errors.New("授权订单号重复")
+		}
+	}
+
+	this.seq++
+
+	var auth = &aliPayFundAuth{}
+	auth.AuthNo = fmt.Sprintf("%s1000%010d", time.Now().Format("20060102"), this.seq)
+	auth.OutOrderNo = bizValue(biz, "out_order_no")
+	auth.OutRequestNo = bizValue(biz, "out_request_no")
+	auth.OrderTitle = bizValue(biz, "order_title")
+	auth.OrderStatus = k_ALIPAY_FUND_AUTH_STATUS_AUTHORIZED
+	auth.PayerUserId = payerId
+	auth.FreezeAmount, _ = strconv.ParseFloat(bizValue(biz, "amount"), 64)
+	auth.RestAmount = auth.FreezeAmount
+	this.auths[auth.AuthNo] = auth
+	return auth.AuthNo, nil
+}
+
+// Notify 将订单当前的状态以异步通知的形式发送到创建订单时提供的 notify_url
+func (this *AliPayServer) Notify(orderNo string) error {
+	this.mu.Lock()
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		this.mu.Unlock()
+		return ErrTradeNotExist
+	}
+
+	var notifyId = newNotifyId()
+	this.notifyIds[notifyId] = struct{}{}
+
+	var p = aliPayNotifyValues(this.appId, notifyId, trade)
+	var notifyURL = trade.NotifyURL
+	this.mu.Unlock()
+
+	if notifyURL == "" {
+		return errors.New("订单没有设置 notify_url")
+	}
+	return this.sendNotify(notifyURL, p)
+}
+
+// Sign 模拟用户在支付宝页面上确认签约，agreementNo 为商户的签约协议号（external_agreement_no）
+func (this *AliPayServer) Sign(agreementNo, principalId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var agreement = this.agreements[agreementNo]
+	if agreement == nil {
+		return errors.New("签约协议不存在")
+	}
+	if agreement.Status != k_ALIPAY_AGREEMENT_STATUS_TEMP {
+		return errors.New("签约协议已经生效")
+	}
+
+	this.seq++
+	agreement.AgreementNo = fmt.Sprintf("%s0000%010d", time.Now().Format("20060102"), this.seq)
+	agreement.Status = k_ALIPAY_AGREEMENT_STATUS_NORMAL
+	agreement.PrincipalId = principalId
+	agreement.SignTime = time.Now().Format("2006-01-02 15:04:05")
+	agreement.InvalidTime = "2115-02-01 00:00:00"
+	return nil
+}
+
+// AgreementReturnURL 生成用户签约完成之后，浏览器跳转回商户页面时使用的 URL
+func (this *AliPayServer) AgreementReturnURL(agreementNo string) (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var agreement = this.agreements[agreementNo]
+	if agreement == nil {
+		return "", errors.New("签约协议不存在")
+	}
+	if agreement.ReturnURL == "" {
+		return "", errors.New("签约协议没有设置 return_url")
+	}
+	return agreement.ReturnURL, nil
+}
+
+// NotifyAgreement 将签约协议当前的状态以签约（dut_user_sign）或者解约（dut_user_unsign）通知的形式发送到签约时提供的 notify_url
+func (this *AliPayServer) NotifyAgreement(agreementNo string) error {
+	this.mu.Lock()
+	var agreement = this.agreements[agreementNo]
+	if agreement == nil || agreement.Status == k_ALIPAY_AGREEMENT_STATUS_TEMP {
+		this.mu.Unlock()
+		return errors.New("用户还没有签约")
+	}
+
+	var p = url.Values{}
+	p.Set("notify_type", "dut_user_sign")
+	if agreement.Status == k_ALIPAY_AGREEMENT_STATUS_STOP {
+		p.Set("notify_type", "dut_user_unsign")
+	}
+	p.Set("notify_id", newNotifyId())
+	p.Set("notify_time", time.Now().Format("2006-01-02 15:04:05"))
+	p.Set("app_id", this.appId)
+	p.Set("auth_app_id", this.appId)
+	p.Set("charset", "utf-8")
+	p.Set("version", "1.0")
+	p.Set("sign_type", "RSA2")
+	p.Set("agreement_no", agreement.AgreementNo)
+	p.Set("external_agreement_no", agreement.ExternalAgreementNo)
+	p.Set("personal_product_code", agreement.PersonalProductCode)
+	p.Set("sign_scene", agreement.SignScene)
+	p.Set("status", agreement.Status)
+	p.Set("alipay_user_id", agreement.PrincipalId)
+	p.Set("sign_time", agreement.SignTime)
+	p.Set("invalid_time", agreement.InvalidTime)
+	var notifyURL = agreement.NotifyURL
+	this.mu.Unlock()
+
+	if notifyURL == "" {
+		return errors.New("签约协议没有设置 notify_url")
+	}
+	return this.sendNotify(notifyURL, p)
+}
+
+// sendNotify 对通知的参数签名之后发送到 notifyURL，商户需要返回 success
+func (this *AliPayServer) sendNotify(notifyURL string, p url.Values) error {
+	// 异步通知的签名不包含 sign 和 sign_type
+	sign, err := signAliPay(p, this.privateKey, "sign", "sign_type")
+	if err != nil {
+		return err
+	}
+	p.Set("sign", sign)
+
+	rsp, err := http.PostForm(notifyURL, p)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != "success" {
+		return fmt.Errorf("商户没有确认接收到通知: %d %s", rsp.StatusCode, body)
+	}
+	return nil
+}
+
+// ReturnURL 生成用户支付完成之后，浏览器跳转回商户页面时使用的 URL（包含签名）
+func (this *AliPayServer) ReturnURL(orderNo string) (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		return "", ErrTradeNotExist
+	}
+	if trade.ReturnURL == "" {
+		return "", errors.New("订单没有设置 return_url")
+	}
+
+	returnURL, err := url.Parse(trade.ReturnURL)
+	if err != nil {
+		return "", err
+	}
+
+	var p = url.Values{}
+	p.Set("method", "alipay.trade.page.pay.return")
+	p.Set("app_id", this.appId)
+	p.Set("auth_app_id", this.appId)
+	p.Set("charset", "utf-8")
+	p.Set("version", "1.0")
+	p.Set("sign_type", "RSA2")
+	p.Set("timestamp", time.Now().Format("2006-01-02 15:04:05"))
+	p.Set("trade_no", trade.TradeNo)
+	p.Set("out_trade_no", trade.OutTradeNo)
+	p.Set("total_amount", trade.TotalAmount)
+
+	sign, err := signAliPay(p, this.privateKey, "sign", "sign_type")
+	if err != nil {
+		return "", err
+	}
+	p.Set("sign", sign)
+
+	var query = returnURL.Query()
+	for key := range p {
+		query.Set(key, p.Get(key))
+	}
+	returnURL.RawQuery = query.Encode()
+	return returnURL.String(), nil
+}
+
+func (this *AliPayServer) handleGateway(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	// 旧版的异步通知验证接口
+	if req.Form.Get("service") == "notify_verify" {
+		this.mu.Lock()
+		_, ok := this.notifyIds[req.Form.Get("notify_id")]
+		this.mu.Unlock()
+		w.Write([]byte(strconv.FormatBool(ok)))
+		return
+	}
+
+	var method = req.Form.Get("method")
+	if method == "" {
+		http.Error(w, "missing method", http.StatusBadRequest)
+		return
+	}
+
+	biz, subCode, subMsg := this.verifyRequest(req.Form)
+	if subCode != "" {
+		this.writeError(w, method, "40002", subCode, subMsg)
+		return
+	}
+
+	switch method {
+	case "alipay.trade.page.pay", "alipay.trade.wap.pay":
+		this.createTrade(req.Form, biz, k_ALIPAY_TRADE_STATUS_WAIT_BUYER_PAY)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>AliPay Cashier " + bizValue(biz, "out_trade_no") + "</body></html>"))
+	case "alipay.trade.precreate":
+		var trade = this.createTrade(req.Form, biz, k_ALIPAY_TRADE_STATUS_WAIT_BUYER_PAY)
+		this.writeResponse(w, method, map[string]interface{}{
+			"code":         "10000",
+			"msg":          "Success",
+			"out_trade_no": trade.OutTradeNo,
+			"qr_code":      this.URL + "/qr/" + trade.TradeNo,
+		})
+	case "alipay.trade.pay":
+		this.payTrade(w, method, req.Form, biz)
+	case "alipay.trade.query":
+		this.queryTrade(w, method, biz)
+	case "alipay.trade.refund":
+		this.refundTrade(w, method, biz)
+	case "alipay.user.agreement.page.sign":
+		this.createAgreement(req.Form, biz)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>AliPay Agreement " + bizValue(biz, "external_agreement_no") + "</body></html>"))
+	case "alipay.user.agreement.query":
+		this.queryAgreement(w, method, biz)
+	case "alipay.user.agreement.unsign":
+		this.unsignAgreement(w, method, biz)
+	case "alipay.fund.trans.uni.transfer":
+		this.transfer(w, method, biz)
+	case "alipay.fund.trans.common.query":
+		this.queryTransfer(w, method, biz)
+	case "alipay.trade.royalty.relation.bind":
+		this.bindRoyaltyRelation(w, method, biz)
+	case "alipay.trade.order.settle":
+		this.settleTrade(w, method, biz)
+	case "alipay.trade.order.settle.query":
+		this.querySettle(w, method, biz)
+	case "alipay.fund.auth.operation.detail.query":
+		this.queryFundAuth(w, method, biz)
+	case "alipay.fund.auth.order.unfreeze":
+		this.unfreezeFundAuth(w, method, biz)
+	default:
+		this.writeError(w, method, "40004", "isv.invalid-method", "不存在的方法名")
+	}
+}
+
+// verifyRequest 验证请求的 app_id 和签名，并解析 biz_content，验证失败时返回错误码和错误信息
+func (this *AliPayServer) verifyRequest(form url.Values) (biz map[string]interface{}, subCode, subMsg string) {
+	if form.Get("app_id") != this.appId {
+		return nil, "isv.invalid-app-id", "无效的AppID参数"
+	}
+	if form.Get("sign_type") != "RSA2" {
+		return nil, "isv.invalid-signature-type", "无效的签名类型"
+	}
+	if err := verifyRSA2(signContent(form, "sign"), form.Get("sign"), this.merchantKey); err != nil {
+		return nil, "isv.invalid-signature", "验签出错"
+	}
+
+	biz = make(map[string]interface{})
+	if content := form.Get("biz_content"); content != "" {
+		if err := json.Unmarshal([]byte(content), &biz); err != nil {
+			return nil, "isv.invalid-parameter", "biz_content 格式错误"
+		}
+	}
+	return biz, "", ""
+}
+
+func (this *AliPayServer) createTrade(form url.Values, biz map[string]interface{}, status string) *aliPayTrade {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.seq++
+
+	var trade = &aliPayTrade{}
+	trade.OutTradeNo = bizValue(biz, "out_trade_no")
+	trade.TradeNo = fmt.Sprintf("%s2200%010d", time.Now().Format("20060102"), this.seq)
+	trade.Subject = bizValue(biz, "subject")
+	trade.TotalAmount = bizValue(biz, "total_amount")
+	trade.TradeStatus = status
+	trade.NotifyURL = form.Get("notify_url")
+	trade.ReturnURL = form.Get("return_url")
+	if status == k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS {
+		trade.GmtPayment = time.Now().Format("2006-01-02 15:04:05")
+	}
+	this.trades[trade.OutTradeNo] = trade
+	return trade
+}
+
+func (this *AliPayServer) findTrade(biz map[string]interface{}) *aliPayTrade {
+	var tradeNo = bizValue(biz, "trade_no")
+	var orderNo = bizValue(biz, "out_trade_no")
+	for _, trade := range this.trades {
+		if (tradeNo != "" && trade.TradeNo == tradeNo) || (orderNo != "" && trade.OutTradeNo == orderNo) {
+			return trade
+		}
+	}
+	return nil
+}
+
+func (this *AliPayServer) queryTrade(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	this.mu.Lock()
+	var trade = this.findTrade(biz)
+	if trade == nil {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.TRADE_NOT_EXIST", "交易不存在")
+		return
+	}
+	var rsp = map[string]interface{}{
+		"code":           "10000",
+		"msg":            "Success",
+		"trade_no":       trade.TradeNo,
+		"out_trade_no":   trade.OutTradeNo,
+		"trade_status":   trade.TradeStatus,
+		"total_amount":   trade.TotalAmount,
+		"buyer_user_id":  trade.BuyerUserId,
+		"buyer_logon_id": trade.BuyerLogonId,
+		"send_pay_date":  trade.GmtPayment,
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+// payTrade 统一收单交易支付，auth_no 不为空时从资金授权冻结的资金中扣款
+func (this *AliPayServer) payTrade(w http.ResponseWriter, method string, form url.Values, biz map[string]interface{}) {
+	if params, ok := biz["agreement_params"].(map[string]interface{}); ok {
+		this.payAgreement(w, method, form, biz, bizValue(params, "agreement_no"))
+		return
+	}
+
+	var authNo = bizValue(biz, "auth_no")
+	if authNo == "" {
+		var trade = this.createTrade(form, biz, k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS)
+		this.writeResponse(w, method, map[string]interface{}{
+			"code":         "10000",
+			"msg":          "Success",
+			"out_trade_no": trade.OutTradeNo,
+			"trade_no":     trade.TradeNo,
+			"total_amount": trade.TotalAmount,
+		})
+		return
+	}
+
+	this.mu.Lock()
+	var auth = this.auths[authNo]
+	if auth == nil || auth.OrderStatus != k_ALIPAY_FUND_AUTH_STATUS_AUTHORIZED {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.AUTH_NO_ERROR", "授权单号不存在或者状态不正确")
+		return
+	}
+	if auth.PayerUserId != bizValue(biz, "buyer_id") {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.BUYER_NOT_MATCH", "买家与授权用户不一致")
+		return
+	}
+	var amount, _ = strconv.ParseFloat(bizValue(biz, "total_amount"), 64)
+	if amount <= 0 || amount > auth.RestAmount+0.001 {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.TOTAL_FEE_EXCEED", "订单金额超过可用的授权金额")
+		return
+	}
+	auth.PayAmount += amount
+	auth.RestAmount -= amount
+	// COMPLETE 表示扣款之后解冻剩余的资金
+	if bizValue(biz, "auth_confirm_mode") == "COMPLETE" || auth.RestAmount < 0.001 {
+		auth.RestAmount = 0
+		auth.OrderStatus = k_ALIPAY_FUND_AUTH_STATUS_FINISH
+	}
+	var payerId = auth.PayerUserId
+	this.mu.Unlock()
+
+	var trade = this.createTrade(form, biz, k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS)
+
+	this.mu.Lock()
+	trade.BuyerUserId = payerId
+	trade.BuyerLogonId = payerId + "@sandbox.com"
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, map[string]interface{}{
+		"code":          "10000",
+		"msg":           "Success",
+		"out_trade_no":  trade.OutTradeNo,
+		"trade_no":      trade.TradeNo,
+		"total_amount":  trade.TotalAmount,
+		"buyer_user_id": payerId,
+	})
+}
+
+// payAgreement 按签约协议扣款，扣款金额不能超过签约时约定的单次扣款金额
+func (this *AliPayServer) payAgreement(w http.ResponseWriter, method string, form url.Values, biz map[string]interface{}, agreementId string) {
+	this.mu.Lock()
+	var agreement = this.findAgreement(map[string]interface{}{"agreement_no": agreementId})
+	if agreement == nil || agreement.Status != k_ALIPAY_AGREEMENT_STATUS_NORMAL {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.AGREEMENT_NOT_EXIST", "用户协议不存在或者已经解约")
+		return
+	}
+	var amount, _ = strconv.ParseFloat(bizValue(biz, "total_amount"), 64)
+	if amount <= 0 || amount > agreement.SingleAmount+0.001 {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.CYCLE_PAY_SINGLE_FEE_EXCEED", "周期扣款的单笔金额超过约定值")
+		return
+	}
+	var payerId = agreement.PrincipalId
+	this.mu.Unlock()
+
+	var trade = this.createTrade(form, biz, k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS)
+
+	this.mu.Lock()
+	trade.BuyerUserId = payerId
+	trade.BuyerLogonId = payerId + "@sandbox.com"
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, map[string]interface{}{
+		"code":          "10000",
+		"msg":           "Success",
+		"out_trade_no":  trade.OutTradeNo,
+		"trade_no":      trade.TradeNo,
+		"total_amount":  trade.TotalAmount,
+		"buyer_user_id": payerId,
+	})
+}
+
+func (this *AliPayServer) createAgreement(form url.Values, biz map[string]interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var agreement = &aliPayAgreement{}
+	agreement.ExternalAgreementNo = bizValue(biz, "external_agreement_no")
+	agreement.PersonalProductCode = bizValue(biz, "personal_product_code")
+	agreement.SignScene = bizValue(biz, "sign_scene")
+	agreement.Status = k_ALIPAY_AGREEMENT_STATUS_TEMP
+	if rule, ok := biz["period_rule_params"].(map[string]interface{}); ok {
+		agreement.SingleAmount, _ = strconv.ParseFloat(bizValue(rule, "single_amount"), 64)
+	}
+	agreement.NotifyURL = form.Get("notify_url")
+	agreement.ReturnURL = form.Get("return_url")
+	this.agreements[agreement.ExternalAgreementNo] = agreement
+}
+
+func (this *AliPayServer) findAgreement(biz map[string]interface{}) *aliPayAgreement {
+	var agreementId = bizValue(biz, "agreement_no")
+	var agreementNo = bizValue(biz, "external_agreement_no")
+	for _, agreement := range this.agreements {
+		if (agreementId != "" && agreement.AgreementNo == agreementId) || (agreementNo != "" && agreement.ExternalAgreementNo == agreementNo) {
+			return agreement
+		}
+	}
+	return nil
+}
+
+func (this *AliPayServer) queryAgreement(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	this.mu.Lock()
+	var agreement = this.findAgreement(biz)
+	if agreement == nil || agreement.Status == k_ALIPAY_AGREEMENT_STATUS_TEMP {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "USER_AGREEMENT_NOT_EXIST", "用户协议不存在")
+		return
+	}
+	var rsp = map[string]interface{}{
+		"code":                  "10000",
+		"msg":                   "Success",
+		"agreement_no":          agreement.AgreementNo,
+		"external_agreement_no": agreement.ExternalAgreementNo,
+		"personal_product_code": agreement.PersonalProductCode,
+		"sign_scene":            agreement.SignScene,
+		"status":                agreement.Status,
+		"principal_id":          agreement.PrincipalId,
+		"sign_time":             agreement.SignTime,
+		"valid_time":            agreement.SignTime,
+		"invalid_time":          agreement.InvalidTime,
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+func (this *AliPayServer) unsignAgreement(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	this.mu.Lock()
+	var agreement = this.findAgreement(biz)
+	if agreement == nil || agreement.Status != k_ALIPAY_AGREEMENT_STATUS_NORMAL {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "USER_AGREEMENT_NOT_EXIST", "用户协议不存在或者已经解约")
+		return
+	}
+	agreement.Status = k_ALIPAY_AGREEMENT_STATUS_STOP
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, map[string]interface{}{
+		"code": "10000",
+		"msg":  "Success",
+	})
+}
+
+// transfer 转账到支付宝账户，使用相同的 out_biz_no 重试时返回第一次转账的结果
+func (this *AliPayServer) transfer(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	if bizValue(biz, "product_code") != "TRANS_ACCOUNT_NO_PWD" || bizValue(biz, "out_biz_no") == "" {
+		this.writeError(w, method, "40004", "INVALID_PARAMETER", "参数有误")
+		return
+	}
+	var payee, _ = biz["payee_info"].(map[string]interface{})
+	if payee == nil || bizValue(payee, "identity") == "" {
+		this.writeError(w, method, "40004", "PAYEE_NOT_EXIST", "收款账号不存在")
+		return
+	}
+	var identityType = bizValue(payee, "identity_type")
+	if identityType != "ALIPAY_USER_ID" && identityType != "ALIPAY_LOGON_ID" {
+		this.writeError(w, method, "40004", "INVALID_PARAMETER", "参数有误")
+		return
+	}
+	// 使用登录账号转账时必须校验收款方的姓名
+	if identityType == "ALIPAY_LOGON_ID" && bizValue(payee, "name") == "" {
+		this.writeError(w, method, "40004", "PAYEE_USER_INFO_ERROR", "收款方的姓名不能为空")
+		return
+	}
+	var amount, _ = strconv.ParseFloat(bizValue(biz, "trans_amount"), 64)
+	if amount < 0.1 {
+		this.writeError(w, method, "40004", "EXCEED_LIMIT_SM_MIN_AMOUNT", "单笔最低转账金额 0.1 元")
+		return
+	}
+
+	this.mu.Lock()
+	var transfer = this.transfers[bizValue(biz, "out_biz_no")]
+	if transfer == nil {
+		if amount > this.Balance+0.001 {
+			this.mu.Unlock()
+			this.writeError(w, method, "40004", "PAYER_BALANCE_NOT_ENOUGH", "付款方余额不足")
+			return
+		}
+		this.Balance -= amount
+		this.seq++
+
+		transfer = &aliPayTransfer{}
+		transfer.OutBizNo = bizValue(biz, "out_biz_no")
+		transfer.OrderId = fmt.Sprintf("%s0200%010d", time.Now().Format("20060102"), this.seq)
+		transfer.PayFundOrderId = fmt.Sprintf("%s0300%010d", time.Now().Format("20060102"), this.seq)
+		transfer.TransAmount = fmt.Sprintf("%.2f", amount)
+		transfer.Identity = bizValue(payee, "identity")
+		transfer.IdentityType = identityType
+		transfer.Name = bizValue(payee, "name")
+		transfer.Status = k_ALIPAY_FUND_TRANS_STATUS_SUCCESS
+		transfer.PayDate = time.Now().Format("2006-01-02 15:04:05")
+		this.transfers[transfer.OutBizNo] = transfer
+	}
+	var rsp = map[string]interface{}{
+		"code":              "10000",
+		"msg":               "Success",
+		"out_biz_no":        transfer.OutBizNo,
+		"order_id":          transfer.OrderId,
+		"pay_fund_order_id": transfer.PayFundOrderId,
+		"status":            transfer.Status,
+		"trans_date":        transfer.PayDate,
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+func (this *AliPayServer) queryTransfer(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	var orderId = bizValue(biz, "order_id")
+	var outBizNo = bizValue(biz, "out_biz_no")
+
+	this.mu.Lock()
+	var transfer *aliPayTransfer
+	for _, t := range this.transfers {
+		if (orderId != "" && t.OrderId == orderId) || (outBizNo != "" && t.OutBizNo == outBizNo) {
+			transfer = t
+		}
+	}
+	if transfer == nil {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ORDER_NOT_EXIST", "转账订单不存在")
+		return
+	}
+	var rsp = map[string]interface{}{
+		"code":              "10000",
+		"msg":               "Success",
+		"order_id":          transfer.OrderId,
+		"pay_fund_order_id": transfer.PayFundOrderId,
+		"out_biz_no":        transfer.OutBizNo,
+		"trans_amount":      transfer.TransAmount,
+		"status":            transfer.Status,
+		"pay_date":          transfer.PayDate,
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+// bindRoyaltyRelation 绑定分账关系，只能向已经绑定的接收方分账
+func (this *AliPayServer) bindRoyaltyRelation(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	var receivers, _ = biz["receiver_list"].([]interface{})
+	if bizValue(biz, "out_request_no") == "" || len(receivers) == 0 {
+		this.writeError(w, method, "40004", "INVALID_PARAMETER", "参数有误")
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, item := range receivers {
+		var receiver, _ = item.(map[string]interface{})
+		var receiverType = bizValue(receiver, "type")
+		if bizValue(receiver, "account") == "" || (receiverType != "userId" && receiverType != "loginName") {
+			this.writeError(w, method, "40004", "INVALID_PARAMETER", "分账接收方参数有误")
+			return
+		}
+		this.royalties[bizValue(receiver, "account")] = receiverType
+	}
+	this.writeResponse(w, method, map[string]interface{}{
+		"code":        "10000",
+		"msg":         "Success",
+		"result_code": "SUCCESS",
+	})
+}
+
+// settleTrade 统一收单交易结算，分账总额不能超过交易金额减去已退款和已分账的金额，
+// extend_params.royalty_finish 为 true 时完结分账，使用相同的 out_request_no 重试时返回第一次分账的结果
+func (this *AliPayServer) settleTrade(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	var parameters, _ = biz["royalty_parameters"].([]interface{})
+	var requestNo = bizValue(biz, "out_request_no")
+	if requestNo == "" || len(parameters) == 0 {
+		this.writeError(w, method, "40004", "INVALID_PARAMETER", "参数有误")
+		return
+	}
+
+	this.mu.Lock()
+	var trade = this.findTrade(biz)
+	if trade == nil {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.TRADE_NOT_EXIST", "交易不存在")
+		return
+	}
+
+	var settle = trade.settles[requestNo]
+	if settle == nil {
+		if trade.TradeStatus != k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS || trade.SettleFinish {
+			this.mu.Unlock()
+			this.writeError(w, method, "40004", "ACQ.TRADE_STATUS_ERROR", "交易状态不合法或者分账已经完结")
+			return
+		}
+
+		var total, _ = strconv.ParseFloat(trade.TotalAmount, 64)
+		var amount float64 = 0
+		this.seq++
+		settle = &aliPaySettle{}
+		settle.OutRequestNo = requestNo
+		settle.SettleNo = fmt.Sprintf("%s0400%010d", time.Now().Format("20060102"), this.seq)
+		settle.OperationDt = time.Now().Format("2006-01-02 15:04:05")
+		for _, item := range parameters {
+			var parameter, _ = item.(map[string]interface{})
+			var value, _ = strconv.ParseFloat(bizValue(parameter, "amount"), 64)
+			var detail = map[string]interface{}{
+				"operation_type": "transfer",
+				"trans_in_type":  bizValue(parameter, "trans_in_type"),
+				"trans_in":       bizValue(parameter, "trans_in"),
+				"amount":         bizValue(parameter, "amount"),
+				"state":          k_ALIPAY_ROYALTY_STATE_SUCCESS,
+				"execute_dt":     settle.OperationDt,
+			}
+			if this.royalties[bizValue(parameter, "trans_in")] != bizValue(parameter, "trans_in_type") {
+				detail["state"] = k_ALIPAY_ROYALTY_STATE_FAIL
+				detail["error_code"] = "TRANS_IN_NOT_BIND"
+				detail["error_desc"] = "分账关系没有绑定"
+			} else {
+				amount += value
+			}
+			settle.Details = append(settle.Details, detail)
+		}
+		if amount+trade.SettleAmount+trade.RefundFee > total+0.001 {
+			this.mu.Unlock()
+			this.writeError(w, method, "40004", "ACQ.ALLOC_AMOUNT_VALIDATE_ERROR", "分账金额超过最大可分账金额")
+			return
+		}
+
+		trade.SettleAmount += amount
+		if extend, ok := biz["extend_params"].(map[string]interface{}); ok && bizValue(extend, "royalty_finish") == "true" {
+			trade.SettleFinish = true
+		}
+		if trade.settles == nil {
+			trade.settles = make(map[string]*aliPaySettle)
+		}
+		trade.settles[requestNo] = settle
+	}
+
+	var rsp = map[string]interface{}{
+		"code":      "10000",
+		"msg":       "Success",
+		"trade_no":  trade.TradeNo,
+		"settle_no": settle.SettleNo,
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+func (this *AliPayServer) querySettle(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	this.mu.Lock()
+	var settle *aliPaySettle
+	if trade := this.findTrade(biz); trade != nil {
+		settle = trade.settles[bizValue(biz, "out_request_no")]
+	}
+	if settle == nil {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.TRADE_SETTLE_NOT_EXIST", "分账单不存在")
+		return
+	}
+	var rsp = map[string]interface{}{
+		"code":                "10000",
+		"msg":                 "Success",
+		"out_request_no":      settle.OutRequestNo,
+		"operation_dt":        settle.OperationDt,
+		"royalty_detail_list": settle.Details,
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+func (this *AliPayServer) findFundAuth(biz map[string]interface{}) *aliPayFundAuth {
+	if auth := this.auths[bizValue(biz, "auth_no")]; auth != nil {
+		return auth
+	}
+	var orderNo = bizValue(biz, "out_order_no")
+	for _, auth := range this.auths {
+		if orderNo != "" && auth.OutOrderNo == orderNo {
+			return auth
+		}
+	}
+	return nil
+}
+
+func (this *AliPayServer) queryFundAuth(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	this.mu.Lock()
+	var auth = this.findFundAuth(biz)
+	if auth == nil {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ORDER_NOT_EXIST", "授权订单不存在")
+		return
+	}
+	var rsp = map[string]interface{}{
+		"code":                "10000",
+		"msg":                 "Success",
+		"auth_no":             auth.AuthNo,
+		"out_order_no":        auth.OutOrderNo,
+		"out_request_no":      auth.OutRequestNo,
+		"order_title":         auth.OrderTitle,
+		"order_status":        auth.OrderStatus,
+		"payer_user_id":       auth.PayerUserId,
+		"payer_logon_id":      auth.PayerUserId + "@sandbox.com",
+		"total_freeze_amount": fmt.Sprintf("%.2f", auth.FreezeAmount),
+		"total_pay_amount":    fmt.Sprintf("%.2f", auth.PayAmount),
+		"rest_amount":         fmt.Sprintf("%.2f", auth.RestAmount),
+		"operation_type":      "FREEZE",
+		"status":              "SUCCESS",
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+func (this *AliPayServer) unfreezeFundAuth(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	this.mu.Lock()
+	var auth = this.auths[bizValue(biz, "auth_no")]
+	if auth == nil {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "AUTH_NO_NOT_EXIST", "授权单号不存在")
+		return
+	}
+	// 相同 out_request_no 的解冻请求返回第一次解冻的结果
+	var requestNo = bizValue(biz, "out_request_no")
+	if rsp, ok := auth.unfreezes[requestNo]; ok {
+		this.mu.Unlock()
+		this.writeResponse(w, method, rsp)
+		return
+	}
+	var amount, _ = strconv.ParseFloat(bizValue(biz, "amount"), 64)
+	if auth.OrderStatus != k_ALIPAY_FUND_AUTH_STATUS_AUTHORIZED || amount <= 0 || amount > auth.RestAmount+0.001 {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "UNFREEZE_AMOUNT_LESS_THAN_REST_AMOUNT", "解冻金额超过剩余的冻结金额")
+		return
+	}
+	auth.RestAmount -= amount
+	if auth.RestAmount < 0.001 {
+		auth.RestAmount = 0
+		auth.OrderStatus = k_ALIPAY_FUND_AUTH_STATUS_FINISH
+	}
+
+	this.seq++
+	var rsp = map[string]interface{}{
+		"code":           "10000",
+		"msg":            "Success",
+		"auth_no":        auth.AuthNo,
+		"out_order_no":   auth.OutOrderNo,
+		"operation_id":   fmt.Sprintf("%s2000%010d", time.Now().Format("20060102"), this.seq),
+		"out_request_no": requestNo,
+		"amount":         fmt.Sprintf("%.2f", amount),
+		"status":         "SUCCESS",
+	}
+	if auth.unfreezes == nil {
+		auth.unfreezes = make(map[string]map[string]interface{})
+	}
+	auth.unfreezes[requestNo] = rsp
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+func (this *AliPayServer) refundTrade(w http.ResponseWriter, method string, biz map[string]interface{}) {
+	this.mu.Lock()
+	var trade = this.findTrade(biz)
+	if trade == nil {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.TRADE_NOT_EXIST", "交易不存在")
+		return
+	}
+	// 与支付宝一样，相同 out_request_no 的退款请求返回第一次退款的结果
+	var requestNo = bizValue(biz, "out_request_no")
+	if rsp, ok := trade.refunds[requestNo]; ok && requestNo != "" {
+		this.mu.Unlock()
+		this.writeResponse(w, method, rsp)
+		return
+	}
+	if trade.TradeStatus != k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.TRADE_STATUS_ERROR", "交易状态不合法")
+		return
+	}
+
+	var total, _ = strconv.ParseFloat(trade.TotalAmount, 64)
+	var amount, _ = strconv.ParseFloat(bizValue(biz, "refund_amount"), 64)
+	if amount <= 0 || trade.RefundFee+amount > total+0.001 {
+		this.mu.Unlock()
+		this.writeError(w, method, "40004", "ACQ.REFUND_AMT_NOT_EQUAL_TOTAL", "退款金额超限")
+		return
+	}
+	trade.RefundFee += amount
+	if trade.RefundFee >= total-0.001 {
+		trade.TradeStatus = k_ALIPAY_TRADE_STATUS_TRADE_CLOSED
+	}
+
+	var rsp = map[string]interface{}{
+		"code":           "10000",
+		"msg":            "Success",
+		"trade_no":       trade.TradeNo,
+		"out_trade_no":   trade.OutTradeNo,
+		"fund_change":    "Y",
+		"refund_fee":     fmt.Sprintf("%.2f", trade.RefundFee),
+		"gmt_refund_pay": time.Now().Format("2006-01-02 15:04:05"),
+	}
+	if requestNo != "" {
+		if trade.refunds == nil {
+			trade.refunds = make(map[string]map[string]interface{})
+		}
+		trade.refunds[requestNo] = rsp
+	}
+	this.mu.Unlock()
+
+	this.writeResponse(w, method, rsp)
+}
+
+func (this *AliPayServer) writeError(w http.ResponseWriter, method, code, subCode, subMsg string) {
+	this.writeResponse(w, method, map[string]interface{}{
+		"code":     code,
+		"msg":      "Business Failed",
+		"sub_code": subCode,
+		"sub_msg":  subMsg,
+	})
+}
+
+// writeResponse 响应内容为 {"xxx_response": {...}, "sign": "..."}，签名的内容为 xxx_response 对应的原始 JSON
+func (this *AliPayServer) writeResponse(w http.ResponseWriter, method string, content map[string]interface{}) {
+	contentBytes, _ := json.Marshal(content)
+	sign, _ := signRSA2(string(contentBytes), this.privateKey)
+
+	var nodeName = strings.Replace(method, ".", "_", -1) + "_response"
+	var body = fmt.Sprintf(`{"%s":%s,"sign":"%s"}`, nodeName, contentBytes, sign)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Write([]byte(body))
+}
+
+func bizValue(biz map[string]interface{}, key string) string {
+	var v, ok = biz[key]
+	if ok == false || v == nil {
+		return ""
+	}
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", value)
+	}
+}
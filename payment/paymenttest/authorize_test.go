@@ -0,0 +1,211 @@
+package paymenttest
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAliPayAuthorize(t *testing.T) {
+	merchantKey, merchantPublicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAliPayServer("2016073100129537", merchantPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var s = payment.NewService()
+	var ap = payment.NewAliPay("2016073100129537", "2088102169227503", server.PublicKey, merchantKey, false, payment.WithBaseURL(server.URL))
+	ap.NotifyURL = "http://127.0.0.1/pay/notify"
+	s.RegisterChannel(ap)
+
+	// 资金授权只支持 App 方式和人民币
+	var order = newOrder("A4001")
+	order.Intent = payment.K_TRADE_INTENT_AUTHORIZE
+	if _, err = s.CreatePayment(payment.K_CHANNEL_ALIPAY, order); err != payment.ErrAliPayNotAllowed {
+		t.Fatalf("期望返回 ErrAliPayNotAllowed，实际为 %v", err)
+	}
+	order.TradeMethod = payment.K_TRADE_METHOD_APP
+	order.Currency = "USD"
+	if _, err = ap.Authorize(order); err != payment.ErrCurrencyNotSupported {
+		t.Fatalf("期望返回 ErrCurrencyNotSupported，实际为 %v", err)
+	}
+	order.Currency = ""
+
+	orderStr, err := s.CreatePayment(payment.K_CHANNEL_ALIPAY, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetAuthorizationWithOrderNo(payment.K_CHANNEL_ALIPAY, "A4001"); err == nil {
+		t.Fatal("用户没有授权时应该返回错误")
+	}
+	if _, err = server.Freeze(strings.Replace(orderStr, "A4001", "A4000", -1), "2088102175953034"); err == nil {
+		t.Fatal("参数被修改之后应该验证签名失败")
+	}
+	authNo, err := server.Freeze(orderStr, "2088102175953034")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := s.GetAuthorizationWithOrderNo(payment.K_CHANNEL_ALIPAY, "A4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Authorized == false || auth.AuthorizationId != authNo || auth.TotalAmount != "20.00" || auth.PayerId != "2088102175953034" {
+		t.Fatalf("预授权信息错误: %+v", auth)
+	}
+
+	// 每次扣款都会创建一笔新的交易
+	capture, err := s.Capture(payment.K_CHANNEL_ALIPAY, &payment.CaptureParam{AuthorizationId: authNo, OrderNo: "A4001-1", Amount: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capture.CaptureSuccess == false || capture.Amount != "5.00" || capture.OrderNo != "A4001-1" || capture.CaptureId == "" {
+		t.Fatalf("扣款信息错误: %+v", capture)
+	}
+	trade, err := s.GetTradeWithOrderNo(payment.K_CHANNEL_ALIPAY, "A4001-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess == false || trade.TradeNo != capture.CaptureId || trade.PayerId != "2088102175953034" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	if _, err = s.Capture(payment.K_CHANNEL_ALIPAY, &payment.CaptureParam{AuthorizationId: authNo, OrderNo: "A4001-2", Amount: 16}); err == nil {
+		t.Fatal("扣款金额超过剩余的冻结金额时应该返回错误")
+	}
+	if _, err = s.Capture(payment.K_CHANNEL_ALIPAY, &payment.CaptureParam{AuthorizationId: authNo, Amount: 1}); err != payment.ErrUnknownOrderNo {
+		t.Fatalf("期望返回 ErrUnknownOrderNo，实际为 %v", err)
+	}
+
+	// Amount 为 0 时扣除剩余的全部金额，之后不能再撤销
+	if capture, err = s.Capture(payment.K_CHANNEL_ALIPAY, &payment.CaptureParam{AuthorizationId: authNo, OrderNo: "A4001-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if capture.Amount != "15.00" {
+		t.Fatalf("扣款信息错误: %+v", capture)
+	}
+	if auth, _ = s.GetAuthorization(payment.K_CHANNEL_ALIPAY, authNo); auth.Authorized || auth.Status != k_ALIPAY_FUND_AUTH_STATUS_FINISH {
+		t.Fatalf("预授权信息错误: %+v", auth)
+	}
+	if err = s.Void(payment.K_CHANNEL_ALIPAY, authNo); err != payment.ErrUnknownAuthorization {
+		t.Fatalf("已经扣款完成的预授权不能撤销，实际为 %v", err)
+	}
+
+	// 撤销之后剩余的资金全部解冻
+	order = newOrder("A4002")
+	order.Intent = payment.K_TRADE_INTENT_AUTHORIZE
+	order.TradeMethod = payment.K_TRADE_METHOD_APP
+	if orderStr, err = s.CreatePayment(payment.K_CHANNEL_ALIPAY, order); err != nil {
+		t.Fatal(err)
+	}
+	if authNo, err = server.Freeze(orderStr, "2088102175953034"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Void(payment.K_CHANNEL_ALIPAY, authNo); err != nil {
+		t.Fatal(err)
+	}
+	if server.auths[authNo].RestAmount != 0 {
+		t.Fatalf("撤销之后剩余的冻结金额应该为 0，实际为 %v", server.auths[authNo].RestAmount)
+	}
+	if _, err = s.Capture(payment.K_CHANNEL_ALIPAY, &payment.CaptureParam{AuthorizationId: authNo, OrderNo: "A4002-1", Amount: 1}); err != payment.ErrUnknownAuthorization {
+		t.Fatalf("撤销之后不能再扣款，实际为 %v", err)
+	}
+}
+
+func TestPayPalAuthorize(t *testing.T) {
+	var server = NewPayPalServer("client-id", "secret")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var pp = payment.NewPayPal("client-id", "secret", false, payment.WithBaseURL(server.URL))
+	pp.ReturnURL = "http://127.0.0.1/pay/return"
+	pp.CancelURL = "http://127.0.0.1/pay/cancel"
+	s.RegisterChannel(pp)
+
+	var authorize = func(orderNo string) string {
+		var order = newOrder(orderNo)
+		order.Currency = "USD"
+		order.Intent = payment.K_TRADE_INTENT_AUTHORIZE
+		approvalURL, err := s.CreatePayment(payment.K_CHANNEL_PAYPAL, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(approvalURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paymentId = u.Query().Get("paymentId")
+		server.Approve(paymentId, "PAYER1")
+
+		// 付款执行之后只会创建预授权，交易还没有完成
+		trade, err := s.GetTrade(payment.K_CHANNEL_PAYPAL, paymentId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trade.TradeSuccess || trade.Status != payment.K_TRADE_STATUS_PENDING || trade.AuthorizationId == "" {
+			t.Fatalf("交易信息错误: %+v", trade)
+		}
+		return trade.AuthorizationId
+	}
+
+	var authorizationId = authorize("P4001")
+	auth, err := s.GetAuthorization(payment.K_CHANNEL_PAYPAL, authorizationId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Authorized == false || auth.OrderNo != "P4001" || auth.TotalAmount != "20.00" {
+		t.Fatalf("预授权信息错误: %+v", auth)
+	}
+	if _, err = s.GetAuthorizationWithOrderNo(payment.K_CHANNEL_PAYPAL, "P4001"); err != payment.ErrPayPalNotAllowed {
+		t.Fatalf("期望返回 ErrPayPalNotAllowed，实际为 %v", err)
+	}
+
+	var param = &payment.CaptureParam{AuthorizationId: authorizationId, Amount: 5, Currency: "EUR"}
+	if _, err = s.Capture(payment.K_CHANNEL_PAYPAL, param); err != payment.ErrCurrencyMismatch {
+		t.Fatalf("期望返回 ErrCurrencyMismatch，实际为 %v", err)
+	}
+	param.Currency = ""
+	capture, err := s.Capture(payment.K_CHANNEL_PAYPAL, param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capture.CaptureSuccess == false || capture.Amount != "5.00" || capture.OrderNo != "P4001" {
+		t.Fatalf("扣款信息错误: %+v", capture)
+	}
+
+	param.Amount = 16
+	if _, err = s.Capture(payment.K_CHANNEL_PAYPAL, param); err == nil {
+		t.Fatal("扣款金额超过剩余的预授权金额时应该返回错误")
+	}
+
+	// Amount 为 0 时扣除剩余的全部金额
+	param.Amount = 0
+	if capture, err = s.Capture(payment.K_CHANNEL_PAYPAL, param); err != nil {
+		t.Fatal(err)
+	}
+	if capture.Amount != "15.00" {
+		t.Fatalf("扣款信息错误: %+v", capture)
+	}
+	if auth, _ = s.GetAuthorization(payment.K_CHANNEL_PAYPAL, authorizationId); auth.Authorized || auth.Status != k_PAYPAL_AUTHORIZATION_STATE_CAPTURED {
+		t.Fatalf("预授权信息错误: %+v", auth)
+	}
+	if err = s.Void(payment.K_CHANNEL_PAYPAL, authorizationId); err == nil {
+		t.Fatal("已经扣款完成的预授权不能撤销")
+	}
+
+	authorizationId = authorize("P4002")
+	if err = s.Void(payment.K_CHANNEL_PAYPAL, authorizationId); err != nil {
+		t.Fatal(err)
+	}
+	if auth, _ = s.GetAuthorization(payment.K_CHANNEL_PAYPAL, authorizationId); auth.Authorized || auth.Status != k_PAYPAL_AUTHORIZATION_STATE_VOIDED {
+		t.Fatalf("预授权信息错误: %+v", auth)
+	}
+	if _, err = s.Capture(payment.K_CHANNEL_PAYPAL, &payment.CaptureParam{AuthorizationId: authorizationId}); err == nil {
+		t.Fatal("撤销之后不能再扣款")
+	}
+}
@@ -0,0 +1,151 @@
+package paymenttest
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"testing"
+	"time"
+)
+
+func TestPayPalDispute(t *testing.T) {
+	var server = NewPayPalServer("client-id", "secret")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "", notifications)
+	defer receiver.Close()
+	server.WebhookURL = receiver.URL + "/pay/notify?channel=" + payment.K_CHANNEL_PAYPAL
+
+	var pp = payment.NewPayPal("client-id", "secret", false, payment.WithBaseURL(server.URL))
+	pp.ReturnURL = receiver.URL + "/pay/return"
+	pp.CancelURL = receiver.URL + "/pay/cancel"
+	pp.WebHookId = server.WebhookId
+	s.RegisterChannel(pp)
+
+	var since = time.Now().Add(-time.Minute)
+
+	// 付款处于 created 状态时，GetTrade 会执行付款并生成 Sale
+	var saleIds []string
+	for _, orderNo := range []string{"P6001", "P6002"} {
+		var order = newOrder(orderNo)
+		order.Currency = "USD"
+		if _, err := s.CreatePayment(payment.K_CHANNEL_PAYPAL, order); err != nil {
+			t.Fatal(err)
+		}
+		var paymentId string
+		server.mu.Lock()
+		for id, p := range server.payments {
+			if p.Transactions[0].InvoiceNumber == orderNo {
+				paymentId = id
+			}
+		}
+		server.mu.Unlock()
+		server.Approve(paymentId, "PAYER1")
+		if _, err := s.GetTrade(payment.K_CHANNEL_PAYPAL, paymentId); err != nil {
+			t.Fatal(err)
+		}
+		saleIds = append(saleIds, server.payments[paymentId].Transactions[0].RelatedResources[0].Sale.Id)
+	}
+
+	if _, err := server.OpenDispute("not_exist", "MERCHANDISE_OR_SERVICE_NOT_RECEIVED", 0); err == nil {
+		t.Fatal("Sale 不存在时不能发起争议")
+	}
+	disputeId, err := server.OpenDispute(saleIds[0], "MERCHANDISE_OR_SERVICE_NOT_RECEIVED", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherId, err := server.OpenDispute(saleIds[1], "UNAUTHORISED", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 每页只返回一个争议，ListDisputes 会自动获取所有分页
+	server.PageSize = 1
+	disputes, err := s.ListDisputes(payment.K_CHANNEL_PAYPAL, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disputes) != 2 {
+		t.Fatalf("争议列表错误: %+v", disputes)
+	}
+	if disputes, _ = s.ListDisputes(payment.K_CHANNEL_PAYPAL, time.Now().Add(time.Minute)); len(disputes) != 0 {
+		t.Fatalf("不应该返回 since 之前创建的争议: %+v", disputes)
+	}
+
+	dispute, err := s.GetDispute(payment.K_CHANNEL_PAYPAL, disputeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dispute.Status != payment.K_DISPUTE_STATUS_WAITING_MERCHANT || dispute.Stage != "INQUIRY" || dispute.Amount != "5.00" || dispute.Currency != "USD" || dispute.OrderNo != "P6001" || dispute.TradeNo != saleIds[0] || dispute.ResponseDeadline.IsZero() {
+		t.Fatalf("争议信息错误: %+v", dispute)
+	}
+	if _, err = s.GetDispute(payment.K_CHANNEL_PAYPAL, ""); err != payment.ErrUnknownDispute {
+		t.Fatalf("期望返回 ErrUnknownDispute，实际为 %v", err)
+	}
+	if _, err = s.GetDispute(payment.K_CHANNEL_PAYPAL, "not_exist"); err == nil {
+		t.Fatal("争议不存在时应该返回错误")
+	}
+
+	if err = s.SendDisputeMessage(payment.K_CHANNEL_PAYPAL, disputeId, "货物已经发出"); err != nil {
+		t.Fatal(err)
+	}
+	if dispute, _ = s.GetDispute(payment.K_CHANNEL_PAYPAL, disputeId); dispute.Status != payment.K_DISPUTE_STATUS_WAITING_BUYER {
+		t.Fatalf("发送消息之后应该等待买家回复: %+v", dispute)
+	}
+
+	// 发货证明需要提供物流信息，只有等待商户处理的争议才能提交证据
+	var evidence = &payment.DisputeEvidence{Type: payment.K_EVIDENCE_TYPE_FULFILLMENT, CarrierName: "SF"}
+	if err = s.ProvideDisputeEvidence(payment.K_CHANNEL_PAYPAL, otherId, []*payment.DisputeEvidence{evidence}); err == nil {
+		t.Fatal("没有物流单号时提交证据应该返回错误")
+	}
+	evidence.TrackingNumber = "SF1001"
+	if err = s.ProvideDisputeEvidence(payment.K_CHANNEL_PAYPAL, disputeId, []*payment.DisputeEvidence{evidence}); err == nil {
+		t.Fatal("等待买家回复时提交证据应该返回错误")
+	}
+	if err = s.ProvideDisputeEvidence(payment.K_CHANNEL_PAYPAL, otherId, []*payment.DisputeEvidence{evidence, {Type: payment.K_EVIDENCE_TYPE_REFUND, RefundId: "REFUND1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if dispute, _ = s.GetDispute(payment.K_CHANNEL_PAYPAL, otherId); dispute.Status != payment.K_DISPUTE_STATUS_UNDER_REVIEW {
+		t.Fatalf("提交证据之后应该进入审核状态: %+v", dispute)
+	}
+	if evidences := server.disputes[otherId].Evidences; len(evidences) != 2 || evidences[0].EvidenceInfo.TrackingInfo[0].TrackingNumber != "SF1001" || evidences[1].EvidenceType != "PROOF_OF_REFUND" {
+		t.Fatalf("证据错误: %+v", evidences)
+	}
+	if err = s.EscalateDispute(payment.K_CHANNEL_PAYPAL, otherId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if dispute, _ = s.GetDispute(payment.K_CHANNEL_PAYPAL, otherId); dispute.Stage != "CHARGEBACK" || dispute.Status != payment.K_DISPUTE_STATUS_UNDER_REVIEW {
+		t.Fatalf("升级之后争议应该进入索赔阶段: %+v", dispute)
+	}
+	if err = s.SendDisputeMessage(payment.K_CHANNEL_PAYPAL, otherId, "货物已经发出"); err == nil {
+		t.Fatal("索赔阶段不能向买家发送消息")
+	}
+	if err = server.ResolveDispute(otherId, "RESOLVED_SELLER_FAVOUR"); err != nil {
+		t.Fatal(err)
+	}
+	if dispute, _ = s.GetDispute(payment.K_CHANNEL_PAYPAL, otherId); dispute.Status != payment.K_DISPUTE_STATUS_RESOLVED || dispute.Outcome != "RESOLVED_SELLER_FAVOUR" {
+		t.Fatalf("争议裁决结果错误: %+v", dispute)
+	}
+
+	// 接受索赔之后争议金额会退还给买家
+	if err = s.AcceptDispute(payment.K_CHANNEL_PAYPAL, disputeId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if dispute, _ = s.GetDispute(payment.K_CHANNEL_PAYPAL, disputeId); dispute.Status != payment.K_DISPUTE_STATUS_RESOLVED || dispute.Outcome != "RESOLVED_BUYER_FAVOUR" {
+		t.Fatalf("接受索赔之后争议应该已经解决: %+v", dispute)
+	}
+	if _, _, sale := server.findSale(saleIds[0]); sale.State != k_PAYPAL_SALE_STATE_PARTIALLY_REFUNDED {
+		t.Fatalf("接受索赔之后 Sale 的状态错误: %s", sale.State)
+	}
+	if err = s.EscalateDispute(payment.K_CHANNEL_PAYPAL, disputeId, ""); err == nil {
+		t.Fatal("已经解决的争议不能升级")
+	}
+
+	if err = server.NotifyDispute(disputeId, K_PAYPAL_EVENT_DISPUTE_RESOLVED); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_DISPUTE || noti.DisputeId != disputeId || noti.OrderNo != "P6001" {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+}
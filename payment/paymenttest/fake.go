@@ -0,0 +1,382 @@
+package paymenttest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/ngx"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	K_CHANNEL_FAKE = "fake"
+)
+
+const (
+	K_TRADE_STATUS_WAIT_BUYER_PAY = "WAIT_BUYER_PAY"
+	K_TRADE_STATUS_SUCCESS        = "SUCCESS"
+	K_TRADE_STATUS_CLOSED         = "CLOSED"
+	K_TRADE_STATUS_REFUND         = "REFUND"
+)
+
+// FakeChannel 中的各个操作，用于注入错误
+const (
+	K_OPERATION_CREATE_TRADE_ORDER      = "CreateTradeOrder"
+	K_OPERATION_GET_TRADE               = "GetTrade"
+	K_OPERATION_GET_TRADE_WITH_ORDER_NO = "GetTradeWithOrderNo"
+	K_OPERATION_RETURN_HANDLER          = "ReturnHandler"
+	K_OPERATION_NOTIFY_HANDLER          = "NotifyHandler"
+)
+
+var (
+	ErrTradeNotExist = errors.New("交易不存在")
+)
+
+// FakeChannel 是一个完全在内存中运行的 PayChannel，用于在测试中代替真实的支付渠道
+type FakeChannel struct {
+	mu         sync.Mutex
+	identifier string
+	accountId  string
+	orders     []*payment.Order
+	trades     map[string]*payment.Trade // key 为订单号
+	notifyIds  map[string]struct{}
+	errs       map[string]error
+	latency    time.Duration
+	seq        int
+
+	PayURL     string   // CreateTradeOrder 返回的支付 URL
+	NotifyURL  string   // 生成的通知请求的 URL
+	Currencies []string // 支持的货币，为空时支持所有的货币
+}
+
+func NewFakeChannel(identifier string) *FakeChannel {
+	if identifier == "" {
+		identifier = K_CHANNEL_FAKE
+	}
+	var c = &FakeChannel{}
+	c.identifier = identifier
+	c.trades = make(map[string]*payment.Trade)
+	c.notifyIds = make(map[string]struct{})
+	c.errs = make(map[string]error)
+	c.PayURL = "http://fake.pay/checkout"
+	c.NotifyURL = "http://127.0.0.1/pay/notify"
+	return c
+}
+
+// NewFakeAccount 创建一个使用指定商户账号的 FakeChannel，用于测试同一个支付渠道注册多个商户账号的情况
+func NewFakeAccount(identifier, accountId string) *FakeChannel {
+	var c = NewFakeChannel(identifier)
+	c.accountId = accountId
+	return c
+}
+
+func (this *FakeChannel) Identifier() string {
+	return this.identifier
+}
+
+func (this *FakeChannel) AccountId() string {
+	return this.accountId
+}
+
+func (this *FakeChannel) addChannel(u *ngx.URL) {
+	u.Add("channel", this.identifier)
+	if this.accountId != "" {
+		u.Add("account", this.accountId)
+	}
+}
+
+// SetError 设置指定操作返回的错误，err 为 nil 时清除该操作的错误
+func (this *FakeChannel) SetError(operation string, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if err == nil {
+		delete(this.errs, operation)
+		return
+	}
+	this.errs[operation] = err
+}
+
+// SetLatency 设置每个操作的延迟时间
+func (this *FakeChannel) SetLatency(latency time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.latency = latency
+}
+
+func (this *FakeChannel) before(operation string) error {
+	this.mu.Lock()
+	var latency = this.latency
+	var err = this.errs[operation]
+	this.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return err
+}
+
+func (this *FakeChannel) CreateTradeOrder(order *payment.Order) (payURL string, err error) {
+	if err = this.before(K_OPERATION_CREATE_TRADE_ORDER); err != nil {
+		return "", err
+	}
+	return this.createTrade(order), nil
+}
+
+// SupportCurrency 订单的货币为空或者在 Currencies 中时返回 true
+func (this *FakeChannel) SupportCurrency(tradeMethod, currency string) bool {
+	if currency == "" || len(this.Currencies) == 0 {
+		return true
+	}
+	for _, c := range this.Currencies {
+		if c == currency {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *FakeChannel) createTrade(order *payment.Order) (payURL string) {
+	var amount = order.Totals().Total
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.seq++
+
+	var trade = &payment.Trade{}
+	trade.Channel = this.identifier
+	trade.OrderNo = order.OrderNo
+	trade.TradeNo = fmt.Sprintf("%s%08d", strings.ToUpper(this.identifier), this.seq)
+	trade.TradeStatus = K_TRADE_STATUS_WAIT_BUYER_PAY
+	trade.TotalAmount = payment.FormatAmount(order.Currency, amount)
+	trade.Currency = order.Currency
+	trade.RawTrade = order
+
+	this.orders = append(this.orders, order)
+	this.trades[order.OrderNo] = trade
+
+	var checkoutURL = ngx.MustURL(this.PayURL)
+	this.addChannel(checkoutURL)
+	checkoutURL.Add("order_no", order.OrderNo)
+	checkoutURL.Add("trade_no", trade.TradeNo)
+	return checkoutURL.String()
+}
+
+// Orders 返回所有通过 CreateTradeOrder 创建的订单
+func (this *FakeChannel) Orders() []*payment.Order {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var orders = make([]*payment.Order, len(this.orders))
+	copy(orders, this.orders)
+	return orders
+}
+
+// SetTrade 直接设置订单对应的交易信息，可用于模拟没有经过 CreateTradeOrder 创建的交易
+func (this *FakeChannel) SetTrade(trade *payment.Trade) {
+	if trade == nil {
+		return
+	}
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	trade.Channel = this.identifier
+	this.trades[trade.OrderNo] = trade
+}
+
+// SetTradeStatus 设置订单对应交易的状态
+func (this *FakeChannel) SetTradeStatus(orderNo, status string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		return ErrTradeNotExist
+	}
+	trade.TradeStatus = status
+	trade.TradeSuccess = status == K_TRADE_STATUS_SUCCESS
+	return nil
+}
+
+// Pay 模拟用户完成支付
+func (this *FakeChannel) Pay(orderNo, payerId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		return ErrTradeNotExist
+	}
+	trade.PayerId = payerId
+
+	trade.TradeStatus = K_TRADE_STATUS_SUCCESS
+	trade.TradeSuccess = true
+	return nil
+}
+
+func (this *FakeChannel) trade(match func(t *payment.Trade) bool) (result *payment.Trade, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, t := range this.trades {
+		if match(t) {
+			var c = *t
+			c.Status = fakeTradeStatus(c.TradeStatus)
+			return &c, nil
+		}
+	}
+	return nil, ErrTradeNotExist
+}
+
+func (this *FakeChannel) GetTrade(tradeNo string) (result *payment.Trade, err error) {
+	if err = this.before(K_OPERATION_GET_TRADE); err != nil {
+		return nil, err
+	}
+	return this.trade(func(t *payment.Trade) bool {
+		return t.TradeNo == tradeNo
+	})
+}
+
+func (this *FakeChannel) GetTradeWithOrderNo(orderNo string) (result *payment.Trade, err error) {
+	if err = this.before(K_OPERATION_GET_TRADE_WITH_ORDER_NO); err != nil {
+		return nil, err
+	}
+	return this.trade(func(t *payment.Trade) bool {
+		return t.OrderNo == orderNo
+	})
+}
+
+// ReturnRequest 生成一个用户支付完成之后跳转回来的请求，该请求可以直接交给 Service.ReturnURLHandler 处理
+func (this *FakeChannel) ReturnRequest(orderNo, returnURL string) (req *http.Request, err error) {
+	this.mu.Lock()
+	var trade = this.trades[orderNo]
+	this.mu.Unlock()
+
+	if trade == nil {
+		return nil, ErrTradeNotExist
+	}
+
+	var u = ngx.MustURL(returnURL)
+	this.addChannel(u)
+	u.Add("order_no", orderNo)
+	u.Add("trade_no", trade.TradeNo)
+	return http.NewRequest(http.MethodGet, u.String(), nil)
+}
+
+// ReturnHandler 根据 URL 中的 trade_no 查询交易，并验证交易与订单号是否一致
+func (this *FakeChannel) ReturnHandler(req *http.Request) (result *payment.Trade, err error) {
+	if err = this.before(K_OPERATION_RETURN_HANDLER); err != nil {
+		return nil, err
+	}
+
+	req.ParseForm()
+
+	var tradeNo = req.FormValue("trade_no")
+	if tradeNo == "" {
+		return nil, payment.ErrUnknownTradeNo
+	}
+
+	if result, err = this.GetTrade(tradeNo); err != nil {
+		return nil, err
+	}
+	if result.OrderNo != req.FormValue("order_no") {
+		return nil, payment.ErrTradeMismatch
+	}
+	return result, nil
+}
+
+// NotifyRequest 生成一个异步通知请求，该请求可以直接交给 Service.NotifyURLHandler 处理
+func (this *FakeChannel) NotifyRequest(orderNo, notifyType string) (req *http.Request, err error) {
+	this.mu.Lock()
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		this.mu.Unlock()
+		return nil, ErrTradeNotExist
+	}
+	var form = url.Values{}
+	form.Add("notify_type", notifyType)
+	form.Add("trade_no", trade.TradeNo)
+	form.Add("trade_status", trade.TradeStatus)
+	this.mu.Unlock()
+
+	return this.notifyRequest(orderNo, form)
+}
+
+func (this *FakeChannel) notifyRequest(orderNo string, form url.Values) (req *http.Request, err error) {
+	var notifyId = newNotifyId()
+	this.mu.Lock()
+	this.notifyIds[notifyId] = struct{}{}
+	this.mu.Unlock()
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	this.addChannel(notifyURL)
+	if orderNo != "" {
+		notifyURL.Add("order_no", orderNo)
+	}
+
+	form.Add("notify_id", notifyId)
+
+	req, err = http.NewRequest(http.MethodPost, notifyURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// NotifyHandler 只接受由 NotifyRequest 生成的通知，每个通知只能被处理一次
+func (this *FakeChannel) NotifyHandler(req *http.Request) (result *payment.Notification, err error) {
+	if err = this.before(K_OPERATION_NOTIFY_HANDLER); err != nil {
+		return nil, err
+	}
+
+	req.ParseForm()
+
+	var notifyId = req.FormValue("notify_id")
+
+	this.mu.Lock()
+	_, ok := this.notifyIds[notifyId]
+	delete(this.notifyIds, notifyId)
+	this.mu.Unlock()
+
+	if ok == false {
+		return nil, payment.ErrUnknownNotification
+	}
+
+	result = &payment.Notification{}
+	result.Channel = this.identifier
+	result.NotifyType = req.FormValue("notify_type")
+	result.OrderNo = req.FormValue("order_no")
+	result.TradeNo = req.FormValue("trade_no")
+	// 通知中只有交易状态，没有交易金额，用于测试 Service 查询交易补充通知的逻辑
+	result.RawStatus = req.FormValue("trade_status")
+	result.Status = fakeTradeStatus(result.RawStatus)
+	result.RawNotify = req.Form
+	return result, nil
+}
+
+func fakeTradeStatus(status string) string {
+	switch status {
+	case K_TRADE_STATUS_WAIT_BUYER_PAY:
+		return payment.K_TRADE_STATUS_PENDING
+	case K_TRADE_STATUS_SUCCESS:
+		return payment.K_TRADE_STATUS_SUCCESS
+	case K_TRADE_STATUS_CLOSED:
+		return payment.K_TRADE_STATUS_CLOSED
+	case K_TRADE_STATUS_REFUND:
+		return payment.K_TRADE_STATUS_REFUNDED
+	}
+	return ""
+}
+
+func newNotifyId() string {
+	var b = make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
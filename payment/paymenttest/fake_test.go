@@ -0,0 +1,181 @@
+package paymenttest
+
+import (
+	"errors"
+	"github.com/smartwalle/m4go/payment"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newOrder(orderNo string) *payment.Order {
+	var o = &payment.Order{}
+	o.OrderNo = orderNo
+	o.Subject = "test"
+	o.Discount = 1
+	o.AddProduct("test", "sku001", 2, 10.5, 0)
+	return o
+}
+
+func TestFakeChannel_ServiceFlow(t *testing.T) {
+	var fc = NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	url, err := s.CreatePayment(K_CHANNEL_FAKE, newOrder("o1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url == "" {
+		t.Fatal("支付 URL 不能为空")
+	}
+	if orders := fc.Orders(); len(orders) != 1 || orders[0].OrderNo != "o1" {
+		t.Fatalf("订单记录错误: %+v", orders)
+	}
+
+	trade, err := s.GetTradeWithOrderNo(K_CHANNEL_FAKE, "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess || trade.TotalAmount != "20.00" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	if err = fc.Pay("o1", "payer1"); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := fc.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noti, err := s.NotifyURLHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_TRADE || noti.OrderNo != "o1" || noti.TradeNo != trade.TradeNo {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+
+	// 同一个通知只能处理一次
+	if _, err = fc.NotifyHandler(req); err != payment.ErrUnknownNotification {
+		t.Fatalf("重复的通知应该返回 ErrUnknownNotification, 实际为 %v", err)
+	}
+
+	trade, err = s.GetTrade(K_CHANNEL_FAKE, trade.TradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess == false || trade.PayerId != "payer1" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+}
+
+func TestFakeChannel_Error(t *testing.T) {
+	var fc = NewFakeChannel("")
+	var errTimeout = errors.New("timeout")
+	fc.SetError(K_OPERATION_CREATE_TRADE_ORDER, errTimeout)
+
+	if _, err := fc.CreateTradeOrder(newOrder("o1")); err != errTimeout {
+		t.Fatalf("期望返回注入的错误, 实际为 %v", err)
+	}
+	if len(fc.Orders()) != 0 {
+		t.Fatal("失败的请求不应该记录订单")
+	}
+
+	fc.SetError(K_OPERATION_CREATE_TRADE_ORDER, nil)
+	fc.SetLatency(time.Millisecond * 20)
+
+	var begin = time.Now()
+	if _, err := fc.CreateTradeOrder(newOrder("o1")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(begin) < time.Millisecond*20 {
+		t.Fatal("延迟没有生效")
+	}
+}
+
+func TestFakeChannel_Return(t *testing.T) {
+	var fc = NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	if _, err := s.CreatePayment(K_CHANNEL_FAKE, newOrder("o1")); err != nil {
+		t.Fatal(err)
+	}
+	fc.Pay("o1", "payer1")
+
+	req, err := fc.ReturnRequest("o1", "http://127.0.0.1/pay/return")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trade, err := s.ReturnURLHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.OrderNo != "o1" || trade.TradeSuccess == false {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "http://127.0.0.1/pay/return?channel=fake&order_no=o2&trade_no="+trade.TradeNo, nil)
+	if _, err = s.ReturnURLHandler(req); err != payment.ErrTradeMismatch {
+		t.Fatalf("订单号不一致时应该返回 ErrTradeMismatch，实际为 %v", err)
+	}
+}
+
+// 没有实现对应接口的支付渠道
+func TestFakeChannel_NotAllowed(t *testing.T) {
+	var s = payment.NewService()
+	s.RegisterChannel(NewFakeChannel(""))
+
+	var order = newOrder("o1")
+	order.Intent = payment.K_TRADE_INTENT_AUTHORIZE
+	if _, err := s.CreatePayment(K_CHANNEL_FAKE, order); err != payment.ErrAuthorizeNotAllowed {
+		t.Fatalf("期望返回 ErrAuthorizeNotAllowed，实际为 %v", err)
+	}
+	if _, err := s.Capture(K_CHANNEL_FAKE, &payment.CaptureParam{AuthorizationId: "a1", OrderNo: "o1-1"}); err != payment.ErrAuthorizeNotAllowed {
+		t.Fatalf("期望返回 ErrAuthorizeNotAllowed，实际为 %v", err)
+	}
+	if _, err := s.Refund(K_CHANNEL_FAKE, &payment.RefundParam{OrderNo: "o1", RefundNo: "r1", Amount: 1}); err != payment.ErrRefundNotAllowed {
+		t.Fatalf("期望返回 ErrRefundNotAllowed，实际为 %v", err)
+	}
+	if _, err := s.CreateAgreement(K_CHANNEL_FAKE, &payment.Agreement{AgreementNo: "a1"}); err != payment.ErrAgreementNotAllowed {
+		t.Fatalf("期望返回 ErrAgreementNotAllowed，实际为 %v", err)
+	}
+	if _, err := s.Payout(K_CHANNEL_FAKE, &payment.Payout{PayoutNo: "p1", Amount: 1, PayeeAccount: "seller1"}); err != payment.ErrPayoutNotAllowed {
+		t.Fatalf("期望返回 ErrPayoutNotAllowed，实际为 %v", err)
+	}
+	if err := s.AddSplitReceiver(K_CHANNEL_FAKE, &payment.SplitReceiver{Type: payment.K_RECEIVER_TYPE_MERCHANT, Account: "seller1"}); err != payment.ErrSplitNotAllowed {
+		t.Fatalf("期望返回 ErrSplitNotAllowed，实际为 %v", err)
+	}
+	if _, err := s.ListDisputes(K_CHANNEL_FAKE, time.Time{}); err != payment.ErrDisputeNotAllowed {
+		t.Fatalf("期望返回 ErrDisputeNotAllowed，实际为 %v", err)
+	}
+}
+
+func TestFakeChannel_Currency(t *testing.T) {
+	var fc = NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	var order = newOrder("o1")
+	order.Currency = "JPY"
+	if _, err := s.CreatePayment(K_CHANNEL_FAKE, order); err != nil {
+		t.Fatal(err)
+	}
+	// 单价先按照 JPY 的小数位数舍入为 11，再计算总金额 11 * 2 - 1
+	if trade, _ := s.GetTradeWithOrderNo(K_CHANNEL_FAKE, "o1"); trade.TotalAmount != "21" || trade.Currency != "JPY" {
+		t.Fatalf("JPY 的金额不应该有小数: %+v", trade)
+	}
+
+	fc.Currencies = []string{"CNY"}
+	order = newOrder("o2")
+	order.Currency = "USD"
+	if _, err := s.CreatePayment(K_CHANNEL_FAKE, order); err != payment.ErrCurrencyNotSupported {
+		t.Fatalf("期望返回 ErrCurrencyNotSupported，实际为 %v", err)
+	}
+
+	if len(fc.Orders()) != 1 {
+		t.Fatalf("不支持的货币不应该创建订单: %d", len(fc.Orders()))
+	}
+}
@@ -0,0 +1,312 @@
+package paymenttest
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 以下测试使用模拟服务器验证 AliPay、WXPay 和 PayPal 通过 SDK 请求支付渠道接口的完整流程
+
+func notifyReceiver(t *testing.T, s *payment.Service, ack string, result chan<- *payment.Notification) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		noti, err := s.NotifyURLHandler(req)
+		if err != nil {
+			t.Errorf("处理通知失败: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(ack))
+		result <- noti
+	}))
+}
+
+func TestAliPayIntegration(t *testing.T) {
+	merchantKey, merchantPublicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAliPayServer("2016073100129537", merchantPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "success", notifications)
+	defer receiver.Close()
+
+	var ap = payment.NewAliPay("2016073100129537", "2088102169227503", server.PublicKey, merchantKey, false, payment.WithBaseURL(server.URL))
+	ap.NotifyURL = receiver.URL + "/pay/notify"
+	ap.ReturnURL = receiver.URL + "/pay/return"
+	ap.CancelURL = receiver.URL + "/pay/cancel"
+	s.RegisterChannel(ap)
+
+	var order = newOrder("A1001")
+	order.TradeMethod = payment.K_TRADE_METHOD_QRCODE
+	qrCode, err := s.CreatePayment(payment.K_CHANNEL_ALIPAY, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qrCode == "" {
+		t.Fatal("二维码内容不能为空")
+	}
+
+	trade, err := s.GetTradeWithOrderNo(payment.K_CHANNEL_ALIPAY, "A1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess || trade.TotalAmount != "20.00" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	server.Pay("A1001", "2088102175953034")
+	if err = server.Notify("A1001"); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_TRADE || noti.OrderNo != "A1001" || noti.TradeNo != trade.TradeNo {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+
+	trade, err = s.GetTrade(payment.K_CHANNEL_ALIPAY, trade.TradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess == false || trade.PayerId != "2088102175953034" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	// 退款，使用相同的退款单号重试不会重复退款
+	refund, err := ap.Refund(&payment.RefundParam{TradeNo: trade.TradeNo, RefundNo: "AR1", Amount: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Status != payment.K_REFUND_STATUS_SUCCESS || refund.OrderNo != "A1001" || refund.TradeNo != trade.TradeNo || refund.Amount != "5.00" {
+		t.Fatalf("退款信息错误: %+v", refund)
+	}
+	if refund, err = s.Refund(payment.K_CHANNEL_ALIPAY, &payment.RefundParam{OrderNo: "A1001", RefundNo: "AR1", Amount: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if refund.TradeNo != trade.TradeNo || refund.RefundNo != "AR1" || server.trades["A1001"].RefundFee != 5 {
+		t.Fatalf("重复退款错误: %+v, 已退款 %v", refund, server.trades["A1001"].RefundFee)
+	}
+	if _, err = s.Refund(payment.K_CHANNEL_ALIPAY, &payment.RefundParam{OrderNo: "A1001", RefundNo: "AR2", Amount: 20.01}); err != payment.ErrInvalidAmount {
+		t.Fatalf("退款金额超过交易金额时应该返回 ErrInvalidAmount，实际为 %v", err)
+	}
+	if _, err = s.Refund(payment.K_CHANNEL_ALIPAY, &payment.RefundParam{OrderNo: "A1001", RefundNo: "AR2", Amount: 15.01}); err == nil {
+		t.Fatal("累计退款金额超过交易金额时应该返回错误")
+	}
+
+	if err = server.Notify("A1001"); err != nil {
+		t.Fatal(err)
+	}
+	noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_REFUND || noti.OrderNo != "A1001" || noti.RefundAmount != "5.00" || noti.RefundStatus != payment.K_REFUND_STATUS_SUCCESS {
+		t.Fatalf("退款通知信息错误: %+v", noti)
+	}
+
+	// 电脑网站支付返回的是收银台的 URL，打开之后才会创建交易，同步返回的 URL 需要验证签名
+	payURL, err := s.CreatePayment(payment.K_CHANNEL_ALIPAY, newOrder("A1002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.Get(payURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+
+	server.Pay("A1002", "2088102175953034")
+	returnURL, err := server.ReturnURL("A1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, returnURL, nil)
+	if trade, err = s.ReturnURLHandler(req); err != nil {
+		t.Fatal(err)
+	}
+	if trade.OrderNo != "A1002" || trade.TradeSuccess == false {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, strings.Replace(returnURL, "total_amount=20.00", "total_amount=0.01", 1), nil)
+	if _, err = s.ReturnURLHandler(req); err != payment.ErrInvalidSignature {
+		t.Fatalf("参数被修改之后应该返回 ErrInvalidSignature，实际为 %v", err)
+	}
+}
+
+func TestWXPayIntegration(t *testing.T) {
+	var server = NewWXPayServer("wx0000000000000001", "10000100", "test-api-key-00000000000000000000")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "<xml><return_code><![CDATA[SUCCESS]]></return_code></xml>", notifications)
+	defer receiver.Close()
+
+	var wp = payment.NewWXPal("wx0000000000000001", "test-api-key-00000000000000000000", "10000100", false, payment.WithBaseURL(server.URL))
+	wp.NotifyURL = receiver.URL + "/pay/notify"
+	s.RegisterChannel(wp)
+
+	var order = newOrder("W2001")
+	order.TradeMethod = payment.K_TRADE_METHOD_QRCODE
+	order.IP = "127.0.0.1"
+	codeURL, err := s.CreatePayment(payment.K_CHANNEL_WXPAY, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codeURL == "" {
+		t.Fatal("code_url 不能为空")
+	}
+
+	server.Pay("W2001", "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o")
+	if err = server.Notify("W2001"); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_TRADE || noti.OrderNo != "W2001" {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+
+	trade, err := s.GetTrade(payment.K_CHANNEL_WXPAY, noti.TradeNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess == false || trade.TotalAmount != "20.00" || trade.PayerId != "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+
+	// 微信支付的退款需要提供交易金额，通过 Service 退款时会使用查询到的交易金额
+	if _, err = wp.Refund(&payment.RefundParam{TradeNo: trade.TradeNo, RefundNo: "WR1", Amount: 5, TotalAmount: 10}); err == nil {
+		t.Fatal("交易金额错误时应该返回错误")
+	}
+	var param = &payment.RefundParam{TradeNo: trade.TradeNo, RefundNo: "WR1", Amount: 5}
+	refund, err := s.Refund(payment.K_CHANNEL_WXPAY, param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if param.OrderNo != "" || param.TotalAmount != 0 || param.Currency != "" {
+		t.Fatalf("不应该修改调用方的退款参数: %+v", param)
+	}
+	if refund.Status != payment.K_REFUND_STATUS_PROCESSING || refund.OrderNo != "W2001" || refund.RefundId == "" || refund.Amount != "5.00" {
+		t.Fatalf("退款信息错误: %+v", refund)
+	}
+	retry, err := wp.Refund(&payment.RefundParam{TradeNo: trade.TradeNo, OrderNo: "W2001", RefundNo: "WR1", Amount: 5, TotalAmount: 20, Currency: "CNY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.RefundId != refund.RefundId || server.trades["W2001"].RefundFee != 500 {
+		t.Fatalf("重复退款错误: %+v, 已退款 %d", retry, server.trades["W2001"].RefundFee)
+	}
+
+	// 退款通知没有签名，通过解密 req_info 获取退款信息
+	if err = server.NotifyRefund("WR1"); err != nil {
+		t.Fatal(err)
+	}
+	noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_REFUND || noti.OrderNo != "W2001" || noti.TradeNo != trade.TradeNo || noti.RefundNo != "WR1" || noti.RefundId != refund.RefundId || noti.RefundAmount != "5.00" || noti.TotalAmount != "20.00" || noti.RefundStatus != payment.K_REFUND_STATUS_SUCCESS || noti.RawStatus != "SUCCESS" || noti.RefundTime.IsZero() {
+		t.Fatalf("退款通知信息错误: %+v", noti)
+	}
+	if _, err = wp.NotifyHandler(httptest.NewRequest(http.MethodPost, "/pay/notify?notify_type=refund", strings.NewReader("<xml><return_code>SUCCESS</return_code><req_info>invalid</req_info></xml>"))); err != payment.ErrInvalidSignature {
+		t.Fatalf("无法解密的退款通知应该返回 ErrInvalidSignature，实际为 %v", err)
+	}
+
+	trade, err = s.GetTradeWithOrderNo(payment.K_CHANNEL_WXPAY, "W2001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.Status != payment.K_TRADE_STATUS_REFUNDED {
+		t.Fatalf("退款之后交易状态应该为 %s，实际为 %+v", payment.K_TRADE_STATUS_REFUNDED, trade)
+	}
+}
+
+func TestPayPalIntegration(t *testing.T) {
+	var server = NewPayPalServer("client-id", "secret")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "", notifications)
+	defer receiver.Close()
+	server.WebhookURL = receiver.URL + "/pay/notify?channel=" + payment.K_CHANNEL_PAYPAL
+
+	var pp = payment.NewPayPal("client-id", "secret", false, payment.WithBaseURL(server.URL))
+	pp.ReturnURL = receiver.URL + "/pay/return"
+	pp.CancelURL = receiver.URL + "/pay/cancel"
+	pp.WebHookId = server.WebhookId
+	s.RegisterChannel(pp)
+
+	var order = newOrder("P3001")
+	order.Currency = "USD"
+	approvalURL, err := s.CreatePayment(payment.K_CHANNEL_PAYPAL, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approvalURL == "" {
+		t.Fatal("approval_url 不能为空")
+	}
+
+	var paymentId string
+	server.mu.Lock()
+	for id := range server.payments {
+		paymentId = id
+	}
+	server.mu.Unlock()
+	server.Approve(paymentId, "PAYER1")
+
+	// 同步返回的 URL 必须包含创建付款时的订单号，避免使用其它订单的 paymentId 重放
+	for _, orderNo := range []string{"", "P3002"} {
+		req, _ := http.NewRequest(http.MethodGet, receiver.URL+"/pay/return?channel=paypal&order_no="+orderNo+"&paymentId="+paymentId+"&PayerID=PAYER1", nil)
+		if _, err = s.ReturnURLHandler(req); err != payment.ErrTradeMismatch {
+			t.Fatalf("订单号为 %q 时应该返回 ErrTradeMismatch，实际为 %v", orderNo, err)
+		}
+	}
+
+	// 付款处于 created 状态时，GetTrade 会执行付款
+	trade, err := s.GetTrade(payment.K_CHANNEL_PAYPAL, paymentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess == false || trade.OrderNo != "P3001" || trade.PayerId != "PAYER1" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+	req, _ := http.NewRequest(http.MethodGet, receiver.URL+"/pay/return?channel=paypal&order_no=P3001&paymentId="+paymentId+"&PayerID=PAYER1", nil)
+	if trade, err = s.ReturnURLHandler(req); err != nil || trade.OrderNo != "P3001" {
+		t.Fatalf("同步返回失败: %+v %v", trade, err)
+	}
+
+	if err = server.Notify(paymentId, K_PAYPAL_EVENT_SALE_COMPLETED); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_TRADE || noti.OrderNo != "P3001" || noti.TradeNo != paymentId {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+
+	refund, err := s.Refund(payment.K_CHANNEL_PAYPAL, &payment.RefundParam{TradeNo: paymentId, RefundNo: "PR1", Amount: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Status != payment.K_REFUND_STATUS_SUCCESS || refund.OrderNo != "P3001" || refund.RefundId == "" || refund.Amount != "5.00" {
+		t.Fatalf("退款信息错误: %+v", refund)
+	}
+	if _, err = pp.Refund(&payment.RefundParam{TradeNo: paymentId, RefundNo: "PR2", Amount: 15.01, Currency: "USD"}); err == nil {
+		t.Fatal("累计退款金额超过交易金额时应该返回错误")
+	}
+	if _, err = s.Refund(payment.K_CHANNEL_PAYPAL, &payment.RefundParam{OrderNo: "P3001", RefundNo: "PR2", Amount: 5}); err != payment.ErrPayPalNotAllowed {
+		t.Fatalf("PayPal 不支持使用订单号查询交易，实际为 %v", err)
+	}
+
+	if err = server.Notify(paymentId, K_PAYPAL_EVENT_SALE_REFUNDED); err != nil {
+		t.Fatal(err)
+	}
+	noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_REFUND || noti.OrderNo != "P3001" || noti.TradeNo != paymentId || noti.RefundId != refund.RefundId || noti.RefundAmount != "5.00" || noti.RefundStatus != payment.K_REFUND_STATUS_SUCCESS {
+		t.Fatalf("退款通知信息错误: %+v", noti)
+	}
+}
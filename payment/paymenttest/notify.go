@@ -0,0 +1,235 @@
+package paymenttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/smartwalle/m4go/payment"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SampleNotification 生成模拟异步通知的参数，用于在没有真实支付的情况下调试通知的处理逻辑
+type SampleNotification struct {
+	NotifyURL   string // 接收通知的 URL，会自动添加 channel 参数
+	AccountId   string // 商户账号，不为空时会添加 account 参数
+	OrderNo     string
+	TradeNo     string // 为空时自动生成
+	TotalAmount float64
+	Currency    string // 为空时支付宝和微信支付使用 CNY，PayPal 使用 USD
+	PayerId     string
+	EventType   string // PayPal 的事件类型，为空时使用 K_PAYPAL_EVENT_SALE_COMPLETED
+}
+
+func (this *SampleNotification) notifyURL(channel string, query url.Values) (string, error) {
+	u, err := url.Parse(this.NotifyURL)
+	if err != nil {
+		return "", err
+	}
+	var q = u.Query()
+	q.Set("channel", channel)
+	if this.AccountId != "" {
+		q.Set("account", this.AccountId)
+	}
+	for key := range query {
+		if q.Get(key) == "" {
+			q.Set(key, query.Get(key))
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (this *SampleNotification) tradeNo(prefix string) string {
+	if this.TradeNo != "" {
+		return this.TradeNo
+	}
+	return prefix + time.Now().Format("20060102150405") + strings.ToUpper(newNotifyId()[:8])
+}
+
+func (this *SampleNotification) currency(defaultCurrency string) string {
+	if this.Currency == "" {
+		return defaultCurrency
+	}
+	return this.Currency
+}
+
+// aliPayNotifyValues 生成支付宝交易状态的异步通知参数，不包含签名
+func aliPayNotifyValues(appId, notifyId string, trade *aliPayTrade) url.Values {
+	var p = url.Values{}
+	p.Set("notify_time", time.Now().Format("2006-01-02 15:04:05"))
+	p.Set("notify_type", "trade_status_sync")
+	p.Set("notify_id", notifyId)
+	p.Set("app_id", appId)
+	p.Set("charset", "utf-8")
+	p.Set("version", "1.0")
+	p.Set("sign_type", "RSA2")
+	p.Set("trade_no", trade.TradeNo)
+	p.Set("out_trade_no", trade.OutTradeNo)
+	p.Set("subject", trade.Subject)
+	p.Set("trade_status", trade.TradeStatus)
+	p.Set("total_amount", trade.TotalAmount)
+	p.Set("buyer_id", trade.BuyerUserId)
+	p.Set("buyer_logon_id", trade.BuyerLogonId)
+	p.Set("gmt_payment", trade.GmtPayment)
+	if trade.RefundFee > 0 {
+		p.Set("refund_fee", fmt.Sprintf("%.2f", trade.RefundFee))
+	}
+	return p
+}
+
+// NewAliPayNotification 生成支付成功的异步通知，privateKey 为与 AliPay 中 aliPublicKey 对应的私钥（测试密钥）
+func NewAliPayNotification(appId, privateKey string, n *SampleNotification) (*http.Request, error) {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var trade = &aliPayTrade{}
+	trade.OutTradeNo = n.OrderNo
+	trade.TradeNo = n.tradeNo("")
+	trade.Subject = n.OrderNo
+	trade.TotalAmount = payment.FormatAmount(n.currency(payment.K_CURRENCY_CNY), n.TotalAmount)
+	trade.TradeStatus = k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS
+	trade.BuyerUserId = n.PayerId
+	trade.GmtPayment = time.Now().Format("2006-01-02 15:04:05")
+
+	var p = aliPayNotifyValues(appId, newNotifyId(), trade)
+	// 异步通知的签名不包含 sign 和 sign_type
+	sign, err := signAliPay(p, key, "sign", "sign_type")
+	if err != nil {
+		return nil, err
+	}
+	p.Set("sign", sign)
+
+	notifyURL, err := n.notifyURL(payment.K_CHANNEL_ALIPAY, nil)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, notifyURL, strings.NewReader(p.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// wxPayNotifyValues 生成微信支付结果通知的参数，不包含签名
+func wxPayNotifyValues(appId, mchId string, trade *wxPayTrade) url.Values {
+	var p = url.Values{}
+	p.Set("return_code", "SUCCESS")
+	p.Set("appid", appId)
+	p.Set("mch_id", mchId)
+	p.Set("nonce_str", newNotifyId())
+	p.Set("result_code", "SUCCESS")
+	p.Set("openid", trade.OpenId)
+	p.Set("is_subscribe", "N")
+	p.Set("trade_type", trade.TradeType)
+	p.Set("bank_type", "CFT")
+	p.Set("total_fee", strconv.Itoa(trade.TotalFee))
+	p.Set("fee_type", trade.FeeType)
+	p.Set("cash_fee", strconv.Itoa(trade.TotalFee))
+	p.Set("transaction_id", trade.TransactionId)
+	p.Set("out_trade_no", trade.OutTradeNo)
+	p.Set("time_end", trade.TimeEnd)
+	if trade.SignType != "" {
+		p.Set("sign_type", trade.SignType)
+	}
+	return p
+}
+
+// NewWXPayNotification 生成支付成功的通知，apiKey 为商户的 API 密钥，signType 为空时使用 MD5
+func NewWXPayNotification(appId, mchId, apiKey, signType string, n *SampleNotification) (*http.Request, error) {
+	var currency = n.currency(payment.K_CURRENCY_CNY)
+
+	var trade = &wxPayTrade{}
+	trade.OutTradeNo = n.OrderNo
+	trade.TransactionId = n.tradeNo("42")
+	trade.TradeType = "NATIVE"
+	trade.TotalFee = payment.ToMinorUnit(currency, n.TotalAmount)
+	trade.FeeType = currency
+	trade.SignType = signType
+	trade.OpenId = n.PayerId
+	trade.TimeEnd = time.Now().Format("20060102150405")
+
+	var p = wxPayNotifyValues(appId, mchId, trade)
+	p.Set("sign", signWXPay(p, apiKey, signType))
+
+	// WXPay 根据 notify_type 区分通知的类型，统一下单时会添加在 notify_url 中
+	notifyURL, err := n.notifyURL(payment.K_CHANNEL_WXPAY, url.Values{"notify_type": {"trade"}, "order_no": {n.OrderNo}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, notifyURL, bytes.NewReader(encodeXML(p)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	return req, nil
+}
+
+// newPayPalWebhookRequest 生成 Webhook 通知的请求，签名相关的 Header 只有 PayPalServer 能够验证
+func newPayPalWebhookRequest(webhookURL, transmissionId, certURL string, event map[string]interface{}) (*http.Request, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Paypal-Transmission-Id", transmissionId)
+	req.Header.Set("Paypal-Transmission-Time", time.Now().UTC().Format(time.RFC3339))
+	req.Header.Set("Paypal-Transmission-Sig", newNotifyId())
+	req.Header.Set("Paypal-Cert-Url", certURL)
+	req.Header.Set("Paypal-Auth-Algo", "SHA256withRSA")
+	return req, nil
+}
+
+func newPayPalEvent(eventType, resourceType string, resource interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               "WH-" + strings.ToUpper(newNotifyId()[:16]),
+		"create_time":      time.Now().UTC().Format(time.RFC3339),
+		"event_version":    "1.0",
+		"event_type":       eventType,
+		"resource_version": "1.0",
+		"resource_type":    resourceType,
+		"resource":         resource,
+	}
+}
+
+// NewPayPalNotification 生成 Sale 相关的 Webhook 通知，PayPal 通过接口验证 Webhook 的签名，
+// 生成的通知无法通过 PayPal 的验证，只能用于调试验证签名之后的处理逻辑
+func NewPayPalNotification(n *SampleNotification) (*http.Request, error) {
+	var eventType = n.EventType
+	if eventType == "" {
+		eventType = K_PAYPAL_EVENT_SALE_COMPLETED
+	}
+
+	var currency = n.currency(payment.K_CURRENCY_USD)
+	var amount = &ppAmount{Total: payment.FormatAmount(currency, n.TotalAmount), Currency: currency}
+	var tradeNo = n.tradeNo("PAY-")
+	var now = time.Now().UTC().Format(time.RFC3339)
+
+	var event map[string]interface{}
+	switch eventType {
+	case K_PAYPAL_EVENT_SALE_COMPLETED:
+		var sale = &ppSale{Id: "SALE-" + strings.ToUpper(newNotifyId()[:16]), State: k_PAYPAL_SALE_STATE_COMPLETED, Amount: amount, ParentPayment: tradeNo, InvoiceNumber: n.OrderNo, CreateTime: now}
+		event = newPayPalEvent(eventType, "sale", sale)
+	case K_PAYPAL_EVENT_SALE_REFUNDED:
+		var refund = &ppRefund{Id: "REFUND-" + strings.ToUpper(newNotifyId()[:16]), State: "completed", Amount: amount, ParentPayment: tradeNo, InvoiceNumber: n.OrderNo, CreateTime: now}
+		event = newPayPalEvent(eventType, "refund", refund)
+	default:
+		return nil, fmt.Errorf("不支持的事件类型 %s", eventType)
+	}
+
+	notifyURL, err := n.notifyURL(payment.K_CHANNEL_PAYPAL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newPayPalWebhookRequest(notifyURL, newNotifyId(), "https://api.sandbox.paypal.com/v1/notifications/certs/CERT-360caa42-fca2a594-1d93a270", event)
+}
@@ -0,0 +1,83 @@
+package paymenttest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"testing"
+)
+
+func TestNewAliPayNotification(t *testing.T) {
+	privateKey, publicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := NewAliPayNotification("2016073100129537", privateKey, &SampleNotification{NotifyURL: "http://127.0.0.1/pay/notify", AccountId: "hk", OrderNo: "o1", TotalAmount: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := req.URL.Query(); q.Get("channel") != "alipay" || q.Get("account") != "hk" {
+		t.Fatalf("通知 URL 错误: %s", req.URL)
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	p, err := url.ParseQuery(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Get("out_trade_no") != "o1" || p.Get("total_amount") != "20.00" || p.Get("trade_status") != k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS {
+		t.Fatalf("通知内容错误: %v", p)
+	}
+	key, _ := parsePublicKey(publicKey)
+	if err = verifyRSA2(signContent(p, "sign", "sign_type"), p.Get("sign"), key); err != nil {
+		t.Fatalf("签名验证失败: %v", err)
+	}
+}
+
+func TestNewWXPayNotification(t *testing.T) {
+	req, err := NewWXPayNotification("wx1", "mch1", "key1", k_WXPAY_SIGN_TYPE_HMAC_SHA256, &SampleNotification{NotifyURL: "http://127.0.0.1/pay/notify", OrderNo: "o1", TotalAmount: 20.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := req.URL.Query(); q.Get("channel") != "wxpay" || q.Get("notify_type") != "trade" || q.Get("order_no") != "o1" {
+		t.Fatalf("通知 URL 错误: %s", req.URL)
+	}
+
+	p, err := decodeXML(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Get("out_trade_no") != "o1" || p.Get("total_fee") != "2050" || p.Get("fee_type") != "CNY" {
+		t.Fatalf("通知内容错误: %v", p)
+	}
+	if p.Get("sign") != signWXPay(p, "key1", k_WXPAY_SIGN_TYPE_HMAC_SHA256) {
+		t.Fatal("签名错误")
+	}
+}
+
+func TestNewPayPalNotification(t *testing.T) {
+	req, err := NewPayPalNotification(&SampleNotification{NotifyURL: "http://127.0.0.1/pay/notify", OrderNo: "o1", TradeNo: "PAY-1", TotalAmount: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event = struct {
+		EventType string  `json:"event_type"`
+		Resource  *ppSale `json:"resource"`
+	}{}
+	if err = json.NewDecoder(req.Body).Decode(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.EventType != K_PAYPAL_EVENT_SALE_COMPLETED || event.Resource.InvoiceNumber != "o1" || event.Resource.ParentPayment != "PAY-1" ||
+		event.Resource.Amount.Total != "20.00" || event.Resource.Amount.Currency != "USD" {
+		t.Fatalf("通知内容错误: %+v", event.Resource)
+	}
+	if req.Header.Get("Paypal-Transmission-Id") == "" || req.URL.Query().Get("channel") != "paypal" {
+		t.Fatal("通知的 Header 或者 URL 错误")
+	}
+
+	if _, err = NewPayPalNotification(&SampleNotification{EventType: "UNKNOWN"}); err == nil {
+		t.Fatal("不支持的事件类型应该返回错误")
+	}
+}
@@ -0,0 +1,223 @@
+package paymenttest
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"testing"
+)
+
+func TestAliPayPayout(t *testing.T) {
+	merchantKey, merchantPublicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAliPayServer("2016073100129537", merchantPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Balance = 100
+
+	var s = payment.NewService()
+	var ap = payment.NewAliPay("2016073100129537", "2088102169227503", server.PublicKey, merchantKey, false, payment.WithBaseURL(server.URL))
+	s.RegisterChannel(ap)
+
+	if _, err = s.Payout(payment.K_CHANNEL_ALIPAY, &payment.Payout{PayoutNo: "AP001", Amount: 12.5, Currency: "USD", PayeeAccount: "2088102175953034"}); err != payment.ErrCurrencyNotSupported {
+		t.Fatalf("期望返回 ErrCurrencyNotSupported，实际为 %v", err)
+	}
+	for _, amount := range []float64{0, -1} {
+		if _, err = s.Payout(payment.K_CHANNEL_ALIPAY, &payment.Payout{PayoutNo: "AP001", Amount: amount, PayeeAccount: "2088102175953034"}); err != payment.ErrInvalidAmount {
+			t.Fatalf("付款金额为 %v 时应该返回 ErrInvalidAmount，实际为 %v", amount, err)
+		}
+	}
+
+	// 2088 开头的 16 位数字作为支付宝用户 ID 使用，使用相同的付款单号重试不会重复付款
+	result, err := s.Payout(payment.K_CHANNEL_ALIPAY, &payment.Payout{PayoutNo: "AP001", Amount: 12.5, PayeeAccount: "2088102175953034"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_PAYOUT_STATUS_SUCCESS || result.PayoutNo != "AP001" || result.Amount != "12.50" || result.PayoutId == "" {
+		t.Fatalf("付款结果错误: %+v", result)
+	}
+	if server.transfers["AP001"].IdentityType != "ALIPAY_USER_ID" {
+		t.Fatalf("收款账号类型错误: %s", server.transfers["AP001"].IdentityType)
+	}
+	retry, err := s.Payout(payment.K_CHANNEL_ALIPAY, &payment.Payout{PayoutNo: "AP001", Amount: 12.5, PayeeAccount: "2088102175953034"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.PayoutId != result.PayoutId || server.Balance != 87.5 {
+		t.Fatalf("重复付款: %+v, 余额 %v", retry, server.Balance)
+	}
+
+	// 使用登录账号付款时必须设置收款人姓名，逐笔付款的失败记录在 FailReason 中
+	results, err := s.BatchPayout(payment.K_CHANNEL_ALIPAY, "AB001", []*payment.Payout{
+		{PayoutNo: "AP002", Amount: 1, PayeeAccount: "buyer@sandbox.com", PayeeName: "沙箱环境"},
+		{PayoutNo: "AP003", Amount: 1, PayeeAccount: "buyer@sandbox.com"},
+		{PayoutNo: "AP004", Amount: 100, PayeeAccount: "2088102175953034"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Status != payment.K_PAYOUT_STATUS_SUCCESS || results[0].BatchNo != "AB001" {
+		t.Fatalf("批量付款结果错误: %+v", results)
+	}
+	if results[1].Status != payment.K_PAYOUT_STATUS_FAILED || results[1].FailReason == "" || results[1].BatchNo != "AB001" {
+		t.Fatalf("没有收款人姓名时应该付款失败: %+v", results[1])
+	}
+	if results[2].Status != payment.K_PAYOUT_STATUS_FAILED || results[2].FailReason == "" {
+		t.Fatalf("余额不足时应该付款失败: %+v", results[2])
+	}
+
+	if result, err = s.GetPayoutWithPayoutNo(payment.K_CHANNEL_ALIPAY, "AP002"); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_PAYOUT_STATUS_SUCCESS || result.PayoutId != results[0].PayoutId || result.Amount != "1.00" {
+		t.Fatalf("查询付款结果错误: %+v", result)
+	}
+	if result, err = s.GetPayout(payment.K_CHANNEL_ALIPAY, retry.PayoutId); err != nil || result.PayoutNo != "AP001" {
+		t.Fatalf("查询付款结果错误: %+v, %v", result, err)
+	}
+	if _, err = s.GetPayoutWithPayoutNo(payment.K_CHANNEL_ALIPAY, "AP003"); err == nil {
+		t.Fatal("付款失败时不会创建转账订单，查询应该返回错误")
+	}
+}
+
+func TestWXPayPayout(t *testing.T) {
+	var server = NewWXPayServer("wx0000000000000001", "10000100", "test-api-key-00000000000000000000")
+	defer server.Close()
+	server.SetRealName("oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", "张三")
+
+	var s = payment.NewService()
+	var wp = payment.NewWXPal("wx0000000000000001", "test-api-key-00000000000000000000", "10000100", false, payment.WithBaseURL(server.URL))
+	s.RegisterChannel(wp)
+
+	if _, err := s.Payout(payment.K_CHANNEL_WXPAY, &payment.Payout{PayoutNo: "WP001", Amount: 1, Currency: "USD", PayeeAccount: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"}); err != payment.ErrCurrencyNotSupported {
+		t.Fatalf("期望返回 ErrCurrencyNotSupported，实际为 %v", err)
+	}
+
+	var payout = &payment.Payout{PayoutNo: "WP001", Amount: 12.5, PayeeAccount: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", PayeeName: "张三", IP: "127.0.0.1"}
+	result, err := s.Payout(payment.K_CHANNEL_WXPAY, payout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_PAYOUT_STATUS_SUCCESS || result.PayoutNo != "WP001" || result.Amount != "12.50" || result.PayoutId == "" {
+		t.Fatalf("付款结果错误: %+v", result)
+	}
+	if retry, err := s.Payout(payment.K_CHANNEL_WXPAY, payout); err != nil || retry.PayoutId != result.PayoutId {
+		t.Fatalf("重复付款: %+v, %v", retry, err)
+	}
+
+	// 设置收款人姓名时会强制校验，付款金额不能低于 0.3 元
+	results, err := s.BatchPayout(payment.K_CHANNEL_WXPAY, "WB001", []*payment.Payout{
+		{PayoutNo: "WP002", Amount: 1, PayeeAccount: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", IP: "127.0.0.1"},
+		{PayoutNo: "WP003", Amount: 1, PayeeAccount: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", PayeeName: "李四", IP: "127.0.0.1"},
+		{PayoutNo: "WP004", Amount: 0.29, PayeeAccount: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", IP: "127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Status != payment.K_PAYOUT_STATUS_SUCCESS || results[0].BatchNo != "WB001" {
+		t.Fatalf("批量付款结果错误: %+v", results)
+	}
+	if results[1].Status != payment.K_PAYOUT_STATUS_FAILED || results[1].FailReason == "" {
+		t.Fatalf("收款人姓名不匹配时应该付款失败: %+v", results[1])
+	}
+	if results[2].Status != payment.K_PAYOUT_STATUS_FAILED || results[2].Amount != "0.29" {
+		t.Fatalf("付款金额低于最低限额时应该付款失败: %+v", results[2])
+	}
+
+	if result, err = s.GetPayoutWithPayoutNo(payment.K_CHANNEL_WXPAY, "WP002"); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_PAYOUT_STATUS_SUCCESS || result.PayoutId != results[0].PayoutId || result.Amount != "1.00" {
+		t.Fatalf("查询付款结果错误: %+v", result)
+	}
+	if _, err = s.GetPayoutWithPayoutNo(payment.K_CHANNEL_WXPAY, "WP003"); err == nil {
+		t.Fatal("付款失败时查询应该返回错误")
+	}
+	if _, err = s.GetPayout(payment.K_CHANNEL_WXPAY, result.PayoutId); err != payment.ErrWXPayNotAllowed {
+		t.Fatalf("期望返回 ErrWXPayNotAllowed，实际为 %v", err)
+	}
+}
+
+func TestPayPalPayout(t *testing.T) {
+	var server = NewPayPalServer("client-id", "secret")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = notifyReceiver(t, s, "", notifications)
+	defer receiver.Close()
+	server.WebhookURL = receiver.URL + "/pay/notify?channel=" + payment.K_CHANNEL_PAYPAL
+
+	var pp = payment.NewPayPal("client-id", "secret", false, payment.WithBaseURL(server.URL))
+	pp.WebHookId = server.WebhookId
+	s.RegisterChannel(pp)
+
+	// PayPal 异步处理付款，创建之后付款状态为处理中
+	result, err := s.Payout(payment.K_CHANNEL_PAYPAL, &payment.Payout{PayoutNo: "PP001", Amount: 12.5, Currency: "USD", PayeeAccount: "buyer1@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_PAYOUT_STATUS_PROCESSING || result.PayoutNo != "PP001" || result.Amount != "12.50" || result.PayoutId == "" {
+		t.Fatalf("付款结果错误: %+v", result)
+	}
+	if _, err = s.Payout(payment.K_CHANNEL_PAYPAL, &payment.Payout{PayoutNo: "PP001", Amount: 12.5, Currency: "USD", PayeeAccount: "buyer1@example.com"}); err == nil {
+		t.Fatal("重复的批量付款单号应该返回错误")
+	}
+
+	if err = server.ProcessPayout(result.PayoutId, k_PAYPAL_PAYOUT_ITEM_STATUS_SUCCESS, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.NotifyPayout(result.PayoutId); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_PAYOUT || noti.OrderNo != "PP001" || noti.TradeNo != result.PayoutId {
+		t.Fatalf("付款通知信息错误: %+v", noti)
+	}
+	if result, err = s.GetPayout(payment.K_CHANNEL_PAYPAL, result.PayoutId); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_PAYOUT_STATUS_SUCCESS || result.PayoutNo != "PP001" {
+		t.Fatalf("查询付款结果错误: %+v", result)
+	}
+	if _, err = s.GetPayoutWithPayoutNo(payment.K_CHANNEL_PAYPAL, "PP001"); err != payment.ErrPayPalNotAllowed {
+		t.Fatalf("期望返回 ErrPayPalNotAllowed，实际为 %v", err)
+	}
+
+	// 批量付款的货币必须一致
+	if _, err = s.BatchPayout(payment.K_CHANNEL_PAYPAL, "PB001", []*payment.Payout{
+		{PayoutNo: "PP002", Amount: 1, Currency: "USD", PayeeAccount: "buyer2@example.com"},
+		{PayoutNo: "PP003", Amount: 1, Currency: "EUR", PayeeAccount: "buyer3@example.com"},
+	}); err != payment.ErrCurrencyMismatch {
+		t.Fatalf("期望返回 ErrCurrencyMismatch，实际为 %v", err)
+	}
+	results, err := s.BatchPayout(payment.K_CHANNEL_PAYPAL, "PB001", []*payment.Payout{
+		{PayoutNo: "PP002", Amount: 1, Currency: "JPY", PayeeAccount: "buyer2@example.com"},
+		{PayoutNo: "PP003", Amount: 2, Currency: "JPY", PayeeAccount: "buyer3@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].BatchNo != "PB001" || results[0].Amount != "1" || results[1].Status != payment.K_PAYOUT_STATUS_PROCESSING {
+		t.Fatalf("批量付款结果错误: %+v", results)
+	}
+
+	// 收款人没有 PayPal 账户时付款状态为 UNCLAIMED，收款人注册之后仍然可以领取，所以仍然是处理中
+	if err = server.ProcessPayout(results[1].PayoutId, "UNCLAIMED", "RECEIVER_UNREGISTERED"); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.NotifyPayout(results[1].PayoutId); err != nil {
+		t.Fatal(err)
+	}
+	if noti = <-notifications; noti.NotifyType != payment.K_NOTIFY_TYPE_PAYOUT || noti.OrderNo != "PP003" {
+		t.Fatalf("付款通知信息错误: %+v", noti)
+	}
+	if result, err = s.GetPayout(payment.K_CHANNEL_PAYPAL, results[1].PayoutId); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_PAYOUT_STATUS_PROCESSING || result.RawStatus != "UNCLAIMED" || result.FailReason != "RECEIVER_UNREGISTERED" {
+		t.Fatalf("查询付款结果错误: %+v", result)
+	}
+}
@@ -0,0 +1,1698 @@
+package paymenttest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	k_PAYPAL_PAYMENT_STATE_CREATED  = "created"
+	k_PAYPAL_PAYMENT_STATE_APPROVED = "approved"
+
+	k_PAYPAL_SALE_STATE_COMPLETED          = "completed"
+	k_PAYPAL_SALE_STATE_PARTIALLY_REFUNDED = "partially_refunded"
+	k_PAYPAL_SALE_STATE_REFUNDED           = "refunded"
+
+	k_PAYPAL_PAYMENT_INTENT_AUTHORIZE = "authorize"
+
+	k_PAYPAL_AUTHORIZATION_STATE_AUTHORIZED         = "authorized"
+	k_PAYPAL_AUTHORIZATION_STATE_PARTIALLY_CAPTURED = "partially_captured"
+	k_PAYPAL_AUTHORIZATION_STATE_CAPTURED           = "captured"
+	k_PAYPAL_AUTHORIZATION_STATE_VOIDED             = "voided"
+
+	k_PAYPAL_PLAN_STATE_CREATED = "CREATED"
+	k_PAYPAL_PLAN_STATE_ACTIVE  = "ACTIVE"
+
+	k_PAYPAL_AGREEMENT_STATE_PENDING   = "Pending"
+	k_PAYPAL_AGREEMENT_STATE_ACTIVE    = "Active"
+	k_PAYPAL_AGREEMENT_STATE_CANCELLED = "Cancelled"
+
+	k_PAYPAL_PAYOUT_BATCH_STATUS_PENDING = "PENDING"
+	k_PAYPAL_PAYOUT_BATCH_STATUS_SUCCESS = "SUCCESS"
+	k_PAYPAL_PAYOUT_ITEM_STATUS_PENDING  = "PENDING"
+	k_PAYPAL_PAYOUT_ITEM_STATUS_SUCCESS  = "SUCCESS"
+
+	k_PAYPAL_DISPUTE_STATUS_WAITING_FOR_SELLER_RESPONSE = "WAITING_FOR_SELLER_RESPONSE"
+	k_PAYPAL_DISPUTE_STATUS_WAITING_FOR_BUYER_RESPONSE  = "WAITING_FOR_BUYER_RESPONSE"
+	k_PAYPAL_DISPUTE_STATUS_UNDER_REVIEW                = "UNDER_REVIEW"
+	k_PAYPAL_DISPUTE_STATUS_RESOLVED                    = "RESOLVED"
+
+	k_PAYPAL_DISPUTE_STAGE_INQUIRY    = "INQUIRY"
+	k_PAYPAL_DISPUTE_STAGE_CHARGEBACK = "CHARGEBACK"
+
+	k_PAYPAL_ORDER_STATUS_CREATED   = "CREATED"
+	k_PAYPAL_ORDER_STATUS_APPROVED  = "APPROVED"
+	k_PAYPAL_ORDER_STATUS_COMPLETED = "COMPLETED"
+
+	k_PAYPAL_V2_CAPTURE_STATUS_COMPLETED          = "COMPLETED"
+	k_PAYPAL_V2_CAPTURE_STATUS_PARTIALLY_REFUNDED = "PARTIALLY_REFUNDED"
+	k_PAYPAL_V2_CAPTURE_STATUS_REFUNDED           = "REFUNDED"
+
+	K_PAYPAL_EVENT_SALE_COMPLETED    = "PAYMENT.SALE.COMPLETED"
+	K_PAYPAL_EVENT_SALE_REFUNDED     = "PAYMENT.SALE.REFUNDED"
+	K_PAYPAL_EVENT_ORDER_APPROVED    = "CHECKOUT.ORDER.APPROVED"
+	K_PAYPAL_EVENT_CAPTURE_COMPLETED = "PAYMENT.CAPTURE.COMPLETED"
+	K_PAYPAL_EVENT_CAPTURE_REFUNDED  = "PAYMENT.CAPTURE.REFUNDED"
+
+	K_PAYPAL_EVENT_SUBSCRIPTION_CREATED   = "BILLING.SUBSCRIPTION.CREATED"
+	K_PAYPAL_EVENT_SUBSCRIPTION_CANCELLED = "BILLING.SUBSCRIPTION.CANCELLED"
+
+	K_PAYPAL_EVENT_PAYOUTS_ITEM_SUCCEEDED = "PAYMENT.PAYOUTS-ITEM.SUCCEEDED"
+	K_PAYPAL_EVENT_PAYOUTS_ITEM_FAILED    = "PAYMENT.PAYOUTS-ITEM.FAILED"
+
+	K_PAYPAL_EVENT_DISPUTE_CREATED  = "CUSTOMER.DISPUTE.CREATED"
+	K_PAYPAL_EVENT_DISPUTE_UPDATED  = "CUSTOMER.DISPUTE.UPDATED"
+	K_PAYPAL_EVENT_DISPUTE_RESOLVED = "CUSTOMER.DISPUTE.RESOLVED"
+)
+
+// PayPalServer 模拟 PayPal 的 REST API，支持 OAuth 获取 Token、Payments v1 接口、Orders v2 接口以及 Webhook 通知
+type PayPalServer struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	clientId      string
+	secret        string
+	tokens        map[string]struct{}
+	payments      map[string]*ppPayment
+	orders        map[string]*ppOrder
+	plans         map[string]*ppBillingPlan
+	agreements    map[string]*ppBillingAgreement // key 为创建签约协议时返回的 token
+	payouts       map[string]*ppBatchPayout      // key 为 payout_batch_id
+	disputes      map[string]*ppDispute          // key 为 dispute_id
+	requests      map[string][]byte              // key 为 PayPal-Request-Id，value 为第一次请求的响应
+	transmissions map[string]string              // key 为 transmission id，value 为 webhook id
+	seq           int
+
+	WebhookId  string // Webhook 的 ID，创建 PayPal 时作为 WebHookId 使用
+	WebhookURL string // 接收 Webhook 通知的 URL
+	PageSize   int    // 争议列表每页的数量，默认为 10
+}
+
+type ppLink struct {
+	Href   string `json:"href"`
+	Rel    string `json:"rel"`
+	Method string `json:"method"`
+}
+
+type ppPayerInfo struct {
+	Email   string `json:"email,omitempty"`
+	PayerId string `json:"payer_id,omitempty"`
+}
+
+type ppPayer struct {
+	PaymentMethod string       `json:"payment_method"`
+	PayerInfo     *ppPayerInfo `json:"payer_info,omitempty"`
+}
+
+type ppAmount struct {
+	Total    string          `json:"total"`
+	Currency string          `json:"currency"`
+	Details  json.RawMessage `json:"details,omitempty"`
+}
+
+type ppSale struct {
+	Id            string    `json:"id"`
+	State         string    `json:"state"`
+	Amount        *ppAmount `json:"amount"`
+	ParentPayment string    `json:"parent_payment"`
+	InvoiceNumber string    `json:"invoice_number,omitempty"`
+	CreateTime    string    `json:"create_time"`
+	refunded      float64
+}
+
+type ppRefund struct {
+	Id            string    `json:"id"`
+	State         string    `json:"state"`
+	Amount        *ppAmount `json:"amount"`
+	SaleId        string    `json:"sale_id"`
+	ParentPayment string    `json:"parent_payment"`
+	InvoiceNumber string    `json:"invoice_number,omitempty"`
+	CreateTime    string    `json:"create_time"`
+}
+
+// ppAuthorization intent 为 authorize 的付款执行之后创建的预授权
+type ppAuthorization struct {
+	Id            string    `json:"id"`
+	State         string    `json:"state"`
+	Amount        *ppAmount `json:"amount"`
+	ParentPayment string    `json:"parent_payment"`
+	InvoiceNumber string    `json:"invoice_number,omitempty"`
+	ValidUntil    string    `json:"valid_until"`
+	CreateTime    string    `json:"create_time"`
+	captured      float64
+}
+
+type ppAuthorizationCapture struct {
+	Id             string    `json:"id"`
+	State          string    `json:"state"`
+	Amount         *ppAmount `json:"amount"`
+	IsFinalCapture bool      `json:"is_final_capture"`
+	ParentPayment  string    `json:"parent_payment"`
+	InvoiceNumber  string    `json:"invoice_number,omitempty"`
+	CreateTime     string    `json:"create_time"`
+}
+
+type ppRelatedResource struct {
+	Sale          *ppSale                 `json:"sale,omitempty"`
+	Refund        *ppRefund               `json:"refund,omitempty"`
+	Authorization *ppAuthorization        `json:"authorization,omitempty"`
+	Capture       *ppAuthorizationCapture `json:"capture,omitempty"`
+}
+
+type ppTransaction struct {
+	Amount           *ppAmount            `json:"amount"`
+	Description      string               `json:"description,omitempty"`
+	InvoiceNumber    string               `json:"invoice_number,omitempty"`
+	ItemList         json.RawMessage      `json:"item_list,omitempty"`
+	RelatedResources []*ppRelatedResource `json:"related_resources"`
+}
+
+type ppPayment struct {
+	Id           string            `json:"id"`
+	Intent       string            `json:"intent"`
+	State        string            `json:"state"`
+	Payer        *ppPayer          `json:"payer"`
+	Transactions []*ppTransaction  `json:"transactions"`
+	RedirectURLs map[string]string `json:"redirect_urls,omitempty"`
+	CreateTime   string            `json:"create_time"`
+	Links        []*ppLink         `json:"links"`
+}
+
+type ppMoney struct {
+	CurrencyCode string          `json:"currency_code"`
+	Value        string          `json:"value"`
+	Breakdown    json.RawMessage `json:"breakdown,omitempty"`
+}
+
+type ppCapture struct {
+	Id                string                 `json:"id"`
+	Status            string                 `json:"status"`
+	Amount            *ppMoney               `json:"amount"`
+	InvoiceId         string                 `json:"invoice_id,omitempty"`
+	CreateTime        string                 `json:"create_time"`
+	SupplementaryData map[string]interface{} `json:"supplementary_data,omitempty"`
+	Links             []*ppLink              `json:"links,omitempty"`
+	refunds           []*ppCaptureRefund
+	refunded          float64
+}
+
+// ppCaptureRefund Orders v2 的退款，与 PayPal 一样只通过 up 链接关联 Capture
+type ppCaptureRefund struct {
+	Id         string    `json:"id"`
+	Status     string    `json:"status"`
+	Amount     *ppMoney  `json:"amount"`
+	InvoiceId  string    `json:"invoice_id,omitempty"`
+	CreateTime string    `json:"create_time"`
+	Links      []*ppLink `json:"links"`
+}
+
+type ppPurchaseUnit struct {
+	ReferenceId string          `json:"reference_id"`
+	InvoiceId   string          `json:"invoice_id,omitempty"`
+	Amount      *ppMoney        `json:"amount"`
+	Items       json.RawMessage `json:"items,omitempty"`
+	Shipping    json.RawMessage `json:"shipping,omitempty"`
+	Payments    *struct {
+		Captures []*ppCapture `json:"captures"`
+	} `json:"payments,omitempty"`
+}
+
+type ppOrderPayer struct {
+	PayerId      string `json:"payer_id"`
+	EmailAddress string `json:"email_address"`
+}
+
+type ppOrder struct {
+	Id            string            `json:"id"`
+	Intent        string            `json:"intent"`
+	Status        string            `json:"status"`
+	PurchaseUnits []*ppPurchaseUnit `json:"purchase_units"`
+	Payer         *ppOrderPayer     `json:"payer,omitempty"`
+	CreateTime    string            `json:"create_time"`
+	Links         []*ppLink         `json:"links"`
+}
+
+type ppMerchantPreferences struct {
+	ReturnURL               string `json:"return_url"`
+	CancelURL               string `json:"cancel_url"`
+	AutoBillAmount          string `json:"auto_bill_amount,omitempty"`
+	InitialFailAmountAction string `json:"initial_fail_amount_action,omitempty"`
+	MaxFailAttempts         string `json:"max_fail_attempts,omitempty"`
+}
+
+type ppBillingPlan struct {
+	Id                  string                 `json:"id,omitempty"`
+	Name                string                 `json:"name"`
+	Description         string                 `json:"description"`
+	Type                string                 `json:"type"`
+	State               string                 `json:"state,omitempty"`
+	PaymentDefinitions  json.RawMessage        `json:"payment_definitions,omitempty"`
+	MerchantPreferences *ppMerchantPreferences `json:"merchant_preferences,omitempty"`
+	CreateTime          string                 `json:"create_time,omitempty"`
+	Links               []*ppLink              `json:"links,omitempty"`
+}
+
+// ppBillingAgreement 用户确认并执行之前只有 token，执行之后才会分配 Id
+type ppBillingAgreement struct {
+	Id          string         `json:"id,omitempty"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	StartDate   string         `json:"start_date"`
+	State       string         `json:"state,omitempty"`
+	Plan        *ppBillingPlan `json:"plan"`
+	Payer       *ppPayer       `json:"payer"`
+	Links       []*ppLink      `json:"links,omitempty"`
+	token       string
+}
+
+type ppCurrency struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type ppSenderBatchHeader struct {
+	SenderBatchId string `json:"sender_batch_id"`
+	EmailSubject  string `json:"email_subject,omitempty"`
+}
+
+type ppBatchHeader struct {
+	PayoutBatchId     string               `json:"payout_batch_id"`
+	BatchStatus       string               `json:"batch_status"`
+	TimeCreated       string               `json:"time_created"`
+	SenderBatchHeader *ppSenderBatchHeader `json:"sender_batch_header"`
+}
+
+type ppPayoutItem struct {
+	RecipientType string      `json:"recipient_type"`
+	Amount        *ppCurrency `json:"amount"`
+	Note          string      `json:"note,omitempty"`
+	Receiver      string      `json:"receiver"`
+	SenderItemId  string      `json:"sender_item_id"`
+}
+
+type ppPayoutErrors struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+type ppPayoutItemDetail struct {
+	PayoutItemId      string          `json:"payout_item_id"`
+	TransactionId     string          `json:"transaction_id,omitempty"`
+	TransactionStatus string          `json:"transaction_status"`
+	PayoutBatchId     string          `json:"payout_batch_id"`
+	PayoutItem        *ppPayoutItem   `json:"payout_item"`
+	Errors            *ppPayoutErrors `json:"errors,omitempty"`
+	TimeProcessed     string          `json:"time_processed,omitempty"`
+}
+
+// ppBatchPayout 批量付款，创建之后所有付款的状态都是 PENDING，需要调用 ProcessPayout 模拟 PayPal 处理付款
+type ppBatchPayout struct {
+	BatchHeader *ppBatchHeader        `json:"batch_header"`
+	Items       []*ppPayoutItemDetail `json:"items"`
+}
+
+type ppDisputedTransaction struct {
+	SellerTransactionId string `json:"seller_transaction_id"`
+	InvoiceNumber       string `json:"invoice_number,omitempty"`
+}
+
+type ppDisputeOutcome struct {
+	OutcomeCode string `json:"outcome_code"`
+}
+
+type ppDisputeMessage struct {
+	PostedBy   string `json:"posted_by"`
+	TimePosted string `json:"time_posted"`
+	Content    string `json:"content"`
+}
+
+type ppTrackingInfo struct {
+	CarrierName    string `json:"carrier_name"`
+	TrackingNumber string `json:"tracking_number"`
+}
+
+type ppEvidenceInfo struct {
+	TrackingInfo []*ppTrackingInfo `json:"tracking_info,omitempty"`
+	RefundIds    []string          `json:"refund_ids,omitempty"`
+}
+
+type ppEvidence struct {
+	EvidenceType string          `json:"evidence_type"`
+	EvidenceInfo *ppEvidenceInfo `json:"evidence_info,omitempty"`
+	Notes        string          `json:"notes,omitempty"`
+}
+
+// ppDispute 买家发起的争议，创建之后处于 INQUIRY 阶段并等待商户处理，需要调用 ResolveDispute 模拟 PayPal 做出裁决
+type ppDispute struct {
+	DisputeId             string                   `json:"dispute_id"`
+	CreateTime            string                   `json:"create_time"`
+	UpdateTime            string                   `json:"update_time"`
+	DisputedTransactions  []*ppDisputedTransaction `json:"disputed_transactions"`
+	Reason                string                   `json:"reason"`
+	Status                string                   `json:"status"`
+	DisputeAmount         *ppCurrency              `json:"dispute_amount"`
+	DisputeOutcome        *ppDisputeOutcome        `json:"dispute_outcome,omitempty"`
+	DisputeLifeCycleStage string                   `json:"dispute_life_cycle_stage"`
+	SellerResponseDueDate string                   `json:"seller_response_due_date,omitempty"`
+	Messages              []*ppDisputeMessage      `json:"messages,omitempty"`
+	Evidences             []*ppEvidence            `json:"evidences,omitempty"`
+	created               time.Time
+}
+
+// NewPayPalServer 创建并启动 PayPal 模拟服务器
+func NewPayPalServer(clientId, secret string) *PayPalServer {
+	var s = &PayPalServer{}
+	s.clientId = clientId
+	s.secret = secret
+	s.tokens = make(map[string]struct{})
+	s.payments = make(map[string]*ppPayment)
+	s.orders = make(map[string]*ppOrder)
+	s.plans = make(map[string]*ppBillingPlan)
+	s.agreements = make(map[string]*ppBillingAgreement)
+	s.payouts = make(map[string]*ppBatchPayout)
+	s.disputes = make(map[string]*ppDispute)
+	s.requests = make(map[string][]byte)
+	s.transmissions = make(map[string]string)
+	s.WebhookId = "WH-" + strings.ToUpper(newNotifyId()[:16])
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/v1/oauth2/token", s.handleToken)
+	mux.HandleFunc("/v1/payments/payment", s.auth(s.handleCreatePayment))
+	mux.HandleFunc("/v1/payments/payment/", s.auth(s.handlePayment))
+	mux.HandleFunc("/v1/payments/sale/", s.auth(s.handleSale))
+	mux.HandleFunc("/v1/payments/authorization/", s.auth(s.handleAuthorization))
+	mux.HandleFunc("/v1/payments/billing-plans", s.auth(s.handleCreateBillingPlan))
+	mux.HandleFunc("/v1/payments/billing-plans/", s.auth(s.handleBillingPlan))
+	mux.HandleFunc("/v1/payments/billing-agreements", s.auth(s.handleCreateBillingAgreement))
+	mux.HandleFunc("/v1/payments/billing-agreements/", s.auth(s.handleBillingAgreement))
+	mux.HandleFunc("/v1/payments/payouts", s.auth(s.handleCreatePayout))
+	mux.HandleFunc("/v1/payments/payouts/", s.auth(s.handlePayout))
+	mux.HandleFunc("/v1/payments/payouts-item/", s.auth(s.handlePayoutItem))
+	mux.HandleFunc("/v1/customer/disputes", s.auth(s.handleListDisputes))
+	mux.HandleFunc("/v1/customer/disputes/", s.auth(s.handleDispute))
+	mux.HandleFunc("/v1/notifications/verify-webhook-signature", s.auth(s.handleVerifyWebhookSignature))
+	mux.HandleFunc("/v2/checkout/orders", s.auth(s.handleCreateOrder))
+	mux.HandleFunc("/v2/checkout/orders/", s.auth(s.handleOrder))
+	mux.HandleFunc("/v2/payments/captures/", s.auth(s.handleCapture))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Approve 模拟用户在 PayPal 页面上同意付款
+func (this *PayPalServer) Approve(paymentId, payerId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var payment = this.payments[paymentId]
+	if payment == nil {
+		return ErrTradeNotExist
+	}
+	payment.Payer.PayerInfo = &ppPayerInfo{PayerId: payerId, Email: strings.ToLower(payerId) + "@example.com"}
+	return nil
+}
+
+// Notify 将 Sale 相关的事件发送到 WebhookURL，eventType 为 K_PAYPAL_EVENT_SALE_COMPLETED 或 K_PAYPAL_EVENT_SALE_REFUNDED
+func (this *PayPalServer) Notify(paymentId, eventType string) error {
+	this.mu.Lock()
+	var payment = this.payments[paymentId]
+	if payment == nil {
+		this.mu.Unlock()
+		return ErrTradeNotExist
+	}
+	if len(payment.Transactions) == 0 || len(payment.Transactions[0].RelatedResources) == 0 {
+		this.mu.Unlock()
+		return errors.New("付款还没有执行")
+	}
+
+	var event map[string]interface{}
+	var resources = payment.Transactions[0].RelatedResources
+	switch eventType {
+	case K_PAYPAL_EVENT_SALE_COMPLETED:
+		event = newPayPalEvent(eventType, "sale", resources[0].Sale)
+	case K_PAYPAL_EVENT_SALE_REFUNDED:
+		var refund = resources[len(resources)-1].Refund
+		if refund == nil {
+			this.mu.Unlock()
+			return errors.New("付款没有退款")
+		}
+		event = newPayPalEvent(eventType, "refund", refund)
+	default:
+		this.mu.Unlock()
+		return fmt.Errorf("不支持的事件类型 %s", eventType)
+	}
+	this.mu.Unlock()
+
+	return this.sendWebhook(event)
+}
+
+// ApproveAgreement 模拟用户在 PayPal 页面上同意签约，token 为创建签约协议时 approval_url 中的 token
+func (this *PayPalServer) ApproveAgreement(token, payerId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var agreement = this.agreements[token]
+	if agreement == nil {
+		return errors.New("签约协议不存在")
+	}
+	if agreement.Id != "" {
+		return errors.New("签约协议已经执行")
+	}
+	agreement.Payer.PayerInfo = &ppPayerInfo{PayerId: payerId, Email: strings.ToLower(payerId) + "@example.com"}
+	return nil
+}
+
+// AgreementReturnURL 生成用户同意签约之后，浏览器跳转回商户页面时使用的 URL，即 Billing Plan 的 return_url 附加 token
+func (this *PayPalServer) AgreementReturnURL(token string) (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var agreement = this.agreements[token]
+	if agreement == nil {
+		return "", errors.New("签约协议不存在")
+	}
+	u, err := url.Parse(agreement.Plan.MerchantPreferences.ReturnURL)
+	if err != nil {
+		return "", err
+	}
+	var p = u.Query()
+	p.Set("token", token)
+	u.RawQuery = p.Encode()
+	return u.String(), nil
+}
+
+// NotifyAgreement 将签约协议相关的事件发送到 WebhookURL，eventType 为 K_PAYPAL_EVENT_SUBSCRIPTION_CREATED 或 K_PAYPAL_EVENT_SUBSCRIPTION_CANCELLED
+func (this *PayPalServer) NotifyAgreement(agreementId, eventType string) error {
+	if eventType != K_PAYPAL_EVENT_SUBSCRIPTION_CREATED && eventType != K_PAYPAL_EVENT_SUBSCRIPTION_CANCELLED {
+		return fmt.Errorf("不支持的事件类型 %s", eventType)
+	}
+
+	this.mu.Lock()
+	var agreement = this.findAgreement(agreementId)
+	if agreement == nil {
+		this.mu.Unlock()
+		return errors.New("签约协议不存在")
+	}
+	var event = newPayPalEvent(eventType, "Agreement", agreement)
+	this.mu.Unlock()
+
+	return this.sendWebhook(event)
+}
+
+// ProcessPayout 模拟 PayPal 处理批量付款中的一笔付款，status 为 SUCCESS、FAILED、UNCLAIMED 等付款状态，
+// 失败的付款会使用 errName 作为错误信息
+func (this *PayPalServer) ProcessPayout(payoutItemId, status, errName string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var batch, item = this.findPayoutItem(payoutItemId)
+	if item == nil {
+		return errors.New("付款不存在")
+	}
+	if item.TransactionStatus != k_PAYPAL_PAYOUT_ITEM_STATUS_PENDING {
+		return errors.New("付款已经处理")
+	}
+
+	this.seq++
+	item.TransactionStatus = status
+	item.TimeProcessed = time.Now().UTC().Format(time.RFC3339)
+	if status == k_PAYPAL_PAYOUT_ITEM_STATUS_SUCCESS {
+		item.TransactionId = fmt.Sprintf("%017dT", this.seq)
+	} else if errName != "" {
+		item.Errors = &ppPayoutErrors{Name: errName, Message: errName}
+	}
+
+	// 所有的付款都处理之后批量付款才会完成
+	for _, item := range batch.Items {
+		if item.TransactionStatus == k_PAYPAL_PAYOUT_ITEM_STATUS_PENDING {
+			return nil
+		}
+	}
+	batch.BatchHeader.BatchStatus = k_PAYPAL_PAYOUT_BATCH_STATUS_SUCCESS
+	return nil
+}
+
+// NotifyPayout 将付款的处理结果发送到 WebhookURL，付款成功时事件类型为 K_PAYPAL_EVENT_PAYOUTS_ITEM_SUCCEEDED，否则为 K_PAYPAL_EVENT_PAYOUTS_ITEM_FAILED
+func (this *PayPalServer) NotifyPayout(payoutItemId string) error {
+	this.mu.Lock()
+	var _, item = this.findPayoutItem(payoutItemId)
+	if item == nil || item.TransactionStatus == k_PAYPAL_PAYOUT_ITEM_STATUS_PENDING {
+		this.mu.Unlock()
+		return errors.New("付款还没有处理")
+	}
+	var eventType = K_PAYPAL_EVENT_PAYOUTS_ITEM_FAILED
+	if item.TransactionStatus == k_PAYPAL_PAYOUT_ITEM_STATUS_SUCCESS {
+		eventType = K_PAYPAL_EVENT_PAYOUTS_ITEM_SUCCEEDED
+	}
+	var event = newPayPalEvent(eventType, "payouts_item", item)
+	this.mu.Unlock()
+
+	return this.sendWebhook(event)
+}
+
+// OpenDispute 模拟买家对已完成的 Sale 发起争议，amount 为 0 或者超过 Sale 的金额时使用 Sale 的金额，返回争议的 ID
+func (this *PayPalServer) OpenDispute(saleId, reason string, amount float64) (disputeId string, err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var _, _, sale = this.findSale(saleId)
+	if sale == nil || sale.State == k_PAYPAL_SALE_STATE_REFUNDED {
+		return "", errors.New("Sale 不存在或者已经全额退款")
+	}
+	if total, _ := strconv.ParseFloat(sale.Amount.Total, 64); amount <= 0 || amount > total {
+		amount = total
+	}
+
+	this.seq++
+	var now = time.Now().UTC()
+	var dispute = &ppDispute{}
+	dispute.DisputeId = fmt.Sprintf("PP-D-%d", this.seq)
+	dispute.CreateTime = now.Format(time.RFC3339)
+	dispute.UpdateTime = dispute.CreateTime
+	dispute.DisputedTransactions = []*ppDisputedTransaction{{SellerTransactionId: sale.Id, InvoiceNumber: sale.InvoiceNumber}}
+	dispute.Reason = reason
+	dispute.Status = k_PAYPAL_DISPUTE_STATUS_WAITING_FOR_SELLER_RESPONSE
+	dispute.DisputeAmount = &ppCurrency{Value: fmt.Sprintf("%.2f", amount), Currency: sale.Amount.Currency}
+	dispute.DisputeLifeCycleStage = k_PAYPAL_DISPUTE_STAGE_INQUIRY
+	dispute.SellerResponseDueDate = now.Add(time.Hour * 24 * 20).Format(time.RFC3339)
+	dispute.created = now
+	this.disputes[dispute.DisputeId] = dispute
+	return dispute.DisputeId, nil
+}
+
+// ResolveDispute 模拟 PayPal 对争议做出裁决，outcome 为裁决结果，例如 RESOLVED_BUYER_FAVOUR、RESOLVED_SELLER_FAVOUR
+func (this *PayPalServer) ResolveDispute(disputeId, outcome string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var dispute = this.disputes[disputeId]
+	if dispute == nil {
+		return errors.New("争议不存在")
+	}
+	if dispute.Status == k_PAYPAL_DISPUTE_STATUS_RESOLVED {
+		return errors.New("争议已经解决")
+	}
+	this.resolveDispute(dispute, outcome)
+	return nil
+}
+
+// NotifyDispute 将争议相关的事件发送到 WebhookURL，eventType 为 K_PAYPAL_EVENT_DISPUTE_* 中的一个
+func (this *PayPalServer) NotifyDispute(disputeId, eventType string) error {
+	if eventType != K_PAYPAL_EVENT_DISPUTE_CREATED && eventType != K_PAYPAL_EVENT_DISPUTE_UPDATED && eventType != K_PAYPAL_EVENT_DISPUTE_RESOLVED {
+		return fmt.Errorf("不支持的事件类型 %s", eventType)
+	}
+
+	this.mu.Lock()
+	var dispute = this.disputes[disputeId]
+	if dispute == nil {
+		this.mu.Unlock()
+		return errors.New("争议不存在")
+	}
+	var event = newPayPalEvent(eventType, "dispute", dispute)
+	this.mu.Unlock()
+
+	return this.sendWebhook(event)
+}
+
+// ApproveOrder 模拟用户在 PayPal 页面上确认 Orders v2 的订单
+func (this *PayPalServer) ApproveOrder(orderId, payerId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var order = this.orders[orderId]
+	if order == nil {
+		return ErrTradeNotExist
+	}
+	if order.Status != k_PAYPAL_ORDER_STATUS_CREATED {
+		return errors.New("订单已经确认")
+	}
+	order.Status = k_PAYPAL_ORDER_STATUS_APPROVED
+	order.Payer = &ppOrderPayer{PayerId: payerId, EmailAddress: strings.ToLower(payerId) + "@example.com"}
+	return nil
+}
+
+// RefundOrder 模拟商户在 PayPal 后台对 Orders v2 的订单退款，amount 为 0 时全额退款
+func (this *PayPalServer) RefundOrder(orderId string, amount float64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var capture = this.orderCapture(orderId)
+	if capture == nil {
+		return errors.New("订单还没有扣款")
+	}
+	_, err := this.refundCapture(capture, amount)
+	return err
+}
+
+func (this *PayPalServer) orderCapture(orderId string) *ppCapture {
+	var order = this.orders[orderId]
+	if order == nil || len(order.PurchaseUnits) == 0 {
+		return nil
+	}
+	var unit = order.PurchaseUnits[0]
+	if unit.Payments == nil || len(unit.Payments.Captures) == 0 {
+		return nil
+	}
+	return unit.Payments.Captures[0]
+}
+
+func (this *PayPalServer) refundCapture(capture *ppCapture, amount float64) (*ppCaptureRefund, error) {
+	var total, _ = strconv.ParseFloat(capture.Amount.Value, 64)
+	if amount <= 0 {
+		amount = total - capture.refunded
+	}
+	if amount <= 0 || capture.refunded+amount > total+0.001 {
+		return nil, errors.New("退款金额超过交易金额")
+	}
+
+	capture.refunded += amount
+	capture.Status = k_PAYPAL_V2_CAPTURE_STATUS_PARTIALLY_REFUNDED
+	if capture.refunded >= total-0.001 {
+		capture.Status = k_PAYPAL_V2_CAPTURE_STATUS_REFUNDED
+	}
+
+	this.seq++
+	var refund = &ppCaptureRefund{}
+	refund.Id = fmt.Sprintf("%016dR", this.seq)
+	refund.Status = k_PAYPAL_V2_CAPTURE_STATUS_COMPLETED
+	refund.Amount = &ppMoney{CurrencyCode: capture.Amount.CurrencyCode, Value: fmt.Sprintf("%.2f", amount)}
+	refund.InvoiceId = capture.InvoiceId
+	refund.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	refund.Links = []*ppLink{
+		{Href: this.URL + "/v2/payments/refunds/" + refund.Id, Rel: "self", Method: "GET"},
+		{Href: this.URL + "/v2/payments/captures/" + capture.Id, Rel: "up", Method: "GET"},
+	}
+	capture.refunds = append(capture.refunds, refund)
+	return refund, nil
+}
+
+// NotifyOrder 将 Orders v2 相关的事件发送到 WebhookURL，eventType 为 K_PAYPAL_EVENT_ORDER_APPROVED、
+// K_PAYPAL_EVENT_CAPTURE_COMPLETED 或 K_PAYPAL_EVENT_CAPTURE_REFUNDED
+func (this *PayPalServer) NotifyOrder(orderId, eventType string) error {
+	this.mu.Lock()
+	var order = this.orders[orderId]
+	if order == nil {
+		this.mu.Unlock()
+		return ErrTradeNotExist
+	}
+
+	var event map[string]interface{}
+	switch eventType {
+	case K_PAYPAL_EVENT_ORDER_APPROVED:
+		event = newPayPalEvent(eventType, "checkout-order", order)
+	case K_PAYPAL_EVENT_CAPTURE_COMPLETED, K_PAYPAL_EVENT_CAPTURE_REFUNDED:
+		var capture = this.orderCapture(orderId)
+		if capture == nil {
+			this.mu.Unlock()
+			return errors.New("订单还没有扣款")
+		}
+		if eventType == K_PAYPAL_EVENT_CAPTURE_COMPLETED {
+			event = newPayPalEvent(eventType, "capture", capture)
+			break
+		}
+		if len(capture.refunds) == 0 {
+			this.mu.Unlock()
+			return errors.New("订单没有退款")
+		}
+		event = newPayPalEvent(eventType, "refund", capture.refunds[len(capture.refunds)-1])
+	default:
+		this.mu.Unlock()
+		return fmt.Errorf("不支持的事件类型 %s", eventType)
+	}
+	this.mu.Unlock()
+
+	return this.sendWebhook(event)
+}
+
+// sendWebhook 将事件发送到 WebhookURL，签名相关的 Header 只有 PayPalServer 能够验证
+func (this *PayPalServer) sendWebhook(event map[string]interface{}) error {
+	this.mu.Lock()
+	var transmissionId = newNotifyId()
+	this.transmissions[transmissionId] = this.WebhookId
+	var webhookURL = this.WebhookURL
+	this.mu.Unlock()
+
+	if webhookURL == "" {
+		return errors.New("没有设置 WebhookURL")
+	}
+
+	req, err := newPayPalWebhookRequest(webhookURL, transmissionId, this.URL+"/v1/notifications/certs/CERT-360caa42-fca2a594-1d93a270", event)
+	if err != nil {
+		return err
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("商户没有确认接收到通知: %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+func (this *PayPalServer) handleToken(w http.ResponseWriter, req *http.Request) {
+	clientId, secret, ok := req.BasicAuth()
+	if ok == false || clientId != this.clientId || secret != this.secret {
+		this.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client", "error_description": "Client Authentication failed"})
+		return
+	}
+
+	var token = "A21AA" + newNotifyId()
+	this.mu.Lock()
+	this.tokens[token] = struct{}{}
+	this.mu.Unlock()
+
+	this.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"scope":        "https://uri.paypal.com/services/payments/payment",
+		"access_token": token,
+		"token_type":   "Bearer",
+		"app_id":       "APP-80W284485P519543T",
+		"expires_in":   32400,
+		"nonce":        time.Now().UTC().Format(time.RFC3339) + newNotifyId(),
+	})
+}
+
+func (this *PayPalServer) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		this.mu.Lock()
+		_, ok := this.tokens[token]
+		this.mu.Unlock()
+
+		if ok == false {
+			this.writeError(w, http.StatusUnauthorized, "AUTHENTICATION_FAILURE", "Authentication failed due to invalid authentication credentials or a missing Authorization header.")
+			return
+		}
+		next(w, req)
+	}
+}
+
+func (this *PayPalServer) handleCreatePayment(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		this.writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_SUPPORTED", "The server does not implement the requested HTTP method.")
+		return
+	}
+
+	var payment = &ppPayment{}
+	if err := json.NewDecoder(req.Body).Decode(payment); err != nil {
+		this.writeError(w, http.StatusBadRequest, "MALFORMED_REQUEST", err.Error())
+		return
+	}
+	if payment.Payer == nil || len(payment.Transactions) == 0 || payment.Transactions[0].Amount == nil {
+		this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Invalid request - see details")
+		return
+	}
+
+	this.mu.Lock()
+	this.seq++
+	payment.Id = fmt.Sprintf("PAY-%020d", this.seq)
+	payment.State = k_PAYPAL_PAYMENT_STATE_CREATED
+	payment.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	payment.Links = []*ppLink{
+		{Href: this.URL + "/v1/payments/payment/" + payment.Id, Rel: "self", Method: "GET"},
+		{Href: this.URL + "/cgi-bin/webscr?cmd=_express-checkout&token=EC-" + strconv.Itoa(this.seq) + "&paymentId=" + payment.Id, Rel: "approval_url", Method: "REDIRECT"},
+		{Href: this.URL + "/v1/payments/payment/" + payment.Id + "/execute", Rel: "execute", Method: "POST"},
+	}
+	for _, trans := range payment.Transactions {
+		trans.RelatedResources = []*ppRelatedResource{}
+	}
+	this.payments[payment.Id] = payment
+	body, _ := json.Marshal(payment)
+	this.mu.Unlock()
+
+	this.writeRaw(w, http.StatusCreated, body)
+}
+
+func (this *PayPalServer) handlePayment(w http.ResponseWriter, req *http.Request) {
+	var path = strings.TrimPrefix(req.URL.Path, "/v1/payments/payment/")
+	var paymentId = strings.TrimSuffix(path, "/execute")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var payment = this.payments[paymentId]
+	if payment == nil {
+		this.writeError(w, http.StatusNotFound, "INVALID_RESOURCE_ID", "Requested resource ID was not found.")
+		return
+	}
+
+	if strings.HasSuffix(path, "/execute") {
+		var param = struct {
+			PayerId string `json:"payer_id"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&param)
+
+		if payment.Payer.PayerInfo == nil || payment.Payer.PayerInfo.PayerId != param.PayerId {
+			this.writeError(w, http.StatusBadRequest, "PAYMENT_NOT_APPROVED_FOR_EXECUTION", "Payer has not approved payment")
+			return
+		}
+		if payment.State != k_PAYPAL_PAYMENT_STATE_CREATED {
+			this.writeError(w, http.StatusBadRequest, "PAYMENT_ALREADY_DONE", "Payment has been done already for this cart.")
+			return
+		}
+
+		payment.State = k_PAYPAL_PAYMENT_STATE_APPROVED
+		for _, trans := range payment.Transactions {
+			this.seq++
+			// intent 为 authorize 的付款只创建预授权，需要通过 /v1/payments/authorization/{id}/capture 扣款
+			if payment.Intent == k_PAYPAL_PAYMENT_INTENT_AUTHORIZE {
+				var auth = &ppAuthorization{}
+				auth.Id = fmt.Sprintf("%017dA", this.seq)
+				auth.State = k_PAYPAL_AUTHORIZATION_STATE_AUTHORIZED
+				auth.Amount = &ppAmount{Total: trans.Amount.Total, Currency: trans.Amount.Currency}
+				auth.ParentPayment = payment.Id
+				auth.InvoiceNumber = trans.InvoiceNumber
+				auth.ValidUntil = time.Now().AddDate(0, 0, 29).UTC().Format(time.RFC3339)
+				auth.CreateTime = time.Now().UTC().Format(time.RFC3339)
+				trans.RelatedResources = append(trans.RelatedResources, &ppRelatedResource{Authorization: auth})
+				continue
+			}
+			var sale = &ppSale{}
+			sale.Id = fmt.Sprintf("%017dS", this.seq)
+			sale.State = k_PAYPAL_SALE_STATE_COMPLETED
+			sale.Amount = &ppAmount{Total: trans.Amount.Total, Currency: trans.Amount.Currency}
+			sale.ParentPayment = payment.Id
+			sale.InvoiceNumber = trans.InvoiceNumber
+			sale.CreateTime = time.Now().UTC().Format(time.RFC3339)
+			trans.RelatedResources = append(trans.RelatedResources, &ppRelatedResource{Sale: sale})
+		}
+	}
+
+	body, _ := json.Marshal(payment)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+func (this *PayPalServer) findSale(saleId string) (*ppPayment, *ppTransaction, *ppSale) {
+	for _, payment := range this.payments {
+		for _, trans := range payment.Transactions {
+			for _, res := range trans.RelatedResources {
+				if res.Sale != nil && res.Sale.Id == saleId {
+					return payment, trans, res.Sale
+				}
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+func (this *PayPalServer) handleSale(w http.ResponseWriter, req *http.Request) {
+	var path = strings.TrimPrefix(req.URL.Path, "/v1/payments/sale/")
+	var saleId = strings.TrimSuffix(path, "/refund")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var payment, trans, sale = this.findSale(saleId)
+	if sale == nil {
+		this.writeError(w, http.StatusNotFound, "INVALID_RESOURCE_ID", "Requested resource ID was not found.")
+		return
+	}
+
+	if strings.HasSuffix(path, "/refund") == false {
+		body, _ := json.Marshal(sale)
+		this.writeRaw(w, http.StatusOK, body)
+		return
+	}
+
+	var param = struct {
+		Amount        *ppAmount `json:"amount"`
+		InvoiceNumber string    `json:"invoice_number"`
+	}{}
+	json.NewDecoder(req.Body).Decode(&param)
+
+	var total, _ = strconv.ParseFloat(sale.Amount.Total, 64)
+	var amount = total - sale.refunded
+	if param.Amount != nil {
+		amount, _ = strconv.ParseFloat(param.Amount.Total, 64)
+	}
+	if amount <= 0 || sale.refunded+amount > total+0.001 {
+		this.writeError(w, http.StatusBadRequest, "REFUND_EXCEEDED_TRANSACTION_AMOUNT", "Refund amount exceeded transaction amount")
+		return
+	}
+
+	sale.refunded += amount
+	sale.State = k_PAYPAL_SALE_STATE_PARTIALLY_REFUNDED
+	if sale.refunded >= total-0.001 {
+		sale.State = k_PAYPAL_SALE_STATE_REFUNDED
+	}
+
+	this.seq++
+	var refund = &ppRefund{}
+	refund.Id = fmt.Sprintf("%017dR", this.seq)
+	refund.State = k_PAYPAL_SALE_STATE_COMPLETED
+	refund.Amount = &ppAmount{Total: fmt.Sprintf("-%.2f", amount), Currency: sale.Amount.Currency}
+	refund.SaleId = sale.Id
+	refund.ParentPayment = payment.Id
+	refund.InvoiceNumber = sale.InvoiceNumber
+	refund.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	trans.RelatedResources = append(trans.RelatedResources, &ppRelatedResource{Refund: refund})
+
+	body, _ := json.Marshal(refund)
+	this.writeRaw(w, http.StatusCreated, body)
+}
+
+func (this *PayPalServer) findAuthorization(authorizationId string) (*ppTransaction, *ppAuthorization) {
+	for _, payment := range this.payments {
+		for _, trans := range payment.Transactions {
+			for _, res := range trans.RelatedResources {
+				if res.Authorization != nil && res.Authorization.Id == authorizationId {
+					return trans, res.Authorization
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (this *PayPalServer) handleAuthorization(w http.ResponseWriter, req *http.Request) {
+	var path = strings.TrimPrefix(req.URL.Path, "/v1/payments/authorization/")
+	var authorizationId = strings.TrimSuffix(strings.TrimSuffix(path, "/capture"), "/void")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var trans, auth = this.findAuthorization(authorizationId)
+	if auth == nil {
+		this.writeError(w, http.StatusNotFound, "INVALID_RESOURCE_ID", "Requested resource ID was not found.")
+		return
+	}
+
+	var capturable = auth.State == k_PAYPAL_AUTHORIZATION_STATE_AUTHORIZED || auth.State == k_PAYPAL_AUTHORIZATION_STATE_PARTIALLY_CAPTURED
+
+	switch {
+	case strings.HasSuffix(path, "/void"):
+		if capturable == false {
+			this.writeError(w, http.StatusBadRequest, "AUTHORIZATION_ALREADY_COMPLETED", "Authorization has been previously captured or voided.")
+			return
+		}
+		auth.State = k_PAYPAL_AUTHORIZATION_STATE_VOIDED
+	case strings.HasSuffix(path, "/capture"):
+		if capturable == false {
+			this.writeError(w, http.StatusBadRequest, "AUTHORIZATION_ALREADY_COMPLETED", "Authorization has been previously captured or voided.")
+			return
+		}
+
+		var param = struct {
+			Amount         *ppAmount `json:"amount"`
+			IsFinalCapture bool      `json:"is_final_capture"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&param)
+
+		if param.Amount == nil || param.Amount.Currency != auth.Amount.Currency {
+			this.writeError(w, http.StatusBadRequest, "CURRENCY_MISMATCH", "Currency of capture must be the same as currency of authorization.")
+			return
+		}
+		var total, _ = strconv.ParseFloat(auth.Amount.Total, 64)
+		var amount, _ = strconv.ParseFloat(param.Amount.Total, 64)
+		if amount <= 0 || auth.captured+amount > total+0.001 {
+			this.writeError(w, http.StatusBadRequest, "CAPTURE_AMOUNT_LIMIT_EXCEEDED", "Capture amount exceeds allowable limit.")
+			return
+		}
+
+		auth.captured += amount
+		auth.State = k_PAYPAL_AUTHORIZATION_STATE_PARTIALLY_CAPTURED
+		if param.IsFinalCapture || auth.captured >= total-0.001 {
+			auth.State = k_PAYPAL_AUTHORIZATION_STATE_CAPTURED
+		}
+
+		this.seq++
+		var capture = &ppAuthorizationCapture{}
+		capture.Id = fmt.Sprintf("%017dC", this.seq)
+		capture.State = k_PAYPAL_SALE_STATE_COMPLETED
+		capture.Amount = &ppAmount{Total: fmt.Sprintf("%.2f", amount), Currency: auth.Amount.Currency}
+		capture.IsFinalCapture = auth.State == k_PAYPAL_AUTHORIZATION_STATE_CAPTURED
+		capture.ParentPayment = auth.ParentPayment
+		capture.InvoiceNumber = auth.InvoiceNumber
+		capture.CreateTime = time.Now().UTC().Format(time.RFC3339)
+		trans.RelatedResources = append(trans.RelatedResources, &ppRelatedResource{Capture: capture})
+
+		body, _ := json.Marshal(capture)
+		this.writeRaw(w, http.StatusCreated, body)
+		return
+	}
+
+	body, _ := json.Marshal(auth)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+func (this *PayPalServer) handleCreateBillingPlan(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		this.writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_SUPPORTED", "The server does not implement the requested HTTP method.")
+		return
+	}
+
+	var plan = &ppBillingPlan{}
+	if err := json.NewDecoder(req.Body).Decode(plan); err != nil {
+		this.writeError(w, http.StatusBadRequest, "MALFORMED_REQUEST", err.Error())
+		return
+	}
+	if plan.Name == "" || len(plan.PaymentDefinitions) == 0 || plan.MerchantPreferences == nil || plan.MerchantPreferences.ReturnURL == "" {
+		this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Invalid request - see details")
+		return
+	}
+
+	this.mu.Lock()
+	this.seq++
+	plan.Id = fmt.Sprintf("P-%024d", this.seq)
+	plan.State = k_PAYPAL_PLAN_STATE_CREATED
+	plan.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	plan.Links = []*ppLink{{Href: this.URL + "/v1/payments/billing-plans/" + plan.Id, Rel: "self", Method: "GET"}}
+	this.plans[plan.Id] = plan
+	body, _ := json.Marshal(plan)
+	this.mu.Unlock()
+
+	this.writeRaw(w, http.StatusCreated, body)
+}
+
+// handleBillingPlan 查询 Billing Plan，或者通过 PATCH 修改 Billing Plan 的状态
+func (this *PayPalServer) handleBillingPlan(w http.ResponseWriter, req *http.Request) {
+	var planId = strings.TrimPrefix(req.URL.Path, "/v1/payments/billing-plans/")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var plan = this.plans[planId]
+	if plan == nil {
+		this.writeError(w, http.StatusNotFound, "INVALID_RESOURCE_ID", "Requested resource ID was not found.")
+		return
+	}
+
+	if req.Method == http.MethodPatch {
+		var patches = []struct {
+			Op    string `json:"op"`
+			Path  string `json:"path"`
+			Value struct {
+				State string `json:"state"`
+			} `json:"value"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&patches); err != nil {
+			this.writeError(w, http.StatusBadRequest, "MALFORMED_REQUEST", err.Error())
+			return
+		}
+		for _, patch := range patches {
+			if patch.Op != "replace" || patch.Path != "/" || patch.Value.State == "" {
+				this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Invalid request - see details")
+				return
+			}
+			plan.State = patch.Value.State
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	body, _ := json.Marshal(plan)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+func (this *PayPalServer) handleCreateBillingAgreement(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		this.writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_SUPPORTED", "The server does not implement the requested HTTP method.")
+		return
+	}
+
+	var agreement = &ppBillingAgreement{}
+	if err := json.NewDecoder(req.Body).Decode(agreement); err != nil {
+		this.writeError(w, http.StatusBadRequest, "MALFORMED_REQUEST", err.Error())
+		return
+	}
+	if agreement.Plan == nil || agreement.Payer == nil {
+		this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Invalid request - see details")
+		return
+	}
+	if startDate, err := time.Parse(time.RFC3339, agreement.StartDate); err != nil || startDate.Before(time.Now()) {
+		this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Agreement start date is required and should be in the future.")
+		return
+	}
+
+	this.mu.Lock()
+	var plan = this.plans[agreement.Plan.Id]
+	if plan == nil || plan.State != k_PAYPAL_PLAN_STATE_ACTIVE {
+		this.mu.Unlock()
+		this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Plan is not in active state.")
+		return
+	}
+
+	this.seq++
+	agreement.token = fmt.Sprintf("EC-%017d", this.seq)
+	agreement.State = k_PAYPAL_AGREEMENT_STATE_PENDING
+	agreement.Plan = plan
+	agreement.Links = []*ppLink{
+		{Href: this.URL + "/cgi-bin/webscr?cmd=_express-checkout&token=" + agreement.token, Rel: "approval_url", Method: "REDIRECT"},
+		{Href: this.URL + "/v1/payments/billing-agreements/" + agreement.token + "/agreement-execute", Rel: "execute", Method: "POST"},
+	}
+	this.agreements[agreement.token] = agreement
+	body, _ := json.Marshal(agreement)
+	this.mu.Unlock()
+
+	this.writeRaw(w, http.StatusCreated, body)
+}
+
+// handleBillingAgreement 处理 {token}/agreement-execute、{id} 以及 {id}/cancel
+func (this *PayPalServer) handleBillingAgreement(w http.ResponseWriter, req *http.Request) {
+	var path = strings.TrimPrefix(req.URL.Path, "/v1/payments/billing-agreements/")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if strings.HasSuffix(path, "/agreement-execute") {
+		var agreement = this.agreements[strings.TrimSuffix(path, "/agreement-execute")]
+		if agreement == nil || agreement.Id != "" {
+			this.writeError(w, http.StatusBadRequest, "INVALID_TOKEN", "The token is invalid or has been used.")
+			return
+		}
+		if agreement.Payer.PayerInfo == nil {
+			this.writeError(w, http.StatusBadRequest, "PAYMENT_NOT_APPROVED_FOR_EXECUTION", "Payer has not approved agreement")
+			return
+		}
+
+		this.seq++
+		agreement.Id = fmt.Sprintf("I-%012d", this.seq)
+		agreement.State = k_PAYPAL_AGREEMENT_STATE_ACTIVE
+		agreement.Links = []*ppLink{{Href: this.URL + "/v1/payments/billing-agreements/" + agreement.Id, Rel: "self", Method: "GET"}}
+
+		body, _ := json.Marshal(agreement)
+		this.writeRaw(w, http.StatusOK, body)
+		return
+	}
+
+	var agreement = this.findAgreement(strings.TrimSuffix(path, "/cancel"))
+	if agreement == nil {
+		this.writeError(w, http.StatusNotFound, "INVALID_PROFILE_ID", "The profile ID is invalid.")
+		return
+	}
+
+	if strings.HasSuffix(path, "/cancel") {
+		if agreement.State != k_PAYPAL_AGREEMENT_STATE_ACTIVE {
+			this.writeError(w, http.StatusBadRequest, "STATUS_INVALID", "Invalid profile status for cancel action; profile should be active or suspended.")
+			return
+		}
+		agreement.State = k_PAYPAL_AGREEMENT_STATE_CANCELLED
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	body, _ := json.Marshal(agreement)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+// findAgreement 按 Id 查找已经执行的签约协议
+func (this *PayPalServer) findAgreement(agreementId string) *ppBillingAgreement {
+	for _, agreement := range this.agreements {
+		if agreement.Id != "" && agreement.Id == agreementId {
+			return agreement
+		}
+	}
+	return nil
+}
+
+// handleCreatePayout 创建批量付款，sender_batch_id 不能重复
+func (this *PayPalServer) handleCreatePayout(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		this.writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_SUPPORTED", "The server does not implement the requested HTTP method.")
+		return
+	}
+
+	var param = struct {
+		SenderBatchHeader *ppSenderBatchHeader `json:"sender_batch_header"`
+		Items             []*ppPayoutItem      `json:"items"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&param); err != nil {
+		this.writeError(w, http.StatusBadRequest, "MALFORMED_REQUEST", err.Error())
+		return
+	}
+	if param.SenderBatchHeader == nil || param.SenderBatchHeader.SenderBatchId == "" || len(param.Items) == 0 {
+		this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Invalid request - see details")
+		return
+	}
+	for _, item := range param.Items {
+		var amount float64
+		if item.Amount != nil {
+			amount, _ = strconv.ParseFloat(item.Amount.Value, 64)
+		}
+		if item.Receiver == "" || amount <= 0 || item.Amount.Currency == "" {
+			this.writeError(w, http.StatusBadRequest, "VALIDATION_ERROR", "Invalid request - see details")
+			return
+		}
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, batch := range this.payouts {
+		if batch.BatchHeader.SenderBatchHeader.SenderBatchId == param.SenderBatchHeader.SenderBatchId {
+			this.writeError(w, http.StatusBadRequest, "USER_BUSINESS_ERROR", "Batch with given sender_batch_id already exists")
+			return
+		}
+	}
+
+	this.seq++
+	var batch = &ppBatchPayout{}
+	batch.BatchHeader = &ppBatchHeader{}
+	batch.BatchHeader.PayoutBatchId = fmt.Sprintf("%013dB", this.seq)
+	batch.BatchHeader.BatchStatus = k_PAYPAL_PAYOUT_BATCH_STATUS_PENDING
+	batch.BatchHeader.TimeCreated = time.Now().UTC().Format(time.RFC3339)
+	batch.BatchHeader.SenderBatchHeader = param.SenderBatchHeader
+	for _, item := range param.Items {
+		this.seq++
+		var detail = &ppPayoutItemDetail{}
+		detail.PayoutItemId = fmt.Sprintf("%013dI", this.seq)
+		detail.TransactionStatus = k_PAYPAL_PAYOUT_ITEM_STATUS_PENDING
+		detail.PayoutBatchId = batch.BatchHeader.PayoutBatchId
+		detail.PayoutItem = item
+		batch.Items = append(batch.Items, detail)
+	}
+	this.payouts[batch.BatchHeader.PayoutBatchId] = batch
+
+	body, _ := json.Marshal(map[string]interface{}{"batch_header": batch.BatchHeader})
+	this.writeRaw(w, http.StatusCreated, body)
+}
+
+func (this *PayPalServer) handlePayout(w http.ResponseWriter, req *http.Request) {
+	var batchId = strings.TrimPrefix(req.URL.Path, "/v1/payments/payouts/")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var batch = this.payouts[batchId]
+	if batch == nil {
+		this.writeError(w, http.StatusNotFound, "INVALID_RESOURCE_ID", "Requested resource ID was not found.")
+		return
+	}
+	body, _ := json.Marshal(batch)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+func (this *PayPalServer) handlePayoutItem(w http.ResponseWriter, req *http.Request) {
+	var itemId = strings.TrimPrefix(req.URL.Path, "/v1/payments/payouts-item/")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var _, item = this.findPayoutItem(itemId)
+	if item == nil {
+		this.writeError(w, http.StatusNotFound, "INVALID_RESOURCE_ID", "Requested resource ID was not found.")
+		return
+	}
+	body, _ := json.Marshal(item)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+func (this *PayPalServer) findPayoutItem(payoutItemId string) (*ppBatchPayout, *ppPayoutItemDetail) {
+	for _, batch := range this.payouts {
+		for _, item := range batch.Items {
+			if item.PayoutItemId == payoutItemId {
+				return batch, item
+			}
+		}
+	}
+	return nil, nil
+}
+
+// handleListDisputes 按创建时间倒序返回争议，支持 start_time 过滤，每页的数量由 page_size 或者 PageSize 决定，
+// 还有下一页时返回 rel 为 next 的链接
+func (this *PayPalServer) handleListDisputes(w http.ResponseWriter, req *http.Request) {
+	var query = req.URL.Query()
+	var startTime time.Time
+	if value := query.Get("start_time"); value != "" {
+		var err error
+		if startTime, err = time.Parse(time.RFC3339, value); err != nil {
+			this.writeIssue(w, "INVALID_START_TIME", "start_time 格式错误")
+			return
+		}
+	}
+	var pageSize, _ = strconv.Atoi(query.Get("page_size"))
+	if pageSize <= 0 {
+		pageSize = this.PageSize
+	}
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+	var offset, _ = strconv.Atoi(query.Get("next_page_token"))
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var disputes = make([]*ppDispute, 0, len(this.disputes))
+	for _, dispute := range this.disputes {
+		if dispute.created.Before(startTime) {
+			continue
+		}
+		disputes = append(disputes, dispute)
+	}
+	sort.Slice(disputes, func(i, j int) bool {
+		if disputes[i].created.Equal(disputes[j].created) {
+			return disputes[i].DisputeId > disputes[j].DisputeId
+		}
+		return disputes[i].created.After(disputes[j].created)
+	})
+
+	var result = struct {
+		Items []*ppDispute `json:"items"`
+		Links []*ppLink    `json:"links"`
+	}{Items: []*ppDispute{}}
+	if offset < len(disputes) {
+		var end = offset + pageSize
+		if end > len(disputes) {
+			end = len(disputes)
+		}
+		result.Items = disputes[offset:end]
+		if end < len(disputes) {
+			query.Set("next_page_token", strconv.Itoa(end))
+			result.Links = append(result.Links, &ppLink{Href: this.URL + "/v1/customer/disputes?" + query.Encode(), Rel: "next", Method: "GET"})
+		}
+	}
+	body, _ := json.Marshal(result)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+// handleDispute 处理 {id}、{id}/accept-claim、{id}/provide-evidence、{id}/send-message 以及 {id}/escalate，
+// 已经解决的争议不能再处理；只有 INQUIRY 阶段的争议可以向买家发送消息以及升级为索赔
+func (this *PayPalServer) handleDispute(w http.ResponseWriter, req *http.Request) {
+	var path = strings.TrimPrefix(req.URL.Path, "/v1/customer/disputes/")
+	var disputeId, action = path, ""
+	if i := strings.Index(path, "/"); i > 0 {
+		disputeId, action = path[:i], path[i+1:]
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var dispute = this.disputes[disputeId]
+	if dispute == nil {
+		this.writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "The specified resource does not exist.")
+		return
+	}
+	if action == "" {
+		body, _ := json.Marshal(dispute)
+		this.writeRaw(w, http.StatusOK, body)
+		return
+	}
+	if req.Method != http.MethodPost {
+		this.writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_SUPPORTED", "The server does not implement the requested HTTP method.")
+		return
+	}
+	if dispute.Status == k_PAYPAL_DISPUTE_STATUS_RESOLVED {
+		this.writeIssue(w, "DISPUTE_RESOLVED", "The dispute has been resolved.")
+		return
+	}
+
+	var param = struct {
+		Note      string        `json:"note"`
+		Message   string        `json:"message"`
+		Evidences []*ppEvidence `json:"evidences"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&param); err != nil {
+		this.writeError(w, http.StatusBadRequest, "MALFORMED_REQUEST", err.Error())
+		return
+	}
+
+	var now = time.Now().UTC().Format(time.RFC3339)
+	switch action {
+	case "accept-claim":
+		// 接受索赔之后争议金额会退还给买家
+		if _, _, sale := this.findSale(dispute.DisputedTransactions[0].SellerTransactionId); sale != nil {
+			var total, _ = strconv.ParseFloat(sale.Amount.Total, 64)
+			var amount, _ = strconv.ParseFloat(dispute.DisputeAmount.Value, 64)
+			sale.refunded += amount
+			sale.State = k_PAYPAL_SALE_STATE_PARTIALLY_REFUNDED
+			if sale.refunded >= total-0.001 {
+				sale.State = k_PAYPAL_SALE_STATE_REFUNDED
+			}
+		}
+		this.resolveDispute(dispute, "RESOLVED_BUYER_FAVOUR")
+	case "provide-evidence":
+		if dispute.Status != k_PAYPAL_DISPUTE_STATUS_WAITING_FOR_SELLER_RESPONSE {
+			this.writeIssue(w, "NOT_ELIGIBLE_TO_PROVIDE_EVIDENCE", "The dispute is not waiting for seller response.")
+			return
+		}
+		if len(param.Evidences) == 0 {
+			this.writeIssue(w, "MISSING_EVIDENCE", "At least one evidence is required.")
+			return
+		}
+		for _, evidence := range param.Evidences {
+			var info = evidence.EvidenceInfo
+			switch evidence.EvidenceType {
+			case "PROOF_OF_FULFILLMENT":
+				if info == nil || len(info.TrackingInfo) == 0 || info.TrackingInfo[0].TrackingNumber == "" {
+					this.writeIssue(w, "MISSING_TRACKING_INFO", "Tracking info is required for PROOF_OF_FULFILLMENT.")
+					return
+				}
+			case "PROOF_OF_REFUND":
+				if info == nil || len(info.RefundIds) == 0 || info.RefundIds[0] == "" {
+					this.writeIssue(w, "MISSING_REFUND_ID", "Refund id is required for PROOF_OF_REFUND.")
+					return
+				}
+			case "OTHER":
+			default:
+				this.writeIssue(w, "INVALID_EVIDENCE_TYPE", "The evidence type is invalid.")
+				return
+			}
+		}
+		dispute.Evidences = append(dispute.Evidences, param.Evidences...)
+		dispute.Status = k_PAYPAL_DISPUTE_STATUS_UNDER_REVIEW
+	case "send-message":
+		if dispute.DisputeLifeCycleStage != k_PAYPAL_DISPUTE_STAGE_INQUIRY || param.Message == "" {
+			this.writeIssue(w, "NOT_ELIGIBLE_TO_SEND_MESSAGE", "Messages can only be sent in the inquiry stage.")
+			return
+		}
+		dispute.Messages = append(dispute.Messages, &ppDisputeMessage{PostedBy: "SELLER", TimePosted: now, Content: param.Message})
+		dispute.Status = k_PAYPAL_DISPUTE_STATUS_WAITING_FOR_BUYER_RESPONSE
+	case "escalate":
+		if dispute.DisputeLifeCycleStage != k_PAYPAL_DISPUTE_STAGE_INQUIRY {
+			this.writeIssue(w, "NOT_ELIGIBLE_TO_ESCALATE", "Only disputes in the inquiry stage can be escalated.")
+			return
+		}
+		dispute.DisputeLifeCycleStage = k_PAYPAL_DISPUTE_STAGE_CHARGEBACK
+		dispute.Status = k_PAYPAL_DISPUTE_STATUS_UNDER_REVIEW
+	default:
+		this.writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "The specified resource does not exist.")
+		return
+	}
+	dispute.UpdateTime = now
+
+	this.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"links": []*ppLink{{Href: this.URL + "/v1/customer/disputes/" + dispute.DisputeId, Rel: "self", Method: "GET"}},
+	})
+}
+
+func (this *PayPalServer) resolveDispute(dispute *ppDispute, outcome string) {
+	dispute.Status = k_PAYPAL_DISPUTE_STATUS_RESOLVED
+	dispute.DisputeOutcome = &ppDisputeOutcome{OutcomeCode: outcome}
+	dispute.UpdateTime = time.Now().UTC().Format(time.RFC3339)
+}
+
+func (this *PayPalServer) handleCreateOrder(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		this.writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_SUPPORTED", "The server does not implement the requested HTTP method.")
+		return
+	}
+
+	var order = &ppOrder{}
+	if err := json.NewDecoder(req.Body).Decode(order); err != nil {
+		this.writeError(w, http.StatusBadRequest, "MALFORMED_REQUEST_JSON", err.Error())
+		return
+	}
+	if order.Intent == "" || len(order.PurchaseUnits) == 0 || order.PurchaseUnits[0].Amount == nil {
+		this.writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Request is not well-formed, syntactically incorrect, or violates schema.")
+		return
+	}
+
+	this.mu.Lock()
+	this.seq++
+	order.Id = fmt.Sprintf("%016dO", this.seq)
+	order.Status = k_PAYPAL_ORDER_STATUS_CREATED
+	order.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	order.Links = []*ppLink{
+		{Href: this.URL + "/v2/checkout/orders/" + order.Id, Rel: "self", Method: "GET"},
+		{Href: this.URL + "/checkoutnow?token=" + order.Id, Rel: "approve", Method: "GET"},
+		{Href: this.URL + "/v2/checkout/orders/" + order.Id + "/capture", Rel: "capture", Method: "POST"},
+	}
+	for i, unit := range order.PurchaseUnits {
+		if unit.ReferenceId == "" {
+			unit.ReferenceId = "default"
+			if i > 0 {
+				unit.ReferenceId = strconv.Itoa(i)
+			}
+		}
+	}
+	this.orders[order.Id] = order
+	body, _ := json.Marshal(order)
+	this.mu.Unlock()
+
+	this.writeRaw(w, http.StatusCreated, body)
+}
+
+func (this *PayPalServer) handleOrder(w http.ResponseWriter, req *http.Request) {
+	var path = strings.TrimPrefix(req.URL.Path, "/v2/checkout/orders/")
+	var orderId = strings.TrimSuffix(path, "/capture")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var order = this.orders[orderId]
+	if order == nil {
+		this.writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "The specified resource does not exist.")
+		return
+	}
+
+	if strings.HasSuffix(path, "/capture") {
+		if req.Method != http.MethodPost {
+			this.writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_SUPPORTED", "The server does not implement the requested HTTP method.")
+			return
+		}
+		// 与 PayPal 一样，相同 PayPal-Request-Id 的请求返回第一次请求的结果
+		var requestId = req.Header.Get("PayPal-Request-Id")
+		if body, ok := this.requests[requestId]; ok && requestId != "" {
+			this.writeRaw(w, http.StatusCreated, body)
+			return
+		}
+		switch order.Status {
+		case k_PAYPAL_ORDER_STATUS_CREATED:
+			this.writeIssue(w, "ORDER_NOT_APPROVED", "Payer has not yet approved the Order for payment.")
+			return
+		case k_PAYPAL_ORDER_STATUS_COMPLETED:
+			this.writeIssue(w, "ORDER_ALREADY_CAPTURED", "Order already captured.If 'intent=CAPTURE' only one capture per order is allowed.")
+			return
+		}
+
+		order.Status = k_PAYPAL_ORDER_STATUS_COMPLETED
+		for _, unit := range order.PurchaseUnits {
+			this.seq++
+			var capture = &ppCapture{}
+			capture.Id = fmt.Sprintf("%016dC", this.seq)
+			capture.Status = k_PAYPAL_V2_CAPTURE_STATUS_COMPLETED
+			capture.Amount = &ppMoney{CurrencyCode: unit.Amount.CurrencyCode, Value: unit.Amount.Value}
+			capture.InvoiceId = unit.InvoiceId
+			capture.CreateTime = time.Now().UTC().Format(time.RFC3339)
+			capture.SupplementaryData = map[string]interface{}{"related_ids": map[string]string{"order_id": order.Id}}
+			capture.Links = []*ppLink{
+				{Href: this.URL + "/v2/payments/captures/" + capture.Id, Rel: "self", Method: "GET"},
+				{Href: this.URL + "/v2/payments/captures/" + capture.Id + "/refund", Rel: "refund", Method: "POST"},
+				{Href: this.URL + "/v2/checkout/orders/" + order.Id, Rel: "up", Method: "GET"},
+			}
+			unit.Payments = &struct {
+				Captures []*ppCapture `json:"captures"`
+			}{Captures: []*ppCapture{capture}}
+		}
+		body, _ := json.Marshal(order)
+		if requestId != "" {
+			this.requests[requestId] = body
+		}
+		this.writeRaw(w, http.StatusCreated, body)
+		return
+	}
+
+	body, _ := json.Marshal(order)
+	this.writeRaw(w, http.StatusOK, body)
+}
+
+func (this *PayPalServer) handleCapture(w http.ResponseWriter, req *http.Request) {
+	var path = strings.TrimPrefix(req.URL.Path, "/v2/payments/captures/")
+	var captureId = strings.TrimSuffix(path, "/refund")
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var capture *ppCapture
+	for orderId := range this.orders {
+		if c := this.orderCapture(orderId); c != nil && c.Id == captureId {
+			capture = c
+			break
+		}
+	}
+	if capture == nil {
+		this.writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "The specified resource does not exist.")
+		return
+	}
+
+	if strings.HasSuffix(path, "/refund") == false {
+		body, _ := json.Marshal(capture)
+		this.writeRaw(w, http.StatusOK, body)
+		return
+	}
+
+	// 与 PayPal 一样，相同 PayPal-Request-Id 的退款请求返回第一次退款的结果
+	var requestId = req.Header.Get("PayPal-Request-Id")
+	if body, ok := this.requests[requestId]; ok && requestId != "" {
+		this.writeRaw(w, http.StatusCreated, body)
+		return
+	}
+
+	var param = struct {
+		Amount *ppMoney `json:"amount"`
+	}{}
+	json.NewDecoder(req.Body).Decode(&param)
+
+	var amount float64
+	if param.Amount != nil {
+		amount, _ = strconv.ParseFloat(param.Amount.Value, 64)
+	}
+	refund, err := this.refundCapture(capture, amount)
+	if err != nil {
+		this.writeIssue(w, "REFUND_AMOUNT_EXCEEDED", err.Error())
+		return
+	}
+	body, _ := json.Marshal(refund)
+	if requestId != "" {
+		this.requests[requestId] = body
+	}
+	this.writeRaw(w, http.StatusCreated, body)
+}
+
+func (this *PayPalServer) handleVerifyWebhookSignature(w http.ResponseWriter, req *http.Request) {
+	var param = struct {
+		TransmissionId string `json:"transmission_id"`
+		WebhookId      string `json:"webhook_id"`
+	}{}
+	json.NewDecoder(req.Body).Decode(&param)
+
+	this.mu.Lock()
+	var webhookId, ok = this.transmissions[param.TransmissionId]
+	this.mu.Unlock()
+
+	var status = "FAILURE"
+	if ok && webhookId == param.WebhookId {
+		status = "SUCCESS"
+	}
+	this.writeJSON(w, http.StatusOK, map[string]string{"verification_status": status})
+}
+
+func (this *PayPalServer) writeError(w http.ResponseWriter, status int, name, message string) {
+	this.writeJSON(w, status, map[string]string{
+		"name":     name,
+		"message":  message,
+		"debug_id": newNotifyId()[:13],
+	})
+}
+
+// writeIssue 返回 Orders v2 的业务错误，与 PayPal 一样错误原因在 details 中
+func (this *PayPalServer) writeIssue(w http.ResponseWriter, issue, description string) {
+	this.writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+		"name":     "UNPROCESSABLE_ENTITY",
+		"message":  "The requested action could not be performed, semantically incorrect, or failed business validation.",
+		"debug_id": newNotifyId()[:13],
+		"details":  []map[string]string{{"issue": issue, "description": description}},
+	})
+}
+
+func (this *PayPalServer) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, _ := json.Marshal(v)
+	this.writeRaw(w, status, body)
+}
+
+func (this *PayPalServer) writeRaw(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
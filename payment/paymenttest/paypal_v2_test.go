@@ -0,0 +1,169 @@
+package paymenttest
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// PayPalV2 直接使用 PayPal 的 REST API，不依赖 SDK
+func TestPayPalV2(t *testing.T) {
+	var server = NewPayPalServer("client-id", "secret")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var notifications = make(chan *payment.Notification, 1)
+	var receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		noti, err := s.NotifyURLHandler(req, payment.WithFetchTrade())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		notifications <- noti
+	}))
+	defer receiver.Close()
+	server.WebhookURL = receiver.URL + "/pay/notify?channel=" + payment.K_CHANNEL_PAYPAL_V2
+
+	var pp = payment.NewPayPalV2("client-id", "secret", false, payment.WithBaseURL(server.URL))
+	pp.ReturnURL = receiver.URL + "/pay/return"
+	pp.CancelURL = receiver.URL + "/pay/cancel"
+	pp.WebHookId = server.WebhookId
+	s.RegisterChannel(pp)
+	s.RegisterChannel(payment.NewPayPal("client-id", "secret", false, payment.WithBaseURL(server.URL)))
+
+	var order = newOrder("P4001")
+	order.Currency = "USD"
+	approveURL, err := s.CreatePayment(payment.K_CHANNEL_PAYPAL_V2, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(approveURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orderId = u.Query().Get("token")
+	if orderId == "" {
+		t.Fatalf("确认付款的 URL 错误: %s", approveURL)
+	}
+
+	var returnRequest = func(orderNo string) *http.Request {
+		var q = url.Values{}
+		q.Set("channel", payment.K_CHANNEL_PAYPAL_V2)
+		if orderNo != "" {
+			q.Set("order_no", orderNo)
+		}
+		q.Set("token", orderId)
+		q.Set("PayerID", "PAYER1")
+		req, _ := http.NewRequest(http.MethodGet, pp.ReturnURL+"?"+q.Encode(), nil)
+		return req
+	}
+
+	if _, err = s.ReturnURLHandler(returnRequest("P4001")); err != payment.ErrPayerNotApproved {
+		t.Fatalf("用户没有确认付款时应该返回 ErrPayerNotApproved，实际为 %v", err)
+	}
+	server.ApproveOrder(orderId, "PAYER1")
+	for _, orderNo := range []string{"P4002", ""} {
+		if _, err = s.ReturnURLHandler(returnRequest(orderNo)); err != payment.ErrTradeMismatch {
+			t.Fatalf("订单号 %q 与订单不一致时应该返回 ErrTradeMismatch，实际为 %v", orderNo, err)
+		}
+	}
+
+	// 查询交易不会扣款
+	trade, err := s.GetTrade(payment.K_CHANNEL_PAYPAL_V2, orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess || trade.TradeStatus != k_PAYPAL_ORDER_STATUS_APPROVED || server.orders[orderId].Status != k_PAYPAL_ORDER_STATUS_APPROVED {
+		t.Fatalf("查询交易时不应该扣款: %+v", trade)
+	}
+
+	// 用户确认付款之后 ReturnHandler 会扣款
+	trade, err = s.ReturnURLHandler(returnRequest("P4001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trade.TradeSuccess == false || trade.TradeNo != orderId || trade.OrderNo != "P4001" || trade.PayerId != "PAYER1" || trade.TotalAmount != "20.00" || trade.Currency != "USD" {
+		t.Fatalf("交易信息错误: %+v", trade)
+	}
+	if trade, err = s.GetTrade(payment.K_CHANNEL_PAYPAL_V2, orderId); err != nil || trade.TradeSuccess == false {
+		t.Fatalf("查询交易错误: %+v, %v", trade, err)
+	}
+
+	// 重复扣款时 PayPal 根据 PayPal-Request-Id 返回第一次扣款的结果，没有相同的 PayPal-Request-Id 时返回 ORDER_ALREADY_CAPTURED
+	if trade, err = pp.CaptureOrder(orderId); err != nil || trade.TradeSuccess == false {
+		t.Fatalf("重复扣款错误: %+v, %v", trade, err)
+	}
+	server.mu.Lock()
+	delete(server.requests, orderId)
+	server.mu.Unlock()
+	if trade, err = pp.CaptureOrder(orderId); err != nil || trade.TradeSuccess == false {
+		t.Fatalf("订单已经扣款时应该返回订单，实际为 %+v, %v", trade, err)
+	}
+
+	if err = server.NotifyOrder(orderId, K_PAYPAL_EVENT_CAPTURE_COMPLETED); err != nil {
+		t.Fatal(err)
+	}
+	var noti = <-notifications
+	if noti.Channel != payment.K_CHANNEL_PAYPAL_V2 || noti.NotifyType != payment.K_NOTIFY_TYPE_TRADE || noti.TradeNo != orderId || noti.OrderNo != "P4001" {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+	if noti.Status != payment.K_TRADE_STATUS_SUCCESS || noti.TotalAmount != "20.00" || noti.PaidTime.IsZero() {
+		t.Fatalf("通知信息错误: %+v", noti)
+	}
+
+	// 退款通知中没有订单号（Order Id），需要通过 Capture 获取
+	if err = server.RefundOrder(orderId, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.NotifyOrder(orderId, K_PAYPAL_EVENT_CAPTURE_REFUNDED); err != nil {
+		t.Fatal(err)
+	}
+	noti = <-notifications
+	if noti.NotifyType != payment.K_NOTIFY_TYPE_REFUND || noti.TradeNo != orderId || noti.OrderNo != "P4001" || noti.RefundAmount != "5.00" || noti.Status != payment.K_TRADE_STATUS_REFUNDED || noti.RefundStatus != payment.K_REFUND_STATUS_SUCCESS {
+		t.Fatalf("退款通知信息错误: %+v", noti)
+	}
+	if noti.Trade == nil || noti.Trade.TradeNo != orderId || noti.TotalAmount != "20.00" {
+		t.Fatalf("退款通知没有查询交易: %+v", noti)
+	}
+
+	// 通过接口退款，使用退款单号作为 PayPal-Request-Id，重试不会重复退款
+	refund, err := s.Refund(payment.K_CHANNEL_PAYPAL_V2, &payment.RefundParam{TradeNo: orderId, RefundNo: "PR4001", Amount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Status != payment.K_REFUND_STATUS_SUCCESS || refund.TradeNo != orderId || refund.OrderNo != "P4001" || refund.RefundId == "" || refund.Amount != "3.00" {
+		t.Fatalf("退款信息错误: %+v", refund)
+	}
+	retry, err := pp.Refund(&payment.RefundParam{TradeNo: orderId, RefundNo: "PR4001", Amount: 3, Currency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.RefundId != refund.RefundId || server.orderCapture(orderId).refunded != 8 {
+		t.Fatalf("重复退款错误: %+v", retry)
+	}
+	if _, err = s.Refund(payment.K_CHANNEL_PAYPAL_V2, &payment.RefundParam{TradeNo: orderId, RefundNo: "PR4002", Amount: 12.01}); err == nil {
+		t.Fatal("累计退款金额超过交易金额时应该返回错误")
+	}
+	if _, err = s.Refund(payment.K_CHANNEL_PAYPAL_V2, &payment.RefundParam{TradeNo: orderId, Amount: 3}); err != payment.ErrUnknownRefund {
+		t.Fatalf("没有退款单号时应该返回 ErrUnknownRefund，实际为 %v", err)
+	}
+	if _, err = s.Refund(payment.K_CHANNEL_PAYPAL_V2, &payment.RefundParam{TradeNo: orderId, RefundNo: "PR4002"}); err != payment.ErrInvalidAmount {
+		t.Fatalf("退款金额为 0 时应该返回 ErrInvalidAmount，实际为 %v", err)
+	}
+
+	// 签名无法通过 PayPal 验证的通知，会计入验签失败的监控指标
+	var m = payment.NewExpvarMetrics("")
+	s.Use(payment.MetricsMiddleware(m))
+	req, err := newPayPalWebhookRequest(server.WebhookURL, newNotifyId(), server.URL+"/v1/notifications/certs/CERT", newPayPalEvent(K_PAYPAL_EVENT_CAPTURE_COMPLETED, "capture", map[string]string{"id": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.NotifyURLHandler(req); err != payment.ErrInvalidSignature {
+		t.Fatalf("签名错误时应该返回 ErrInvalidSignature，实际为 %v", err)
+	}
+	if v := m.Get(`payment_verify_failures_total{channel="paypal_v2",operation="NotifyURLHandler"}`); v == nil || v.String() != "1" {
+		t.Fatalf("验签失败的次数应该为 1，实际为 %v", v)
+	}
+}
@@ -0,0 +1,356 @@
+package paymenttest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func aliPayRequest(t *testing.T, s *AliPayServer, merchantKey, method string, biz map[string]string) map[string]interface{} {
+	var key, err = parsePrivateKey(merchantKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bizBytes, _ := json.Marshal(biz)
+
+	var p = url.Values{}
+	p.Set("app_id", "2016073100129537")
+	p.Set("method", method)
+	p.Set("charset", "utf-8")
+	p.Set("sign_type", "RSA2")
+	p.Set("timestamp", "2018-08-01 10:00:00")
+	p.Set("version", "1.0")
+	p.Set("notify_url", biz["notify_url"])
+	p.Set("biz_content", string(bizBytes))
+	sign, err := signAliPay(p, key, "sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Set("sign", sign)
+
+	rsp, err := http.PostForm(s.URL+k_ALIPAY_GATEWAY_PATH, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	var raw = make(map[string]json.RawMessage)
+	if err = json.NewDecoder(rsp.Body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+
+	var content = raw[strings.Replace(method, ".", "_", -1)+"_response"]
+	var rspSign string
+	json.Unmarshal(raw["sign"], &rspSign)
+
+	pubKey, _ := parsePublicKey(s.PublicKey)
+	if err = verifyRSA2(string(content), rspSign, pubKey); err != nil {
+		t.Fatalf("响应签名验证失败: %v", err)
+	}
+
+	var result = make(map[string]interface{})
+	json.Unmarshal(content, &result)
+	return result
+}
+
+func TestAliPayServer(t *testing.T) {
+	merchantKey, merchantPublicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewAliPayServer("2016073100129537", merchantPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var notified = false
+	var receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		var p = req.PostForm
+		pubKey, _ := parsePublicKey(s.PublicKey)
+		if err := verifyRSA2(signContent(p, "sign", "sign_type"), p.Get("sign"), pubKey); err != nil {
+			t.Errorf("通知签名验证失败: %v", err)
+			return
+		}
+
+		rsp, err := http.Get(s.URL + k_ALIPAY_GATEWAY_PATH + "?service=notify_verify&notify_id=" + p.Get("notify_id"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if string(body) != "true" {
+			t.Errorf("notify_verify 应该返回 true")
+			return
+		}
+
+		notified = p.Get("trade_status") == k_ALIPAY_TRADE_STATUS_TRADE_SUCCESS && p.Get("out_trade_no") == "A1001" && req.URL.Query().Get("channel") == "alipay"
+		w.Write([]byte("success"))
+	}))
+	defer receiver.Close()
+
+	var rsp = aliPayRequest(t, s, merchantKey, "alipay.trade.precreate", map[string]string{
+		"out_trade_no": "A1001",
+		"subject":      "test",
+		"total_amount": "10.00",
+		"notify_url":   receiver.URL + "/pay/notify?channel=alipay",
+	})
+	if rsp["code"] != "10000" || rsp["qr_code"] == "" {
+		t.Fatalf("创建订单失败: %v", rsp)
+	}
+
+	rsp = aliPayRequest(t, s, merchantKey, "alipay.trade.query", map[string]string{"out_trade_no": "A1001"})
+	if rsp["trade_status"] != k_ALIPAY_TRADE_STATUS_WAIT_BUYER_PAY {
+		t.Fatalf("交易状态错误: %v", rsp)
+	}
+
+	if err = s.Pay("A1001", "2088102175953034"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Notify("A1001"); err != nil {
+		t.Fatal(err)
+	}
+	if notified == false {
+		t.Fatal("没有收到正确的通知")
+	}
+
+	rsp = aliPayRequest(t, s, merchantKey, "alipay.trade.refund", map[string]string{"out_trade_no": "A1001", "refund_amount": "4.00"})
+	if rsp["code"] != "10000" || rsp["refund_fee"] != "4.00" {
+		t.Fatalf("退款失败: %v", rsp)
+	}
+	rsp = aliPayRequest(t, s, merchantKey, "alipay.trade.refund", map[string]string{"out_trade_no": "A1001", "refund_amount": "7.00"})
+	if rsp["code"] == "10000" {
+		t.Fatal("退款金额超过订单金额时应该失败")
+	}
+
+	// 使用其它的密钥签名的请求应该被拒绝
+	otherKey, _, _ := GenerateRSAKey(1024)
+	rsp = aliPayRequest(t, s, otherKey, "alipay.trade.query", map[string]string{"out_trade_no": "A1001"})
+	if rsp["sub_code"] != "isv.invalid-signature" {
+		t.Fatalf("签名错误的请求应该被拒绝: %v", rsp)
+	}
+}
+
+func wxPayRequest(t *testing.T, s *WXPayServer, path string, p url.Values) url.Values {
+	p.Set("appid", "wx0000000000000001")
+	p.Set("mch_id", "10000100")
+	p.Set("nonce_str", newNotifyId())
+	p.Set("sign_type", k_WXPAY_SIGN_TYPE_HMAC_SHA256)
+	p.Set("sign", signWXPay(p, "test-api-key-00000000000000000000", k_WXPAY_SIGN_TYPE_HMAC_SHA256))
+
+	rsp, err := http.Post(s.URL+path, "text/xml", bytes.NewReader(encodeXML(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	result, err := decodeXML(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Get("return_code") != "SUCCESS" {
+		t.Fatalf("请求失败: %v", result)
+	}
+	if result.Get("sign") != signWXPay(result, "test-api-key-00000000000000000000", k_WXPAY_SIGN_TYPE_HMAC_SHA256) {
+		t.Fatalf("响应签名验证失败: %v", result)
+	}
+	return result
+}
+
+func TestWXPayServer(t *testing.T) {
+	var s = NewWXPayServer("wx0000000000000001", "10000100", "test-api-key-00000000000000000000")
+	defer s.Close()
+
+	var notified = false
+	var receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p, err := decodeXML(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if p.Get("sign") != signWXPay(p, "test-api-key-00000000000000000000", p.Get("sign_type")) {
+			t.Errorf("通知签名验证失败: %v", p)
+			return
+		}
+		notified = p.Get("out_trade_no") == "W2001" && p.Get("total_fee") == "1000" && p.Get("openid") == "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"
+		w.Write([]byte("<xml><return_code><![CDATA[SUCCESS]]></return_code><return_msg><![CDATA[OK]]></return_msg></xml>"))
+	}))
+	defer receiver.Close()
+
+	var p = url.Values{}
+	p.Set("body", "test")
+	p.Set("out_trade_no", "W2001")
+	p.Set("total_fee", "1000")
+	p.Set("spbill_create_ip", "127.0.0.1")
+	p.Set("notify_url", receiver.URL+"/pay/notify?channel=wxpay")
+	p.Set("trade_type", "NATIVE")
+	var rsp = wxPayRequest(t, s, k_WXPAY_SANDBOX_PREFIX+"/pay/unifiedorder", p)
+	if rsp.Get("result_code") != "SUCCESS" || strings.HasPrefix(rsp.Get("code_url"), "weixin://") == false {
+		t.Fatalf("统一下单失败: %v", rsp)
+	}
+
+	p = url.Values{}
+	p.Set("out_trade_no", "W2001")
+	rsp = wxPayRequest(t, s, "/pay/orderquery", p)
+	if rsp.Get("trade_state") != k_WXPAY_TRADE_STATE_NOTPAY {
+		t.Fatalf("交易状态错误: %v", rsp)
+	}
+
+	if err := s.Pay("W2001", "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Notify("W2001"); err != nil {
+		t.Fatal(err)
+	}
+	if notified == false {
+		t.Fatal("没有收到正确的通知")
+	}
+
+	p = url.Values{}
+	p.Set("out_trade_no", "W2001")
+	p.Set("out_refund_no", "W2001R1")
+	p.Set("total_fee", "1000")
+	p.Set("refund_fee", "1000")
+	rsp = wxPayRequest(t, s, "/secapi/pay/refund", p)
+	if rsp.Get("result_code") != "SUCCESS" || rsp.Get("refund_fee") != "1000" {
+		t.Fatalf("退款失败: %v", rsp)
+	}
+
+	p = url.Values{}
+	p.Set("out_trade_no", "W2001")
+	p.Set("out_refund_no", "W2001R2")
+	p.Set("total_fee", "1000")
+	p.Set("refund_fee", "1")
+	rsp = wxPayRequest(t, s, "/secapi/pay/refund", p)
+	if rsp.Get("result_code") == "SUCCESS" {
+		t.Fatal("退款金额超过订单金额时应该失败")
+	}
+}
+
+func payPalRequest(t *testing.T, s *PayPalServer, token, method, path string, param, result interface{}) int {
+	var body []byte
+	if param != nil {
+		body, _ = json.Marshal(param)
+	}
+	req, _ := http.NewRequest(method, s.URL+path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+
+	if result != nil {
+		json.NewDecoder(rsp.Body).Decode(result)
+	}
+	return rsp.StatusCode
+}
+
+func TestPayPalServer(t *testing.T) {
+	var s = NewPayPalServer("client-id", "secret")
+	defer s.Close()
+
+	// 获取 Token
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("client-id:secret")))
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token = struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	json.NewDecoder(rsp.Body).Decode(&token)
+	rsp.Body.Close()
+	if token.AccessToken == "" {
+		t.Fatal("获取 Token 失败")
+	}
+
+	if status := payPalRequest(t, s, "invalid", http.MethodGet, "/v1/payments/payment/PAY-1", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("无效的 Token 应该返回 401，实际为 %d", status)
+	}
+
+	var notified = false
+	var receiver = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event = struct {
+			EventType string `json:"event_type"`
+			Resource  struct {
+				ParentPayment string `json:"parent_payment"`
+				InvoiceNumber string `json:"invoice_number"`
+			} `json:"resource"`
+		}{}
+		json.NewDecoder(req.Body).Decode(&event)
+
+		var result = struct {
+			VerificationStatus string `json:"verification_status"`
+		}{}
+		payPalRequest(t, s, token.AccessToken, http.MethodPost, "/v1/notifications/verify-webhook-signature", map[string]string{
+			"transmission_id": req.Header.Get("Paypal-Transmission-Id"),
+			"webhook_id":      s.WebhookId,
+		}, &result)
+		if result.VerificationStatus != "SUCCESS" {
+			t.Errorf("Webhook 签名验证失败")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		notified = event.EventType == K_PAYPAL_EVENT_SALE_COMPLETED && event.Resource.InvoiceNumber == "P3001"
+	}))
+	defer receiver.Close()
+	s.WebhookURL = receiver.URL + "/pay/notify?channel=paypal"
+
+	var payment = &ppPayment{}
+	var status = payPalRequest(t, s, token.AccessToken, http.MethodPost, "/v1/payments/payment", map[string]interface{}{
+		"intent": "sale",
+		"payer":  map[string]string{"payment_method": "paypal"},
+		"transactions": []map[string]interface{}{
+			{"invoice_number": "P3001", "amount": map[string]string{"total": "12.00", "currency": "USD"}},
+		},
+	}, payment)
+	if status != http.StatusCreated || payment.State != k_PAYPAL_PAYMENT_STATE_CREATED || len(payment.Links) == 0 {
+		t.Fatalf("创建付款失败: %d %+v", status, payment)
+	}
+
+	if status = payPalRequest(t, s, token.AccessToken, http.MethodPost, "/v1/payments/payment/"+payment.Id+"/execute", map[string]string{"payer_id": "PAYER1"}, nil); status != http.StatusBadRequest {
+		t.Fatal("用户没有同意付款时不能执行付款")
+	}
+
+	s.Approve(payment.Id, "PAYER1")
+	payment = &ppPayment{Id: payment.Id}
+	payPalRequest(t, s, token.AccessToken, http.MethodPost, "/v1/payments/payment/"+payment.Id+"/execute", map[string]string{"payer_id": "PAYER1"}, payment)
+	if payment.State != k_PAYPAL_PAYMENT_STATE_APPROVED || payment.Transactions[0].RelatedResources[0].Sale.State != k_PAYPAL_SALE_STATE_COMPLETED {
+		t.Fatalf("执行付款失败: %+v", payment)
+	}
+
+	if err = s.Notify(payment.Id, K_PAYPAL_EVENT_SALE_COMPLETED); err != nil {
+		t.Fatal(err)
+	}
+	if notified == false {
+		t.Fatal("没有收到正确的通知")
+	}
+
+	var saleId = payment.Transactions[0].RelatedResources[0].Sale.Id
+	var refund = &ppRefund{}
+	status = payPalRequest(t, s, token.AccessToken, http.MethodPost, "/v1/payments/sale/"+saleId+"/refund", map[string]interface{}{
+		"amount": map[string]string{"total": "2.00", "currency": "USD"},
+	}, refund)
+	if status != http.StatusCreated || refund.State != k_PAYPAL_SALE_STATE_COMPLETED {
+		t.Fatalf("退款失败: %d %+v", status, refund)
+	}
+
+	var sale = &ppSale{}
+	payPalRequest(t, s, token.AccessToken, http.MethodGet, "/v1/payments/sale/"+saleId, nil, sale)
+	if sale.State != k_PAYPAL_SALE_STATE_PARTIALLY_REFUNDED {
+		t.Fatalf("Sale 状态错误: %+v", sale)
+	}
+}
@@ -0,0 +1,162 @@
+package paymenttest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidKey = errors.New("无效的 RSA 密钥")
+)
+
+// GenerateRSAKey 生成一对 PEM 格式的 RSA 密钥，私钥为 PKCS#1 格式，公钥为 PKIX 格式
+func GenerateRSAKey(bits int) (privateKey, publicKey string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", "", err
+	}
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	privateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	publicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}))
+	return privateKey, publicKey, nil
+}
+
+func parsePrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if ok == false {
+		return nil, ErrInvalidKey
+	}
+	return rsaKey, nil
+}
+
+func parsePublicKey(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, ErrInvalidKey
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if ok == false {
+		return nil, ErrInvalidKey
+	}
+	return rsaKey, nil
+}
+
+func signRSA2(content string, key *rsa.PrivateKey) (string, error) {
+	var h = sha256.Sum256([]byte(content))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func verifyRSA2(content, sign string, key *rsa.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return err
+	}
+	var h = sha256.Sum256([]byte(content))
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], sig)
+}
+
+// signContent 将参数按照 key 排序之后拼接为 k1=v1&k2=v2 的形式，忽略值为空的参数和 excludes 中的参数
+func signContent(values url.Values, excludes ...string) string {
+	var keys = make([]string, 0, len(values))
+	for key := range values {
+		var skip = values.Get(key) == ""
+		for _, e := range excludes {
+			if key == e {
+				skip = true
+			}
+		}
+		if skip == false {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var pList = make([]string, 0, len(keys))
+	for _, key := range keys {
+		pList = append(pList, key+"="+values.Get(key))
+	}
+	return strings.Join(pList, "&")
+}
+
+// signAliPay 对支付宝的请求参数进行 RSA2 签名
+func signAliPay(values url.Values, key *rsa.PrivateKey, excludes ...string) (string, error) {
+	return signRSA2(signContent(values, excludes...), key)
+}
+
+const (
+	k_WXPAY_SIGN_TYPE_MD5         = "MD5"
+	k_WXPAY_SIGN_TYPE_HMAC_SHA256 = "HMAC-SHA256"
+)
+
+// signWXPay 计算微信支付的签名，signType 为空时使用 MD5
+func signWXPay(values url.Values, apiKey, signType string) string {
+	var content = signContent(values, "sign") + "&key=" + apiKey
+
+	if signType == k_WXPAY_SIGN_TYPE_HMAC_SHA256 {
+		var h = hmac.New(sha256.New, []byte(apiKey))
+		h.Write([]byte(content))
+		return strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+	}
+
+	var h = md5.Sum([]byte(content))
+	return strings.ToUpper(hex.EncodeToString(h[:]))
+}
+
+// encryptWXPayReqInfo 按照微信支付退款通知的方式加密 req_info：AES-256-ECB，PKCS#7 填充，
+// 密钥为 API 密钥 MD5 之后的小写十六进制字符串，结果使用 Base64 编码
+func encryptWXPayReqInfo(data []byte, apiKey string) (string, error) {
+	var sum = md5.Sum([]byte(apiKey))
+	block, err := aes.NewCipher([]byte(hex.EncodeToString(sum[:])))
+	if err != nil {
+		return "", err
+	}
+
+	var padding = block.BlockSize() - len(data)%block.BlockSize()
+	var plain = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	var cipher = make([]byte, len(plain))
+	for i := 0; i < len(plain); i += block.BlockSize() {
+		block.Encrypt(cipher[i:i+block.BlockSize()], plain[i:i+block.BlockSize()])
+	}
+	return base64.StdEncoding.EncodeToString(cipher), nil
+}
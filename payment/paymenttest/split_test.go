@@ -0,0 +1,250 @@
+package paymenttest
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"testing"
+)
+
+func TestWXPaySplit(t *testing.T) {
+	var server = NewWXPayServer("wx0000000000000001", "10000100", "test-api-key-00000000000000000000")
+	defer server.Close()
+
+	var s = payment.NewService()
+	var wp = payment.NewWXPal("wx0000000000000001", "test-api-key-00000000000000000000", "10000100", false, payment.WithBaseURL(server.URL))
+	wp.NotifyURL = "http://127.0.0.1/pay/notify"
+	s.RegisterChannel(wp)
+
+	// 只有设置了 DelaySettle 的订单才可以分账
+	for _, orderNo := range []string{"W5001", "W5002", "W5003"} {
+		var order = newOrder(orderNo)
+		order.TradeMethod = payment.K_TRADE_METHOD_QRCODE
+		order.IP = "127.0.0.1"
+		order.DelaySettle = orderNo != "W5002"
+		if _, err := s.CreatePayment(payment.K_CHANNEL_WXPAY, order); err != nil {
+			t.Fatal(err)
+		}
+		server.Pay(orderNo, "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o")
+	}
+	var tradeNo = server.trades["W5001"].TransactionId
+
+	var merchant = &payment.SplitReceiver{Type: payment.K_RECEIVER_TYPE_MERCHANT, Account: "1900000109", Ratio: 0.3}
+	var personal = &payment.SplitReceiver{Type: payment.K_RECEIVER_TYPE_PERSONAL, Account: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o", Amount: 2}
+	if _, err := s.Split(payment.K_CHANNEL_WXPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "WS1", Receivers: []*payment.SplitReceiver{merchant}}); err == nil {
+		t.Fatal("没有添加接收方时分账应该返回错误")
+	}
+
+	if err := s.AddSplitReceiver(payment.K_CHANNEL_WXPAY, &payment.SplitReceiver{Type: payment.K_RECEIVER_TYPE_MERCHANT}); err != payment.ErrInvalidSplit {
+		t.Fatalf("期望返回 ErrInvalidSplit，实际为 %v", err)
+	}
+	if err := s.AddSplitReceiver(payment.K_CHANNEL_WXPAY, merchant); err == nil {
+		t.Fatal("商户类型的接收方没有名称时应该返回错误")
+	}
+	merchant.Name = "示例商户"
+	for _, r := range []*payment.SplitReceiver{merchant, personal} {
+		if err := s.AddSplitReceiver(payment.K_CHANNEL_WXPAY, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if server.receivers["1900000109"] != "MERCHANT_ID" || server.receivers["oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"] != "PERSONAL_OPENID" {
+		t.Fatalf("分账接收方类型错误: %v", server.receivers)
+	}
+
+	if _, err := s.Split(payment.K_CHANNEL_WXPAY, &payment.SplitParam{TradeNo: server.trades["W5002"].TransactionId, SplitNo: "WS0", Receivers: []*payment.SplitReceiver{personal}}); err == nil {
+		t.Fatal("没有设置 DelaySettle 的交易分账应该返回错误")
+	}
+
+	// 分账之前会查询交易金额，调用方提供的交易金额不会被使用，按比例计算的分账金额为 20.00 * 0.3
+	var param = &payment.SplitParam{TradeNo: tradeNo, SplitNo: "WS1", TotalAmount: 100, Receivers: []*payment.SplitReceiver{merchant, personal}}
+	result, err := s.Split(payment.K_CHANNEL_WXPAY, param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if param.TotalAmount != 100 || param.Currency != "" || merchant.Amount != 0 {
+		t.Fatalf("不应该修改调用方的分账参数: %+v", param)
+	}
+	if result.Status != payment.K_SPLIT_STATUS_PROCESSING || result.SplitNo != "WS1" || result.SplitId == "" || result.Receivers[0].Amount != "6.00" {
+		t.Fatalf("分账结果错误: %+v", result)
+	}
+	if server.sharings["WS1"].Receivers[0].Amount != 600 || server.sharings["WS1"].Receivers[1].Amount != 200 {
+		t.Fatalf("分账金额错误: %+v", server.sharings["WS1"].Receivers[0])
+	}
+
+	if _, err = s.Split(payment.K_CHANNEL_WXPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "WS2", Receivers: []*payment.SplitReceiver{{Type: payment.K_RECEIVER_TYPE_PERSONAL, Account: personal.Account, Amount: 25}}}); err != payment.ErrSplitAmountExceeded {
+		t.Fatalf("期望返回 ErrSplitAmountExceeded，实际为 %v", err)
+	}
+	// 累计分账金额超过交易金额时由微信支付拒绝
+	if _, err = s.Split(payment.K_CHANNEL_WXPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "WS2", Receivers: []*payment.SplitReceiver{{Type: payment.K_RECEIVER_TYPE_PERSONAL, Account: personal.Account, Amount: 15}}}); err == nil {
+		t.Fatal("累计分账金额超过交易金额时应该返回错误")
+	}
+
+	// 微信支付异步处理分账
+	if result, err = s.GetSplit(payment.K_CHANNEL_WXPAY, tradeNo, "WS1"); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_SPLIT_STATUS_PROCESSING || result.Receivers[1].Status != payment.K_SPLIT_STATUS_PROCESSING {
+		t.Fatalf("分账结果错误: %+v", result)
+	}
+	if err = server.ProcessProfitSharing("WS1", k_WXPAY_PROFIT_SHARING_STATUS_FINISHED); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = s.GetSplit(payment.K_CHANNEL_WXPAY, tradeNo, "WS1"); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_SPLIT_STATUS_SUCCESS || len(result.Receivers) != 2 || result.Receivers[0].Type != payment.K_RECEIVER_TYPE_MERCHANT || result.Receivers[1].Amount != "2.00" || result.Receivers[1].Status != payment.K_SPLIT_STATUS_SUCCESS {
+		t.Fatalf("分账结果错误: %+v", result)
+	}
+
+	// 只能从商户类型的接收方回退，回退金额不能超过分账金额
+	if _, err = s.ReturnSplit(payment.K_CHANNEL_WXPAY, &payment.SplitReturnParam{SplitNo: "WS1", ReturnNo: "WR1", Account: merchant.Account}); err != payment.ErrInvalidSplit {
+		t.Fatalf("期望返回 ErrInvalidSplit，实际为 %v", err)
+	}
+	if _, err = s.ReturnSplit(payment.K_CHANNEL_WXPAY, &payment.SplitReturnParam{SplitNo: "WS1", ReturnNo: "WR1", Account: personal.Account, Amount: 1}); err == nil {
+		t.Fatal("从个人类型的接收方回退应该返回错误")
+	}
+	ret, err := s.ReturnSplit(payment.K_CHANNEL_WXPAY, &payment.SplitReturnParam{SplitNo: "WS1", ReturnNo: "WR1", Account: merchant.Account, Amount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Status != payment.K_SPLIT_STATUS_SUCCESS || ret.Amount != "2.00" || ret.ReturnNo != "WR1" || ret.ReturnId == "" {
+		t.Fatalf("分账回退结果错误: %+v", ret)
+	}
+	if retry, err := s.ReturnSplit(payment.K_CHANNEL_WXPAY, &payment.SplitReturnParam{SplitNo: "WS1", ReturnNo: "WR1", Account: merchant.Account, Amount: 2}); err != nil || retry.ReturnId != ret.ReturnId {
+		t.Fatalf("重复回退: %+v, %v", retry, err)
+	}
+	if ret, err = s.ReturnSplit(payment.K_CHANNEL_WXPAY, &payment.SplitReturnParam{SplitNo: "WS1", ReturnNo: "WR2", Account: merchant.Account, Amount: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if ret.Status != payment.K_SPLIT_STATUS_FAILED || ret.FailReason == "" {
+		t.Fatalf("回退金额超过分账金额时应该回退失败: %+v", ret)
+	}
+
+	// 分账失败时资金退回到冻结资金中，可以再次分账
+	if _, err = s.Split(payment.K_CHANNEL_WXPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "WS3", Receivers: []*payment.SplitReceiver{{Type: payment.K_RECEIVER_TYPE_PERSONAL, Account: personal.Account, Amount: 12}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.ProcessProfitSharing("WS3", k_WXPAY_PROFIT_SHARING_STATUS_CLOSED); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = s.GetSplit(payment.K_CHANNEL_WXPAY, tradeNo, "WS3"); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_SPLIT_STATUS_FAILED || result.Receivers[0].Status != payment.K_SPLIT_STATUS_FAILED || result.Receivers[0].FailReason == "" {
+		t.Fatalf("分账结果错误: %+v", result)
+	}
+	if server.trades["W5001"].SplitFee != 800 {
+		t.Fatalf("分账失败之后已分账金额错误: %d", server.trades["W5001"].SplitFee)
+	}
+
+	// 完结之后不能再分账
+	if err = s.FinishSplit(payment.K_CHANNEL_WXPAY, tradeNo, "WF1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Split(payment.K_CHANNEL_WXPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "WS4", Receivers: []*payment.SplitReceiver{personal}}); err == nil {
+		t.Fatal("完结之后分账应该返回错误")
+	}
+	if err = s.FinishSplit(payment.K_CHANNEL_WXPAY, tradeNo, "WF2"); err == nil {
+		t.Fatal("重复完结应该返回错误")
+	}
+
+	// 单次分账之后交易的分账会立即完结
+	var w5003 = server.trades["W5003"].TransactionId
+	if _, err = s.Split(payment.K_CHANNEL_WXPAY, &payment.SplitParam{TradeNo: w5003, SplitNo: "WS5", Receivers: []*payment.SplitReceiver{personal}, Finish: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.FinishSplit(payment.K_CHANNEL_WXPAY, w5003, "WF3"); err == nil {
+		t.Fatal("单次分账之后完结应该返回错误")
+	}
+}
+
+func TestAliPaySplit(t *testing.T) {
+	merchantKey, merchantPublicKey, err := GenerateRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewAliPayServer("2016073100129537", merchantPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	var s = payment.NewService()
+	var ap = payment.NewAliPay("2016073100129537", "2088102169227503", server.PublicKey, merchantKey, false, payment.WithBaseURL(server.URL))
+	ap.NotifyURL = "http://127.0.0.1/pay/notify"
+	s.RegisterChannel(ap)
+
+	for _, orderNo := range []string{"A5001", "A5002"} {
+		var order = newOrder(orderNo)
+		order.TradeMethod = payment.K_TRADE_METHOD_QRCODE
+		if _, err = s.CreatePayment(payment.K_CHANNEL_ALIPAY, order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Pay("A5001", "2088102175953034")
+	var tradeNo = server.trades["A5001"].TradeNo
+
+	// 2088 开头的 16 位数字为支付宝用户 ID，其它的账号作为登录账号使用
+	var merchant = &payment.SplitReceiver{Type: payment.K_RECEIVER_TYPE_MERCHANT, Account: "2088102175953034", Ratio: 0.3}
+	var personal = &payment.SplitReceiver{Type: payment.K_RECEIVER_TYPE_PERSONAL, Account: "seller@sandbox.com", Name: "沙箱环境", Amount: 2}
+	for _, r := range []*payment.SplitReceiver{merchant, personal} {
+		if err = s.AddSplitReceiver(payment.K_CHANNEL_ALIPAY, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if server.royalties["2088102175953034"] != "userId" || server.royalties["seller@sandbox.com"] != "loginName" {
+		t.Fatalf("分账关系错误: %v", server.royalties)
+	}
+
+	if _, err = s.Split(payment.K_CHANNEL_ALIPAY, &payment.SplitParam{TradeNo: server.trades["A5002"].TradeNo, SplitNo: "AS0", Receivers: []*payment.SplitReceiver{personal}}); err == nil {
+		t.Fatal("没有支付的交易分账应该返回错误")
+	}
+
+	// 支付宝的分账会同步完成，使用相同的分账单号重试不会重复分账
+	var param = &payment.SplitParam{TradeNo: tradeNo, SplitNo: "AS1", Receivers: []*payment.SplitReceiver{merchant, personal}}
+	result, err := s.Split(payment.K_CHANNEL_ALIPAY, param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_SPLIT_STATUS_SUCCESS || result.TradeNo != tradeNo || result.SplitId == "" || result.Receivers[0].Amount != "6.00" {
+		t.Fatalf("分账结果错误: %+v", result)
+	}
+	if retry, err := s.Split(payment.K_CHANNEL_ALIPAY, param); err != nil || retry.SplitId != result.SplitId || server.trades["A5001"].SettleAmount != 8 {
+		t.Fatalf("重复分账: %+v, %v", retry, err)
+	}
+	if result, err = s.GetSplit(payment.K_CHANNEL_ALIPAY, tradeNo, "AS1"); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_SPLIT_STATUS_SUCCESS || len(result.Receivers) != 2 || result.Receivers[0].Type != payment.K_RECEIVER_TYPE_MERCHANT || result.Receivers[1].Type != payment.K_RECEIVER_TYPE_PERSONAL || result.Receivers[1].Amount != "2.00" {
+		t.Fatalf("查询分账结果错误: %+v", result)
+	}
+
+	// 没有绑定分账关系的接收方分账失败
+	if _, err = s.Split(payment.K_CHANNEL_ALIPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "AS2", Receivers: []*payment.SplitReceiver{{Type: payment.K_RECEIVER_TYPE_MERCHANT, Account: "2088000000000001", Amount: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if result, err = s.GetSplit(payment.K_CHANNEL_ALIPAY, tradeNo, "AS2"); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != payment.K_SPLIT_STATUS_FAILED || result.Receivers[0].Status != payment.K_SPLIT_STATUS_FAILED || result.Receivers[0].FailReason == "" {
+		t.Fatalf("查询分账结果错误: %+v", result)
+	}
+
+	// 累计分账金额超过交易金额时由支付宝拒绝
+	if _, err = s.Split(payment.K_CHANNEL_ALIPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "AS3", Receivers: []*payment.SplitReceiver{{Type: payment.K_RECEIVER_TYPE_PERSONAL, Account: personal.Account, Amount: 13}}}); err == nil {
+		t.Fatal("累计分账金额超过交易金额时应该返回错误")
+	}
+
+	if _, err = s.ReturnSplit(payment.K_CHANNEL_ALIPAY, &payment.SplitReturnParam{SplitNo: "AS1", ReturnNo: "AR1", Account: merchant.Account, Amount: 1}); err != payment.ErrAliPayNotAllowed {
+		t.Fatalf("期望返回 ErrAliPayNotAllowed，实际为 %v", err)
+	}
+	if err = s.FinishSplit(payment.K_CHANNEL_ALIPAY, tradeNo, "AF1"); err != payment.ErrAliPayNotAllowed {
+		t.Fatalf("期望返回 ErrAliPayNotAllowed，实际为 %v", err)
+	}
+
+	// 支付宝需要在最后一次分账时完结分账
+	if _, err = s.Split(payment.K_CHANNEL_ALIPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "AS4", Receivers: []*payment.SplitReceiver{personal}, Finish: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Split(payment.K_CHANNEL_ALIPAY, &payment.SplitParam{TradeNo: tradeNo, SplitNo: "AS5", Receivers: []*payment.SplitReceiver{personal}}); err == nil {
+		t.Fatal("完结之后分账应该返回错误")
+	}
+}
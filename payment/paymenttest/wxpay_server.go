@@ -0,0 +1,1079 @@
+package paymenttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	k_WXPAY_SANDBOX_PREFIX = "/sandboxnew"
+
+	k_WXPAY_TRADE_STATE_NOTPAY  = "NOTPAY"
+	k_WXPAY_TRADE_STATE_SUCCESS = "SUCCESS"
+	k_WXPAY_TRADE_STATE_REFUND  = "REFUND"
+
+	k_WXPAY_TRADE_STATE_USERPAYING = "USERPAYING"
+	k_WXPAY_TRADE_TYPE_PAP         = "PAP"
+
+	k_WXPAY_CONTRACT_STATE_SIGNED     = "0"
+	k_WXPAY_CONTRACT_STATE_TERMINATED = "1"
+
+	k_WXPAY_TRANSFER_STATUS_SUCCESS = "SUCCESS"
+
+	k_WXPAY_PROFIT_SHARING_STATUS_PROCESSING = "PROCESSING"
+	k_WXPAY_PROFIT_SHARING_STATUS_FINISHED   = "FINISHED"
+	k_WXPAY_PROFIT_SHARING_STATUS_CLOSED     = "CLOSED"
+
+	k_WXPAY_PROFIT_SHARING_RESULT_PENDING = "PENDING"
+	k_WXPAY_PROFIT_SHARING_RESULT_SUCCESS = "SUCCESS"
+	k_WXPAY_PROFIT_SHARING_RESULT_CLOSED  = "CLOSED"
+
+	k_WXPAY_RECEIVER_TYPE_MERCHANT_ID = "MERCHANT_ID"
+)
+
+// WXPayServer 模拟微信支付的商户平台接口，请求和响应均为 XML，支持 MD5 和 HMAC-SHA256 签名
+type WXPayServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	appId     string
+	mchId     string
+	apiKey    string
+	trades    map[string]*wxPayTrade
+	contracts map[string]*wxPayContract      // key 为 contract_code
+	transfers map[string]*wxPayTransfer      // key 为 partner_trade_no
+	names     map[string]string              // key 为 openid，value 为用户的实名
+	receivers map[string]string              // key 为分账接收方的账号，value 为接收方类型
+	sharings  map[string]*wxPayProfitSharing // key 为 out_order_no
+	seq       int
+}
+
+// wxPayProfitSharing 分账请求，微信支付异步处理分账，需要调用 ProcessProfitSharing 模拟处理完成
+type wxPayProfitSharing struct {
+	TransactionId string
+	OutOrderNo    string
+	OrderId       string
+	Status        string
+	Receivers     []*wxPayProfitSharingReceiver
+	returns       map[string]url.Values // key 为 out_return_no，value 为第一次回退的响应
+}
+
+type wxPayProfitSharingReceiver struct {
+	Type         string `json:"type"`
+	Account      string `json:"account"`
+	Amount       int    `json:"amount"`
+	Description  string `json:"description"`
+	Result       string `json:"result,omitempty"`
+	FailReason   string `json:"fail_reason,omitempty"`
+	FinishTime   string `json:"finish_time,omitempty"`
+	ReturnAmount int    `json:"-"`
+}
+
+// wxPayTransfer 企业付款到零钱，付款会立即成功
+type wxPayTransfer struct {
+	PartnerTradeNo string
+	PaymentNo      string
+	OpenId         string
+	Amount         int
+	Desc           string
+	Status         string
+	PaymentTime    string
+}
+
+// wxPayContract 委托代扣的签约协议，用户签约之前 ContractState 为空
+type wxPayContract struct {
+	ContractId      string
+	ContractCode    string
+	PlanId          string
+	OpenId          string
+	ContractState   string
+	SignedTime      string
+	ExpiredTime     string
+	TerminatedTime  string
+	TerminationMode string
+	NotifyURL       string
+}
+
+type wxPayTrade struct {
+	OutTradeNo    string
+	TransactionId string
+	Body          string
+	TradeType     string
+	TradeState    string
+	TotalFee      int
+	RefundFee     int
+	FeeType       string
+	NotifyURL     string
+	SignType      string
+	OpenId        string
+	TimeEnd       string
+	ProfitSharing string                // 为 Y 时支付成功之后资金会被冻结，用于分账
+	SplitFee      int                   // 已经分账的金额
+	SplitFinished bool                  // 分账是否已经完结
+	refunds       map[string]url.Values // key 为 out_refund_no，value 为第一次退款的响应
+	refundNotify  map[string]string     // key 为 out_refund_no，value 为退款时提供的 notify_url
+}
+
+// NewWXPayServer 创建并启动微信支付模拟服务器，同时支持正式环境和沙箱环境（/sandboxnew）的接口路径
+func NewWXPayServer(appId, mchId, apiKey string) *WXPayServer {
+	var s = &WXPayServer{}
+	s.appId = appId
+	s.mchId = mchId
+	s.apiKey = apiKey
+	s.trades = make(map[string]*wxPayTrade)
+	s.contracts = make(map[string]*wxPayContract)
+	s.transfers = make(map[string]*wxPayTransfer)
+	s.names = make(map[string]string)
+	s.receivers = make(map[string]string)
+	s.sharings = make(map[string]*wxPayProfitSharing)
+
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/pay/unifiedorder", s.handleUnifiedOrder)
+	mux.HandleFunc("/pay/orderquery", s.handleOrderQuery)
+	mux.HandleFunc("/secapi/pay/refund", s.handleRefund)
+	mux.HandleFunc("/pay/refund", s.handleRefund)
+	mux.HandleFunc("/papay/entrustweb", s.handleEntrustWeb)
+	mux.HandleFunc("/papay/querycontract", s.handleQueryContract)
+	mux.HandleFunc("/papay/deletecontract", s.handleDeleteContract)
+	mux.HandleFunc("/pay/pappayapply", s.handlePapPayApply)
+	mux.HandleFunc("/mmpaymkttransfers/promotion/transfers", s.handleTransfers)
+	mux.HandleFunc("/mmpaymkttransfers/gettransferinfo", s.handleGetTransferInfo)
+	mux.HandleFunc("/pay/profitsharingaddreceiver", s.handleAddReceiver)
+	mux.HandleFunc("/secapi/pay/profitsharing", s.handleProfitSharing)
+	mux.HandleFunc("/secapi/pay/multiprofitsharing", s.handleProfitSharing)
+	mux.HandleFunc("/pay/profitsharingquery", s.handleProfitSharingQuery)
+	mux.HandleFunc("/secapi/pay/profitsharingreturn", s.handleProfitSharingReturn)
+	mux.HandleFunc("/secapi/pay/profitsharingfinish", s.handleProfitSharingFinish)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, k_WXPAY_SANDBOX_PREFIX)
+		mux.ServeHTTP(w, req)
+	}))
+	return s
+}
+
+// Pay 模拟用户完成支付
+func (this *WXPayServer) Pay(orderNo, openId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		return ErrTradeNotExist
+	}
+	trade.TradeState = k_WXPAY_TRADE_STATE_SUCCESS
+	trade.OpenId = openId
+	trade.TimeEnd = time.Now().Format("20060102150405")
+	return nil
+}
+
+// Notify 将支付结果通知发送到统一下单时提供的 notify_url
+func (this *WXPayServer) Notify(orderNo string) error {
+	this.mu.Lock()
+	var trade = this.trades[orderNo]
+	if trade == nil {
+		this.mu.Unlock()
+		return ErrTradeNotExist
+	}
+
+	var p = wxPayNotifyValues(this.appId, this.mchId, trade)
+	p.Set("sign", signWXPay(p, this.apiKey, trade.SignType))
+	var notifyURL = trade.NotifyURL
+	this.mu.Unlock()
+
+	if notifyURL == "" {
+		return errors.New("订单没有设置 notify_url")
+	}
+	return this.sendNotify(notifyURL, p)
+}
+
+// NotifyRefund 将退款成功的通知发送到退款时提供的 notify_url，与微信支付一样，通知没有签名，
+// 退款信息使用 API 密钥加密之后放在 req_info 中
+func (this *WXPayServer) NotifyRefund(outRefundNo string) error {
+	this.mu.Lock()
+	var rsp url.Values
+	var notifyURL string
+	for _, trade := range this.trades {
+		if r, ok := trade.refunds[outRefundNo]; ok {
+			rsp = r
+			notifyURL = trade.refundNotify[outRefundNo]
+		}
+	}
+	this.mu.Unlock()
+
+	if rsp == nil {
+		return errors.New("退款不存在")
+	}
+	if notifyURL == "" {
+		return errors.New("退款没有设置 notify_url")
+	}
+
+	var info = url.Values{}
+	for _, key := range []string{"transaction_id", "out_trade_no", "refund_id", "out_refund_no", "total_fee", "refund_fee"} {
+		info.Set(key, rsp.Get(key))
+	}
+	info.Set("settlement_total_fee", rsp.Get("total_fee"))
+	info.Set("settlement_refund_fee", rsp.Get("refund_fee"))
+	info.Set("refund_status", "SUCCESS")
+	info.Set("success_time", time.Now().Format("2006-01-02 15:04:05"))
+	info.Set("refund_recv_accout", "支付用户的零钱")
+	info.Set("refund_account", "REFUND_SOURCE_RECHARGE_FUNDS")
+	info.Set("refund_request_source", "API")
+
+	// req_info 解密之后的根节点为 root
+	var data = encodeXML(info)
+	data = append([]byte("<root>"), data[len("<xml>"):len(data)-len("</xml>")]...)
+	data = append(data, "</root>"...)
+	reqInfo, err := encryptWXPayReqInfo(data, this.apiKey)
+	if err != nil {
+		return err
+	}
+
+	var p = url.Values{}
+	p.Set("return_code", "SUCCESS")
+	p.Set("appid", this.appId)
+	p.Set("mch_id", this.mchId)
+	p.Set("nonce_str", newNotifyId())
+	p.Set("req_info", reqInfo)
+	return this.sendNotify(notifyURL, p)
+}
+
+// SetRealName 设置用户的实名，企业付款使用 FORCE_CHECK 时会校验收款人姓名
+func (this *WXPayServer) SetRealName(openId, name string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.names[openId] = name
+}
+
+// SignContract 模拟用户在微信中确认签约，contractCode 为商户的签约协议号
+func (this *WXPayServer) SignContract(contractCode, openId string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var contract = this.contracts[contractCode]
+	if contract == nil {
+		return errors.New("签约协议不存在")
+	}
+	if contract.ContractState != "" {
+		return errors.New("签约协议已经生效")
+	}
+
+	this.seq++
+	contract.ContractId = fmt.Sprintf("2018%014d", this.seq)
+	contract.OpenId = openId
+	contract.ContractState = k_WXPAY_CONTRACT_STATE_SIGNED
+	contract.SignedTime = time.Now().Format("2006-01-02 15:04:05")
+	contract.ExpiredTime = "2115-02-01 00:00:00"
+	return nil
+}
+
+// NotifyContract 将签约协议当前的状态以签约（ADD）或者解约（DELETE）通知的形式发送到签约时提供的 notify_url
+func (this *WXPayServer) NotifyContract(contractCode string) error {
+	this.mu.Lock()
+	var contract = this.contracts[contractCode]
+	if contract == nil || contract.ContractState == "" {
+		this.mu.Unlock()
+		return errors.New("用户还没有签约")
+	}
+
+	var p = this.successValues()
+	p.Set("contract_code", contract.ContractCode)
+	p.Set("plan_id", contract.PlanId)
+	p.Set("openid", contract.OpenId)
+	p.Set("contract_id", contract.ContractId)
+	p.Set("contract_expired_time", contract.ExpiredTime)
+	if contract.ContractState == k_WXPAY_CONTRACT_STATE_SIGNED {
+		p.Set("change_type", "ADD")
+		p.Set("operate_time", contract.SignedTime)
+	} else {
+		p.Set("change_type", "DELETE")
+		p.Set("operate_time", contract.TerminatedTime)
+		p.Set("contract_termination_mode", contract.TerminationMode)
+	}
+	p.Set("sign", signWXPay(p, this.apiKey, ""))
+	var notifyURL = contract.NotifyURL
+	this.mu.Unlock()
+
+	if notifyURL == "" {
+		return errors.New("签约协议没有设置 notify_url")
+	}
+	return this.sendNotify(notifyURL, p)
+}
+
+// sendNotify 将已经签名的通知发送到 notifyURL，商户需要返回 return_code 为 SUCCESS 的 XML
+// ProcessProfitSharing 模拟微信支付处理分账请求，status 为 FINISHED 时所有接收方分账成功，为 CLOSED 时分账失败，
+// 失败的分账金额会退回到交易的冻结资金中
+func (this *WXPayServer) ProcessProfitSharing(outOrderNo, status string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var sharing = this.sharings[outOrderNo]
+	if sharing == nil {
+		return errors.New("分账请求不存在")
+	}
+	if sharing.Status != k_WXPAY_PROFIT_SHARING_STATUS_PROCESSING {
+		return errors.New("分账请求已经处理")
+	}
+
+	sharing.Status = status
+	for _, r := range sharing.Receivers {
+		r.FinishTime = time.Now().Format("20060102150405")
+		if status == k_WXPAY_PROFIT_SHARING_STATUS_FINISHED {
+			r.Result = k_WXPAY_PROFIT_SHARING_RESULT_SUCCESS
+			continue
+		}
+		r.Result = k_WXPAY_PROFIT_SHARING_RESULT_CLOSED
+		r.FailReason = "ACCOUNT_ABNORMAL"
+		if trade := this.findTrade(url.Values{"transaction_id": {sharing.TransactionId}}); trade != nil {
+			trade.SplitFee -= r.Amount
+		}
+	}
+	return nil
+}
+
+func (this *WXPayServer) sendNotify(notifyURL string, p url.Values) error {
+	rsp, err := http.Post(notifyURL, "text/xml", bytes.NewReader(encodeXML(p)))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	result, err := decodeXML(bytes.NewReader(body))
+	if err != nil || result.Get("return_code") != "SUCCESS" {
+		return fmt.Errorf("商户没有确认接收到通知: %d %s", rsp.StatusCode, body)
+	}
+	return nil
+}
+
+// readRequest 读取请求内容并验证商户号、应用 ID 以及签名
+func (this *WXPayServer) readRequest(w http.ResponseWriter, req *http.Request) (url.Values, bool) {
+	p, err := decodeXML(req.Body)
+	if err != nil {
+		this.writeFail(w, "XML 格式错误")
+		return nil, false
+	}
+	if p.Get("appid") != this.appId || p.Get("mch_id") != this.mchId {
+		this.writeFail(w, "appid 和 mch_id 不匹配")
+		return nil, false
+	}
+	if p.Get("sign") != signWXPay(p, this.apiKey, p.Get("sign_type")) {
+		this.writeFail(w, "签名错误")
+		return nil, false
+	}
+	return p, true
+}
+
+func (this *WXPayServer) handleUnifiedOrder(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	var totalFee, _ = strconv.Atoi(p.Get("total_fee"))
+
+	this.mu.Lock()
+	this.seq++
+	var trade = &wxPayTrade{}
+	trade.OutTradeNo = p.Get("out_trade_no")
+	trade.TransactionId = fmt.Sprintf("4200000%s%09d", time.Now().Format("20060102"), this.seq)
+	trade.Body = p.Get("body")
+	trade.TradeType = p.Get("trade_type")
+	trade.TradeState = k_WXPAY_TRADE_STATE_NOTPAY
+	trade.TotalFee = totalFee
+	trade.FeeType = p.Get("fee_type")
+	if trade.FeeType == "" {
+		trade.FeeType = "CNY"
+	}
+	trade.NotifyURL = p.Get("notify_url")
+	trade.SignType = p.Get("sign_type")
+	trade.ProfitSharing = p.Get("profit_sharing")
+	this.trades[trade.OutTradeNo] = trade
+	var prepayId = fmt.Sprintf("wx%s%010d", time.Now().Format("20060102150405"), this.seq)
+	this.mu.Unlock()
+
+	var rsp = this.successValues()
+	rsp.Set("trade_type", trade.TradeType)
+	rsp.Set("prepay_id", prepayId)
+	switch trade.TradeType {
+	case "NATIVE":
+		rsp.Set("code_url", "weixin://wxpay/bizpayurl?pr="+prepayId)
+	case "MWEB":
+		rsp.Set("mweb_url", this.URL+"/cgi-bin/mmpayweb-bin/checkmweb?prepay_id="+prepayId)
+	}
+	this.writeValues(w, trade.SignType, rsp)
+}
+
+func (this *WXPayServer) findTrade(p url.Values) *wxPayTrade {
+	var transactionId = p.Get("transaction_id")
+	var orderNo = p.Get("out_trade_no")
+	for _, trade := range this.trades {
+		if (transactionId != "" && trade.TransactionId == transactionId) || (orderNo != "" && trade.OutTradeNo == orderNo) {
+			return trade
+		}
+	}
+	return nil
+}
+
+func (this *WXPayServer) handleOrderQuery(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	this.mu.Lock()
+	var trade = this.findTrade(p)
+	if trade == nil {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "ORDERNOTEXIST", "订单不存在")
+		return
+	}
+
+	var rsp = this.successValues()
+	rsp.Set("out_trade_no", trade.OutTradeNo)
+	rsp.Set("transaction_id", trade.TransactionId)
+	rsp.Set("trade_type", trade.TradeType)
+	rsp.Set("trade_state", trade.TradeState)
+	rsp.Set("total_fee", strconv.Itoa(trade.TotalFee))
+	rsp.Set("fee_type", trade.FeeType)
+	rsp.Set("openid", trade.OpenId)
+	rsp.Set("time_end", trade.TimeEnd)
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+func (this *WXPayServer) handleRefund(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	var totalFee, _ = strconv.Atoi(p.Get("total_fee"))
+	var refundFee, _ = strconv.Atoi(p.Get("refund_fee"))
+
+	this.mu.Lock()
+	var trade = this.findTrade(p)
+	if trade == nil {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "ORDERNOTEXIST", "订单不存在")
+		return
+	}
+	// 与微信支付一样，相同 out_refund_no 的退款请求返回第一次退款的结果
+	if rsp, ok := trade.refunds[p.Get("out_refund_no")]; ok {
+		this.mu.Unlock()
+		this.writeValues(w, p.Get("sign_type"), rsp)
+		return
+	}
+	if trade.TradeState != k_WXPAY_TRADE_STATE_SUCCESS && trade.TradeState != k_WXPAY_TRADE_STATE_REFUND {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "TRADE_STATE_ERROR", "订单状态错误")
+		return
+	}
+	if totalFee != trade.TotalFee || refundFee <= 0 || trade.RefundFee+refundFee > trade.TotalFee {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "INVALID_REQUEST", "退款金额错误")
+		return
+	}
+	trade.RefundFee += refundFee
+	trade.TradeState = k_WXPAY_TRADE_STATE_REFUND
+
+	var rsp = this.successValues()
+	rsp.Set("transaction_id", trade.TransactionId)
+	rsp.Set("out_trade_no", trade.OutTradeNo)
+	rsp.Set("out_refund_no", p.Get("out_refund_no"))
+	rsp.Set("refund_id", fmt.Sprintf("50000%s%09d", time.Now().Format("20060102"), this.seq))
+	rsp.Set("refund_fee", strconv.Itoa(refundFee))
+	rsp.Set("total_fee", strconv.Itoa(trade.TotalFee))
+	rsp.Set("cash_fee", strconv.Itoa(trade.TotalFee))
+	if p.Get("out_refund_no") != "" {
+		if trade.refunds == nil {
+			trade.refunds = make(map[string]url.Values)
+			trade.refundNotify = make(map[string]string)
+		}
+		trade.refunds[p.Get("out_refund_no")] = rsp
+		trade.refundNotify[p.Get("out_refund_no")] = p.Get("notify_url")
+	}
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+// handleEntrustWeb 处理用户打开的签约页面，参数在 URL 中并且只支持 MD5 签名
+func (this *WXPayServer) handleEntrustWeb(w http.ResponseWriter, req *http.Request) {
+	var p = req.URL.Query()
+	if p.Get("appid") != this.appId || p.Get("mch_id") != this.mchId {
+		http.Error(w, "appid 和 mch_id 不匹配", http.StatusBadRequest)
+		return
+	}
+	if p.Get("sign") != signWXPay(p, this.apiKey, "") {
+		http.Error(w, "签名错误", http.StatusBadRequest)
+		return
+	}
+
+	this.mu.Lock()
+	if this.contracts[p.Get("contract_code")] == nil {
+		var contract = &wxPayContract{}
+		contract.ContractCode = p.Get("contract_code")
+		contract.PlanId = p.Get("plan_id")
+		contract.NotifyURL = p.Get("notify_url")
+		this.contracts[contract.ContractCode] = contract
+	}
+	this.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte("<html><body>WXPay Entrust " + p.Get("contract_code") + "</body></html>"))
+}
+
+// findContract 按 contract_id 或者 plan_id 加 contract_code 查找已经签约的协议
+func (this *WXPayServer) findContract(p url.Values) *wxPayContract {
+	var contractId = p.Get("contract_id")
+	for _, contract := range this.contracts {
+		if contract.ContractState == "" {
+			continue
+		}
+		if contractId != "" && contract.ContractId == contractId {
+			return contract
+		}
+		if contractId == "" && contract.ContractCode == p.Get("contract_code") && contract.PlanId == p.Get("plan_id") {
+			return contract
+		}
+	}
+	return nil
+}
+
+func (this *WXPayServer) handleQueryContract(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	this.mu.Lock()
+	var contract = this.findContract(p)
+	if contract == nil {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "CONTRACT_NOT_EXIST", "签约协议不存在")
+		return
+	}
+
+	var rsp = this.successValues()
+	rsp.Set("contract_id", contract.ContractId)
+	rsp.Set("contract_code", contract.ContractCode)
+	rsp.Set("plan_id", contract.PlanId)
+	rsp.Set("openid", contract.OpenId)
+	rsp.Set("contract_state", contract.ContractState)
+	rsp.Set("contract_signed_time", contract.SignedTime)
+	rsp.Set("contract_expired_time", contract.ExpiredTime)
+	rsp.Set("contract_terminated_time", contract.TerminatedTime)
+	rsp.Set("contract_termination_mode", contract.TerminationMode)
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+func (this *WXPayServer) handleDeleteContract(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	this.mu.Lock()
+	var contract = this.findContract(p)
+	if contract == nil || contract.ContractState != k_WXPAY_CONTRACT_STATE_SIGNED {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "CONTRACT_NOT_EXIST", "签约协议不存在或者已经解约")
+		return
+	}
+	contract.ContractState = k_WXPAY_CONTRACT_STATE_TERMINATED
+	contract.TerminatedTime = time.Now().Format("2006-01-02 15:04:05")
+	// 3 表示商户 API 解约
+	contract.TerminationMode = "3"
+
+	var rsp = this.successValues()
+	rsp.Set("contract_id", contract.ContractId)
+	rsp.Set("plan_id", contract.PlanId)
+	rsp.Set("contract_code", contract.ContractCode)
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+// handlePapPayApply 受理委托代扣，受理之后交易状态为 USERPAYING，需要调用 Pay 模拟扣款完成
+func (this *WXPayServer) handlePapPayApply(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+	if p.Get("trade_type") != k_WXPAY_TRADE_TYPE_PAP {
+		this.writeBizFail(w, p.Get("sign_type"), "PARAM_ERROR", "trade_type 必须为 PAP")
+		return
+	}
+
+	var totalFee, _ = strconv.Atoi(p.Get("total_fee"))
+
+	this.mu.Lock()
+	var contract = this.findContract(p)
+	if contract == nil || contract.ContractState != k_WXPAY_CONTRACT_STATE_SIGNED {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "CONTRACT_NOT_EXIST", "签约协议不存在或者已经解约")
+		return
+	}
+	if this.trades[p.Get("out_trade_no")] != nil {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "ORDERPAID", "商户订单号重复")
+		return
+	}
+
+	this.seq++
+	var trade = &wxPayTrade{}
+	trade.OutTradeNo = p.Get("out_trade_no")
+	trade.TransactionId = fmt.Sprintf("4200000%s%09d", time.Now().Format("20060102"), this.seq)
+	trade.Body = p.Get("body")
+	trade.TradeType = k_WXPAY_TRADE_TYPE_PAP
+	trade.TradeState = k_WXPAY_TRADE_STATE_USERPAYING
+	trade.TotalFee = totalFee
+	trade.FeeType = "CNY"
+	trade.NotifyURL = p.Get("notify_url")
+	trade.SignType = p.Get("sign_type")
+	trade.OpenId = contract.OpenId
+	this.trades[trade.OutTradeNo] = trade
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), this.successValues())
+}
+
+// handleTransfers 企业付款到零钱，请求使用 mch_appid 和 mchid 并且只支持 MD5 签名，响应没有签名，
+// 使用相同的 partner_trade_no 重试时返回第一次付款的结果
+func (this *WXPayServer) handleTransfers(w http.ResponseWriter, req *http.Request) {
+	p, err := decodeXML(req.Body)
+	if err != nil {
+		this.writeFail(w, "XML 格式错误")
+		return
+	}
+	if p.Get("mch_appid") != this.appId || p.Get("mchid") != this.mchId {
+		this.writeFail(w, "mch_appid 和 mchid 不匹配")
+		return
+	}
+	if p.Get("sign") != signWXPay(p, this.apiKey, "") {
+		this.writeFail(w, "签名错误")
+		return
+	}
+
+	var amount, _ = strconv.Atoi(p.Get("amount"))
+	var openId = p.Get("openid")
+
+	this.mu.Lock()
+	var transfer = this.transfers[p.Get("partner_trade_no")]
+	if transfer == nil {
+		var errCode, errCodeDes string
+		switch {
+		case p.Get("partner_trade_no") == "" || openId == "" || p.Get("desc") == "":
+			errCode, errCodeDes = "PARAM_ERROR", "参数错误"
+		case amount < 30:
+			errCode, errCodeDes = "AMOUNT_LIMIT", "付款金额不能小于最低限额"
+		case p.Get("check_name") == "FORCE_CHECK" && p.Get("re_user_name") == "":
+			errCode, errCodeDes = "PARAM_ERROR", "收款用户姓名不能为空"
+		case p.Get("check_name") == "FORCE_CHECK" && this.names[openId] != p.Get("re_user_name"):
+			errCode, errCodeDes = "NAME_MISMATCH", "姓名校验出错"
+		}
+		if errCode != "" {
+			this.mu.Unlock()
+			var rsp = this.transferValues()
+			rsp.Set("result_code", "FAIL")
+			rsp.Set("err_code", errCode)
+			rsp.Set("err_code_des", errCodeDes)
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write(encodeXML(rsp))
+			return
+		}
+
+		this.seq++
+		transfer = &wxPayTransfer{}
+		transfer.PartnerTradeNo = p.Get("partner_trade_no")
+		transfer.PaymentNo = fmt.Sprintf("1000018301%s%08d", time.Now().Format("20060102"), this.seq)
+		transfer.OpenId = openId
+		transfer.Amount = amount
+		transfer.Desc = p.Get("desc")
+		transfer.Status = k_WXPAY_TRANSFER_STATUS_SUCCESS
+		transfer.PaymentTime = time.Now().Format("2006-01-02 15:04:05")
+		this.transfers[transfer.PartnerTradeNo] = transfer
+	}
+
+	var rsp = this.transferValues()
+	rsp.Set("partner_trade_no", transfer.PartnerTradeNo)
+	rsp.Set("payment_no", transfer.PaymentNo)
+	rsp.Set("payment_time", transfer.PaymentTime)
+	this.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(encodeXML(rsp))
+}
+
+func (this *WXPayServer) transferValues() url.Values {
+	var rsp = url.Values{}
+	rsp.Set("return_code", "SUCCESS")
+	rsp.Set("return_msg", "OK")
+	rsp.Set("mch_appid", this.appId)
+	rsp.Set("mchid", this.mchId)
+	rsp.Set("nonce_str", newNotifyId())
+	rsp.Set("result_code", "SUCCESS")
+	return rsp
+}
+
+func (this *WXPayServer) handleGetTransferInfo(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	this.mu.Lock()
+	var transfer = this.transfers[p.Get("partner_trade_no")]
+	if transfer == nil {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "NOT_FOUND", "指定单号数据不存在")
+		return
+	}
+
+	var rsp = this.successValues()
+	rsp.Set("partner_trade_no", transfer.PartnerTradeNo)
+	rsp.Set("detail_id", transfer.PaymentNo)
+	rsp.Set("status", transfer.Status)
+	rsp.Set("openid", transfer.OpenId)
+	rsp.Set("payment_amount", strconv.Itoa(transfer.Amount))
+	rsp.Set("transfer_time", transfer.PaymentTime)
+	rsp.Set("payment_time", transfer.PaymentTime)
+	rsp.Set("desc", transfer.Desc)
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+// handleAddReceiver 添加分账接收方，请求中的 receiver 为 JSON 格式，商户类型的接收方必须提供名称
+func (this *WXPayServer) handleAddReceiver(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	var receiver struct {
+		Type         string `json:"type"`
+		Account      string `json:"account"`
+		Name         string `json:"name"`
+		RelationType string `json:"relation_type"`
+	}
+	if err := json.Unmarshal([]byte(p.Get("receiver")), &receiver); err != nil || receiver.Account == "" || receiver.RelationType == "" {
+		this.writeBizFail(w, p.Get("sign_type"), "PARAM_ERROR", "分账接收方参数错误")
+		return
+	}
+	if receiver.Type == k_WXPAY_RECEIVER_TYPE_MERCHANT_ID && receiver.Name == "" {
+		this.writeBizFail(w, p.Get("sign_type"), "PARAM_ERROR", "商户类型的分账接收方必须提供名称")
+		return
+	}
+
+	this.mu.Lock()
+	this.receivers[receiver.Account] = receiver.Type
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), this.successValues())
+}
+
+// handleProfitSharing 处理单次分账和多次分账请求，单次分账之后交易的分账会立即完结，
+// 分账请求受理之后状态为 PROCESSING，使用相同的 out_order_no 重试时返回第一次分账的结果
+func (this *WXPayServer) handleProfitSharing(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	var receivers []*wxPayProfitSharingReceiver
+	if err := json.Unmarshal([]byte(p.Get("receivers")), &receivers); err != nil || len(receivers) == 0 || p.Get("out_order_no") == "" {
+		this.writeBizFail(w, p.Get("sign_type"), "PARAM_ERROR", "分账参数错误")
+		return
+	}
+
+	this.mu.Lock()
+	var sharing = this.sharings[p.Get("out_order_no")]
+	if sharing == nil {
+		var trade = this.findTrade(url.Values{"transaction_id": {p.Get("transaction_id")}})
+		var errCode, errCodeDes string
+		switch {
+		case trade == nil:
+			errCode, errCodeDes = "ORDERNOTEXIST", "订单不存在"
+		case trade.ProfitSharing != "Y":
+			errCode, errCodeDes = "NOT_SHARE_ORDER", "该笔订单不能分账"
+		case trade.TradeState != k_WXPAY_TRADE_STATE_SUCCESS && trade.TradeState != k_WXPAY_TRADE_STATE_REFUND:
+			errCode, errCodeDes = "ORDER_NOT_READY", "订单处理中，暂时无法分账"
+		case trade.SplitFinished:
+			errCode, errCodeDes = "INVALID_REQUEST", "订单的分账已经完结"
+		}
+
+		var total = 0
+		for _, r := range receivers {
+			if errCode == "" && (r.Amount <= 0 || this.receivers[r.Account] != r.Type) {
+				errCode, errCodeDes = "RECEIVER_INVALID", "分账接收方不存在或者分账金额错误"
+			}
+			total += r.Amount
+		}
+		if errCode == "" && trade.SplitFee+trade.RefundFee+total > trade.TotalFee {
+			errCode, errCodeDes = "NOT_ENOUGH", "分账金额超出最大可分金额"
+		}
+		if errCode != "" {
+			this.mu.Unlock()
+			this.writeBizFail(w, p.Get("sign_type"), errCode, errCodeDes)
+			return
+		}
+
+		this.seq++
+		sharing = &wxPayProfitSharing{}
+		sharing.TransactionId = trade.TransactionId
+		sharing.OutOrderNo = p.Get("out_order_no")
+		sharing.OrderId = fmt.Sprintf("3008450740%s%08d", time.Now().Format("20060102"), this.seq)
+		sharing.Status = k_WXPAY_PROFIT_SHARING_STATUS_PROCESSING
+		for _, r := range receivers {
+			r.Result = k_WXPAY_PROFIT_SHARING_RESULT_PENDING
+		}
+		sharing.Receivers = receivers
+		this.sharings[sharing.OutOrderNo] = sharing
+
+		trade.SplitFee += total
+		if strings.HasSuffix(req.URL.Path, "/multiprofitsharing") == false {
+			trade.SplitFinished = true
+		}
+	}
+
+	var rsp = this.successValues()
+	rsp.Set("transaction_id", sharing.TransactionId)
+	rsp.Set("out_order_no", sharing.OutOrderNo)
+	rsp.Set("order_id", sharing.OrderId)
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+func (this *WXPayServer) handleProfitSharingQuery(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	this.mu.Lock()
+	var sharing = this.sharings[p.Get("out_order_no")]
+	if sharing == nil || sharing.TransactionId != p.Get("transaction_id") {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "ORDERNOTEXIST", "分账单不存在")
+		return
+	}
+
+	var receivers, _ = json.Marshal(sharing.Receivers)
+	var rsp = this.successValues()
+	rsp.Set("transaction_id", sharing.TransactionId)
+	rsp.Set("out_order_no", sharing.OutOrderNo)
+	rsp.Set("order_id", sharing.OrderId)
+	rsp.Set("status", sharing.Status)
+	rsp.Set("receivers", string(receivers))
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+// handleProfitSharingReturn 分账回退，只能从商户类型并且已经分账成功的接收方回退，回退会同步完成，
+// 可回退的金额不足时回退结果为 FAILED，使用相同的 out_return_no 重试时返回第一次回退的结果
+func (this *WXPayServer) handleProfitSharingReturn(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	var amount, _ = strconv.Atoi(p.Get("return_amount"))
+
+	this.mu.Lock()
+	var sharing = this.sharings[p.Get("out_order_no")]
+	if sharing == nil {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "ORDERNOTEXIST", "分账单不存在")
+		return
+	}
+	if rsp, ok := sharing.returns[p.Get("out_return_no")]; ok {
+		this.mu.Unlock()
+		this.writeValues(w, p.Get("sign_type"), rsp)
+		return
+	}
+
+	var receiver *wxPayProfitSharingReceiver
+	for _, r := range sharing.Receivers {
+		if r.Type == k_WXPAY_RECEIVER_TYPE_MERCHANT_ID && r.Account == p.Get("return_account") {
+			receiver = r
+		}
+	}
+	if p.Get("out_return_no") == "" || p.Get("return_account_type") != k_WXPAY_RECEIVER_TYPE_MERCHANT_ID || receiver == nil || amount <= 0 {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), "PARAM_ERROR", "回退方不存在或者回退金额错误")
+		return
+	}
+
+	this.seq++
+	var rsp = this.successValues()
+	rsp.Set("order_id", sharing.OrderId)
+	rsp.Set("out_order_no", sharing.OutOrderNo)
+	rsp.Set("out_return_no", p.Get("out_return_no"))
+	rsp.Set("return_no", fmt.Sprintf("3008450740%s%08d", time.Now().Format("20060102"), this.seq))
+	rsp.Set("return_account_type", p.Get("return_account_type"))
+	rsp.Set("return_account", receiver.Account)
+	rsp.Set("return_amount", strconv.Itoa(amount))
+	rsp.Set("description", p.Get("description"))
+	if receiver.Result != k_WXPAY_PROFIT_SHARING_RESULT_SUCCESS || receiver.ReturnAmount+amount > receiver.Amount {
+		rsp.Set("result", "FAILED")
+		rsp.Set("fail_reason", "BALANCE_NOT_ENOUGH")
+	} else {
+		receiver.ReturnAmount += amount
+		rsp.Set("result", "SUCCESS")
+		rsp.Set("finish_time", time.Now().Format("20060102150405"))
+	}
+	if sharing.returns == nil {
+		sharing.returns = make(map[string]url.Values)
+	}
+	sharing.returns[p.Get("out_return_no")] = rsp
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+// handleProfitSharingFinish 完结分账，完结之后交易不能再分账
+func (this *WXPayServer) handleProfitSharingFinish(w http.ResponseWriter, req *http.Request) {
+	p, ok := this.readRequest(w, req)
+	if ok == false {
+		return
+	}
+
+	this.mu.Lock()
+	var trade = this.findTrade(url.Values{"transaction_id": {p.Get("transaction_id")}})
+	var errCode, errCodeDes string
+	switch {
+	case trade == nil:
+		errCode, errCodeDes = "ORDERNOTEXIST", "订单不存在"
+	case trade.ProfitSharing != "Y":
+		errCode, errCodeDes = "NOT_SHARE_ORDER", "该笔订单不能分账"
+	case trade.SplitFinished:
+		errCode, errCodeDes = "INVALID_REQUEST", "订单的分账已经完结"
+	case p.Get("out_order_no") == "" || p.Get("description") == "":
+		errCode, errCodeDes = "PARAM_ERROR", "参数错误"
+	}
+	if errCode != "" {
+		this.mu.Unlock()
+		this.writeBizFail(w, p.Get("sign_type"), errCode, errCodeDes)
+		return
+	}
+
+	this.seq++
+	trade.SplitFinished = true
+	var rsp = this.successValues()
+	rsp.Set("transaction_id", trade.TransactionId)
+	rsp.Set("out_order_no", p.Get("out_order_no"))
+	rsp.Set("order_id", fmt.Sprintf("3008450740%s%08d", time.Now().Format("20060102"), this.seq))
+	this.mu.Unlock()
+
+	this.writeValues(w, p.Get("sign_type"), rsp)
+}
+
+func (this *WXPayServer) successValues() url.Values {
+	var p = url.Values{}
+	p.Set("return_code", "SUCCESS")
+	p.Set("return_msg", "OK")
+	p.Set("appid", this.appId)
+	p.Set("mch_id", this.mchId)
+	p.Set("nonce_str", newNotifyId())
+	p.Set("result_code", "SUCCESS")
+	return p
+}
+
+func (this *WXPayServer) writeFail(w http.ResponseWriter, msg string) {
+	var p = url.Values{}
+	p.Set("return_code", "FAIL")
+	p.Set("return_msg", msg)
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(encodeXML(p))
+}
+
+func (this *WXPayServer) writeBizFail(w http.ResponseWriter, signType, errCode, errCodeDes string) {
+	var p = this.successValues()
+	p.Set("result_code", "FAIL")
+	p.Set("err_code", errCode)
+	p.Set("err_code_des", errCodeDes)
+	this.writeValues(w, signType, p)
+}
+
+func (this *WXPayServer) writeValues(w http.ResponseWriter, signType string, p url.Values) {
+	p.Set("sign", signWXPay(p, this.apiKey, signType))
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(encodeXML(p))
+}
+
+func encodeXML(p url.Values) []byte {
+	var keys = make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf = &bytes.Buffer{}
+	buf.WriteString("<xml>")
+	for _, key := range keys {
+		var value = p.Get(key)
+		if value == "" {
+			continue
+		}
+		buf.WriteString("<" + key + "><![CDATA[")
+		buf.WriteString(value)
+		buf.WriteString("]]></" + key + ">")
+	}
+	buf.WriteString("</xml>")
+	return buf.Bytes()
+}
+
+func decodeXML(r io.Reader) (url.Values, error) {
+	var p = url.Values{}
+	var d = xml.NewDecoder(r)
+	var key string
+	var depth = 0
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			key = t.Name.Local
+		case xml.CharData:
+			if depth == 2 && key != "" {
+				p.Set(key, p.Get(key)+string(t))
+			}
+		case xml.EndElement:
+			depth--
+			key = ""
+		}
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty xml")
+	}
+	return p, nil
+}
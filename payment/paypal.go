@@ -5,23 +5,44 @@ import (
 	"github.com/smartwalle/ngx"
 	"github.com/smartwalle/paypal"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	K_CHANNEL_PAYPAL = "paypal"
 )
 
+// PayPal Refund 的状态
+const (
+	k_PAYPAL_REFUND_STATE_PENDING   = "pending"
+	k_PAYPAL_REFUND_STATE_COMPLETED = "completed"
+	k_PAYPAL_REFUND_STATE_FAILED    = "failed"
+	k_PAYPAL_REFUND_STATE_CANCELLED = "cancelled"
+)
+
 type PayPal struct {
 	client              *paypal.PayPal
+	now                 func() time.Time
+	accountId           string
 	ReturnURL           string // 支付成功之后回调 URL
 	CancelURL           string // 用户取消付款回调 URL
 	WebHookId           string
 	ExperienceProfileId string
 }
 
-func NewPayPal(clientId, secret string, isProduction bool) *PayPal {
+func NewPayPal(clientId, secret string, isProduction bool, opts ...Option) *PayPal {
+	var o = newOptions(K_CHANNEL_PAYPAL, opts...)
+
 	var p = &PayPal{}
+	p.now = o.now
+	p.accountId = o.accountId
 	p.client = paypal.New(clientId, secret, isProduction)
+	p.client.SetHTTPClient(o.httpClient)
+	if o.baseURL != "" {
+		p.client.SetAPIDomain(o.baseURL)
+	}
 	return p
 }
 
@@ -29,17 +50,51 @@ func (this *PayPal) Identifier() string {
 	return K_CHANNEL_PAYPAL
 }
 
+func (this *PayPal) AccountId() string {
+	return this.accountId
+}
+
 func (this *PayPal) CreateTradeOrder(order *Order) (url string, err error) {
+	return this.createPayment(order, paypal.K_PAYMENT_INTENT_SALE)
+}
+
+// SupportCurrency PayPal 的订单必须指定货币
+func (this *PayPal) SupportCurrency(tradeMethod, currency string) bool {
+	return containsCurrency(paypalCurrencies, currency)
+}
+
+func (this *PayPal) decimals(currency string) int {
+	return paypalDecimals(currency)
+}
+
+func (this *PayPal) formatAmount(currency string, amount float64) string {
+	return paypalFormatAmount(currency, amount)
+}
+
+// paypalDecimals 返回货币在 PayPal 中的小数位数，PayPal 不支持 HUF、JPY 和 TWD 使用小数
+func paypalDecimals(currency string) int {
+	if paypalZeroDecimalCurrencies[currency] {
+		return 0
+	}
+	return CurrencyDecimals(currency)
+}
+
+func paypalFormatAmount(currency string, amount float64) string {
+	var d = paypalDecimals(currency)
+	return strconv.FormatFloat(roundAmount(amount, d), 'f', d, 64)
+}
+
+func (this *PayPal) createPayment(order *Order, intent paypal.PaymentIntent) (url string, err error) {
 	// PayPal 不用判断 method
 	var p = &paypal.Payment{}
-	p.Intent = paypal.K_PAYMENT_INTENT_SALE
+	p.Intent = intent
 
 	var cancelURL = ngx.MustURL(this.CancelURL)
-	cancelURL.Add("channel", this.Identifier())
+	addChannel(cancelURL, this.Identifier(), this.accountId)
 	cancelURL.Add("order_no", order.OrderNo)
 
 	var returnURL = ngx.MustURL(this.ReturnURL)
-	returnURL.Add("channel", this.Identifier())
+	addChannel(returnURL, this.Identifier(), this.accountId)
 	returnURL.Add("order_no", order.OrderNo)
 
 	p.Payer = &paypal.Payer{}
@@ -69,31 +124,27 @@ func (this *PayPal) CreateTradeOrder(order *Order) (url string, err error) {
 		transaction.ItemList.ShippingAddress.Phone = order.ShippingAddress.Phone
 	}
 
+	// PayPal 会验证各项金额的总和，所以按照 PayPal 的小数位数计算各项金额
+	var decimals = this.decimals(order.Currency)
 	var items = make([]*paypal.Item, 0, 0)
-	var productAmount float64 = 0
-	var productTax float64 = 0
 	for _, p := range order.ProductList {
 		var item = &paypal.Item{}
 		item.Name = p.Name
 		item.Quantity = fmt.Sprintf("%d", p.Quantity)
-		item.Price = fmt.Sprintf("%.2f", p.Price)
-		item.Tax = fmt.Sprintf("%.2f", p.Tax)
+		item.Price = this.formatAmount(order.Currency, p.Price)
+		item.Tax = this.formatAmount(order.Currency, p.Tax)
 		item.SKU = p.SKU
 		item.Currency = order.Currency
 		items = append(items, item)
-
-		productAmount += p.Price * float64(p.Quantity)
-		productTax += p.Tax * float64(p.Quantity)
 	}
 	transaction.ItemList.Items = items
 
-	transaction.Amount.Details.Shipping = fmt.Sprintf("%.2f", order.Shipping)
-	transaction.Amount.Details.ShippingDiscount = fmt.Sprintf("%.2f", order.Discount)
-	transaction.Amount.Details.Tax = fmt.Sprintf("%.2f", productTax)
-	transaction.Amount.Details.Subtotal = fmt.Sprintf("%.2f", productAmount)
-
-	var amount = productAmount + productTax + order.Shipping - order.Discount
-	transaction.Amount.Total = fmt.Sprintf("%.2f", amount)
+	var totals = order.totals(decimals)
+	transaction.Amount.Details.Shipping = this.formatAmount(order.Currency, totals.Shipping)
+	transaction.Amount.Details.ShippingDiscount = this.formatAmount(order.Currency, totals.Discount)
+	transaction.Amount.Details.Tax = this.formatAmount(order.Currency, totals.Tax)
+	transaction.Amount.Details.Subtotal = this.formatAmount(order.Currency, totals.Subtotal)
+	transaction.Amount.Total = this.formatAmount(order.Currency, totals.Total)
 
 	p.Transactions = []*paypal.Transaction{transaction}
 
@@ -116,25 +167,66 @@ func (this *PayPal) GetTrade(tradeNo string) (result *Trade, err error) {
 		return nil, err
 	}
 
+	if rsp.State == paypal.K_PAYMENT_STATE_CREATED && rsp.Payer != nil && rsp.Payer.PayerInfo != nil {
+		if rsp, err = this.client.ExecuteApprovedPayment(rsp.Id, rsp.Payer.PayerInfo.PayerId); err != nil {
+			return nil, err
+		}
+	}
+	return this.trade(rsp), nil
+}
+
+// ReturnHandler 处理用户在 PayPal 确认付款之后跳转回来的请求，URL 中的 order_no、paymentId 和 PayerID 需要与付款信息一致
+func (this *PayPal) ReturnHandler(req *http.Request) (result *Trade, err error) {
+	req.ParseForm()
+
+	var paymentId = req.FormValue("paymentId")
+	var payerId = req.FormValue("PayerID")
+	if paymentId == "" {
+		return nil, ErrUnknownTradeNo
+	}
+	if payerId == "" {
+		return nil, ErrPayerNotApproved
+	}
+
+	rsp, err := this.client.GetPaymentDetails(paymentId)
+	if err != nil {
+		return nil, err
+	}
+
+	// order_no 由 CreateTradeOrder 添加在 ReturnURL 中，缺少时无法确认 paymentId 属于该订单
+	var orderNo = req.FormValue("order_no")
+	if orderNo == "" || len(rsp.Transactions) == 0 || rsp.Transactions[0].InvoiceNumber != orderNo {
+		return nil, ErrTradeMismatch
+	}
+	if rsp.Payer != nil && rsp.Payer.PayerInfo != nil && rsp.Payer.PayerInfo.PayerId != "" && rsp.Payer.PayerInfo.PayerId != payerId {
+		return nil, ErrTradeMismatch
+	}
+
 	if rsp.State == paypal.K_PAYMENT_STATE_CREATED {
-		if paymentRsp, err := this.client.ExecuteApprovedPayment(rsp.Id, rsp.Payer.PayerInfo.PayerId); err != nil {
+		if rsp, err = this.client.ExecuteApprovedPayment(rsp.Id, payerId); err != nil {
 			return nil, err
-		} else {
-			rsp = paymentRsp
 		}
 	}
+	return this.trade(rsp), nil
+}
 
+func (this *PayPal) trade(rsp *paypal.Payment) (result *Trade) {
 	result = &Trade{}
 	result.Channel = this.Identifier()
 	result.RawTrade = rsp
 	result.TradeNo = rsp.Id
 	result.TradeStatus = string(rsp.State)
+	result.Status = K_TRADE_STATUS_PENDING
+	if rsp.State == paypal.K_PAYMENT_STATE_FAILED {
+		result.Status = K_TRADE_STATUS_FAILED
+	}
 
 	if len(rsp.Transactions) > 0 {
 		var trans = rsp.Transactions[0]
 		result.OrderNo = trans.InvoiceNumber
 		if trans.Amount != nil {
 			result.TotalAmount = trans.Amount.Total
+			result.Currency = trans.Amount.Currency
 		}
 		if rsp.Payer != nil && rsp.Payer.PayerInfo != nil {
 			result.PayerId = rsp.Payer.PayerInfo.PayerId
@@ -142,42 +234,174 @@ func (this *PayPal) GetTrade(tradeNo string) (result *Trade, err error) {
 		}
 		if len(trans.RelatedResources) > 0 {
 			var relatedRes = trans.RelatedResources[0]
-			result.TradeStatus = string(relatedRes.Sale.State)
-			if result.TradeStatus == string(paypal.K_SALE_STATE_COMPLETED) {
-				result.TradeSuccess = true
+			if relatedRes.Sale != nil {
+				result.TradeStatus = string(relatedRes.Sale.State)
+				result.Status = payPalSaleStatus(relatedRes.Sale.State)
+				if result.TradeStatus == string(paypal.K_SALE_STATE_COMPLETED) {
+					result.TradeSuccess = true
+				}
+			} else if relatedRes.Authorization != nil {
+				result.TradeStatus = string(relatedRes.Authorization.State)
+				result.Status = payPalAuthorizationStatus(relatedRes.Authorization.State)
+				result.AuthorizationId = relatedRes.Authorization.Id
 			}
 		}
 	}
-	return result, nil
+	return result
 }
 
 func (this *PayPal) GetTradeWithOrderNo(orderNo string) (result *Trade, err error) {
 	return nil, ErrPayPalNotAllowed
 }
 
+// Refund 对付款的 Sale 退款，退款单号作为退款的 invoice_number
+func (this *PayPal) Refund(param *RefundParam) (result *Refund, err error) {
+	rsp, err := this.client.GetPaymentDetails(param.TradeNo)
+	if err != nil {
+		return nil, err
+	}
+
+	var sale *paypal.Sale
+	for _, trans := range rsp.Transactions {
+		for _, res := range trans.RelatedResources {
+			if res.Sale != nil && sale == nil {
+				sale = res.Sale
+			}
+		}
+	}
+	if sale == nil {
+		return nil, ErrUnknownTradeNo
+	}
+
+	var amount = &paypal.Amount{}
+	amount.Currency = param.Currency
+	amount.Total = this.formatAmount(param.Currency, param.Amount)
+
+	refund, err := this.client.RefundSale(sale.Id, param.RefundNo, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.OrderNo = param.OrderNo
+	result.TradeNo = rsp.Id
+	result.RefundNo = param.RefundNo
+	result.RefundId = refund.Id
+	result.Status = payPalRefundStatus(refund.State)
+	result.Amount = amount.Total
+	result.RawRefund = refund
+	return result, nil
+}
+
+// payPalRefundStatus 将 PayPal Refund 的状态转换为 K_REFUND_STATUS_*
+func payPalRefundStatus(state string) string {
+	switch state {
+	case k_PAYPAL_REFUND_STATE_PENDING:
+		return K_REFUND_STATUS_PROCESSING
+	case k_PAYPAL_REFUND_STATE_COMPLETED:
+		return K_REFUND_STATUS_SUCCESS
+	case k_PAYPAL_REFUND_STATE_FAILED, k_PAYPAL_REFUND_STATE_CANCELLED:
+		return K_REFUND_STATUS_FAILED
+	}
+	return ""
+}
+
+// payPalSaleStatus 将 PayPal Sale 的状态转换为 K_TRADE_STATUS_*
+func payPalSaleStatus(state paypal.SaleState) string {
+	switch state {
+	case paypal.K_SALE_STATE_PENDING:
+		return K_TRADE_STATUS_PENDING
+	case paypal.K_SALE_STATE_COMPLETED:
+		return K_TRADE_STATUS_SUCCESS
+	case paypal.K_SALE_STATE_REFUNDED, paypal.K_SALE_STATE_PARTIALLY_REFUNDED:
+		return K_TRADE_STATUS_REFUNDED
+	case paypal.K_SALE_STATE_DENIED:
+		return K_TRADE_STATUS_FAILED
+	}
+	return ""
+}
+
+// payPalAuthorizationStatus 将 PayPal Authorization 的状态转换为 K_TRADE_STATUS_*，已经授权但是没有扣款的交易为 K_TRADE_STATUS_PENDING
+func payPalAuthorizationStatus(state paypal.AuthorizationState) string {
+	switch state {
+	case paypal.K_AUTHORIZATION_STATE_PENDING, paypal.K_AUTHORIZATION_STATE_AUTHORIZED:
+		return K_TRADE_STATUS_PENDING
+	case paypal.K_AUTHORIZATION_STATE_CAPTURED, paypal.K_AUTHORIZATION_STATE_PARTIALLY_CAPTURED:
+		return K_TRADE_STATUS_SUCCESS
+	case paypal.K_AUTHORIZATION_STATE_VOIDED, paypal.K_AUTHORIZATION_STATE_EXPIRED:
+		return K_TRADE_STATUS_CLOSED
+	}
+	return ""
+}
+
+// NotifyHandler 处理 PayPal 的 Webhook 通知，通知无法通过 PayPal 的签名验证时返回 ErrInvalidSignature
 func (this *PayPal) NotifyHandler(req *http.Request) (result *Notification, err error) {
+	// SDK 会调用 PayPal 的接口验证通知，验证失败和验证请求失败返回的错误无法区分，都当做签名验证失败处理
 	event, err := this.client.GetWebhookEvent(this.WebHookId, req)
 	if err != nil {
-		return nil, err
+		return nil, ErrInvalidSignature
 	}
 
 	result = &Notification{}
 	result.Channel = this.Identifier()
 	result.RawNotify = event
 
-	// TODO 需要处理退款
 	switch event.ResourceType {
 	case paypal.K_EVENT_RESOURCE_TYPE_SALE:
+		var sale = event.Sale()
 		result.NotifyType = K_NOTIFY_TYPE_TRADE
-		result.OrderNo = event.Sale().InvoiceNumber
-		result.TradeNo = event.Sale().ParentPayment
+		result.OrderNo = sale.InvoiceNumber
+		result.TradeNo = sale.ParentPayment
+		result.Status = payPalSaleStatus(sale.State)
+		result.RawStatus = string(sale.State)
+		if sale.Amount != nil {
+			result.TotalAmount = sale.Amount.Total
+			result.Currency = sale.Amount.Currency
+		}
+		if sale.CreateTime != "" {
+			result.PaidTime, _ = time.Parse(time.RFC3339, sale.CreateTime)
+		}
 	case paypal.K_EVENT_RESOURCE_TYPE_REFUND:
+		// 退款通知中只有退款金额，交易金额需要查询交易
+		var refund = event.Refund()
 		result.NotifyType = K_NOTIFY_TYPE_REFUND
-		result.OrderNo = event.Refund().InvoiceNumber
-		result.TradeNo = event.Refund().ParentPayment
+		result.OrderNo = refund.InvoiceNumber
+		result.TradeNo = refund.ParentPayment
+		result.Status = K_TRADE_STATUS_REFUNDED
+		result.RawStatus = refund.State
+		result.RefundId = refund.Id
+		result.RefundStatus = payPalRefundStatus(refund.State)
+		if refund.CreateTime != "" {
+			result.RefundTime, _ = time.Parse(time.RFC3339, refund.CreateTime)
+		}
+		if refund.Amount != nil {
+			// PayPal 退款的金额为负数
+			result.RefundAmount = strings.TrimPrefix(refund.Amount.Total, "-")
+			result.Currency = refund.Amount.Currency
+		}
 	case paypal.K_EVENT_RESOURCE_TYPE_DISPUTE:
 		result.NotifyType = K_NOTIFY_TYPE_DISPUTE
-		result.OrderNo = event.Dispute().DisputedTransactions[0].InvoiceNumber
+		result.DisputeId = event.Dispute().DisputeId
+		if trans := event.Dispute().DisputedTransactions; len(trans) > 0 {
+			result.OrderNo = trans[0].InvoiceNumber
+		}
+
+	case paypal.K_EVENT_RESOURCE_TYPE_AGREEMENT:
+		switch event.EventType {
+		case paypal.K_EVENT_TYPE_BILLING_SUBSCRIPTION_CREATED:
+			result.NotifyType = K_NOTIFY_TYPE_AGREEMENT_SIGN
+		case paypal.K_EVENT_TYPE_BILLING_SUBSCRIPTION_CANCELLED:
+			result.NotifyType = K_NOTIFY_TYPE_AGREEMENT_UNSIGN
+		}
+		result.AgreementNo = payPalAgreementNo(event.BillingAgreement())
+		result.AgreementId = event.BillingAgreement().Id
+	case paypal.K_EVENT_RESOURCE_TYPE_PAYOUTS_ITEM:
+		result.NotifyType = K_NOTIFY_TYPE_PAYOUT
+		if item := event.PayoutItem(); item.PayoutItem != nil {
+			result.OrderNo = item.PayoutItem.SenderItemId
+		}
+		result.TradeNo = event.PayoutItem().PayoutItemId
 	}
 	return result, nil
 }
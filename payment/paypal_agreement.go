@@ -0,0 +1,156 @@
+package payment
+
+import (
+	"fmt"
+	"github.com/smartwalle/ngx"
+	"github.com/smartwalle/paypal"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CreateAgreement 创建并激活 Billing Plan，然后基于该 Plan 创建 Billing Agreement，返回用户确认签约的 URL，
+// PayPal 的签约协议没有商户协议号，所以 AgreementNo 会附加在 Billing Plan 的 return_url 中
+func (this *PayPal) CreateAgreement(agreement *Agreement) (url string, err error) {
+	var returnURL = ngx.MustURL(this.ReturnURL)
+	addChannel(returnURL, this.Identifier(), this.accountId)
+	returnURL.Add("agreement_no", agreement.AgreementNo)
+
+	var cancelURL = ngx.MustURL(this.CancelURL)
+	addChannel(cancelURL, this.Identifier(), this.accountId)
+	cancelURL.Add("agreement_no", agreement.AgreementNo)
+
+	var period = agreement.Period
+	if period <= 0 {
+		period = 1
+	}
+
+	var definition = &paypal.PaymentDefinition{}
+	definition.Name = agreement.Subject
+	definition.Type = paypal.K_PAYMENT_DEFINITION_TYPE_REGULAR
+	definition.Frequency = strings.ToUpper(agreement.PeriodType)
+	definition.FrequencyInterval = fmt.Sprintf("%d", period)
+	definition.Cycles = fmt.Sprintf("%d", agreement.Cycles)
+	definition.Amount = &paypal.Currency{}
+	definition.Amount.Value = this.formatAmount(agreement.Currency, agreement.Amount)
+	definition.Amount.Currency = agreement.Currency
+
+	var plan = &paypal.BillingPlan{}
+	plan.Name = agreement.Subject
+	plan.Description = agreement.Subject
+	plan.Type = paypal.K_BILLING_PLAN_TYPE_INFINITE
+	if agreement.Cycles > 0 {
+		plan.Type = paypal.K_BILLING_PLAN_TYPE_FIXED
+	}
+	plan.PaymentDefinitions = []*paypal.PaymentDefinition{definition}
+	plan.MerchantPreferences = &paypal.MerchantPreferences{}
+	plan.MerchantPreferences.ReturnURL = returnURL.String()
+	plan.MerchantPreferences.CancelURL = cancelURL.String()
+	plan.MerchantPreferences.AutoBillAmount = "YES"
+	plan.MerchantPreferences.InitialFailAmountAction = "CONTINUE"
+	plan.MerchantPreferences.MaxFailAttempts = "3"
+
+	if plan, err = this.client.CreateBillingPlan(plan); err != nil {
+		return "", err
+	}
+	if err = this.client.ActivateBillingPlan(plan.Id); err != nil {
+		return "", err
+	}
+
+	// PayPal 要求 start_date 必须晚于当前时间
+	var startTime = agreement.StartTime
+	if now := this.now(); startTime.Before(now.Add(time.Minute)) {
+		startTime = now.Add(time.Minute)
+	}
+
+	var p = &paypal.BillingAgreement{}
+	p.Name = agreement.Subject
+	p.Description = agreement.Subject
+	p.StartDate = startTime.UTC().Format("2006-01-02T15:04:05Z")
+	p.Plan = &paypal.BillingPlan{Id: plan.Id}
+	p.Payer = &paypal.Payer{}
+	p.Payer.PaymentMethod = paypal.K_PAYMENT_METHOD_PAYPAL
+
+	result, err := this.client.CreateBillingAgreement(p)
+	if err != nil {
+		return "", err
+	}
+
+	for _, link := range result.Links {
+		if link.Rel == "approval_url" {
+			return link.Href, nil
+		}
+	}
+	return "", err
+}
+
+// AgreementReturnHandler 处理用户确认签约之后跳转回来的请求，会使用 URL 中的 token 执行签约协议
+func (this *PayPal) AgreementReturnHandler(req *http.Request) (result *Subscription, err error) {
+	req.ParseForm()
+
+	var token = req.FormValue("token")
+	if token == "" {
+		return nil, ErrUnknownAgreement
+	}
+
+	rsp, err := this.client.ExecuteBillingAgreement(token)
+	if err != nil {
+		return nil, err
+	}
+
+	result = this.subscription(rsp)
+	var agreementNo = req.FormValue("agreement_no")
+	if result.AgreementNo == "" {
+		result.AgreementNo = agreementNo
+	}
+	if agreementNo != "" && result.AgreementNo != agreementNo {
+		return nil, ErrTradeMismatch
+	}
+	return result, nil
+}
+
+func (this *PayPal) GetAgreement(agreementId string) (result *Subscription, err error) {
+	rsp, err := this.client.GetBillingAgreement(agreementId)
+	if err != nil {
+		return nil, err
+	}
+	return this.subscription(rsp), nil
+}
+
+// ChargeAgreement PayPal 会按照 Billing Plan 自动扣款，不支持主动扣款
+func (this *PayPal) ChargeAgreement(param *AgreementChargeParam) (result *Trade, err error) {
+	return nil, ErrPayPalNotAllowed
+}
+
+func (this *PayPal) CancelAgreement(agreementId string) (err error) {
+	return this.client.CancelBillingAgreement(agreementId, "cancel")
+}
+
+func (this *PayPal) subscription(rsp *paypal.BillingAgreement) (result *Subscription) {
+	result = &Subscription{}
+	result.Channel = this.Identifier()
+	result.RawAgreement = rsp
+	result.AgreementNo = payPalAgreementNo(rsp)
+	result.AgreementId = rsp.Id
+	result.Status = rsp.State
+	if rsp.State == paypal.K_BILLING_AGREEMENT_STATE_ACTIVE {
+		result.Active = true
+	}
+	if rsp.Payer != nil && rsp.Payer.PayerInfo != nil {
+		result.PayerId = rsp.Payer.PayerInfo.PayerId
+	}
+	return result
+}
+
+// payPalAgreementNo 从 Billing Plan 的 return_url 中获取商户协议号，签约协议中没有 Billing Plan 的信息时返回空字符串
+func payPalAgreementNo(rsp *paypal.BillingAgreement) string {
+	if rsp == nil || rsp.Plan == nil || rsp.Plan.MerchantPreferences == nil {
+		return ""
+	}
+	u, err := url.Parse(rsp.Plan.MerchantPreferences.ReturnURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("agreement_no")
+}
@@ -0,0 +1,124 @@
+package payment
+
+import (
+	"github.com/smartwalle/paypal"
+	"strconv"
+)
+
+const (
+	k_PAYPAL_CAPTURE_STATE_DENIED = "denied"
+)
+
+// Authorize 创建 intent 为 authorize 的付款，用户同意付款并执行之后，可以通过 Trade 的 AuthorizationId 进行扣款
+func (this *PayPal) Authorize(order *Order) (url string, err error) {
+	return this.createPayment(order, paypal.K_PAYMENT_INTENT_AUTHORIZE)
+}
+
+func (this *PayPal) GetAuthorization(authorizationId string) (result *Authorization, err error) {
+	rsp, err := this.client.GetAuthorization(authorizationId)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Authorization{}
+	result.Channel = this.Identifier()
+	result.RawAuthorization = rsp
+	result.OrderNo = rsp.InvoiceNumber
+	result.AuthorizationId = rsp.Id
+	result.Status = string(rsp.State)
+	if rsp.Amount != nil {
+		result.TotalAmount = rsp.Amount.Total
+	}
+	if rsp.State == paypal.K_AUTHORIZATION_STATE_AUTHORIZED || rsp.State == paypal.K_AUTHORIZATION_STATE_PARTIALLY_CAPTURED {
+		result.Authorized = true
+	}
+	return result, nil
+}
+
+func (this *PayPal) GetAuthorizationWithOrderNo(orderNo string) (result *Authorization, err error) {
+	return nil, ErrPayPalNotAllowed
+}
+
+// Capture 从预授权中扣款，PayPal 要求扣款时的货币与预授权一致，所以会先查询预授权信息
+func (this *PayPal) Capture(param *CaptureParam) (result *Capture, err error) {
+	auth, err := this.client.GetAuthorization(param.AuthorizationId)
+	if err != nil {
+		return nil, err
+	}
+	if auth.Amount == nil {
+		return nil, ErrUnknownAuthorization
+	}
+	if param.Currency != "" && param.Currency != auth.Amount.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+
+	var amount = &paypal.Amount{}
+	amount.Currency = auth.Amount.Currency
+	amount.Total = auth.Amount.Total
+
+	var isFinal = param.IsFinal
+	if param.Amount > 0 {
+		amount.Total = this.formatAmount(amount.Currency, param.Amount)
+	} else {
+		isFinal = true
+		if amount.Total, err = this.restAmount(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	rsp, err := this.client.CaptureAuthorization(param.AuthorizationId, amount, isFinal)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Capture{}
+	result.Channel = this.Identifier()
+	result.RawCapture = rsp
+	result.OrderNo = auth.InvoiceNumber
+	result.AuthorizationId = param.AuthorizationId
+	result.CaptureId = rsp.Id
+	result.Status = string(rsp.State)
+	if rsp.Amount != nil {
+		result.Amount = rsp.Amount.Total
+	}
+	if rsp.State == paypal.K_CAPTURE_STATE_COMPLETED {
+		result.CaptureSuccess = true
+	}
+	return result, nil
+}
+
+// restAmount 返回预授权剩余可以扣款的金额，PayPal 的预授权信息中没有已经扣款的金额，需要根据付款中的 capture 计算
+func (this *PayPal) restAmount(auth *paypal.Authorization) (string, error) {
+	if auth.State == paypal.K_AUTHORIZATION_STATE_AUTHORIZED {
+		return auth.Amount.Total, nil
+	}
+
+	rsp, err := this.client.GetPaymentDetails(auth.ParentPayment)
+	if err != nil {
+		return "", err
+	}
+
+	var rest, _ = strconv.ParseFloat(auth.Amount.Total, 64)
+	for _, trans := range rsp.Transactions {
+		var matched = false
+		var captured float64
+		for _, res := range trans.RelatedResources {
+			if res.Authorization != nil && res.Authorization.Id == auth.Id {
+				matched = true
+			}
+			if res.Capture != nil && res.Capture.Amount != nil && string(res.Capture.State) != k_PAYPAL_CAPTURE_STATE_DENIED {
+				var value, _ = strconv.ParseFloat(res.Capture.Amount.Total, 64)
+				captured += value
+			}
+		}
+		if matched {
+			rest -= captured
+		}
+	}
+	return this.formatAmount(auth.Amount.Currency, rest), nil
+}
+
+func (this *PayPal) Void(authorizationId string) (err error) {
+	_, err = this.client.VoidAuthorization(authorizationId)
+	return err
+}
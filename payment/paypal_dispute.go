@@ -0,0 +1,119 @@
+package payment
+
+import (
+	"github.com/smartwalle/paypal"
+	"net/url"
+	"time"
+)
+
+// ListDisputes 获取 since 之后创建的争议，会自动获取所有分页，since 为零值时获取 PayPal 默认返回的争议
+func (this *PayPal) ListDisputes(since time.Time) (results []*Dispute, err error) {
+	var p = &paypal.DisputeListParam{}
+	if since.IsZero() == false {
+		p.StartTime = since.UTC().Format("2006-01-02T15:04:05.000Z")
+	}
+
+	for {
+		rsp, err := this.client.ListDisputes(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range rsp.Items {
+			results = append(results, this.dispute(item))
+		}
+
+		var nextPageToken = ""
+		for _, link := range rsp.Links {
+			if link.Rel == "next" {
+				if u, err := url.Parse(link.Href); err == nil {
+					nextPageToken = u.Query().Get("next_page_token")
+				}
+			}
+		}
+		if nextPageToken == "" || nextPageToken == p.NextPageToken {
+			break
+		}
+		p.NextPageToken = nextPageToken
+	}
+	return results, nil
+}
+
+func (this *PayPal) GetDispute(disputeId string) (result *Dispute, err error) {
+	rsp, err := this.client.GetDispute(disputeId)
+	if err != nil {
+		return nil, err
+	}
+	return this.dispute(rsp), nil
+}
+
+func (this *PayPal) AcceptDispute(disputeId, note string) (err error) {
+	return this.client.AcceptDisputeClaim(disputeId, note)
+}
+
+func (this *PayPal) ProvideDisputeEvidence(disputeId string, evidences []*DisputeEvidence) (err error) {
+	var items = make([]*paypal.DisputeEvidence, 0, len(evidences))
+	for _, evidence := range evidences {
+		var item = &paypal.DisputeEvidence{}
+		item.Notes = evidence.Notes
+		item.EvidenceInfo = &paypal.EvidenceInfo{}
+
+		switch evidence.Type {
+		case K_EVIDENCE_TYPE_FULFILLMENT:
+			item.EvidenceType = "PROOF_OF_FULFILLMENT"
+			item.EvidenceInfo.TrackingInfo = []*paypal.TrackingInfo{{CarrierName: evidence.CarrierName, TrackingNumber: evidence.TrackingNumber}}
+		case K_EVIDENCE_TYPE_REFUND:
+			item.EvidenceType = "PROOF_OF_REFUND"
+			item.EvidenceInfo.RefundIds = []string{evidence.RefundId}
+		default:
+			item.EvidenceType = "OTHER"
+		}
+		items = append(items, item)
+	}
+	return this.client.ProvideDisputeEvidence(disputeId, items)
+}
+
+func (this *PayPal) SendDisputeMessage(disputeId, message string) (err error) {
+	return this.client.SendDisputeMessage(disputeId, message)
+}
+
+func (this *PayPal) EscalateDispute(disputeId, note string) (err error) {
+	return this.client.EscalateDispute(disputeId, note)
+}
+
+func (this *PayPal) dispute(rsp *paypal.Dispute) (result *Dispute) {
+	result = &Dispute{}
+	result.Channel = this.Identifier()
+	result.RawDispute = rsp
+	result.DisputeId = rsp.DisputeId
+	result.Reason = rsp.Reason
+	result.Stage = rsp.DisputeLifeCycleStage
+	result.RawStatus = rsp.Status
+
+	switch rsp.Status {
+	case paypal.K_DISPUTE_STATUS_OPEN, paypal.K_DISPUTE_STATUS_WAITING_FOR_SELLER_RESPONSE:
+		result.Status = K_DISPUTE_STATUS_WAITING_MERCHANT
+	case paypal.K_DISPUTE_STATUS_WAITING_FOR_BUYER_RESPONSE:
+		result.Status = K_DISPUTE_STATUS_WAITING_BUYER
+	case paypal.K_DISPUTE_STATUS_RESOLVED:
+		result.Status = K_DISPUTE_STATUS_RESOLVED
+	default:
+		result.Status = K_DISPUTE_STATUS_UNDER_REVIEW
+	}
+
+	if rsp.DisputeOutcome != nil {
+		result.Outcome = rsp.DisputeOutcome.OutcomeCode
+	}
+	if rsp.DisputeAmount != nil {
+		result.Amount = rsp.DisputeAmount.Value
+		result.Currency = rsp.DisputeAmount.Currency
+	}
+	if len(rsp.DisputedTransactions) > 0 {
+		result.OrderNo = rsp.DisputedTransactions[0].InvoiceNumber
+		result.TradeNo = rsp.DisputedTransactions[0].SellerTransactionId
+	}
+
+	result.ResponseDeadline, _ = time.Parse(time.RFC3339, rsp.SellerResponseDueDate)
+	result.CreateTime, _ = time.Parse(time.RFC3339, rsp.CreateTime)
+	result.UpdateTime, _ = time.Parse(time.RFC3339, rsp.UpdateTime)
+	return result
+}
@@ -0,0 +1,113 @@
+package payment
+
+import (
+	"github.com/smartwalle/paypal"
+)
+
+// Payout 通过 PayPal Payouts 向用户付款，PayeeAccount 为收款人的 PayPal 邮箱
+func (this *PayPal) Payout(payout *Payout) (result *PayoutResult, err error) {
+	results, err := this.BatchPayout(payout.PayoutNo, []*Payout{payout})
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, ErrUnknownPayout
+	}
+	return results[0], nil
+}
+
+// BatchPayout 创建批量付款之后会立即查询付款结果，PayPal 会异步处理批量付款，还没有处理的付款的状态为 K_PAYOUT_STATUS_PROCESSING，
+// 之后可以通过 GetPayout 或者 K_NOTIFY_TYPE_PAYOUT 通知获取付款结果
+func (this *PayPal) BatchPayout(batchNo string, payouts []*Payout) (results []*PayoutResult, err error) {
+	var p = &paypal.BatchPayout{}
+	p.SenderBatchHeader = &paypal.SenderBatchHeader{}
+	p.SenderBatchHeader.SenderBatchId = batchNo
+
+	for _, payout := range payouts {
+		var item = &paypal.PayoutItem{}
+		item.RecipientType = paypal.K_RECIPIENT_TYPE_EMAIL
+		item.Receiver = payout.PayeeAccount
+		item.SenderItemId = payout.PayoutNo
+		item.Note = payout.Remark
+		item.Amount = &paypal.Currency{}
+		item.Amount.Value = this.formatAmount(payout.Currency, payout.Amount)
+		item.Amount.Currency = payout.Currency
+		p.Items = append(p.Items, item)
+	}
+
+	rsp, err := this.client.CreateBatchPayout(p)
+	if err != nil {
+		return nil, err
+	}
+
+	detail, err := this.client.GetBatchPayout(rsp.BatchHeader.PayoutBatchId)
+	if err != nil {
+		return nil, err
+	}
+
+	var items = make(map[string]*paypal.PayoutItemDetail)
+	for _, item := range detail.Items {
+		if item.PayoutItem != nil {
+			items[item.PayoutItem.SenderItemId] = item
+		}
+	}
+
+	results = make([]*PayoutResult, 0, len(payouts))
+	for _, payout := range payouts {
+		var result *PayoutResult
+		if item := items[payout.PayoutNo]; item != nil {
+			result = this.payoutResult(item)
+		} else {
+			result = &PayoutResult{}
+			result.Channel = this.Identifier()
+			result.PayoutNo = payout.PayoutNo
+			result.Status = K_PAYOUT_STATUS_PROCESSING
+			result.RawStatus = rsp.BatchHeader.BatchStatus
+			result.Amount = this.formatAmount(payout.Currency, payout.Amount)
+		}
+		result.BatchNo = batchNo
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// GetPayout 使用 payout_item_id 查询付款结果
+func (this *PayPal) GetPayout(payoutId string) (result *PayoutResult, err error) {
+	rsp, err := this.client.GetPayoutItem(payoutId)
+	if err != nil {
+		return nil, err
+	}
+	return this.payoutResult(rsp), nil
+}
+
+func (this *PayPal) GetPayoutWithPayoutNo(payoutNo string) (result *PayoutResult, err error) {
+	return nil, ErrPayPalNotAllowed
+}
+
+func (this *PayPal) payoutResult(item *paypal.PayoutItemDetail) (result *PayoutResult) {
+	result = &PayoutResult{}
+	result.Channel = this.Identifier()
+	result.RawPayout = item
+	result.PayoutId = item.PayoutItemId
+	result.RawStatus = item.TransactionStatus
+	if item.PayoutItem != nil {
+		result.PayoutNo = item.PayoutItem.SenderItemId
+		if item.PayoutItem.Amount != nil {
+			result.Amount = item.PayoutItem.Amount.Value
+		}
+	}
+	if item.Errors != nil {
+		result.FailReason = item.Errors.Message
+	}
+
+	switch item.TransactionStatus {
+	case paypal.K_PAYOUT_ITEM_STATUS_SUCCESS:
+		result.Status = K_PAYOUT_STATUS_SUCCESS
+	case paypal.K_PAYOUT_ITEM_STATUS_FAILED, paypal.K_PAYOUT_ITEM_STATUS_RETURNED, paypal.K_PAYOUT_ITEM_STATUS_BLOCKED,
+		paypal.K_PAYOUT_ITEM_STATUS_REFUNDED, paypal.K_PAYOUT_ITEM_STATUS_DENIED:
+		result.Status = K_PAYOUT_STATUS_FAILED
+	default:
+		result.Status = K_PAYOUT_STATUS_PROCESSING
+	}
+	return result
+}
@@ -0,0 +1,773 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/smartwalle/ngx"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	K_CHANNEL_PAYPAL_V2 = "paypal_v2"
+)
+
+const (
+	k_PAYPAL_V2_SANDBOX_API_DOMAIN    = "https://api.sandbox.paypal.com"
+	k_PAYPAL_V2_PRODUCTION_API_DOMAIN = "https://api.paypal.com"
+
+	k_PAYPAL_V2_INTENT_CAPTURE = "CAPTURE"
+
+	k_PAYPAL_V2_ORDER_STATUS_CREATED               = "CREATED"
+	k_PAYPAL_V2_ORDER_STATUS_SAVED                 = "SAVED"
+	k_PAYPAL_V2_ORDER_STATUS_APPROVED              = "APPROVED"
+	k_PAYPAL_V2_ORDER_STATUS_PAYER_ACTION_REQUIRED = "PAYER_ACTION_REQUIRED"
+	k_PAYPAL_V2_ORDER_STATUS_VOIDED                = "VOIDED"
+	k_PAYPAL_V2_ORDER_STATUS_COMPLETED             = "COMPLETED"
+
+	k_PAYPAL_V2_CAPTURE_STATUS_COMPLETED          = "COMPLETED"
+	k_PAYPAL_V2_CAPTURE_STATUS_PENDING            = "PENDING"
+	k_PAYPAL_V2_CAPTURE_STATUS_DECLINED           = "DECLINED"
+	k_PAYPAL_V2_CAPTURE_STATUS_REFUNDED           = "REFUNDED"
+	k_PAYPAL_V2_CAPTURE_STATUS_PARTIALLY_REFUNDED = "PARTIALLY_REFUNDED"
+
+	k_PAYPAL_V2_REFUND_STATUS_CANCELLED = "CANCELLED"
+	k_PAYPAL_V2_REFUND_STATUS_FAILED    = "FAILED"
+	k_PAYPAL_V2_REFUND_STATUS_PENDING   = "PENDING"
+	k_PAYPAL_V2_REFUND_STATUS_COMPLETED = "COMPLETED"
+
+	k_PAYPAL_V2_RESOURCE_TYPE_ORDER   = "checkout-order"
+	k_PAYPAL_V2_RESOURCE_TYPE_CAPTURE = "capture"
+	k_PAYPAL_V2_RESOURCE_TYPE_REFUND  = "refund"
+)
+
+// PayPalV2 基于 PayPal Orders v2 接口（PayPal Checkout）的支付渠道，与基于 Payments v1 接口的 PayPal 可以同时注册，
+// 用于逐步迁移商户账号。CreateTradeOrder 返回用户确认付款的 URL，用户确认付款之后在 ReturnHandler 或者 CaptureOrder 中扣款，
+// GetTrade 只查询不扣款，TradeNo 为 PayPal 的订单号（Order Id）
+type PayPalV2 struct {
+	httpClient *http.Client
+	now        func() time.Time
+	accountId  string
+	clientId   string
+	secret     string
+	apiDomain  string
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+
+	ReturnURL string // 支付成功之后回调 URL
+	CancelURL string // 用户取消付款回调 URL
+	WebHookId string
+	BrandName string // 显示在 PayPal 付款页面上的商户名称，为空时使用 PayPal 账号中的名称
+}
+
+func NewPayPalV2(clientId, secret string, isProduction bool, opts ...Option) *PayPalV2 {
+	var o = newOptions(K_CHANNEL_PAYPAL_V2, opts...)
+
+	var p = &PayPalV2{}
+	p.httpClient = o.httpClient
+	p.now = o.now
+	p.accountId = o.accountId
+	p.clientId = clientId
+	p.secret = secret
+	p.apiDomain = k_PAYPAL_V2_SANDBOX_API_DOMAIN
+	if isProduction {
+		p.apiDomain = k_PAYPAL_V2_PRODUCTION_API_DOMAIN
+	}
+	if o.baseURL != "" {
+		p.apiDomain = strings.TrimRight(o.baseURL, "/")
+	}
+	return p
+}
+
+func (this *PayPalV2) Identifier() string {
+	return K_CHANNEL_PAYPAL_V2
+}
+
+func (this *PayPalV2) AccountId() string {
+	return this.accountId
+}
+
+// SupportCurrency PayPal 的订单必须指定货币
+func (this *PayPalV2) SupportCurrency(tradeMethod, currency string) bool {
+	return containsCurrency(paypalCurrencies, currency)
+}
+
+type ppv2Error struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+	DebugId string `json:"debug_id"`
+	Details []*struct {
+		Issue       string `json:"issue"`
+		Description string `json:"description"`
+	} `json:"details,omitempty"`
+}
+
+func (this *ppv2Error) Error() string {
+	if this.Message == "" {
+		return this.Name
+	}
+	return this.Name + ": " + this.Message
+}
+
+// hasIssue 返回错误是否为 issue，PayPal 的业务错误（例如 ORDER_ALREADY_CAPTURED）在 details 中
+func (this *ppv2Error) hasIssue(issue string) bool {
+	if this.Name == issue {
+		return true
+	}
+	for _, detail := range this.Details {
+		if detail != nil && detail.Issue == issue {
+			return true
+		}
+	}
+	return false
+}
+
+type ppv2Link struct {
+	Href   string `json:"href"`
+	Rel    string `json:"rel"`
+	Method string `json:"method,omitempty"`
+}
+
+type ppv2Money struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+type ppv2Breakdown struct {
+	ItemTotal *ppv2Money `json:"item_total,omitempty"`
+	TaxTotal  *ppv2Money `json:"tax_total,omitempty"`
+	Shipping  *ppv2Money `json:"shipping,omitempty"`
+	Discount  *ppv2Money `json:"discount,omitempty"`
+}
+
+type ppv2Amount struct {
+	CurrencyCode string         `json:"currency_code"`
+	Value        string         `json:"value"`
+	Breakdown    *ppv2Breakdown `json:"breakdown,omitempty"`
+}
+
+type ppv2Item struct {
+	Name       string     `json:"name"`
+	UnitAmount *ppv2Money `json:"unit_amount"`
+	Tax        *ppv2Money `json:"tax,omitempty"`
+	Quantity   string     `json:"quantity"`
+	SKU        string     `json:"sku,omitempty"`
+}
+
+type ppv2Address struct {
+	AddressLine1 string `json:"address_line_1,omitempty"`
+	AddressLine2 string `json:"address_line_2,omitempty"`
+	AdminArea2   string `json:"admin_area_2,omitempty"` // 城市
+	AdminArea1   string `json:"admin_area_1,omitempty"` // 州、省
+	PostalCode   string `json:"postal_code,omitempty"`
+	CountryCode  string `json:"country_code"`
+}
+
+type ppv2Shipping struct {
+	Address *ppv2Address `json:"address,omitempty"`
+}
+
+type ppv2Capture struct {
+	Id         string      `json:"id"`
+	Status     string      `json:"status"`
+	Amount     *ppv2Money  `json:"amount,omitempty"`
+	InvoiceId  string      `json:"invoice_id,omitempty"`
+	CreateTime string      `json:"create_time,omitempty"`
+	Links      []*ppv2Link `json:"links,omitempty"`
+
+	SupplementaryData *struct {
+		RelatedIds *ppv2RelatedIds `json:"related_ids"`
+	} `json:"supplementary_data,omitempty"`
+}
+
+type ppv2RelatedIds struct {
+	OrderId   string `json:"order_id"`
+	CaptureId string `json:"capture_id"`
+}
+
+type ppv2Refund struct {
+	Id         string      `json:"id"`
+	Status     string      `json:"status"`
+	Amount     *ppv2Money  `json:"amount,omitempty"`
+	InvoiceId  string      `json:"invoice_id,omitempty"`
+	CreateTime string      `json:"create_time,omitempty"`
+	Links      []*ppv2Link `json:"links,omitempty"`
+
+	SupplementaryData *struct {
+		RelatedIds *ppv2RelatedIds `json:"related_ids"`
+	} `json:"supplementary_data,omitempty"`
+}
+
+type ppv2PurchaseUnit struct {
+	ReferenceId string        `json:"reference_id,omitempty"`
+	InvoiceId   string        `json:"invoice_id,omitempty"`
+	Amount      *ppv2Amount   `json:"amount"`
+	Items       []*ppv2Item   `json:"items,omitempty"`
+	Shipping    *ppv2Shipping `json:"shipping,omitempty"`
+
+	Payments *struct {
+		Captures []*ppv2Capture `json:"captures,omitempty"`
+	} `json:"payments,omitempty"`
+}
+
+type ppv2ApplicationContext struct {
+	BrandName          string `json:"brand_name,omitempty"`
+	ShippingPreference string `json:"shipping_preference,omitempty"`
+	UserAction         string `json:"user_action,omitempty"`
+	ReturnURL          string `json:"return_url,omitempty"`
+	CancelURL          string `json:"cancel_url,omitempty"`
+}
+
+type ppv2Payer struct {
+	PayerId      string `json:"payer_id,omitempty"`
+	EmailAddress string `json:"email_address,omitempty"`
+}
+
+type ppv2Order struct {
+	Id                 string                  `json:"id,omitempty"`
+	Intent             string                  `json:"intent,omitempty"`
+	Status             string                  `json:"status,omitempty"`
+	PurchaseUnits      []*ppv2PurchaseUnit     `json:"purchase_units"`
+	ApplicationContext *ppv2ApplicationContext `json:"application_context,omitempty"`
+	Payer              *ppv2Payer              `json:"payer,omitempty"`
+	CreateTime         string                  `json:"create_time,omitempty"`
+	Links              []*ppv2Link             `json:"links,omitempty"`
+}
+
+type ppv2Event struct {
+	Id           string          `json:"id"`
+	EventType    string          `json:"event_type"`
+	ResourceType string          `json:"resource_type"`
+	Resource     json.RawMessage `json:"resource"`
+}
+
+// token 返回访问接口使用的 Access Token，Token 在过期之前 1 分钟会重新获取
+func (this *PayPalV2) token() (string, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.accessToken != "" && this.now().Before(this.expiresAt) {
+		return this.accessToken, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, this.apiDomain+"/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(this.clientId, this.secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var result = struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}{}
+	if err = this.do(req, &result); err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("获取 PayPal Access Token 失败")
+	}
+
+	this.accessToken = result.AccessToken
+	this.expiresAt = this.now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return this.accessToken, nil
+}
+
+// request 请求 PayPal 的接口，param 不为 nil 时作为 JSON 发送，header 为附加的请求头，例如 PayPal-Request-Id
+func (this *PayPalV2) request(method, path string, header http.Header, param, result interface{}) error {
+	token, err := this.token()
+	if err != nil {
+		return err
+	}
+
+	var body = &bytes.Buffer{}
+	if param != nil {
+		if err = json.NewEncoder(body).Encode(param); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, this.apiDomain+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+	for key := range header {
+		req.Header.Set(key, header.Get(key))
+	}
+
+	err = this.do(req, result)
+	if rspErr, ok := err.(*ppv2Error); ok && rspErr.Name == "AUTHENTICATION_FAILURE" {
+		// Token 已经失效，下一次请求时重新获取
+		this.mu.Lock()
+		this.accessToken = ""
+		this.mu.Unlock()
+	}
+	return err
+}
+
+func (this *PayPalV2) do(req *http.Request, result interface{}) error {
+	rsp, err := this.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		var rspErr = &ppv2Error{}
+		if json.Unmarshal(data, rspErr) != nil || (rspErr.Name == "" && rspErr.Message == "") {
+			return fmt.Errorf("请求 PayPal 失败: %s", rsp.Status)
+		}
+		return rspErr
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+func (this *PayPalV2) money(currency string, amount float64) *ppv2Money {
+	return &ppv2Money{CurrencyCode: currency, Value: paypalFormatAmount(currency, amount)}
+}
+
+// CreateTradeOrder 创建 PayPal 订单，返回用户确认付款的 URL，PayPalV2 不支持预授权
+func (this *PayPalV2) CreateTradeOrder(order *Order) (url string, err error) {
+	var returnURL = ngx.MustURL(this.ReturnURL)
+	addChannel(returnURL, this.Identifier(), this.accountId)
+	returnURL.Add("order_no", order.OrderNo)
+
+	var cancelURL = ngx.MustURL(this.CancelURL)
+	addChannel(cancelURL, this.Identifier(), this.accountId)
+	cancelURL.Add("order_no", order.OrderNo)
+
+	// PayPal 会验证各项金额的总和，所以按照 PayPal 的小数位数计算各项金额
+	var totals = order.totals(paypalDecimals(order.Currency))
+
+	var unit = &ppv2PurchaseUnit{}
+	unit.InvoiceId = order.OrderNo
+	unit.Amount = &ppv2Amount{}
+	unit.Amount.CurrencyCode = order.Currency
+	unit.Amount.Value = paypalFormatAmount(order.Currency, totals.Total)
+	unit.Amount.Breakdown = &ppv2Breakdown{}
+	unit.Amount.Breakdown.ItemTotal = this.money(order.Currency, totals.Subtotal)
+	unit.Amount.Breakdown.TaxTotal = this.money(order.Currency, totals.Tax)
+	unit.Amount.Breakdown.Shipping = this.money(order.Currency, totals.Shipping)
+	unit.Amount.Breakdown.Discount = this.money(order.Currency, totals.Discount)
+
+	for _, p := range order.ProductList {
+		var item = &ppv2Item{}
+		item.Name = p.Name
+		item.UnitAmount = this.money(order.Currency, p.Price)
+		item.Tax = this.money(order.Currency, p.Tax)
+		item.Quantity = fmt.Sprintf("%d", p.Quantity)
+		item.SKU = p.SKU
+		unit.Items = append(unit.Items, item)
+	}
+
+	var param = &ppv2Order{}
+	param.Intent = k_PAYPAL_V2_INTENT_CAPTURE
+	param.PurchaseUnits = []*ppv2PurchaseUnit{unit}
+	param.ApplicationContext = &ppv2ApplicationContext{}
+	param.ApplicationContext.BrandName = this.BrandName
+	param.ApplicationContext.UserAction = "PAY_NOW"
+	param.ApplicationContext.ReturnURL = returnURL.String()
+	param.ApplicationContext.CancelURL = cancelURL.String()
+
+	if addr := order.ShippingAddress; addr != nil {
+		unit.Shipping = &ppv2Shipping{}
+		unit.Shipping.Address = &ppv2Address{}
+		unit.Shipping.Address.AddressLine1 = addr.Line1
+		unit.Shipping.Address.AddressLine2 = addr.Line2
+		unit.Shipping.Address.AdminArea2 = addr.City
+		unit.Shipping.Address.AdminArea1 = addr.State
+		unit.Shipping.Address.PostalCode = addr.PostalCode
+		unit.Shipping.Address.CountryCode = addr.CountryCode
+		param.ApplicationContext.ShippingPreference = "SET_PROVIDED_ADDRESS"
+	}
+
+	var result = &ppv2Order{}
+	if err = this.request(http.MethodPost, "/v2/checkout/orders", nil, param, result); err != nil {
+		return "", err
+	}
+	for _, link := range result.Links {
+		if link.Rel == "approve" {
+			return link.Href, nil
+		}
+	}
+	return "", errors.New("PayPal 没有返回确认付款的 URL")
+}
+
+func (this *PayPalV2) getOrder(orderId string) (*ppv2Order, error) {
+	var result = &ppv2Order{}
+	if err := this.request(http.MethodGet, "/v2/checkout/orders/"+url.PathEscape(orderId), nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// captureOrder 对订单扣款，使用订单号作为 PayPal-Request-Id，重复扣款时 PayPal 会返回第一次扣款的结果，
+// 订单已经被其它请求扣款（ORDER_ALREADY_CAPTURED）时重新查询订单
+func (this *PayPalV2) captureOrder(orderId string) (*ppv2Order, error) {
+	var header = http.Header{}
+	header.Set("PayPal-Request-Id", orderId)
+
+	var result = &ppv2Order{}
+	var err = this.request(http.MethodPost, "/v2/checkout/orders/"+url.PathEscape(orderId)+"/capture", header, struct{}{}, result)
+	if rspErr, ok := err.(*ppv2Error); ok && rspErr.hasIssue("ORDER_ALREADY_CAPTURED") {
+		return this.getOrder(orderId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *PayPalV2) getCapture(captureId string) (*ppv2Capture, error) {
+	var result = &ppv2Capture{}
+	if err := this.request(http.MethodGet, "/v2/payments/captures/"+url.PathEscape(captureId), nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CaptureOrder 对用户已经确认付款的订单扣款，tradeNo 为 PayPal 的订单号
+func (this *PayPalV2) CaptureOrder(tradeNo string) (result *Trade, err error) {
+	rsp, err := this.captureOrder(tradeNo)
+	if err != nil {
+		return nil, err
+	}
+	return this.trade(rsp), nil
+}
+
+// GetTrade 查询交易，不会扣款，用户已经确认付款但是还没有扣款时 TradeStatus 为 APPROVED，TradeSuccess 为 false
+func (this *PayPalV2) GetTrade(tradeNo string) (result *Trade, err error) {
+	rsp, err := this.getOrder(tradeNo)
+	if err != nil {
+		return nil, err
+	}
+	return this.trade(rsp), nil
+}
+
+func (this *PayPalV2) GetTradeWithOrderNo(orderNo string) (result *Trade, err error) {
+	return nil, ErrPayPalNotAllowed
+}
+
+// Refund 对订单的 Capture 退款，使用退款单号作为 PayPal-Request-Id，重复退款时 PayPal 会返回第一次退款的结果
+func (this *PayPalV2) Refund(param *RefundParam) (result *Refund, err error) {
+	order, err := this.getOrder(param.TradeNo)
+	if err != nil {
+		return nil, err
+	}
+
+	var capture *ppv2Capture
+	for _, unit := range order.PurchaseUnits {
+		if unit.Payments != nil && len(unit.Payments.Captures) > 0 && capture == nil {
+			capture = unit.Payments.Captures[0]
+		}
+	}
+	if capture == nil {
+		return nil, ErrUnknownTradeNo
+	}
+
+	var header = http.Header{}
+	header.Set("PayPal-Request-Id", param.RefundNo)
+
+	var p = struct {
+		Amount      *ppv2Money `json:"amount"`
+		NoteToPayer string     `json:"note_to_payer,omitempty"`
+	}{}
+	p.Amount = this.money(param.Currency, param.Amount)
+	p.NoteToPayer = param.Reason
+
+	var refund = &ppv2Refund{}
+	if err = this.request(http.MethodPost, "/v2/payments/captures/"+url.PathEscape(capture.Id)+"/refund", header, p, refund); err != nil {
+		return nil, err
+	}
+
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.OrderNo = param.OrderNo
+	result.TradeNo = order.Id
+	result.RefundNo = param.RefundNo
+	result.RefundId = refund.Id
+	result.Status = payPalV2RefundStatus(refund.Status)
+	result.Amount = p.Amount.Value
+	result.RawRefund = refund
+	return result, nil
+}
+
+// ReturnHandler 处理用户在 PayPal 确认付款之后跳转回来的请求，URL 中的 token 为 PayPal 的订单号，
+// PayPal 订单的 invoice_id 需要与 URL 中的 order_no 一致，验证通过之后扣款
+func (this *PayPalV2) ReturnHandler(req *http.Request) (result *Trade, err error) {
+	req.ParseForm()
+
+	var orderId = req.FormValue("token")
+	var payerId = req.FormValue("PayerID")
+	if orderId == "" {
+		return nil, ErrUnknownTradeNo
+	}
+	if payerId == "" {
+		return nil, ErrPayerNotApproved
+	}
+
+	rsp, err := this.getOrder(orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	// order_no 由 CreateTradeOrder 添加在 ReturnURL 中，缺少时无法确认 token 属于该订单
+	var orderNo = req.FormValue("order_no")
+	if orderNo == "" || len(rsp.PurchaseUnits) == 0 || rsp.PurchaseUnits[0].InvoiceId != orderNo {
+		return nil, ErrTradeMismatch
+	}
+	if rsp.Payer != nil && rsp.Payer.PayerId != "" && rsp.Payer.PayerId != payerId {
+		return nil, ErrTradeMismatch
+	}
+
+	switch rsp.Status {
+	case k_PAYPAL_V2_ORDER_STATUS_APPROVED:
+		if rsp, err = this.captureOrder(rsp.Id); err != nil {
+			return nil, err
+		}
+	case k_PAYPAL_V2_ORDER_STATUS_COMPLETED:
+	default:
+		return nil, ErrPayerNotApproved
+	}
+	return this.trade(rsp), nil
+}
+
+func (this *PayPalV2) trade(rsp *ppv2Order) (result *Trade) {
+	result = &Trade{}
+	result.Channel = this.Identifier()
+	result.RawTrade = rsp
+	result.TradeNo = rsp.Id
+	result.TradeStatus = rsp.Status
+	result.Status = payPalV2OrderStatus(rsp.Status)
+	if rsp.Payer != nil {
+		result.PayerId = rsp.Payer.PayerId
+		result.PayerEmail = rsp.Payer.EmailAddress
+	}
+
+	if len(rsp.PurchaseUnits) > 0 {
+		var unit = rsp.PurchaseUnits[0]
+		result.OrderNo = unit.InvoiceId
+		if unit.Amount != nil {
+			result.TotalAmount = unit.Amount.Value
+			result.Currency = unit.Amount.CurrencyCode
+		}
+		if unit.Payments != nil && len(unit.Payments.Captures) > 0 {
+			result.TradeStatus = unit.Payments.Captures[0].Status
+			result.Status = payPalV2CaptureStatus(result.TradeStatus)
+			result.TradeSuccess = result.TradeStatus == k_PAYPAL_V2_CAPTURE_STATUS_COMPLETED
+		}
+	}
+	return result
+}
+
+// verifyWebhook 使用 PayPal 的接口验证 Webhook 的签名
+func (this *PayPalV2) verifyWebhook(req *http.Request, body []byte) error {
+	var param = struct {
+		AuthAlgo         string          `json:"auth_algo"`
+		CertURL          string          `json:"cert_url"`
+		TransmissionId   string          `json:"transmission_id"`
+		TransmissionSig  string          `json:"transmission_sig"`
+		TransmissionTime string          `json:"transmission_time"`
+		WebhookId        string          `json:"webhook_id"`
+		WebhookEvent     json.RawMessage `json:"webhook_event"`
+	}{}
+	param.AuthAlgo = req.Header.Get("Paypal-Auth-Algo")
+	param.CertURL = req.Header.Get("Paypal-Cert-Url")
+	param.TransmissionId = req.Header.Get("Paypal-Transmission-Id")
+	param.TransmissionSig = req.Header.Get("Paypal-Transmission-Sig")
+	param.TransmissionTime = req.Header.Get("Paypal-Transmission-Time")
+	param.WebhookId = this.WebHookId
+	param.WebhookEvent = body
+
+	var result = struct {
+		VerificationStatus string `json:"verification_status"`
+	}{}
+	if err := this.request(http.MethodPost, "/v1/notifications/verify-webhook-signature", nil, param, &result); err != nil {
+		return err
+	}
+	if result.VerificationStatus != "SUCCESS" {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// NotifyHandler 处理 PayPal 的 Webhook 通知，通知无法通过 PayPal 的签名验证时返回 ErrInvalidSignature
+func (this *PayPalV2) NotifyHandler(req *http.Request) (result *Notification, err error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var event = &ppv2Event{}
+	if err = json.Unmarshal(body, event); err != nil {
+		return nil, ErrInvalidSignature
+	}
+	if err = this.verifyWebhook(req, body); err != nil {
+		return nil, err
+	}
+
+	result = &Notification{}
+	result.Channel = this.Identifier()
+	result.RawNotify = event
+
+	switch event.ResourceType {
+	case k_PAYPAL_V2_RESOURCE_TYPE_ORDER:
+		// 用户已经确认付款，还需要调用 CaptureOrder 扣款
+		var order = &ppv2Order{}
+		if err = json.Unmarshal(event.Resource, order); err != nil {
+			return nil, err
+		}
+		result.NotifyType = K_NOTIFY_TYPE_TRADE
+		result.TradeNo = order.Id
+		result.RawStatus = order.Status
+		result.Status = K_TRADE_STATUS_PENDING
+		if order.Status == k_PAYPAL_V2_ORDER_STATUS_COMPLETED {
+			result.Status = K_TRADE_STATUS_SUCCESS
+		}
+		if order.Payer != nil {
+			result.PayerId = order.Payer.PayerId
+		}
+		if len(order.PurchaseUnits) > 0 {
+			result.OrderNo = order.PurchaseUnits[0].InvoiceId
+			if amount := order.PurchaseUnits[0].Amount; amount != nil {
+				result.TotalAmount = amount.Value
+				result.Currency = amount.CurrencyCode
+			}
+		}
+	case k_PAYPAL_V2_RESOURCE_TYPE_CAPTURE:
+		var capture = &ppv2Capture{}
+		if err = json.Unmarshal(event.Resource, capture); err != nil {
+			return nil, err
+		}
+		result.NotifyType = K_NOTIFY_TYPE_TRADE
+		result.OrderNo = capture.InvoiceId
+		if capture.SupplementaryData != nil && capture.SupplementaryData.RelatedIds != nil {
+			result.TradeNo = capture.SupplementaryData.RelatedIds.OrderId
+		}
+		result.RawStatus = capture.Status
+		result.Status = payPalV2CaptureStatus(capture.Status)
+		if capture.Amount != nil {
+			result.TotalAmount = capture.Amount.Value
+			result.Currency = capture.Amount.CurrencyCode
+		}
+		if capture.CreateTime != "" {
+			result.PaidTime, _ = time.Parse(time.RFC3339, capture.CreateTime)
+		}
+	case k_PAYPAL_V2_RESOURCE_TYPE_REFUND:
+		// 退款通知中只有退款金额和 Capture 的链接，交易金额需要查询交易
+		var refund = &ppv2Refund{}
+		if err = json.Unmarshal(event.Resource, refund); err != nil {
+			return nil, err
+		}
+		result.NotifyType = K_NOTIFY_TYPE_REFUND
+		result.OrderNo = refund.InvoiceId
+		// 查询失败时 TradeNo 为空，通知已经通过验证，不因为查询失败而拒绝
+		result.TradeNo, _ = this.refundOrderId(refund)
+		result.Status = K_TRADE_STATUS_REFUNDED
+		result.RawStatus = refund.Status
+		result.RefundId = refund.Id
+		result.RefundStatus = payPalV2RefundStatus(refund.Status)
+		if refund.CreateTime != "" {
+			result.RefundTime, _ = time.Parse(time.RFC3339, refund.CreateTime)
+		}
+		if refund.Amount != nil {
+			result.RefundAmount = refund.Amount.Value
+			result.Currency = refund.Amount.CurrencyCode
+		}
+	}
+	return result, nil
+}
+
+// refundOrderId 返回退款对应的 PayPal 订单号，通知中没有 related_ids 时通过 up 链接查询 Capture 获取
+func (this *PayPalV2) refundOrderId(refund *ppv2Refund) (string, error) {
+	var captureId string
+	if data := refund.SupplementaryData; data != nil && data.RelatedIds != nil {
+		if data.RelatedIds.OrderId != "" {
+			return data.RelatedIds.OrderId, nil
+		}
+		captureId = data.RelatedIds.CaptureId
+	}
+	if captureId == "" {
+		for _, link := range refund.Links {
+			if link.Rel == "up" {
+				captureId = link.Href[strings.LastIndex(link.Href, "/")+1:]
+				break
+			}
+		}
+	}
+	if captureId == "" {
+		return "", ErrUnknownTradeNo
+	}
+
+	capture, err := this.getCapture(captureId)
+	if err != nil {
+		return "", err
+	}
+	if capture.SupplementaryData == nil || capture.SupplementaryData.RelatedIds == nil || capture.SupplementaryData.RelatedIds.OrderId == "" {
+		return "", ErrUnknownTradeNo
+	}
+	return capture.SupplementaryData.RelatedIds.OrderId, nil
+}
+
+// payPalV2OrderStatus 将 PayPal Order 的状态转换为 K_TRADE_STATUS_*，用户确认付款之后没有扣款的订单为 K_TRADE_STATUS_PENDING
+func payPalV2OrderStatus(status string) string {
+	switch status {
+	case k_PAYPAL_V2_ORDER_STATUS_CREATED, k_PAYPAL_V2_ORDER_STATUS_SAVED, k_PAYPAL_V2_ORDER_STATUS_APPROVED, k_PAYPAL_V2_ORDER_STATUS_PAYER_ACTION_REQUIRED:
+		return K_TRADE_STATUS_PENDING
+	case k_PAYPAL_V2_ORDER_STATUS_COMPLETED:
+		return K_TRADE_STATUS_SUCCESS
+	case k_PAYPAL_V2_ORDER_STATUS_VOIDED:
+		return K_TRADE_STATUS_CLOSED
+	}
+	return ""
+}
+
+// payPalV2CaptureStatus 将 PayPal Capture 的状态转换为 K_TRADE_STATUS_*
+func payPalV2CaptureStatus(status string) string {
+	switch status {
+	case k_PAYPAL_V2_CAPTURE_STATUS_PENDING:
+		return K_TRADE_STATUS_PENDING
+	case k_PAYPAL_V2_CAPTURE_STATUS_COMPLETED:
+		return K_TRADE_STATUS_SUCCESS
+	case k_PAYPAL_V2_CAPTURE_STATUS_REFUNDED, k_PAYPAL_V2_CAPTURE_STATUS_PARTIALLY_REFUNDED:
+		return K_TRADE_STATUS_REFUNDED
+	case k_PAYPAL_V2_CAPTURE_STATUS_DECLINED:
+		return K_TRADE_STATUS_FAILED
+	}
+	return ""
+}
+
+// payPalV2RefundStatus 将 PayPal Refund 的状态转换为 K_REFUND_STATUS_*
+func payPalV2RefundStatus(status string) string {
+	switch status {
+	case k_PAYPAL_V2_REFUND_STATUS_PENDING:
+		return K_REFUND_STATUS_PROCESSING
+	case k_PAYPAL_V2_REFUND_STATUS_COMPLETED:
+		return K_REFUND_STATUS_SUCCESS
+	case k_PAYPAL_V2_REFUND_STATUS_CANCELLED, k_PAYPAL_V2_REFUND_STATUS_FAILED:
+		return K_REFUND_STATUS_FAILED
+	}
+	return ""
+}
@@ -0,0 +1,113 @@
+package qrcode
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"net/http"
+	"strconv"
+)
+
+const (
+	K_FORMAT_PNG = "png"
+	K_FORMAT_SVG = "svg"
+)
+
+// Render 将支付结果生成二维码图片，content 为二维码支付（K_TRADE_METHOD_QRCODE）的支付结果，
+// 即支付宝的 qr_code 或者微信支付的 code_url，format 为 K_FORMAT_SVG 时返回 SVG，否则返回 PNG
+func Render(content, format string, opts *Options) (data []byte, err error) {
+	if format == K_FORMAT_SVG {
+		return SVG(content, opts)
+	}
+	return PNG(content, opts)
+}
+
+// CreatePayment 使用二维码支付方式（K_TRADE_METHOD_QRCODE）创建支付，并生成二维码图片，返回的 content 为支付结果，
+// 需要再次显示二维码时使用 Render 生成，不要重复创建支付。不会修改 order.TradeMethod，与 Service.CreatePayment 一样，
+// 选中的商户账号会被设置到 order.AccountId 中
+func CreatePayment(s *payment.Service, channel string, order *payment.Order, format string, opts *Options) (content string, data []byte, err error) {
+	var o = *order
+	o.TradeMethod = payment.K_TRADE_METHOD_QRCODE
+	content, err = s.CreatePayment(channel, &o)
+	order.AccountId = o.AccountId
+	if err != nil {
+		return "", nil, err
+	}
+	if data, err = Render(content, format, opts); err != nil {
+		return "", nil, err
+	}
+	return content, data, nil
+}
+
+// Handler 返回已经创建的二维码支付的二维码图片，可以通过 format（png、svg）和 size 参数指定图片的格式和尺寸，
+// Handler 不会创建支付，浏览器重试、预加载或者请求不同格式和尺寸的图片都不会重复向支付渠道下单
+type Handler struct {
+	Options *Options
+
+	// LookupPayment 根据请求获取已经创建的二维码支付的支付结果（CreatePayment 返回的 content），必须设置，
+	// 支付不存在时应该返回 payment.ErrUnknownOrderNo
+	LookupPayment func(req *http.Request) (content string, err error)
+}
+
+func NewHandler() *Handler {
+	var h = &Handler{}
+	return h
+}
+
+func (this *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if this.LookupPayment == nil {
+		http.Error(w, "没有设置 LookupPayment", http.StatusNotImplemented)
+		return
+	}
+
+	content, err := this.LookupPayment(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if content == "" {
+		writeError(w, payment.ErrUnknownOrderNo)
+		return
+	}
+
+	var opts = &Options{}
+	if this.Options != nil {
+		*opts = *this.Options
+	}
+	if size, _ := strconv.Atoi(req.FormValue("size")); size > 0 && size <= 2048 {
+		opts.Size = size
+	}
+
+	var format = req.FormValue("format")
+	data, err := Render(content, format, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == K_FORMAT_SVG {
+		w.Header().Set("Content-Type", "image/svg+xml")
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+}
+
+// writeError 与 httpapi 的状态码保持一致，LookupPayment 可能返回 Service.CreatePayment 的错误
+func writeError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*payment.RiskError); ok {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch err {
+	case payment.ErrUnknownOrderNo:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case payment.ErrUnknownChannel, payment.ErrUnknownAccount, payment.ErrInvalidCurrency,
+		payment.ErrCurrencyNotSupported, payment.ErrCurrencyMismatch, payment.ErrOrderExpired:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case payment.ErrChannelUnavailable:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
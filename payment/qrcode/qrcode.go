@@ -0,0 +1,233 @@
+package qrcode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+// Level 纠错等级，等级越高，二维码能够容忍的损坏（例如覆盖 Logo）越多，但是图案也会越复杂
+type Level int
+
+const (
+	K_LEVEL_L Level = iota // 约 7% 的纠错能力
+	K_LEVEL_M              // 约 15% 的纠错能力
+	K_LEVEL_Q              // 约 25% 的纠错能力
+	K_LEVEL_H              // 约 30% 的纠错能力
+)
+
+const (
+	k_DEFAULT_SIZE = 256
+	k_LOGO_RATIO   = 5 // Logo 的宽高为二维码的 1/5
+)
+
+var (
+	ErrEmptyContent = errors.New("二维码内容不能为空")
+)
+
+// Options 生成二维码图片的参数
+type Options struct {
+	Size          int         // 图片的宽高（像素），默认为 256
+	Level         Level       // 纠错等级，默认为 K_LEVEL_M，设置了 Logo 时至少为 K_LEVEL_H
+	Logo          image.Image // 覆盖在二维码中间的 Logo
+	Foreground    color.Color // 默认为黑色
+	Background    color.Color // 默认为白色
+	DisableBorder bool        // 不保留二维码四周的空白区域
+}
+
+func (this *Options) size() int {
+	if this == nil || this.Size <= 0 {
+		return k_DEFAULT_SIZE
+	}
+	return this.Size
+}
+
+func (this *Options) level() qrcode.RecoveryLevel {
+	var level = K_LEVEL_M
+	if this != nil {
+		level = this.Level
+		if this.Logo != nil && level < K_LEVEL_H {
+			level = K_LEVEL_H
+		}
+	}
+
+	switch level {
+	case K_LEVEL_L:
+		return qrcode.Low
+	case K_LEVEL_Q:
+		return qrcode.High
+	case K_LEVEL_H:
+		return qrcode.Highest
+	default:
+		return qrcode.Medium
+	}
+}
+
+func (this *Options) colors() (fg, bg color.Color) {
+	fg, bg = color.Black, color.White
+	if this != nil && this.Foreground != nil {
+		fg = this.Foreground
+	}
+	if this != nil && this.Background != nil {
+		bg = this.Background
+	}
+	return fg, bg
+}
+
+func (this *Options) logo() image.Image {
+	if this == nil {
+		return nil
+	}
+	return this.Logo
+}
+
+// bitmap 生成二维码的模块矩阵，true 表示深色模块
+func bitmap(content string, opts *Options) ([][]bool, error) {
+	if content == "" {
+		return nil, ErrEmptyContent
+	}
+	q, err := qrcode.New(content, opts.level())
+	if err != nil {
+		return nil, err
+	}
+	q.DisableBorder = opts != nil && opts.DisableBorder
+	return q.Bitmap(), nil
+}
+
+// Image 生成二维码图片
+func Image(content string, opts *Options) (image.Image, error) {
+	modules, err := bitmap(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var size = opts.size()
+	var count = len(modules)
+	var scale = size / count
+	if scale < 1 {
+		scale = 1
+		size = count
+	}
+	var offset = (size - scale*count) / 2
+
+	var fg, bg = opts.colors()
+	var img = image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	var fgImg = image.NewUniform(fg)
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark == false {
+				continue
+			}
+			var r = image.Rect(offset+x*scale, offset+y*scale, offset+(x+1)*scale, offset+(y+1)*scale)
+			draw.Draw(img, r, fgImg, image.Point{}, draw.Src)
+		}
+	}
+
+	if logo := opts.logo(); logo != nil {
+		var logoSize = size / k_LOGO_RATIO
+		var padding = logoSize / 10
+		var origin = (size - logoSize) / 2
+		var area = image.Rect(origin, origin, origin+logoSize, origin+logoSize)
+		draw.Draw(img, area.Inset(-padding), image.NewUniform(bg), image.Point{}, draw.Src)
+		draw.Draw(img, area, resize(logo, logoSize), image.Point{}, draw.Over)
+	}
+
+	return img, nil
+}
+
+// WritePNG 将 PNG 格式的二维码图片写入 w
+func WritePNG(w io.Writer, content string, opts *Options) error {
+	img, err := Image(content, opts)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// PNG 生成 PNG 格式的二维码图片
+func PNG(content string, opts *Options) ([]byte, error) {
+	var buf = &bytes.Buffer{}
+	if err := WritePNG(buf, content, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteSVG 将 SVG 格式的二维码图片写入 w，每个模块对应 SVG 中的一个单位，图片的宽高为 Options.Size
+func WriteSVG(w io.Writer, content string, opts *Options) error {
+	modules, err := bitmap(content, opts)
+	if err != nil {
+		return err
+	}
+
+	var size = opts.size()
+	var count = len(modules)
+	var fg, bg = opts.colors()
+
+	var buf = &bytes.Buffer{}
+	fmt.Fprintf(buf, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, count, count)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="%s"/>`, count, count, hexColor(bg))
+	fmt.Fprintf(buf, `<path fill="%s" d="`, hexColor(fg))
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/>`)
+
+	if logo := opts.logo(); logo != nil {
+		var logoBuf = &bytes.Buffer{}
+		if err = png.Encode(logoBuf, logo); err != nil {
+			return err
+		}
+		var logoSize = float64(count) / k_LOGO_RATIO
+		var origin = (float64(count) - logoSize) / 2
+		var padding = logoSize / 10
+		fmt.Fprintf(buf, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s"/>`, origin-padding, origin-padding, logoSize+padding*2, logoSize+padding*2, hexColor(bg))
+		fmt.Fprintf(buf, `<image x="%.2f" y="%.2f" width="%.2f" height="%.2f" href="data:image/png;base64,%s"/>`, origin, origin, logoSize, logoSize, base64.StdEncoding.EncodeToString(logoBuf.Bytes()))
+	}
+
+	buf.WriteString("</svg>\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// SVG 生成 SVG 格式的二维码图片
+func SVG(content string, opts *Options) ([]byte, error) {
+	var buf = &bytes.Buffer{}
+	if err := WriteSVG(buf, content, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func hexColor(c color.Color) string {
+	var r, g, b, _ = c.RGBA()
+	return fmt.Sprintf("#%02x%02x%02x", r>>8, g>>8, b>>8)
+}
+
+// resize 使用最近邻插值将图片缩放为 size * size
+func resize(src image.Image, size int) image.Image {
+	var bounds = src.Bounds()
+	var dst = image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var sx = bounds.Min.X + x*bounds.Dx()/size
+			var sy = bounds.Min.Y + y*bounds.Dy()/size
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+	return dst
+}
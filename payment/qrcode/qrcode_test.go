@@ -0,0 +1,162 @@
+package qrcode
+
+import (
+	"bytes"
+	goqrcode "github.com/skip2/go-qrcode"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPNG(t *testing.T) {
+	data, err := PNG("weixin://wxpay/bizpayurl?pr=wx2018080112345678", &Options{Size: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 300 || img.Bounds().Dy() != 300 {
+		t.Fatalf("图片尺寸错误: %v", img.Bounds())
+	}
+
+	// 四周为空白区域，左上角为定位图案
+	if c := color.GrayModel.Convert(img.At(0, 0)).(color.Gray); c.Y != 0xff {
+		t.Fatal("图片的边缘应该为背景色")
+	}
+
+	if _, err = PNG("", nil); err != ErrEmptyContent {
+		t.Fatalf("内容为空时应该返回 ErrEmptyContent，实际为 %v", err)
+	}
+}
+
+func TestLogo(t *testing.T) {
+	var logo = image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := range logo.Pix {
+		logo.Pix[i] = 0xff
+	}
+	logo.Set(5, 5, color.RGBA{R: 0xff, A: 0xff})
+
+	var opts = &Options{Size: 250, Logo: logo, Level: K_LEVEL_L}
+	if opts.level() != goqrcode.Highest {
+		t.Fatal("设置了 Logo 时应该使用最高的纠错等级")
+	}
+
+	img, err := Image("https://qr.alipay.com/bax03431ljhokirwl38f00a7", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, _, _ := img.At(125, 125).RGBA(); r>>8 != 0xff || g>>8 != 0 {
+		t.Fatal("二维码中间应该为 Logo")
+	}
+}
+
+func TestSVG(t *testing.T) {
+	data, err := SVG("https://qr.alipay.com/bax03431ljhokirwl38f00a7", &Options{Size: 128, Foreground: color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var svg = string(data)
+	if strings.Contains(svg, `width="128"`) == false || strings.Contains(svg, `fill="#102030"`) == false || strings.Contains(svg, "h1v1h-1z") == false {
+		t.Fatalf("SVG 内容错误: %s", svg)
+	}
+}
+
+func TestCreatePayment(t *testing.T) {
+	var fc = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	var order = &payment.Order{}
+	order.OrderNo = "o1"
+	order.TradeMethod = payment.K_TRADE_METHOD_WAP
+	order.AddProduct("test", "sku001", 1, 9.9, 0)
+	content, data, err := CreatePayment(s, paymenttest.K_CHANNEL_FAKE, order, K_FORMAT_PNG, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content == "" {
+		t.Fatal("支付结果不能为空")
+	}
+	if _, err = png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if order.TradeMethod != payment.K_TRADE_METHOD_WAP {
+		t.Fatalf("不应该修改订单的支付方式: %s", order.TradeMethod)
+	}
+	if orders := fc.Orders(); len(orders) != 1 || orders[0].TradeMethod != payment.K_TRADE_METHOD_QRCODE {
+		t.Fatalf("订单信息错误: %+v", orders)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var fc = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(fc)
+
+	var order = &payment.Order{}
+	order.OrderNo = "o1"
+	order.AddProduct("test", "sku001", 1, 9.9, 0)
+	content, _, err := CreatePayment(s, paymenttest.K_CHANNEL_FAKE, order, K_FORMAT_PNG, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lookupErr error
+	var h = NewHandler()
+	h.LookupPayment = func(req *http.Request) (string, error) {
+		if lookupErr != nil {
+			return "", lookupErr
+		}
+		if req.FormValue("order_no") != "o1" {
+			return "", nil
+		}
+		return content, nil
+	}
+
+	var w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pay/qrcode?order_no=o1&size=200", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("响应错误: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 200 {
+		t.Fatalf("图片尺寸错误: %v", img.Bounds())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pay/qrcode?order_no=o1&format=svg", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("响应错误: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// 获取图片不会重复创建支付
+	if orders := fc.Orders(); len(orders) != 1 {
+		t.Fatalf("不应该重复创建支付: %+v", orders)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pay/qrcode?order_no=o2", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("支付不存在时应该返回 404，实际为 %d", w.Code)
+	}
+
+	for err, status := range map[error]int{&payment.RiskError{Reasons: []string{"velocity"}}: http.StatusForbidden, payment.ErrChannelUnavailable: http.StatusServiceUnavailable} {
+		lookupErr = err
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pay/qrcode?order_no=o1", nil))
+		if w.Code != status {
+			t.Fatalf("%v 应该返回 %d，实际为 %d", err, status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package payment
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// 风控检查的结果
+const (
+	K_RISK_ACTION_ALLOW  = "allow"  // 允许创建交易
+	K_RISK_ACTION_REVIEW = "review" // 允许创建交易，但是需要人工审核，可以通过中间件读取 Call.Risk 处理
+	K_RISK_ACTION_DENY   = "deny"   // 拒绝创建交易，CreatePayment 返回 *RiskError
+)
+
+// RuleRiskChecker 产生的原因
+const (
+	K_RISK_REASON_DENY_LIST      = "deny_list"      // IP 或者付款人在黑名单中
+	K_RISK_REASON_IP_VELOCITY    = "ip_velocity"    // 同一个 IP 在时间窗口内创建支付的次数过多
+	K_RISK_REASON_ORDER_VELOCITY = "order_velocity" // 同一个订单号在时间窗口内创建支付的次数过多
+	K_RISK_REASON_AMOUNT_CEILING = "amount_ceiling" // 订单金额超过支付渠道的上限
+	K_RISK_REASON_AMOUNT_REVIEW  = "amount_review"  // 订单金额超过需要人工审核的金额
+)
+
+// RiskDecision 风控检查的结果，Reasons 为做出该决定的原因
+type RiskDecision struct {
+	Action  string   `json:"action"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// RiskChecker 在创建交易之前对订单进行风控检查，key 为路由之后选中的 ChannelKey，
+// 返回 nil 等同于 K_RISK_ACTION_ALLOW，返回 error 时不会创建交易，实现需要保证并发安全
+type RiskChecker interface {
+	Check(key string, order *Order) (*RiskDecision, error)
+}
+
+type RiskFunc func(key string, order *Order) (*RiskDecision, error)
+
+func (this RiskFunc) Check(key string, order *Order) (*RiskDecision, error) {
+	return this(key, order)
+}
+
+// RiskError 风控拒绝创建交易时 CreatePayment 返回的错误
+type RiskError struct {
+	Channel   string
+	AccountId string
+	OrderNo   string
+	Reasons   []string
+}
+
+func (this *RiskError) Error() string {
+	if len(this.Reasons) == 0 {
+		return "订单没有通过风控检查"
+	}
+	return "订单没有通过风控检查: " + strings.Join(this.Reasons, ", ")
+}
+
+// RiskRules RuleRiskChecker 的规则，值为零的规则不生效
+type RiskRules struct {
+	IPWindow    time.Duration // 统计同一个 IP 创建支付次数的时间窗口
+	IPLimit     int           // 同一个 IP 在时间窗口内最多创建支付的次数，超过之后拒绝
+	OrderWindow time.Duration // 统计同一个订单号创建支付次数的时间窗口
+	OrderLimit  int           // 同一个订单号在时间窗口内最多创建支付的次数，超过之后拒绝
+
+	// AmountCeiling 订单金额的上限，超过之后拒绝，ReviewAmount 超过之后需要人工审核，
+	// key 可以是 ChannelKey 或者支付渠道，优先使用 ChannelKey 匹配，金额为订单货币的金额
+	AmountCeiling map[string]float64
+	ReviewAmount  map[string]float64
+
+	DenyIPs        []string // IP 黑名单
+	DenyPayers     []string // 付款人黑名单，与订单中 PayerAttribute 属性的值比较
+	PayerAttribute string   // 订单中标识付款人的属性，默认为 payer
+
+	Now func() time.Time
+}
+
+// RuleRiskChecker 基于规则的风控检查，创建支付的次数保存在内存中，多个实例之间不共享
+type RuleRiskChecker struct {
+	mu         sync.Mutex
+	rules      RiskRules
+	denyIPs    map[string]struct{}
+	denyPayers map[string]struct{}
+	ips        map[string][]time.Time
+	orders     map[string][]time.Time
+}
+
+func NewRuleRiskChecker(rules *RiskRules) *RuleRiskChecker {
+	var c = &RuleRiskChecker{}
+	if rules != nil {
+		c.rules = *rules
+	}
+	if c.rules.PayerAttribute == "" {
+		c.rules.PayerAttribute = "payer"
+	}
+	if c.rules.Now == nil {
+		c.rules.Now = time.Now
+	}
+	c.denyIPs = make(map[string]struct{})
+	c.denyPayers = make(map[string]struct{})
+	c.ips = make(map[string][]time.Time)
+	c.orders = make(map[string][]time.Time)
+	c.DenyIP(c.rules.DenyIPs...)
+	c.DenyPayer(c.rules.DenyPayers...)
+	return c
+}
+
+// DenyIP 将 IP 添加到黑名单
+func (this *RuleRiskChecker) DenyIP(ips ...string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, ip := range ips {
+		this.denyIPs[ip] = struct{}{}
+	}
+}
+
+// DenyPayer 将付款人添加到黑名单
+func (this *RuleRiskChecker) DenyPayer(payers ...string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, payer := range payers {
+		this.denyPayers[payer] = struct{}{}
+	}
+}
+
+// Remove 将 IP 或者付款人从黑名单中移除
+func (this *RuleRiskChecker) Remove(values ...string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, value := range values {
+		delete(this.denyIPs, value)
+		delete(this.denyPayers, value)
+	}
+}
+
+// Check 黑名单和金额上限优先，命中之后不会再统计创建支付的次数
+func (this *RuleRiskChecker) Check(key string, order *Order) (*RiskDecision, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.denyIPs[order.IP]; ok && order.IP != "" {
+		return denyRisk(K_RISK_REASON_DENY_LIST), nil
+	}
+	if payer := order.Attributes[this.rules.PayerAttribute]; payer != "" {
+		if _, ok := this.denyPayers[payer]; ok {
+			return denyRisk(K_RISK_REASON_DENY_LIST), nil
+		}
+	}
+
+	var amount = order.Totals().Total
+	if ceiling, ok := riskAmount(this.rules.AmountCeiling, key); ok && amount > ceiling {
+		return denyRisk(K_RISK_REASON_AMOUNT_CEILING), nil
+	}
+
+	var now = this.rules.Now()
+	var reasons []string
+	if order.IP != "" && hitVelocity(this.ips, order.IP, now, this.rules.IPWindow, this.rules.IPLimit) {
+		reasons = append(reasons, K_RISK_REASON_IP_VELOCITY)
+	}
+	if hitVelocity(this.orders, order.OrderNo, now, this.rules.OrderWindow, this.rules.OrderLimit) {
+		reasons = append(reasons, K_RISK_REASON_ORDER_VELOCITY)
+	}
+	if len(reasons) > 0 {
+		return &RiskDecision{Action: K_RISK_ACTION_DENY, Reasons: reasons}, nil
+	}
+
+	if review, ok := riskAmount(this.rules.ReviewAmount, key); ok && amount > review {
+		return &RiskDecision{Action: K_RISK_ACTION_REVIEW, Reasons: []string{K_RISK_REASON_AMOUNT_REVIEW}}, nil
+	}
+	return &RiskDecision{Action: K_RISK_ACTION_ALLOW}, nil
+}
+
+func denyRisk(reason string) *RiskDecision {
+	return &RiskDecision{Action: K_RISK_ACTION_DENY, Reasons: []string{reason}}
+}
+
+// riskAmount 优先使用 ChannelKey 匹配，然后使用支付渠道匹配
+func riskAmount(amounts map[string]float64, key string) (float64, bool) {
+	if amount, ok := amounts[key]; ok {
+		return amount, true
+	}
+	var channel, _ = splitChannelKey(key)
+	amount, ok := amounts[channel]
+	return amount, ok
+}
+
+// hitVelocity 记录一次创建支付，返回时间窗口内的次数是否超过 limit，过期的记录会被清理
+func hitVelocity(records map[string][]time.Time, key string, now time.Time, window time.Duration, limit int) bool {
+	if window <= 0 || limit <= 0 {
+		return false
+	}
+
+	var since = now.Add(-window)
+	for k, times := range records {
+		var i = 0
+		for i < len(times) && times[i].After(since) == false {
+			i++
+		}
+		if i == len(times) {
+			delete(records, k)
+		} else if i > 0 {
+			records[k] = append(times[:0], times[i:]...)
+		}
+	}
+
+	records[key] = append(records[key], now)
+	return len(records[key]) > limit
+}
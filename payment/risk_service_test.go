@@ -0,0 +1,57 @@
+package payment_test
+
+import (
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"testing"
+)
+
+func TestService_Risk(t *testing.T) {
+	var f = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(f)
+
+	var checker = payment.NewRuleRiskChecker(&payment.RiskRules{
+		AmountCeiling: map[string]float64{paymenttest.K_CHANNEL_FAKE: 100},
+		ReviewAmount:  map[string]float64{paymenttest.K_CHANNEL_FAKE: 10},
+	})
+	s.SetRiskChecker(checker)
+
+	var decisions []*payment.RiskDecision
+	s.Use(func(next payment.Operation) payment.Operation {
+		return func(call *payment.Call) error {
+			var err = next(call)
+			decisions = append(decisions, call.Risk)
+			return err
+		}
+	})
+
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("o1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 || decisions[0].Action != payment.K_RISK_ACTION_REVIEW {
+		t.Fatalf("需要人工审核的订单应该继续创建交易: %+v", decisions)
+	}
+
+	var order = newOrder("o2")
+	order.IP = "10.0.0.1"
+	checker.DenyIP(order.IP)
+	_, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order)
+	riskErr, ok := err.(*payment.RiskError)
+	if ok == false || riskErr.Channel != paymenttest.K_CHANNEL_FAKE || riskErr.OrderNo != "o2" || riskErr.Reasons[0] != payment.K_RISK_REASON_DENY_LIST {
+		t.Fatalf("应该返回 RiskError，实际为 %v", err)
+	}
+	if len(f.Orders()) != 1 {
+		t.Fatalf("风控拒绝时不应该创建交易")
+	}
+
+	s.SetRiskChecker(payment.RiskFunc(func(key string, order *payment.Order) (*payment.RiskDecision, error) {
+		return nil, nil
+	}))
+	if _, err = s.CreatePayment(paymenttest.K_CHANNEL_FAKE, order); err != nil {
+		t.Fatal(err)
+	}
+	if decisions[2].Action != payment.K_RISK_ACTION_ALLOW {
+		t.Fatalf("返回 nil 应该等同于允许: %+v", decisions[2])
+	}
+}
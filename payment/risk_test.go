@@ -0,0 +1,78 @@
+package payment
+
+import (
+	"testing"
+	"time"
+)
+
+func newRiskOrder(orderNo, ip string, price float64) *Order {
+	var order = &Order{OrderNo: orderNo, IP: ip}
+	order.AddProduct("p", "sku", 1, price, 0)
+	return order
+}
+
+func TestRuleRiskChecker(t *testing.T) {
+	var now = time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	var checker = NewRuleRiskChecker(&RiskRules{
+		IPWindow:      time.Minute,
+		IPLimit:       2,
+		OrderWindow:   time.Hour,
+		OrderLimit:    2,
+		AmountCeiling: map[string]float64{"alipay": 1000, "alipay:brand_b": 5000},
+		ReviewAmount:  map[string]float64{"alipay": 500},
+		DenyIPs:       []string{"10.0.0.1"},
+		Now:           func() time.Time { return now },
+	})
+
+	var check = func(key string, order *Order, action string, reasons ...string) {
+		t.Helper()
+		decision, err := checker.Check(key, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Action != action || len(decision.Reasons) != len(reasons) {
+			t.Fatalf("风控结果错误: %+v", decision)
+		}
+		for i, reason := range reasons {
+			if decision.Reasons[i] != reason {
+				t.Fatalf("风控原因错误: %+v", decision)
+			}
+		}
+	}
+
+	// 黑名单
+	check("alipay", newRiskOrder("o1", "10.0.0.1", 10), K_RISK_ACTION_DENY, K_RISK_REASON_DENY_LIST)
+	var order = newRiskOrder("o1", "10.0.0.2", 10)
+	order.Attributes = map[string]string{"payer": "u1"}
+	check("alipay", order, K_RISK_ACTION_ALLOW)
+	checker.DenyPayer("u1")
+	check("alipay", order, K_RISK_ACTION_DENY, K_RISK_REASON_DENY_LIST)
+	checker.Remove("u1")
+
+	// 金额上限，ChannelKey 优先
+	check("alipay", newRiskOrder("o2", "", 1200), K_RISK_ACTION_DENY, K_RISK_REASON_AMOUNT_CEILING)
+	check("alipay:brand_a", newRiskOrder("o2", "", 1200), K_RISK_ACTION_DENY, K_RISK_REASON_AMOUNT_CEILING)
+	check("alipay:brand_b", newRiskOrder("o2", "", 1200), K_RISK_ACTION_REVIEW, K_RISK_REASON_AMOUNT_REVIEW)
+	check("wxpay", newRiskOrder("o2", "", 1200), K_RISK_ACTION_ALLOW)
+
+	// 同一个 IP 在时间窗口内最多 2 次，o1 在上面已经使用了 1 次
+	check("wxpay", newRiskOrder("o3", "10.0.0.3", 10), K_RISK_ACTION_ALLOW)
+	check("wxpay", newRiskOrder("o4", "10.0.0.3", 10), K_RISK_ACTION_ALLOW)
+	check("wxpay", newRiskOrder("o5", "10.0.0.3", 10), K_RISK_ACTION_DENY, K_RISK_REASON_IP_VELOCITY)
+	now = now.Add(time.Minute)
+	check("wxpay", newRiskOrder("o6", "10.0.0.3", 10), K_RISK_ACTION_ALLOW)
+
+	// 同一个订单号在时间窗口内最多 2 次，黑名单命中时不统计，o1 在上面已经使用了 1 次
+	check("wxpay", newRiskOrder("o1", "", 10), K_RISK_ACTION_ALLOW)
+	check("wxpay", newRiskOrder("o1", "10.0.0.4", 10), K_RISK_ACTION_DENY, K_RISK_REASON_ORDER_VELOCITY)
+	if len(checker.orders["o1"]) != 3 {
+		t.Fatalf("应该记录 3 次，实际为 %d", len(checker.orders["o1"]))
+	}
+
+	// 过期的记录会被清理
+	now = now.Add(time.Hour * 2)
+	check("wxpay", newRiskOrder("o7", "10.0.0.5", 10), K_RISK_ACTION_ALLOW)
+	if len(checker.orders) != 1 || len(checker.ips) != 1 {
+		t.Fatalf("过期的记录没有清理: %v, %v", checker.orders, checker.ips)
+	}
+}
@@ -2,90 +2,1232 @@ package payment
 
 import (
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type Service struct {
-	channels map[string]PayChannel
+	channels map[string]PayChannel // key 为 ChannelKey
+	accounts map[string][]string   // key 为支付渠道，value 为该支付渠道按注册顺序排列的商户账号
+	routers  map[string]Router
+	health   *HealthTracker
+	failover FailoverPolicy
+	risk     RiskChecker
+
+	middlewares []Middleware
 }
 
 func NewService() *Service {
 	var s = &Service{}
 	s.channels = make(map[string]PayChannel)
+	s.accounts = make(map[string][]string)
+	s.routers = make(map[string]Router)
 	return s
 }
 
+// RegisterChannel 注册支付渠道，实现了 AccountChannel 的支付渠道会按照 ChannelKey(Identifier(), AccountId()) 注册，
+// 同一个支付渠道可以注册多个不同的商户账号
 func (this *Service) RegisterChannel(c PayChannel) {
-	if c != nil {
-		this.channels[c.Identifier()] = c
+	if c == nil {
+		return
+	}
+	var accountId = accountIdOf(c)
+	var key = ChannelKey(c.Identifier(), accountId)
+	if _, ok := this.channels[key]; ok == false && accountId != "" {
+		this.accounts[c.Identifier()] = append(this.accounts[c.Identifier()], accountId)
 	}
+	this.channels[key] = c
 }
 
+// RemoveChannel 移除支付渠道，channel 可以是 ChannelKey 返回的标识，只移除指定的商户账号
 func (this *Service) RemoveChannel(channel string) {
 	delete(this.channels, channel)
+
+	var identifier, accountId = splitChannelKey(channel)
+	if accountId == "" {
+		return
+	}
+	var accounts = this.accounts[identifier]
+	for i, id := range accounts {
+		if id == accountId {
+			this.accounts[identifier] = append(accounts[:i:i], accounts[i+1:]...)
+			break
+		}
+	}
+}
+
+// SetRouter 设置支付渠道的商户账号路由规则，CreatePayment 时如果订单没有指定 AccountId，会使用该规则选择账号
+func (this *Service) SetRouter(channel string, router Router) {
+	if router == nil {
+		delete(this.routers, channel)
+		return
+	}
+	this.routers[channel] = router
+}
+
+// SetHealthTracker 设置健康检查，设置之后会统计创建交易和查询交易的错误率和延迟，支付渠道熔断期间不会再使用它创建交易
+func (this *Service) SetHealthTracker(tracker *HealthTracker) {
+	this.health = tracker
+}
+
+// SetFailover 设置支付渠道熔断时的备用策略，没有设置时使用同一个支付渠道的其它商户账号
+func (this *Service) SetFailover(policy FailoverPolicy) {
+	this.failover = policy
+}
+
+// SetRiskChecker 设置风控检查，CreatePayment 在创建交易之前会使用选中的商户账号进行检查，拒绝时返回 *RiskError
+func (this *Service) SetRiskChecker(checker RiskChecker) {
+	this.risk = checker
+}
+
+// Use 添加中间件，CreatePayment、查询交易、各回调处理以及预授权扣款、协议扣款、付款和分账等资金操作都会经过中间件，先添加的中间件在外层
+func (this *Service) Use(middlewares ...Middleware) {
+	this.middlewares = append(this.middlewares, middlewares...)
+}
+
+func (this *Service) do(call *Call, op Operation) error {
+	for i := len(this.middlewares) - 1; i >= 0; i-- {
+		op = this.middlewares[i](op)
+	}
+	return op(call)
+}
+
+// accountIdOf 返回 channel 实际使用的商户账号
+func (this *Service) accountIdOf(channel string) string {
+	if p := this.channel(channel); p != nil {
+		return accountIdOf(p)
+	}
+	return ""
 }
 
+// Accounts 返回支付渠道已经注册的商户账号
+func (this *Service) Accounts(channel string) []string {
+	return append([]string(nil), this.accounts[channel]...)
+}
+
+// channel 根据 ChannelKey 获取支付渠道，没有指定商户账号时优先使用没有设置账号的支付渠道，否则使用第一个注册的账号
+func (this *Service) channel(key string) PayChannel {
+	if p := this.channels[key]; p != nil {
+		return p
+	}
+	if accounts := this.accounts[key]; len(accounts) > 0 {
+		return this.channels[ChannelKey(key, accounts[0])]
+	}
+	return nil
+}
+
+// route 为订单选择商户账号，订单指定了 AccountId 时直接使用该账号
+func (this *Service) route(channel string, order *Order) (PayChannel, error) {
+	var accountId = order.AccountId
+	if accountId == "" {
+		if router := this.routers[channel]; router != nil {
+			var err error
+			if accountId, err = router.Route(order, this.Accounts(channel)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if accountId != "" {
+		var p = this.channels[ChannelKey(channel, accountId)]
+		if p == nil {
+			return nil, ErrUnknownAccount
+		}
+		return p, nil
+	}
+
+	var p = this.channel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	return p, nil
+}
+
+// CreatePayment 创建支付，同一个支付渠道注册了多个商户账号时会按照路由规则选择账号，并将选中的账号设置到 order.AccountId 中，
+// 选中的账号熔断时会自动切换到同一个支付渠道的其它可用账号，订单指定了 AccountId 时不会切换，没有可用的账号时返回 ErrChannelUnavailable
 func (this *Service) CreatePayment(channel string, order *Order) (url string, err error) {
-	var p = this.channels[channel]
+	if order == nil {
+		return "", ErrUnknownOrderNo
+	}
+	var call = &Call{Operation: K_OPERATION_CREATE_PAYMENT, Channel: channel, Order: order, OrderNo: order.OrderNo}
+	err = this.do(call, func(call *Call) error {
+		url, err := this.createPayment(call)
+		call.Result = url
+		call.AccountId = call.Order.AccountId
+		return err
+	})
+	url, _ = call.Result.(string)
+	return url, err
+}
+
+func (this *Service) createPayment(call *Call) (url string, err error) {
+	var order = call.Order
+	var pinned = order.AccountId != ""
+	p, err := this.route(call.Channel, order)
+	if err != nil {
+		return "", err
+	}
+	if err = checkCurrency(p, order.TradeMethod, order.Currency); err != nil {
+		return "", err
+	}
+	if this.available(p) == false {
+		// 切换到其它支付渠道会改变 url 的含义，所以只自动切换商户账号，其它支付渠道由调用方通过 Alternatives 获取
+		var alt PayChannel
+		if pinned == false {
+			alt = this.failoverAccount(p, order)
+		}
+		if alt == nil {
+			return "", ErrChannelUnavailable
+		}
+		p = alt
+	}
+	// 风控规则可以按商户账号配置，所以在确定商户账号之后再检查
+	if err = this.checkRisk(call, p); err != nil {
+		return "", err
+	}
+
+	var create = p.CreateTradeOrder
+	if order.Intent == K_TRADE_INTENT_AUTHORIZE {
+		var ac, ok = p.(AuthorizeChannel)
+		if ok == false {
+			return "", ErrAuthorizeNotAllowed
+		}
+		create = ac.Authorize
+	}
+
+	// 半开状态下只允许一个请求尝试，其它请求在尝试的请求完成之前仍然认为不可用
+	if this.allow(p) == false {
+		return "", ErrChannelUnavailable
+	}
+	order.AccountId = accountIdOf(p)
+
+	var done = this.track(p)
+	url, err = create(order)
+	done(err)
+	return url, err
+}
+
+// checkRisk 进行风控检查，并将结果设置到 call.Risk 中，没有设置风控检查时不做任何处理
+func (this *Service) checkRisk(call *Call, p PayChannel) error {
+	if this.risk == nil {
+		return nil
+	}
+	decision, err := this.risk.Check(channelKeyOf(p), call.Order)
+	if err != nil {
+		return err
+	}
+	if decision == nil {
+		decision = &RiskDecision{Action: K_RISK_ACTION_ALLOW}
+	}
+	call.Risk = decision
+	if decision.Action == K_RISK_ACTION_DENY {
+		return &RiskError{Channel: p.Identifier(), AccountId: accountIdOf(p), OrderNo: call.Order.OrderNo, Reasons: decision.Reasons}
+	}
+	return nil
+}
+
+// track 开始统计一次请求，返回的函数用于记录请求的结果，没有设置健康检查时不做任何处理
+func (this *Service) track(p PayChannel) func(err error) {
+	if this.health == nil {
+		return func(err error) {}
+	}
+	var key = channelKeyOf(p)
+	var start = this.health.config.Now()
+	return func(err error) {
+		this.health.Record(key, this.health.config.Now().Sub(start), err)
+	}
+}
+
+func (this *Service) available(p PayChannel) bool {
+	return this.health == nil || this.health.Available(channelKeyOf(p))
+}
+
+// allow 与 available 相同，但是会占用半开状态下唯一的尝试机会，只能在马上要请求支付渠道的时候调用
+func (this *Service) allow(p PayChannel) bool {
+	return this.health == nil || this.health.Allow(channelKeyOf(p))
+}
+
+// failoverAccount 返回同一个支付渠道中第一个可用的备用商户账号
+func (this *Service) failoverAccount(p PayChannel, order *Order) PayChannel {
+	for _, key := range this.Alternatives(channelKeyOf(p), order) {
+		if alt := this.channels[key]; alt != nil && alt.Identifier() == p.Identifier() {
+			return alt
+		}
+	}
+	return nil
+}
+
+// Alternatives 返回订单可以使用的备用支付渠道或者商户账号（ChannelKey），没有注册、已经熔断以及不支持订单货币的会被过滤掉，
+// 没有设置 FailoverPolicy 时使用同一个支付渠道的其它商户账号
+func (this *Service) Alternatives(channel string, order *Order) []string {
+	var key = channel
+	if p := this.channel(channel); p != nil {
+		key = channelKeyOf(p)
+	}
+
+	var keys []string
+	if this.failover != nil {
+		keys = this.failover.Alternates(key, order)
+	} else {
+		var identifier, _ = splitChannelKey(key)
+		for _, accountId := range this.accounts[identifier] {
+			keys = append(keys, ChannelKey(identifier, accountId))
+		}
+	}
+
+	var results []string
+	var seen = map[string]bool{key: true}
+	for _, k := range keys {
+		var alt = this.channel(k)
+		if alt == nil || seen[channelKeyOf(alt)] {
+			continue
+		}
+		seen[channelKeyOf(alt)] = true
+		if this.available(alt) == false || checkCurrency(alt, order.TradeMethod, order.Currency) != nil {
+			continue
+		}
+		results = append(results, channelKeyOf(alt))
+	}
+	return results
+}
+
+// channelsOf 返回 channel 对应的所有支付渠道，channel 为 ChannelKey 时只返回指定的商户账号
+func (this *Service) channelsOf(channel string) []PayChannel {
+	var identifier, accountId = splitChannelKey(channel)
+	if accountId != "" {
+		if p := this.channels[channel]; p != nil {
+			return []PayChannel{p}
+		}
+		return nil
+	}
+
+	var results []PayChannel
+	if p := this.channels[identifier]; p != nil {
+		results = append(results, p)
+	}
+	for _, id := range this.accounts[identifier] {
+		results = append(results, this.channels[ChannelKey(identifier, id)])
+	}
+	return results
+}
+
+// Available 返回支付渠道是否可以用于创建交易，channel 为支付渠道时只要有一个商户账号没有熔断就返回 true，
+// 可以用于在收银台中隐藏暂时不可用的支付方式
+func (this *Service) Available(channel string) bool {
+	for _, p := range this.channelsOf(channel) {
+		if this.available(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Health 返回支付渠道各商户账号的健康状态，没有设置健康检查时返回 nil
+func (this *Service) Health(channel string) []*Health {
+	if this.health == nil {
+		return nil
+	}
+	var results []*Health
+	for _, p := range this.channelsOf(channel) {
+		results = append(results, this.healthOf(channelKeyOf(p)))
+	}
+	return results
+}
+
+// HealthList 返回所有已经注册的支付渠道的健康状态，按照 ChannelKey 排序，没有设置健康检查时返回 nil
+func (this *Service) HealthList() []*Health {
+	if this.health == nil {
+		return nil
+	}
+	var keys = make([]string, 0, len(this.channels))
+	for key := range this.channels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var results = make([]*Health, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, this.healthOf(key))
+	}
+	return results
+}
+
+// healthOf 返回已经注册的支付渠道的健康状态，还没有请求记录的支付渠道为正常状态
+func (this *Service) healthOf(key string) *Health {
+	if h := this.health.Health(key); h != nil {
+		return h
+	}
+	var h = &Health{State: K_HEALTH_STATE_CLOSED, Available: true}
+	h.Channel, h.AccountId = splitChannelKey(key)
+	return h
+}
+
+// checkCurrency 验证货币代码，并且检查支付渠道的支付方式是否支持该货币
+func checkCurrency(p PayChannel, tradeMethod, currency string) error {
+	if currency != "" && IsValidCurrency(currency) == false {
+		return ErrInvalidCurrency
+	}
+	if cc, ok := p.(CurrencyChannel); ok && cc.SupportCurrency(tradeMethod, currency) == false {
+		return ErrCurrencyNotSupported
+	}
+	return nil
+}
+
+func (this *Service) refundChannel(channel string) (RefundChannel, error) {
+	var p = this.channel(channel)
 	if p == nil {
-		return "", ErrUnknownChannel
+		return nil, ErrUnknownChannel
+	}
+	var rc, ok = p.(RefundChannel)
+	if ok == false {
+		return nil, ErrRefundNotAllowed
+	}
+	return rc, nil
+}
+
+// Refund 退款，会先查询交易，使用交易的金额和货币，退款金额不能超过交易金额
+func (this *Service) Refund(channel string, param *RefundParam) (result *Refund, err error) {
+	var call = &Call{Operation: K_OPERATION_REFUND, Channel: channel, Param: param}
+	if param != nil {
+		call.OrderNo = param.OrderNo
+		call.TradeNo = param.TradeNo
+	}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.refund(call)
+		if result != nil {
+			call.OrderNo = result.OrderNo
+			call.TradeNo = result.TradeNo
+			call.Result = result
+		}
+		return err
+	})
+	result, _ = call.Result.(*Refund)
+	return result, err
+}
+
+func (this *Service) refund(call *Call) (result *Refund, err error) {
+	rc, err := this.refundChannel(call.Channel)
+	if err != nil {
+		return nil, err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var param, _ = call.Param.(*RefundParam)
+	if param == nil || param.RefundNo == "" {
+		return nil, ErrUnknownRefund
+	}
+	if param.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+
+	// 不使用调用方提供的交易金额，避免退款金额超过实际的交易金额
+	var trade *Trade
+	switch {
+	case param.TradeNo != "":
+		trade, err = this.getTrade(call.Channel, param.TradeNo)
+	case param.OrderNo != "":
+		trade, err = this.getTradeWithOrderNo(call.Channel, param.OrderNo)
+	default:
+		return nil, ErrUnknownTradeNo
+	}
+	if err != nil {
+		return nil, err
+	}
+	if param.OrderNo != "" && trade.OrderNo != param.OrderNo {
+		return nil, ErrTradeMismatch
+	}
+
+	// 复制一份参数再补充交易信息，不修改调用方的参数
+	var p = *param
+	p.TradeNo = trade.TradeNo
+	p.OrderNo = trade.OrderNo
+	if p.TotalAmount, err = strconv.ParseFloat(trade.TotalAmount, 64); err != nil {
+		return nil, err
 	}
-	return p.CreateTradeOrder(order)
+	p.Currency = trade.Currency
+
+	var decimals = CurrencyDecimals(p.Currency)
+	if roundAmount(p.Amount, decimals) > roundAmount(p.TotalAmount, decimals) {
+		return nil, ErrInvalidAmount
+	}
+	return rc.Refund(&p)
+}
+
+func (this *Service) authorizeChannel(channel string) (AuthorizeChannel, error) {
+	var p = this.channel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	var ac, ok = p.(AuthorizeChannel)
+	if ok == false {
+		return nil, ErrAuthorizeNotAllowed
+	}
+	return ac, nil
+}
+
+// GetAuthorization 查询预授权信息
+func (this *Service) GetAuthorization(channel string, authorizationId string) (result *Authorization, err error) {
+	ac, err := this.authorizeChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+	return ac.GetAuthorization(authorizationId)
+}
+
+// GetAuthorizationWithOrderNo 根据创建预授权时的订单编号查询预授权信息
+func (this *Service) GetAuthorizationWithOrderNo(channel string, orderNo string) (result *Authorization, err error) {
+	ac, err := this.authorizeChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+	return ac.GetAuthorizationWithOrderNo(orderNo)
+}
+
+// Capture 从预授权冻结的资金中扣款，可以全额扣款，也可以分多次扣款
+func (this *Service) Capture(channel string, param *CaptureParam) (result *Capture, err error) {
+	var call = &Call{Operation: K_OPERATION_CAPTURE, Channel: channel, Param: param}
+	if param != nil {
+		call.OrderNo = param.OrderNo
+	}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.capture(call)
+		if result != nil {
+			call.Result = result
+		}
+		return err
+	})
+	result, _ = call.Result.(*Capture)
+	return result, err
+}
+
+func (this *Service) capture(call *Call) (result *Capture, err error) {
+	ac, err := this.authorizeChannel(call.Channel)
+	if err != nil {
+		return nil, err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var param, _ = call.Param.(*CaptureParam)
+	if param == nil || param.AuthorizationId == "" {
+		return nil, ErrUnknownAuthorization
+	}
+	return ac.Capture(param)
+}
+
+// Void 撤销预授权，释放剩余的冻结资金
+func (this *Service) Void(channel string, authorizationId string) (err error) {
+	var call = &Call{Operation: K_OPERATION_VOID, Channel: channel, Param: authorizationId}
+	return this.do(call, this.void)
+}
+
+func (this *Service) void(call *Call) (err error) {
+	ac, err := this.authorizeChannel(call.Channel)
+	if err != nil {
+		return err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var authorizationId, _ = call.Param.(string)
+	if authorizationId == "" {
+		return ErrUnknownAuthorization
+	}
+	return ac.Void(authorizationId)
 }
 
 func (this *Service) GetTrade(channel string, tradeNo string) (result *Trade, err error) {
-	var p = this.channels[channel]
+	var call = &Call{Operation: K_OPERATION_GET_TRADE, Channel: channel, TradeNo: tradeNo}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.getTrade(call.Channel, call.TradeNo)
+		call.setTrade(result)
+		return err
+	})
+	result, _ = call.Result.(*Trade)
+	return result, err
+}
+
+func (this *Service) getTrade(channel string, tradeNo string) (result *Trade, err error) {
+	var p = this.channel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
-	return p.GetTrade(tradeNo)
+	var done = this.track(p)
+	result, err = p.GetTrade(tradeNo)
+	done(err)
+	return result, err
 }
 
 func (this *Service) GetTradeWithOrderNo(channel string, orderNo string) (result *Trade, err error) {
-	var p = this.channels[channel]
+	var call = &Call{Operation: K_OPERATION_GET_TRADE_WITH_ORDER_NO, Channel: channel, OrderNo: orderNo}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.getTradeWithOrderNo(call.Channel, call.OrderNo)
+		call.setTrade(result)
+		return err
+	})
+	result, _ = call.Result.(*Trade)
+	return result, err
+}
+
+func (this *Service) getTradeWithOrderNo(channel string, orderNo string) (result *Trade, err error) {
+	var p = this.channel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
-	return p.GetTradeWithOrderNo(orderNo)
+	var done = this.track(p)
+	result, err = p.GetTradeWithOrderNo(orderNo)
+	done(err)
+	return result, err
 }
 
-func (this *Service) ReturnURLHandler(req *http.Request) (result *Trade, err error) {
-	req.ParseForm()
+func (this *Service) agreementChannel(channel string) (AgreementChannel, error) {
+	var p = this.channel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	var ac, ok = p.(AgreementChannel)
+	if ok == false {
+		return nil, ErrAgreementNotAllowed
+	}
+	return ac, nil
+}
 
-	var channel = req.FormValue("channel")
-	var p = this.channels[channel]
+// CreateAgreement 创建签约协议，返回用户进行签约的 URL
+func (this *Service) CreateAgreement(channel string, agreement *Agreement) (url string, err error) {
+	var call = &Call{Operation: K_OPERATION_CREATE_AGREEMENT, Channel: channel, Param: agreement}
+	if agreement != nil {
+		call.OrderNo = agreement.AgreementNo
+	}
+	err = this.do(call, func(call *Call) error {
+		url, err := this.createAgreement(call)
+		call.Result = url
+		return err
+	})
+	url, _ = call.Result.(string)
+	return url, err
+}
+
+func (this *Service) createAgreement(call *Call) (url string, err error) {
+	ac, err := this.agreementChannel(call.Channel)
+	if err != nil {
+		return "", err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var agreement, _ = call.Param.(*Agreement)
+	if agreement == nil || agreement.AgreementNo == "" {
+		return "", ErrUnknownAgreement
+	}
+	if agreement.Currency != "" && IsValidCurrency(agreement.Currency) == false {
+		return "", ErrInvalidCurrency
+	}
+	return ac.CreateAgreement(agreement)
+}
+
+// AgreementReturnHandler 处理用户签约完成之后跳转回来的请求
+func (this *Service) AgreementReturnHandler(req *http.Request) (result *Subscription, err error) {
+	p, _, err := this.callbackChannel(req)
+	if err != nil {
+		return nil, err
+	}
+	var ac, ok = p.(AgreementChannel)
+	if ok == false {
+		return nil, ErrAgreementNotAllowed
+	}
+	return ac.AgreementReturnHandler(req)
+}
+
+// GetAgreement 查询签约协议的状态
+func (this *Service) GetAgreement(channel string, agreementId string) (result *Subscription, err error) {
+	ac, err := this.agreementChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+	return ac.GetAgreement(agreementId)
+}
+
+// ChargeAgreement 按签约协议扣款，需要由调用方按照 Agreement.NextChargeTime 定时调用
+func (this *Service) ChargeAgreement(channel string, param *AgreementChargeParam) (result *Trade, err error) {
+	var call = &Call{Operation: K_OPERATION_CHARGE_AGREEMENT, Channel: channel, Param: param}
+	if param != nil {
+		call.OrderNo = param.OrderNo
+	}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.chargeAgreement(call)
+		call.setTrade(result)
+		return err
+	})
+	result, _ = call.Result.(*Trade)
+	return result, err
+}
+
+func (this *Service) chargeAgreement(call *Call) (result *Trade, err error) {
+	ac, err := this.agreementChannel(call.Channel)
+	if err != nil {
+		return nil, err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var param, _ = call.Param.(*AgreementChargeParam)
+	if param == nil || param.AgreementId == "" {
+		return nil, ErrUnknownAgreement
+	}
+	if param.OrderNo == "" {
+		return nil, ErrUnknownOrderNo
+	}
+	return ac.ChargeAgreement(param)
+}
+
+// CancelAgreement 解除签约协议
+func (this *Service) CancelAgreement(channel string, agreementId string) (err error) {
+	var call = &Call{Operation: K_OPERATION_CANCEL_AGREEMENT, Channel: channel, Param: agreementId}
+	return this.do(call, this.cancelAgreement)
+}
+
+func (this *Service) cancelAgreement(call *Call) (err error) {
+	ac, err := this.agreementChannel(call.Channel)
+	if err != nil {
+		return err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var agreementId, _ = call.Param.(string)
+	if agreementId == "" {
+		return ErrUnknownAgreement
+	}
+	return ac.CancelAgreement(agreementId)
+}
+
+func (this *Service) payoutChannel(channel string) (PayoutChannel, error) {
+	var p = this.channel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
+	var pc, ok = p.(PayoutChannel)
+	if ok == false {
+		return nil, ErrPayoutNotAllowed
+	}
+	return pc, nil
+}
 
-	var tradeNo = ""
+// Payout 向用户付款
+func (this *Service) Payout(channel string, payout *Payout) (result *PayoutResult, err error) {
+	var call = &Call{Operation: K_OPERATION_PAYOUT, Channel: channel, Param: payout}
+	if payout != nil {
+		call.OrderNo = payout.PayoutNo
+	}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.payout(call)
+		if result != nil {
+			call.Result = result
+		}
+		return err
+	})
+	result, _ = call.Result.(*PayoutResult)
+	return result, err
+}
 
-	switch channel {
-	case K_CHANNEL_ALIPAY:
-		tradeNo = req.FormValue("trade_no")
-	case K_CHANNEL_PAYPAL:
-		tradeNo = req.FormValue("paymentId")
-	case K_CHANNEL_WXPAY:
-		tradeNo = req.FormValue("transaction_id")
+func (this *Service) payout(call *Call) (result *PayoutResult, err error) {
+	pc, err := this.payoutChannel(call.Channel)
+	if err != nil {
+		return nil, err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var payout, _ = call.Param.(*Payout)
+	if payout == nil || payout.PayoutNo == "" {
+		return nil, ErrUnknownPayout
+	}
+	if payout.Amount <= 0 {
+		return nil, ErrInvalidAmount
 	}
+	if payout.Currency != "" && IsValidCurrency(payout.Currency) == false {
+		return nil, ErrInvalidCurrency
+	}
+	return pc.Payout(payout)
+}
 
-	if tradeNo == "" {
+// BatchPayout 批量付款，单笔付款的失败不会返回 error，需要检查每一笔付款的 Status
+func (this *Service) BatchPayout(channel string, batchNo string, payouts []*Payout) (results []*PayoutResult, err error) {
+	var call = &Call{Operation: K_OPERATION_BATCH_PAYOUT, Channel: channel, OrderNo: batchNo, Param: payouts}
+	err = this.do(call, func(call *Call) error {
+		results, err := this.batchPayout(call)
+		if results != nil {
+			call.Result = results
+		}
+		return err
+	})
+	results, _ = call.Result.([]*PayoutResult)
+	return results, err
+}
+
+func (this *Service) batchPayout(call *Call) (results []*PayoutResult, err error) {
+	pc, err := this.payoutChannel(call.Channel)
+	if err != nil {
+		return nil, err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var payouts, _ = call.Param.([]*Payout)
+	for _, payout := range payouts {
+		if payout == nil || payout.PayoutNo == "" {
+			return nil, ErrUnknownPayout
+		}
+		if payout.Amount <= 0 {
+			return nil, ErrInvalidAmount
+		}
+		if payout.Currency != "" && IsValidCurrency(payout.Currency) == false {
+			return nil, ErrInvalidCurrency
+		}
+		if payout.Currency != payouts[0].Currency {
+			return nil, ErrCurrencyMismatch
+		}
+	}
+	return pc.BatchPayout(call.OrderNo, payouts)
+}
+
+// batchPayout 用于不支持批量付款的支付渠道，逐笔调用 payout，付款失败时将错误信息记录在 FailReason 中
+func batchPayout(channel, batchNo string, payouts []*Payout, payout func(payout *Payout) (*PayoutResult, error)) (results []*PayoutResult) {
+	results = make([]*PayoutResult, 0, len(payouts))
+	for _, p := range payouts {
+		var result, err = payout(p)
+		if err != nil {
+			result = &PayoutResult{}
+			result.Channel = channel
+			result.PayoutNo = p.PayoutNo
+			result.Status = K_PAYOUT_STATUS_FAILED
+			result.Amount = FormatAmount(p.Currency, p.Amount)
+			result.FailReason = err.Error()
+		}
+		result.BatchNo = batchNo
+		results = append(results, result)
+	}
+	return results
+}
+
+// GetPayout 根据支付渠道的付款单号查询付款结果
+func (this *Service) GetPayout(channel string, payoutId string) (result *PayoutResult, err error) {
+	var call = &Call{Operation: K_OPERATION_GET_PAYOUT, Channel: channel, Param: payoutId}
+	err = this.do(call, func(call *Call) error {
+		pc, err := this.payoutChannel(call.Channel)
+		if err != nil {
+			return err
+		}
+		call.AccountId = this.accountIdOf(call.Channel)
+		var payoutId, _ = call.Param.(string)
+		result, err := pc.GetPayout(payoutId)
+		call.setPayout(result)
+		return err
+	})
+	result, _ = call.Result.(*PayoutResult)
+	return result, err
+}
+
+// GetPayoutWithPayoutNo 根据商户的付款单号查询付款结果
+func (this *Service) GetPayoutWithPayoutNo(channel string, payoutNo string) (result *PayoutResult, err error) {
+	var call = &Call{Operation: K_OPERATION_GET_PAYOUT_WITH_PAYOUT_NO, Channel: channel, OrderNo: payoutNo}
+	err = this.do(call, func(call *Call) error {
+		pc, err := this.payoutChannel(call.Channel)
+		if err != nil {
+			return err
+		}
+		call.AccountId = this.accountIdOf(call.Channel)
+		result, err := pc.GetPayoutWithPayoutNo(call.OrderNo)
+		call.setPayout(result)
+		return err
+	})
+	result, _ = call.Result.(*PayoutResult)
+	return result, err
+}
+
+func (this *Service) splitChannel(channel string) (SplitChannel, error) {
+	var p = this.channel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	var sc, ok = p.(SplitChannel)
+	if ok == false {
+		return nil, ErrSplitNotAllowed
+	}
+	return sc, nil
+}
+
+// AddSplitReceiver 添加分账接收方
+func (this *Service) AddSplitReceiver(channel string, receiver *SplitReceiver) (err error) {
+	var call = &Call{Operation: K_OPERATION_ADD_SPLIT_RECEIVER, Channel: channel, Param: receiver}
+	return this.do(call, this.addSplitReceiver)
+}
+
+func (this *Service) addSplitReceiver(call *Call) (err error) {
+	sc, err := this.splitChannel(call.Channel)
+	if err != nil {
+		return err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var receiver, _ = call.Param.(*SplitReceiver)
+	if receiver == nil || receiver.Account == "" {
+		return ErrInvalidSplit
+	}
+	return sc.AddSplitReceiver(receiver)
+}
+
+// Split 分账，会先查询交易，使用交易的金额和货币计算分账金额，分账总额不能超过交易金额
+func (this *Service) Split(channel string, param *SplitParam) (result *SplitResult, err error) {
+	var call = &Call{Operation: K_OPERATION_SPLIT, Channel: channel, Param: param}
+	if param != nil {
+		call.TradeNo = param.TradeNo
+	}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.split(call)
+		if result != nil {
+			call.Result = result
+		}
+		return err
+	})
+	result, _ = call.Result.(*SplitResult)
+	return result, err
+}
+
+func (this *Service) split(call *Call) (result *SplitResult, err error) {
+	sc, err := this.splitChannel(call.Channel)
+	if err != nil {
+		return nil, err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var param, _ = call.Param.(*SplitParam)
+	if param == nil {
+		return nil, ErrInvalidSplit
+	}
+	if param.TradeNo == "" {
 		return nil, ErrUnknownTradeNo
 	}
 
-	trade, err := p.GetTrade(tradeNo)
+	// 不使用调用方提供的交易金额，避免分账总额超过实际的交易金额
+	trade, err := this.getTrade(call.Channel, param.TradeNo)
 	if err != nil {
 		return nil, err
 	}
-	return trade, nil
+
+	// 复制一份参数再补充交易信息，Validate 会按比例计算接收方的分账金额，所以接收方也需要复制，不修改调用方的参数
+	var p = *param
+	p.Receivers = make([]*SplitReceiver, 0, len(param.Receivers))
+	for _, r := range param.Receivers {
+		if r != nil {
+			var receiver = *r
+			r = &receiver
+		}
+		p.Receivers = append(p.Receivers, r)
+	}
+	if p.TotalAmount, err = strconv.ParseFloat(trade.TotalAmount, 64); err != nil {
+		return nil, err
+	}
+	p.Currency = trade.Currency
+
+	if err = p.Validate(); err != nil {
+		return nil, err
+	}
+	return sc.Split(&p)
 }
 
-func (this *Service) NotifyURLHandler(req *http.Request) (result *Notification, err error) {
-	req.ParseForm()
+// GetSplit 查询分账结果
+func (this *Service) GetSplit(channel string, tradeNo, splitNo string) (result *SplitResult, err error) {
+	sc, err := this.splitChannel(channel)
+	if err != nil {
+		return nil, err
+	}
+	return sc.GetSplit(tradeNo, splitNo)
+}
 
-	var channel = req.FormValue("channel")
-	var p = this.channels[channel]
+// ReturnSplit 分账回退
+func (this *Service) ReturnSplit(channel string, param *SplitReturnParam) (result *SplitReturn, err error) {
+	var call = &Call{Operation: K_OPERATION_RETURN_SPLIT, Channel: channel, Param: param}
+	err = this.do(call, func(call *Call) error {
+		result, err := this.returnSplit(call)
+		if result != nil {
+			call.Result = result
+		}
+		return err
+	})
+	result, _ = call.Result.(*SplitReturn)
+	return result, err
+}
+
+func (this *Service) returnSplit(call *Call) (result *SplitReturn, err error) {
+	sc, err := this.splitChannel(call.Channel)
+	if err != nil {
+		return nil, err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var param, _ = call.Param.(*SplitReturnParam)
+	if param == nil || param.SplitNo == "" || param.ReturnNo == "" || param.Amount <= 0 {
+		return nil, ErrInvalidSplit
+	}
+	return sc.ReturnSplit(param)
+}
+
+// FinishSplit 完结分账，剩余的冻结资金会解冻给商户
+func (this *Service) FinishSplit(channel string, tradeNo, splitNo string) (err error) {
+	var call = &Call{Operation: K_OPERATION_FINISH_SPLIT, Channel: channel, TradeNo: tradeNo, Param: splitNo}
+	return this.do(call, func(call *Call) error {
+		sc, err := this.splitChannel(call.Channel)
+		if err != nil {
+			return err
+		}
+		call.AccountId = this.accountIdOf(call.Channel)
+		var splitNo, _ = call.Param.(string)
+		return sc.FinishSplit(call.TradeNo, splitNo)
+	})
+}
+
+func (this *Service) disputeChannel(channel string) (DisputeChannel, error) {
+	var p = this.channel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
-	return p.NotifyHandler(req)
+	var dc, ok = p.(DisputeChannel)
+	if ok == false {
+		return nil, ErrDisputeNotAllowed
+	}
+	return dc, nil
+}
+
+// ListDisputes 获取 since 之后创建的争议
+func (this *Service) ListDisputes(channel string, since time.Time) (results []*Dispute, err error) {
+	var call = &Call{Operation: K_OPERATION_LIST_DISPUTES, Channel: channel, Param: since}
+	err = this.do(call, func(call *Call) error {
+		dc, err := this.disputeChannel(call.Channel)
+		if err != nil {
+			return err
+		}
+		call.AccountId = this.accountIdOf(call.Channel)
+		var since, _ = call.Param.(time.Time)
+		results, err := dc.ListDisputes(since)
+		if results != nil {
+			call.Result = results
+		}
+		return err
+	})
+	results, _ = call.Result.([]*Dispute)
+	return results, err
+}
+
+// GetDispute 获取争议的详细信息
+func (this *Service) GetDispute(channel string, disputeId string) (result *Dispute, err error) {
+	var call = &Call{Operation: K_OPERATION_GET_DISPUTE, Channel: channel, Param: disputeId}
+	err = this.do(call, func(call *Call) error {
+		return this.dispute(call, func(dc DisputeChannel, disputeId string) error {
+			result, err := dc.GetDispute(disputeId)
+			if result != nil {
+				call.Result = result
+				call.OrderNo = result.OrderNo
+				call.TradeNo = result.TradeNo
+			}
+			return err
+		})
+	})
+	result, _ = call.Result.(*Dispute)
+	return result, err
+}
+
+// AcceptDispute 接受买家的索赔，争议金额会退还给买家
+func (this *Service) AcceptDispute(channel string, disputeId, note string) (err error) {
+	var call = &Call{Operation: K_OPERATION_ACCEPT_DISPUTE, Channel: channel, Param: disputeId}
+	return this.do(call, func(call *Call) error {
+		return this.dispute(call, func(dc DisputeChannel, disputeId string) error {
+			return dc.AcceptDispute(disputeId, note)
+		})
+	})
+}
+
+// ProvideDisputeEvidence 提交争议证据
+func (this *Service) ProvideDisputeEvidence(channel string, disputeId string, evidences []*DisputeEvidence) (err error) {
+	var call = &Call{Operation: K_OPERATION_PROVIDE_DISPUTE_EVIDENCE, Channel: channel, Param: disputeId}
+	return this.do(call, func(call *Call) error {
+		return this.dispute(call, func(dc DisputeChannel, disputeId string) error {
+			return dc.ProvideDisputeEvidence(disputeId, evidences)
+		})
+	})
+}
+
+// SendDisputeMessage 向买家发送消息
+func (this *Service) SendDisputeMessage(channel string, disputeId, message string) (err error) {
+	var call = &Call{Operation: K_OPERATION_SEND_DISPUTE_MESSAGE, Channel: channel, Param: disputeId}
+	return this.do(call, func(call *Call) error {
+		return this.dispute(call, func(dc DisputeChannel, disputeId string) error {
+			return dc.SendDisputeMessage(disputeId, message)
+		})
+	})
+}
+
+// EscalateDispute 将争议升级为索赔，交由支付渠道处理
+func (this *Service) EscalateDispute(channel string, disputeId, note string) (err error) {
+	var call = &Call{Operation: K_OPERATION_ESCALATE_DISPUTE, Channel: channel, Param: disputeId}
+	return this.do(call, func(call *Call) error {
+		return this.dispute(call, func(dc DisputeChannel, disputeId string) error {
+			return dc.EscalateDispute(disputeId, note)
+		})
+	})
+}
+
+// dispute 检查支付渠道和争议编号（call.Param），然后执行具体的争议操作
+func (this *Service) dispute(call *Call, operation func(dc DisputeChannel, disputeId string) error) error {
+	dc, err := this.disputeChannel(call.Channel)
+	if err != nil {
+		return err
+	}
+	call.AccountId = this.accountIdOf(call.Channel)
+	var disputeId, _ = call.Param.(string)
+	if disputeId == "" {
+		return ErrUnknownDispute
+	}
+	return operation(dc, disputeId)
+}
+
+// callbackChannel 根据回调 URL 中的 channel 和 account 参数获取创建订单的支付渠道
+func (this *Service) callbackChannel(req *http.Request) (p PayChannel, accountId string, err error) {
+	req.ParseForm()
+
+	var channel = req.FormValue("channel")
+	accountId = req.FormValue("account")
+	if p = this.channel(ChannelKey(channel, accountId)); p == nil {
+		if accountId != "" && this.channel(channel) != nil {
+			return nil, "", ErrUnknownAccount
+		}
+		return nil, "", ErrUnknownChannel
+	}
+	return p, accountIdOf(p), nil
+}
+
+// callbackCall 回调 URL 中的 channel 参数是 Service 在创建订单时添加的
+func callbackCall(operation string, req *http.Request) *Call {
+	return &Call{Operation: operation, Channel: req.URL.Query().Get("channel"), Request: req}
+}
+
+func (this *Service) ReturnURLHandler(req *http.Request) (result *Trade, err error) {
+	var call = callbackCall(K_OPERATION_RETURN, req)
+	err = this.do(call, func(call *Call) error {
+		result, err := this.returnURLHandler(call.Request)
+		call.setTrade(result)
+		return err
+	})
+	result, _ = call.Result.(*Trade)
+	return result, err
+}
+
+func (this *Service) returnURLHandler(req *http.Request) (result *Trade, err error) {
+	p, accountId, err := this.callbackChannel(req)
+	if err != nil {
+		return nil, err
+	}
+	if result, err = p.ReturnHandler(req); err != nil {
+		return nil, err
+	}
+	result.AccountId = accountId
+	return result, nil
+}
+
+// CancelURLHandler 处理用户取消付款之后跳转回来的请求
+func (this *Service) CancelURLHandler(req *http.Request) (result *Cancellation, err error) {
+	var call = callbackCall(K_OPERATION_CANCEL, req)
+	err = this.do(call, func(call *Call) error {
+		result, err := this.cancelURLHandler(call.Request)
+		if result != nil {
+			call.Result = result
+			call.AccountId = result.AccountId
+			call.OrderNo = result.OrderNo
+		}
+		return err
+	})
+	result, _ = call.Result.(*Cancellation)
+	return result, err
+}
+
+func (this *Service) cancelURLHandler(req *http.Request) (result *Cancellation, err error) {
+	p, accountId, err := this.callbackChannel(req)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Cancellation{}
+	result.Channel = p.Identifier()
+	result.AccountId = accountId
+	result.OrderNo = req.FormValue("order_no")
+	if result.OrderNo == "" {
+		return nil, ErrUnknownOrderNo
+	}
+	return result, nil
+}
+
+// NotifyOption NotifyURLHandler 的可选参数
+type NotifyOption func(opts *notifyOptions)
+
+type notifyOptions struct {
+	fetchTrade       bool
+	alwaysFetchTrade bool
+}
+
+// WithFetchTrade 通知中的信息不足以确定交易的结果时（参考 Notification.Conclusive），查询交易并补充通知中缺少的信息
+func WithFetchTrade() NotifyOption {
+	return func(opts *notifyOptions) {
+		opts.fetchTrade = true
+	}
+}
+
+// WithAlwaysFetchTrade 交易通知和退款通知总是查询交易，适用于不信任通知内容，需要以查询结果为准的场景
+func WithAlwaysFetchTrade() NotifyOption {
+	return func(opts *notifyOptions) {
+		opts.fetchTrade = true
+		opts.alwaysFetchTrade = true
+	}
+}
+
+// NotifyURLHandler 处理支付渠道的异步通知，通知通过验证之后查询交易失败时仍然返回通知，此时 Notification.Trade 为 nil
+func (this *Service) NotifyURLHandler(req *http.Request, opts ...NotifyOption) (result *Notification, err error) {
+	var o = &notifyOptions{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(o)
+		}
+	}
+
+	var call = callbackCall(K_OPERATION_NOTIFY, req)
+	err = this.do(call, func(call *Call) error {
+		result, err := this.notifyURLHandler(call.Request, o)
+		if result != nil {
+			call.Result = result
+			call.AccountId = result.AccountId
+			call.OrderNo = result.OrderNo
+			call.TradeNo = result.TradeNo
+		}
+		return err
+	})
+	result, _ = call.Result.(*Notification)
+	return result, err
+}
+
+func (this *Service) notifyURLHandler(req *http.Request, opts *notifyOptions) (result *Notification, err error) {
+	p, accountId, err := this.callbackChannel(req)
+	if err != nil {
+		return nil, err
+	}
+	if result, err = p.NotifyHandler(req); err != nil {
+		return nil, err
+	}
+	result.AccountId = accountId
+
+	if opts.fetchTrade == false || (result.NotifyType != K_NOTIFY_TYPE_TRADE && result.NotifyType != K_NOTIFY_TYPE_REFUND) {
+		return result, nil
+	}
+	if opts.alwaysFetchTrade == false && result.Conclusive() {
+		return result, nil
+	}
+
+	// 优先使用交易号查询，PayPal 不支持使用订单号查询交易
+	var trade *Trade
+	switch {
+	case result.TradeNo != "":
+		trade, err = this.getTrade(channelKeyOf(p), result.TradeNo)
+	case result.OrderNo != "":
+		trade, err = this.getTradeWithOrderNo(channelKeyOf(p), result.OrderNo)
+	default:
+		return result, nil
+	}
+	if err != nil {
+		// 查询交易只是为了补充信息，通知本身已经通过验证，返回错误会导致支付渠道不断重试
+		return result, nil
+	}
+	trade.AccountId = accountId
+	result.merge(trade)
+	return result, nil
 }
@@ -0,0 +1,88 @@
+package payment_test
+
+import (
+	"errors"
+	"github.com/smartwalle/m4go/payment"
+	"github.com/smartwalle/m4go/payment/paymenttest"
+	"testing"
+)
+
+// Service 的测试使用 paymenttest.FakeChannel 作为支付渠道，paymenttest 依赖 payment，所以放在 payment_test 包中
+
+func newOrder(orderNo string) *payment.Order {
+	var o = &payment.Order{}
+	o.OrderNo = orderNo
+	o.Subject = "test"
+	o.Discount = 1
+	o.AddProduct("test", "sku001", 2, 10.5, 0)
+	return o
+}
+
+func TestService_NotifyEnrichment(t *testing.T) {
+	var f = paymenttest.NewFakeChannel("")
+	var s = payment.NewService()
+	s.RegisterChannel(f)
+
+	if _, err := s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("o1")); err != nil {
+		t.Fatal(err)
+	}
+	f.Pay("o1", "payer1")
+
+	// 没有使用 WithFetchTrade 时不会查询交易
+	req, _ := f.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	noti, err := s.NotifyURLHandler(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noti.Status != payment.K_TRADE_STATUS_SUCCESS || noti.RawStatus != paymenttest.K_TRADE_STATUS_SUCCESS {
+		t.Fatalf("通知的交易状态错误: %+v", noti)
+	}
+	if noti.Conclusive() || noti.Trade != nil || noti.TotalAmount != "" {
+		t.Fatalf("通知中没有交易金额，不应该查询交易: %+v", noti)
+	}
+
+	req, _ = f.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	noti, err = s.NotifyURLHandler(req, payment.WithFetchTrade())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noti.Trade == nil || noti.Trade.TradeNo != noti.TradeNo {
+		t.Fatalf("应该查询交易: %+v", noti)
+	}
+	if noti.TotalAmount != "20.00" || noti.PayerId != "payer1" || noti.Conclusive() == false {
+		t.Fatalf("应该使用查询到的交易补充通知: %+v", noti)
+	}
+
+	// 查询交易失败时仍然返回已经通过验证的通知
+	f.SetError(paymenttest.K_OPERATION_GET_TRADE, errors.New("query"))
+	req, _ = f.NotifyRequest("o1", payment.K_NOTIFY_TYPE_TRADE)
+	if noti, err = s.NotifyURLHandler(req, payment.WithAlwaysFetchTrade()); err != nil || noti.Trade != nil || noti.Status != payment.K_TRADE_STATUS_SUCCESS {
+		t.Fatalf("查询交易失败时应该返回通知，实际为 %+v, %v", noti, err)
+	}
+	f.SetError(paymenttest.K_OPERATION_GET_TRADE, nil)
+
+	// 查询到的交易状态比通知中的更新，优先使用交易状态
+	if _, err = s.CreatePayment(paymenttest.K_CHANNEL_FAKE, newOrder("o2")); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = f.NotifyRequest("o2", payment.K_NOTIFY_TYPE_TRADE)
+	f.Pay("o2", "payer2")
+	if noti, err = s.NotifyURLHandler(req, payment.WithAlwaysFetchTrade()); err != nil {
+		t.Fatal(err)
+	}
+	if noti.Status != payment.K_TRADE_STATUS_SUCCESS || noti.RawStatus != paymenttest.K_TRADE_STATUS_SUCCESS || noti.Trade.Status != payment.K_TRADE_STATUS_SUCCESS {
+		t.Fatalf("应该使用查询到的交易状态: %+v", noti)
+	}
+	f.SetTradeStatus("o2", paymenttest.K_TRADE_STATUS_CLOSED)
+	req, _ = f.NotifyRequest("o2", payment.K_NOTIFY_TYPE_TRADE)
+	f.SetTradeStatus("o2", paymenttest.K_TRADE_STATUS_SUCCESS)
+	if noti, err = s.NotifyURLHandler(req, payment.WithAlwaysFetchTrade()); err != nil || noti.Status != payment.K_TRADE_STATUS_SUCCESS {
+		t.Fatalf("应该使用查询到的交易状态: %+v, %v", noti, err)
+	}
+
+	// 签约等其它类型的通知不会查询交易
+	var noti2 = &payment.Notification{NotifyType: payment.K_NOTIFY_TYPE_AGREEMENT_SIGN}
+	if noti2.Conclusive() == false {
+		t.Fatalf("其它类型的通知应该总是 Conclusive")
+	}
+}
@@ -1,6 +1,9 @@
 package payment
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 const (
 	K_TRADE_METHOD_WEB    = "web"     // PC 浏览器
@@ -10,14 +13,83 @@ const (
 	K_TRADE_METHOD_F2F    = "f2f"     // 扫描用户的付款码进行收款
 )
 
+const (
+	K_TRADE_INTENT_SALE      = "sale"      // 直接付款
+	K_TRADE_INTENT_AUTHORIZE = "authorize" // 预授权，只冻结资金，之后再扣款或者撤销（PayPal、支付宝）
+)
+
 type PayChannel interface {
 	Identifier() string
 	CreateTradeOrder(order *Order) (url string, err error)
 	GetTrade(tradeNo string) (result *Trade, err error)
 	GetTradeWithOrderNo(orderNo string) (result *Trade, err error)
+	ReturnHandler(req *http.Request) (result *Trade, err error)
 	NotifyHandler(req *http.Request) (result *Notification, err error)
 }
 
+// AccountChannel 支持多个商户账号的支付渠道，同一个支付渠道的多个商户账号可以使用不同的 AccountId 注册到 Service 中，
+// 创建订单时 AccountId 会附加在回调 URL 的 account 参数中，Service 根据该参数将回调交给创建订单的账号处理
+type AccountChannel interface {
+	AccountId() string
+}
+
+// CurrencyChannel 支持多种货币的支付渠道，CreatePayment 会在创建订单之前检查支付方式是否支持订单的货币，
+// currency 为空时表示使用支付渠道默认的货币
+type CurrencyChannel interface {
+	SupportCurrency(tradeMethod, currency string) bool
+}
+
+// RefundChannel 支持通过接口退款的支付渠道，退款的结果也会通过 NotifyHandler 以 K_NOTIFY_TYPE_REFUND 通知
+type RefundChannel interface {
+	Refund(param *RefundParam) (result *Refund, err error)
+}
+
+// AuthorizeChannel 支持预授权的支付渠道，Intent 为 K_TRADE_INTENT_AUTHORIZE 的订单会通过 Authorize 创建
+type AuthorizeChannel interface {
+	Authorize(order *Order) (url string, err error)
+	GetAuthorization(authorizationId string) (result *Authorization, err error)
+	GetAuthorizationWithOrderNo(orderNo string) (result *Authorization, err error)
+	Capture(param *CaptureParam) (result *Capture, err error)
+	Void(authorizationId string) (err error)
+}
+
+// AgreementChannel 支持签约代扣（订阅）的支付渠道，签约和解约的结果会通过 NotifyHandler 以
+// K_NOTIFY_TYPE_AGREEMENT_SIGN 和 K_NOTIFY_TYPE_AGREEMENT_UNSIGN 通知
+type AgreementChannel interface {
+	CreateAgreement(agreement *Agreement) (url string, err error)
+	AgreementReturnHandler(req *http.Request) (result *Subscription, err error)
+	GetAgreement(agreementId string) (result *Subscription, err error)
+	ChargeAgreement(param *AgreementChargeParam) (result *Trade, err error)
+	CancelAgreement(agreementId string) (err error)
+}
+
+// PayoutChannel 支持向用户付款（转账）的支付渠道
+type PayoutChannel interface {
+	Payout(payout *Payout) (result *PayoutResult, err error)
+	BatchPayout(batchNo string, payouts []*Payout) (results []*PayoutResult, err error)
+	GetPayout(payoutId string) (result *PayoutResult, err error)
+	GetPayoutWithPayoutNo(payoutNo string) (result *PayoutResult, err error)
+}
+
+// SplitChannel 支持分账的支付渠道
+type SplitChannel interface {
+	AddSplitReceiver(receiver *SplitReceiver) (err error)
+	Split(param *SplitParam) (result *SplitResult, err error)
+	GetSplit(tradeNo, splitNo string) (result *SplitResult, err error)
+	ReturnSplit(param *SplitReturnParam) (result *SplitReturn, err error)
+	FinishSplit(tradeNo, splitNo string) (err error)
+}
+
+// DisputeChannel 支持争议（拒付）处理的支付渠道
+type DisputeChannel interface {
+	ListDisputes(since time.Time) (results []*Dispute, err error)
+	GetDispute(disputeId string) (result *Dispute, err error)
+	AcceptDispute(disputeId, note string) (err error)
+	ProvideDisputeEvidence(disputeId string, evidences []*DisputeEvidence) (err error)
+	SendDisputeMessage(disputeId, message string) (err error)
+	EscalateDispute(disputeId, note string) (err error)
+}
+
 type ShippingAddress struct {
 	Line1       string
 	Line2       string
@@ -34,6 +106,7 @@ type Product struct {
 	Quantity int
 	Price    float64 // 商品单价
 	Tax      float64 // 商品税费
+	Category string  // 商品类目，用于报关和开票（支付宝）
 }
 
 type Order struct {
@@ -42,12 +115,18 @@ type Order struct {
 	Shipping        float64          // 运费
 	Discount        float64          // 减免金额
 	ProductList     []*Product       // 商品列表
-	Currency        string           // 货币名称，例如 USD（PayPal）
+	Currency        string           // 货币代码（ISO-4217），例如 USD，为空时支付宝和微信支付使用 CNY，PayPal 必须
 	ShippingAddress *ShippingAddress // 收货地址信息（PayPal）
 	AuthCode        string           // 支付授权码，扫描用户的付款码获取（支付宝）
 	TradeMethod     string           // 支付方式（支付宝）
 	IP              string           // 用户端 IP（微信支付）
-	Timeout         int              // 支付超时时间，单位为分钟（支付宝、微信支付）
+	ExpireAt        time.Time        // 订单的过期时间，零值表示使用支付渠道默认的过期时间（支付宝、微信支付）
+	Intent          string           // 支付意图，默认为 K_TRADE_INTENT_SALE
+	DelaySettle     bool             // 延迟结算，支付成功之后资金会被冻结，直到分账完成（微信支付）
+
+	// AccountId 创建交易使用的商户账号，为空时由 Service 按照路由规则选择，CreatePayment 会将其设置为实际使用的账号
+	AccountId  string
+	Attributes map[string]string // 订单的附加属性，例如品牌、地区，可用于选择商户账号
 }
 
 func (this *Order) AddProduct(name, sku string, quantity int, price, tax float64) {
@@ -60,30 +139,451 @@ func (this *Order) AddProduct(name, sku string, quantity int, price, tax float64
 	this.ProductList = append(this.ProductList, p)
 }
 
+// Totals 订单金额的明细，Total = Subtotal + Tax + Shipping - Discount
+type Totals struct {
+	Subtotal float64 // 商品金额（单价 × 数量）
+	Tax      float64 // 商品税费（税费 × 数量）
+	Shipping float64
+	Discount float64
+	Total    float64
+}
+
+// Totals 按照订单货币的小数位数计算订单的金额明细，单价、税费、运费和减免金额先舍入再求和，保证各项之和与总金额一致
+func (this *Order) Totals() Totals {
+	return this.totals(CurrencyDecimals(this.Currency))
+}
+
+// totals 按照指定的小数位数计算订单的金额明细，用于小数位数与 ISO-4217 不一致的支付渠道（PayPal）
+func (this *Order) totals(decimals int) Totals {
+	var t = Totals{}
+	for _, p := range this.ProductList {
+		t.Subtotal += roundAmount(p.Price, decimals) * float64(p.Quantity)
+		t.Tax += roundAmount(p.Tax, decimals) * float64(p.Quantity)
+	}
+	t.Subtotal = roundAmount(t.Subtotal, decimals)
+	t.Tax = roundAmount(t.Tax, decimals)
+	t.Shipping = roundAmount(this.Shipping, decimals)
+	t.Discount = roundAmount(this.Discount, decimals)
+	t.Total = roundAmount(t.Subtotal+t.Tax+t.Shipping-t.Discount, decimals)
+	return t
+}
+
 type Trade struct {
 	Channel      string `json:"channel"`
+	AccountId    string `json:"account_id,omitempty"`
 	OrderNo      string `json:"order_no"`
 	TradeNo      string `json:"trade_no"`
-	TradeStatus  string `json:"trade_status"`
+	TradeStatus  string `json:"trade_status"` // 支付渠道返回的原始状态
+	Status       string `json:"status"`       // 统一之后的交易状态，为 K_TRADE_STATUS_* 中的一个，无法识别原始状态时为空
 	TradeSuccess bool   `json:"paid_success"`
 	PayerId      string `json:"payer_id"`
 	PayerEmail   string `json:"payer_email"`
 	TotalAmount  string `json:"total_amount"`
+	Currency     string `json:"currency,omitempty"`
+
+	// AuthorizationId 预授权编号，只有预授权的交易才有，预授权的交易在扣款之前 TradeSuccess 为 false（PayPal）
+	AuthorizationId string `json:"authorization_id,omitempty"`
 
 	RawTrade interface{} `json:"raw_trade"`
 }
 
+// RefundParam 退款参数，TradeNo 和 OrderNo 至少需要提供一个
+type RefundParam struct {
+	TradeNo     string  // 支付渠道的交易号
+	OrderNo     string  // 商户的订单编号
+	RefundNo    string  // 必须 - 商户的退款单号，使用相同的退款单号重试不会重复退款
+	Amount      float64 // 必须 - 退款金额
+	TotalAmount float64 // 交易金额（微信支付），Service.Refund 会查询交易并使用交易的金额
+	Currency    string  // 交易的货币，Service.Refund 会使用交易的货币
+	Reason      string  // 退款原因
+}
+
+const (
+	K_REFUND_STATUS_PROCESSING = "processing"
+	K_REFUND_STATUS_SUCCESS    = "success"
+	K_REFUND_STATUS_FAILED     = "failed"
+)
+
+// Refund 退款结果，Status 为 K_REFUND_STATUS_* 中的一个
+type Refund struct {
+	Channel  string `json:"channel"`
+	OrderNo  string `json:"order_no"`
+	TradeNo  string `json:"trade_no"`
+	RefundNo string `json:"refund_no"`
+	RefundId string `json:"refund_id"` // 支付渠道的退款单号，支付宝没有单独的退款单号
+	Status   string `json:"status"`
+	Amount   string `json:"amount"`
+
+	RawRefund interface{} `json:"raw_refund"`
+}
+
+// Authorization 预授权信息
+type Authorization struct {
+	Channel         string `json:"channel"`
+	OrderNo         string `json:"order_no"`
+	AuthorizationId string `json:"authorization_id"`
+	Status          string `json:"status"`
+	Authorized      bool   `json:"authorized"`   // 资金是否已经冻结并且可以扣款
+	TotalAmount     string `json:"total_amount"` // 预授权金额
+	PayerId         string `json:"payer_id"`
+
+	RawAuthorization interface{} `json:"raw_authorization"`
+}
+
+// CaptureParam 预授权扣款的参数
+type CaptureParam struct {
+	AuthorizationId string  // 必须 - 预授权编号
+	OrderNo         string  // 扣款的订单编号，每次扣款都需要使用不同的订单编号（支付宝必须）
+	Subject         string  // 扣款的订单主题（支付宝）
+	Amount          float64 // 扣款金额，为 0 时扣除剩余的全部预授权金额
+	Currency        string  // 扣款货币，为空时使用预授权的货币，与预授权的货币不一致时返回 ErrCurrencyMismatch
+	IsFinal         bool    // 是否为最后一次扣款，为 true 时剩余的预授权金额会被释放；Amount 为 0 时总是为 true
+}
+
+// Capture 预授权扣款结果
+type Capture struct {
+	Channel         string `json:"channel"`
+	OrderNo         string `json:"order_no"`
+	AuthorizationId string `json:"authorization_id"`
+	CaptureId       string `json:"capture_id"` // PayPal 的 capture id，支付宝的交易号
+	Status          string `json:"status"`
+	CaptureSuccess  bool   `json:"capture_success"`
+	Amount          string `json:"amount"`
+
+	RawCapture interface{} `json:"raw_capture"`
+}
+
+const (
+	K_AGREEMENT_PERIOD_DAY   = "day"
+	K_AGREEMENT_PERIOD_WEEK  = "week"
+	K_AGREEMENT_PERIOD_MONTH = "month"
+	K_AGREEMENT_PERIOD_YEAR  = "year"
+)
+
+// Agreement 签约代扣（订阅）信息
+type Agreement struct {
+	AgreementNo string    // 必须 - 商户的签约协议号
+	Subject     string    // 必须 - 签约主题
+	Amount      float64   // 必须 - 每期扣款金额
+	Currency    string    // 货币代码，支付宝和微信支付只支持 CNY，PayPal 必须
+	PeriodType  string    // 必须 - 扣款周期的单位
+	Period      int       // 必须 - 扣款周期，例如 PeriodType 为 month 并且 Period 为 1 时表示每月扣款一次
+	Cycles      int       // 扣款总期数，0 表示不限制（支付宝、PayPal）
+	StartTime   time.Time // 第一次扣款的时间，零值表示签约之后立即开始
+	PlanId      string    // 委托代扣的模板 ID，在商户平台配置（微信支付）
+}
+
+// NextChargeTime 返回 last 之后的下一次扣款时间，last 为零值时返回第一次扣款的时间
+func (this *Agreement) NextChargeTime(last time.Time) time.Time {
+	if last.IsZero() {
+		return this.StartTime
+	}
+	var period = this.Period
+	if period <= 0 {
+		period = 1
+	}
+	switch this.PeriodType {
+	case K_AGREEMENT_PERIOD_WEEK:
+		return last.AddDate(0, 0, 7*period)
+	case K_AGREEMENT_PERIOD_MONTH:
+		return last.AddDate(0, period, 0)
+	case K_AGREEMENT_PERIOD_YEAR:
+		return last.AddDate(period, 0, 0)
+	default:
+		return last.AddDate(0, 0, period)
+	}
+}
+
+// AgreementChargeParam 按签约协议扣款的参数，支付宝和微信支付需要商户按照扣款周期主动发起扣款，PayPal 会自动扣款
+type AgreementChargeParam struct {
+	AgreementId string  // 必须 - 支付渠道的签约协议号
+	OrderNo     string  // 必须 - 扣款的订单编号
+	Subject     string  // 扣款的订单主题
+	Amount      float64 // 必须 - 扣款金额
+	IP          string  // 发起扣款的服务器 IP（微信支付）
+}
+
+// Subscription 签约协议的状态
+type Subscription struct {
+	Channel     string `json:"channel"`
+	AgreementNo string `json:"agreement_no"`
+	AgreementId string `json:"agreement_id"`
+	Status      string `json:"status"`
+	Active      bool   `json:"active"` // 协议是否有效并且可以扣款
+	PayerId     string `json:"payer_id"`
+
+	RawAgreement interface{} `json:"raw_agreement"`
+}
+
+// Payout 付款（转账）信息
+type Payout struct {
+	PayoutNo     string  // 必须 - 商户的付款单号
+	Amount       float64 // 必须 - 付款金额
+	Currency     string  // 货币代码，支付宝和微信支付只支持 CNY，PayPal 必须，批量付款时所有付款的货币需要一致
+	PayeeAccount string  // 必须 - 收款账户，支付宝的登录账号或者用户 ID，微信支付的 openid，PayPal 的邮箱
+	PayeeName    string  // 收款人的真实姓名，设置之后会校验收款人姓名（支付宝、微信支付）
+	Remark       string  // 付款备注
+	IP           string  // 发起付款的服务器 IP（微信支付）
+}
+
+const (
+	K_PAYOUT_STATUS_PROCESSING = "processing"
+	K_PAYOUT_STATUS_SUCCESS    = "success"
+	K_PAYOUT_STATUS_FAILED     = "failed"
+)
+
+// PayoutResult 付款结果，Status 为 K_PAYOUT_STATUS_* 中的一个，支付渠道返回的原始状态保存在 RawStatus 中
+type PayoutResult struct {
+	Channel    string `json:"channel"`
+	BatchNo    string `json:"batch_no,omitempty"`
+	PayoutNo   string `json:"payout_no"`
+	PayoutId   string `json:"payout_id"` // 支付渠道的付款单号
+	Status     string `json:"status"`
+	RawStatus  string `json:"raw_status"`
+	Amount     string `json:"amount"`
+	FailReason string `json:"fail_reason,omitempty"`
+
+	RawPayout interface{} `json:"raw_payout"`
+}
+
 const (
-	K_NOTIFY_TYPE_TRADE   = "trade"
-	K_NOTIFY_TYPE_REFUND  = "refund"
-	K_NOTIFY_TYPE_DISPUTE = "dispute" // PayPal
+	K_RECEIVER_TYPE_MERCHANT = "merchant" // 商户，微信支付为商户号，支付宝为 2088 开头的用户 ID
+	K_RECEIVER_TYPE_PERSONAL = "personal" // 个人，微信支付为 openid，支付宝为用户 ID 或者登录账号
+)
+
+// SplitReceiver 分账接收方
+type SplitReceiver struct {
+	Type     string  // 必须 - 接收方类型
+	Account  string  // 必须 - 接收方账号
+	Name     string  // 接收方名称，微信支付的商户类型接收方必须
+	Relation string  // 与接收方的关系，添加接收方时使用（微信支付），默认为 PARTNER
+	Amount   float64 // 分账金额
+	Ratio    float64 // 分账比例，取值范围为 0 到 1，Amount 为 0 时根据交易金额和 Ratio 计算分账金额
+	Remark   string  // 分账描述
+}
+
+// SplitParam 分账参数
+type SplitParam struct {
+	TradeNo     string           // 必须 - 支付渠道的交易号
+	SplitNo     string           // 必须 - 商户的分账单号
+	TotalAmount float64          // 交易金额，用于计算和校验分账金额，Service.Split 会查询交易并使用交易的金额
+	Currency    string           // 交易的货币，用于确定分账金额的小数位数，Service.Split 会使用交易的货币
+	Receivers   []*SplitReceiver // 必须 - 分账接收方
+	Finish      bool             // 是否为最后一次分账，为 true 时剩余的冻结资金会解冻给商户
+}
+
+// Validate 根据 Ratio 计算接收方的分账金额，并校验分账总额不超过交易金额，按比例计算的金额按照货币的小数位数四舍五入
+func (this *SplitParam) Validate() error {
+	if this.TradeNo == "" {
+		return ErrUnknownTradeNo
+	}
+	if this.SplitNo == "" || len(this.Receivers) == 0 {
+		return ErrInvalidSplit
+	}
+
+	var decimals = CurrencyDecimals(this.Currency)
+	var total float64 = 0
+	for _, r := range this.Receivers {
+		if r == nil || r.Account == "" || r.Ratio < 0 || r.Ratio > 1 {
+			return ErrInvalidSplit
+		}
+		if r.Amount <= 0 && r.Ratio > 0 {
+			r.Amount = roundAmount(this.TotalAmount*r.Ratio, decimals)
+		}
+		if r.Amount <= 0 {
+			return ErrInvalidSplit
+		}
+		total += r.Amount
+	}
+	if roundAmount(total, decimals) > roundAmount(this.TotalAmount, decimals) {
+		return ErrSplitAmountExceeded
+	}
+	return nil
+}
+
+const (
+	K_SPLIT_STATUS_PROCESSING = "processing"
+	K_SPLIT_STATUS_SUCCESS    = "success"
+	K_SPLIT_STATUS_FAILED     = "failed"
+)
+
+// SplitReceiverResult 单个接收方的分账结果
+type SplitReceiverResult struct {
+	Type       string `json:"type"`
+	Account    string `json:"account"`
+	Amount     string `json:"amount"`
+	Status     string `json:"status"`
+	FailReason string `json:"fail_reason,omitempty"`
+}
+
+// SplitResult 分账结果，Status 为 K_SPLIT_STATUS_* 中的一个
+type SplitResult struct {
+	Channel   string                 `json:"channel"`
+	TradeNo   string                 `json:"trade_no"`
+	SplitNo   string                 `json:"split_no"`
+	SplitId   string                 `json:"split_id"` // 支付渠道的分账单号
+	Status    string                 `json:"status"`
+	Receivers []*SplitReceiverResult `json:"receivers"`
+
+	RawSplit interface{} `json:"raw_split"`
+}
+
+// SplitReturnParam 分账回退参数，将已经分给接收方的资金退回给商户
+type SplitReturnParam struct {
+	SplitNo  string  // 必须 - 商户的分账单号
+	ReturnNo string  // 必须 - 商户的回退单号
+	Account  string  // 必须 - 回退方的账号，只能是商户类型的接收方
+	Amount   float64 // 必须 - 回退金额
+	Remark   string  // 回退描述
+}
+
+// SplitReturn 分账回退结果，Status 为 K_SPLIT_STATUS_* 中的一个
+type SplitReturn struct {
+	Channel    string `json:"channel"`
+	SplitNo    string `json:"split_no"`
+	ReturnNo   string `json:"return_no"`
+	ReturnId   string `json:"return_id"`
+	Status     string `json:"status"`
+	Amount     string `json:"amount"`
+	FailReason string `json:"fail_reason,omitempty"`
+
+	RawReturn interface{} `json:"raw_return"`
+}
+
+const (
+	K_DISPUTE_STATUS_WAITING_MERCHANT = "waiting_merchant" // 等待商户处理
+	K_DISPUTE_STATUS_WAITING_BUYER    = "waiting_buyer"    // 等待买家处理
+	K_DISPUTE_STATUS_UNDER_REVIEW     = "under_review"     // 支付渠道审核中
+	K_DISPUTE_STATUS_RESOLVED         = "resolved"         // 已经解决
+)
+
+// Dispute 争议信息，Status 为 K_DISPUTE_STATUS_* 中的一个，支付渠道返回的原始状态保存在 RawStatus 中
+type Dispute struct {
+	Channel          string    `json:"channel"`
+	DisputeId        string    `json:"dispute_id"`
+	OrderNo          string    `json:"order_no"`
+	TradeNo          string    `json:"trade_no"` // 发生争议的交易，PayPal 为 Sale 的 ID
+	Reason           string    `json:"reason"`
+	Stage            string    `json:"stage"` // 争议所处的阶段，例如 PayPal 的 INQUIRY、CHARGEBACK
+	Status           string    `json:"status"`
+	RawStatus        string    `json:"raw_status"`
+	Outcome          string    `json:"outcome,omitempty"` // 争议的处理结果，只有已经解决的争议才有
+	Amount           string    `json:"amount"`
+	Currency         string    `json:"currency"`
+	ResponseDeadline time.Time `json:"response_deadline"` // 商户需要在该时间之前处理，零值表示没有期限
+	CreateTime       time.Time `json:"create_time"`
+	UpdateTime       time.Time `json:"update_time"`
+
+	RawDispute interface{} `json:"raw_dispute"`
+}
+
+const (
+	K_EVIDENCE_TYPE_FULFILLMENT = "fulfillment" // 发货证明，需要设置 CarrierName 和 TrackingNumber
+	K_EVIDENCE_TYPE_REFUND      = "refund"      // 退款证明，需要设置 RefundId
+	K_EVIDENCE_TYPE_OTHER       = "other"
+)
+
+// DisputeEvidence 提交给支付渠道的争议证据
+type DisputeEvidence struct {
+	Type           string
+	CarrierName    string
+	TrackingNumber string
+	RefundId       string
+	Notes          string
+}
+
+const (
+	K_NOTIFY_TYPE_TRADE            = "trade"
+	K_NOTIFY_TYPE_REFUND           = "refund"
+	K_NOTIFY_TYPE_DISPUTE          = "dispute" // PayPal
+	K_NOTIFY_TYPE_AGREEMENT_SIGN   = "agreement_sign"
+	K_NOTIFY_TYPE_AGREEMENT_UNSIGN = "agreement_unsign"
+	K_NOTIFY_TYPE_PAYOUT           = "payout" // OrderNo 为商户的付款单号，TradeNo 为支付渠道的付款单号（PayPal）
+)
+
+// 统一之后的交易状态，支付渠道返回的原始状态保存在 RawStatus 中
+const (
+	K_TRADE_STATUS_PENDING  = "pending"  // 等待付款
+	K_TRADE_STATUS_SUCCESS  = "success"  // 支付成功
+	K_TRADE_STATUS_FAILED   = "failed"   // 支付失败
+	K_TRADE_STATUS_CLOSED   = "closed"   // 交易关闭
+	K_TRADE_STATUS_REFUNDED = "refunded" // 已经退款（部分或者全部）
 )
 
 type Notification struct {
 	Channel    string `json:"channel"`
+	AccountId  string `json:"account_id,omitempty"`
 	NotifyType string `json:"notify_type"`
 	OrderNo    string `json:"order_no"`
 	TradeNo    string `json:"trade_no"`
 
+	// 交易通知和退款通知才有，通知中没有提供的信息为空，Status 为 K_TRADE_STATUS_* 中的一个
+	Status      string    `json:"status,omitempty"`
+	RawStatus   string    `json:"raw_status,omitempty"`
+	TotalAmount string    `json:"total_amount,omitempty"`
+	Currency    string    `json:"currency,omitempty"`
+	PayerId     string    `json:"payer_id,omitempty"`
+	PaidTime    time.Time `json:"paid_time"` // 零值表示通知中没有付款时间
+
+	// 退款通知才有，RefundNo 为商户的退款单号，RefundId 为支付渠道的退款单号，RefundAmount 为退款金额（支付宝为累计退款金额），
+	// RefundStatus 为 K_REFUND_STATUS_* 中的一个，RefundTime 为退款成功的时间，零值表示通知中没有退款时间
+	RefundNo     string    `json:"refund_no,omitempty"`
+	RefundId     string    `json:"refund_id,omitempty"`
+	RefundAmount string    `json:"refund_amount,omitempty"`
+	RefundStatus string    `json:"refund_status,omitempty"`
+	RefundTime   time.Time `json:"refund_time"`
+
+	// Trade 通过查询接口获取的交易信息，只有 NotifyURLHandler 使用了 WithFetchTrade 或者 WithAlwaysFetchTrade 并且查询了交易时才有
+	Trade *Trade `json:"trade,omitempty"`
+
+	// 签约和解约通知才有
+	AgreementNo string `json:"agreement_no,omitempty"`
+	AgreementId string `json:"agreement_id,omitempty"`
+
+	// 争议通知才有
+	DisputeId string `json:"dispute_id,omitempty"`
+
 	RawNotify interface{} `json:"raw_notify"`
 }
+
+// Conclusive 返回通知中的信息是否足以确定交易的结果，交易通知和退款通知需要包含交易状态和交易金额，其它类型的通知总是返回 true
+func (this *Notification) Conclusive() bool {
+	if this.NotifyType != K_NOTIFY_TYPE_TRADE && this.NotifyType != K_NOTIFY_TYPE_REFUND {
+		return true
+	}
+	return this.Status != "" && this.TotalAmount != ""
+}
+
+// merge 使用查询到的交易信息补充通知中的信息，查询到的交易状态和金额比通知中的更新，所以优先使用交易的信息，
+// 退款通知的状态保持为 K_TRADE_STATUS_REFUNDED
+func (this *Notification) merge(trade *Trade) {
+	this.Trade = trade
+	if this.OrderNo == "" {
+		this.OrderNo = trade.OrderNo
+	}
+	if this.TradeNo == "" {
+		this.TradeNo = trade.TradeNo
+	}
+	if this.NotifyType == K_NOTIFY_TYPE_TRADE && trade.Status != "" {
+		this.Status = trade.Status
+		this.RawStatus = trade.TradeStatus
+	}
+	if this.RawStatus == "" {
+		this.RawStatus = trade.TradeStatus
+	}
+	if trade.TotalAmount != "" {
+		this.TotalAmount = trade.TotalAmount
+	}
+	if trade.Currency != "" {
+		this.Currency = trade.Currency
+	}
+	if this.PayerId == "" {
+		this.PayerId = trade.PayerId
+	}
+}
+
+type Cancellation struct {
+	Channel   string `json:"channel"`
+	AccountId string `json:"account_id,omitempty"`
+	OrderNo   string `json:"order_no"`
+}
@@ -0,0 +1,84 @@
+package payment
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAgreement_NextChargeTime(t *testing.T) {
+	var start = time.Date(2018, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		periodType string
+		period     int
+		expect     time.Time
+	}{
+		{K_AGREEMENT_PERIOD_DAY, 3, time.Date(2018, 8, 4, 10, 0, 0, 0, time.UTC)},
+		{K_AGREEMENT_PERIOD_WEEK, 1, time.Date(2018, 8, 8, 10, 0, 0, 0, time.UTC)},
+		{K_AGREEMENT_PERIOD_MONTH, 1, time.Date(2018, 9, 1, 10, 0, 0, 0, time.UTC)},
+		{K_AGREEMENT_PERIOD_YEAR, 1, time.Date(2019, 8, 1, 10, 0, 0, 0, time.UTC)},
+		{K_AGREEMENT_PERIOD_MONTH, 0, time.Date(2018, 9, 1, 10, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		var a = &Agreement{PeriodType: test.periodType, Period: test.period, StartTime: start}
+		if next := a.NextChargeTime(time.Time{}); next.Equal(start) == false {
+			t.Fatalf("第一次扣款时间应该为 %s，实际为 %s", start, next)
+		}
+		if next := a.NextChargeTime(start); next.Equal(test.expect) == false {
+			t.Fatalf("%s/%d 的下一次扣款时间应该为 %s，实际为 %s", test.periodType, test.period, test.expect, next)
+		}
+	}
+}
+
+func TestSplitParam_Validate(t *testing.T) {
+	var p = &SplitParam{TradeNo: "t1", SplitNo: "s1", TotalAmount: 99.99}
+	p.Receivers = []*SplitReceiver{
+		{Account: "a1", Ratio: 0.29},
+		{Account: "a2", Amount: 10},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Receivers[0].Amount != 29 {
+		t.Fatalf("按比例计算的分账金额应该为 29.00，实际为 %v", p.Receivers[0].Amount)
+	}
+
+	// 没有小数的货币按比例计算的金额也没有小数
+	var jpy = &SplitParam{TradeNo: "t1", SplitNo: "s1", TotalAmount: 999, Currency: "JPY"}
+	jpy.Receivers = []*SplitReceiver{{Account: "a1", Ratio: 0.3}}
+	if err := jpy.Validate(); err != nil || jpy.Receivers[0].Amount != 300 {
+		t.Fatalf("按比例计算的分账金额应该为 300，实际为 %v, %v", jpy.Receivers[0].Amount, err)
+	}
+
+	p.Receivers = append(p.Receivers, &SplitReceiver{Account: "a3", Ratio: 0.7})
+	if err := p.Validate(); err != ErrSplitAmountExceeded {
+		t.Fatalf("期望返回 ErrSplitAmountExceeded，实际为 %v", err)
+	}
+
+	p.Receivers = []*SplitReceiver{{Account: "a1", Ratio: 1.5}}
+	if err := p.Validate(); err != ErrInvalidSplit {
+		t.Fatalf("期望返回 ErrInvalidSplit，实际为 %v", err)
+	}
+}
+
+func TestOrder_Totals(t *testing.T) {
+	var order = &Order{Shipping: 5, Discount: 2.5}
+	order.AddProduct("a", "sku001", 3, 9.999, 0.333)
+	order.AddProduct("b", "sku002", 1, 20, 1.2)
+
+	var totals = order.Totals()
+	var expect = Totals{Subtotal: 50, Tax: 2.19, Shipping: 5, Discount: 2.5, Total: 54.69}
+	if totals != expect {
+		t.Fatalf("订单金额应该为 %+v，实际为 %+v", expect, totals)
+	}
+	if FormatAmount(order.Currency, totals.Subtotal+totals.Tax+totals.Shipping-totals.Discount) != FormatAmount(order.Currency, totals.Total) {
+		t.Fatalf("各项金额之和与总金额不一致: %+v", totals)
+	}
+
+	order.Currency = "JPY"
+	expect = Totals{Subtotal: 50, Tax: 1, Shipping: 5, Discount: 3, Total: 53}
+	if totals = order.Totals(); totals != expect {
+		t.Fatalf("JPY 的订单金额应该为 %+v，实际为 %+v", expect, totals)
+	}
+}
@@ -1,7 +1,8 @@
 package payment
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"github.com/smartwalle/ngx"
 	"github.com/smartwalle/wxpay"
 	"net/http"
@@ -18,20 +19,36 @@ const (
 	k_WXPAY_NOTIFY_TYPE_REFUND = "refund"
 )
 
+// 查询订单接口返回的交易状态（trade_state），SUCCESS 使用 wxpay.K_TRADE_STATUS_SUCCESS
+const (
+	k_WXPAY_TRADE_STATUS_REFUND     = "REFUND"
+	k_WXPAY_TRADE_STATUS_NOTPAY     = "NOTPAY"
+	k_WXPAY_TRADE_STATUS_CLOSED     = "CLOSED"
+	k_WXPAY_TRADE_STATUS_REVOKED    = "REVOKED"
+	k_WXPAY_TRADE_STATUS_USERPAYING = "USERPAYING"
+	k_WXPAY_TRADE_STATUS_PAYERROR   = "PAYERROR"
+)
+
 type WXPay struct {
-	location  *time.Location
+	now       func() time.Time
+	accountId string
+	apiKey    string
 	client    *wxpay.WXPay
 	NotifyURL string
 }
 
-func NewWXPal(appId, apiKey, mchId string, isProduction bool) *WXPay {
+func NewWXPal(appId, apiKey, mchId string, isProduction bool, opts ...Option) *WXPay {
+	var o = newOptions(K_CHANNEL_WXPAY, opts...)
+
 	var p = &WXPay{}
+	p.apiKey = apiKey
 	p.client = wxpay.New(appId, apiKey, mchId, isProduction)
-	loc, err := time.LoadLocation("Asia/Chongqing")
-	if err != nil {
-		loc = time.UTC
+	p.client.SetHTTPClient(o.httpClient)
+	if o.baseURL != "" {
+		p.client.SetAPIDomain(o.baseURL)
 	}
-	p.location = loc
+	p.now = o.now
+	p.accountId = o.accountId
 	return p
 }
 
@@ -39,55 +56,124 @@ func (this *WXPay) Identifier() string {
 	return K_CHANNEL_WXPAY
 }
 
+func (this *WXPay) AccountId() string {
+	return this.accountId
+}
+
 func (this *WXPay) CreateTradeOrder(order *Order) (url string, err error) {
-	var productAmount float64 = 0
-	var productTax float64 = 0
-	for _, p := range order.ProductList {
-		productAmount += p.Price * float64(p.Quantity)
-		productTax += p.Tax * float64(p.Quantity)
-	}
 	var subject = strings.TrimSpace(order.Subject)
 	if subject == "" {
 		subject = order.OrderNo
 	}
 
-	var amount = int((productAmount + productTax + order.Shipping - order.Discount) * 100)
+	var amount = ToMinorUnit(order.Currency, order.Totals().Total)
 
 	switch order.TradeMethod {
 	case K_TRADE_METHOD_WAP:
-		return this.tradeWapPay(order.OrderNo, subject, order.IP, amount, order.Timeout)
+		return this.tradeWapPay(order, subject, amount)
 	case K_TRADE_METHOD_APP:
-		return this.tradeAppPay(order.OrderNo, subject, order.IP, amount, order.Timeout)
+		return this.tradeAppPay(order, subject, amount)
 	case K_TRADE_METHOD_QRCODE:
-		return this.tradeQRCode(order.OrderNo, subject, order.IP, amount, order.Timeout)
-
+		return this.tradeQRCode(order, subject, amount)
 	}
 	return "", err
 }
 
-func (this *WXPay) trade(tradeType, orderNo, subject, ip string, amount, timeout int) (*wxpay.UnifiedOrderResp, error) {
+type wxpayGoodsDetail struct {
+	CostPrice   int           `json:"cost_price,omitempty"`
+	GoodsDetail []*wxpayGoods `json:"goods_detail"`
+}
+
+type wxpayGoods struct {
+	GoodsId   string `json:"goods_id"`
+	GoodsName string `json:"goods_name,omitempty"`
+	Quantity  int    `json:"quantity"`
+	Price     int    `json:"price"`
+}
+
+// detail 返回统一下单的商品详情（JSON），CostPrice 为减免之前的订单金额，Price 为商品单价，
+// 微信支付的商品详情不支持商品类目，所以不会传递 Product.Category
+func (this *WXPay) detail(order *Order) (string, error) {
+	if len(order.ProductList) == 0 {
+		return "", nil
+	}
+	var totals = order.Totals()
+	var detail = &wxpayGoodsDetail{}
+	detail.CostPrice = ToMinorUnit(order.Currency, totals.Total+totals.Discount)
+	for _, p := range order.ProductList {
+		var goods = &wxpayGoods{}
+		goods.GoodsId = p.SKU
+		if goods.GoodsId == "" {
+			goods.GoodsId = p.Name
+		}
+		goods.GoodsName = p.Name
+		goods.Quantity = p.Quantity
+		goods.Price = ToMinorUnit(order.Currency, p.Price)
+		detail.GoodsDetail = append(detail.GoodsDetail, goods)
+	}
+	data, err := json.Marshal(detail)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SupportCurrency 境外商户可以使用外币进行 App 支付和扫码支付，H5 支付只支持 CNY，订单的货币为空时使用 CNY
+func (this *WXPay) SupportCurrency(tradeMethod, currency string) bool {
+	if currency == "" || currency == K_CURRENCY_CNY {
+		return true
+	}
+	if tradeMethod == K_TRADE_METHOD_WAP {
+		return false
+	}
+	return containsCurrency(wxpayCurrencies, currency)
+}
+
+// timeExpire 返回订单的过期时间（北京时间），微信支付要求过期时间距离下单时间至少 1 分钟，
+// 不足 1 分钟时使用当前时间之后的 1 分钟，不足一秒的部分按一秒计算，与支付宝按分钟向上取整一样不会提前过期
+func (this *WXPay) timeExpire(order *Order) (string, error) {
+	var now = this.now()
+	d, err := expireIn(order, now)
+	if err != nil || d == 0 {
+		return "", err
+	}
+	var expireAt = order.ExpireAt
+	if d < time.Minute {
+		expireAt = now.Add(time.Minute)
+	}
+	if t := expireAt.Truncate(time.Second); t.Before(expireAt) {
+		expireAt = t.Add(time.Second)
+	}
+	return expireAt.In(beijing).Format("20060102150405"), nil
+}
+
+func (this *WXPay) trade(tradeType string, order *Order, subject string, amount int) (*wxpay.UnifiedOrderResp, error) {
 	var p = wxpay.UnifiedOrderParam{}
 	p.Body = subject
 
 	var notifyURL = ngx.MustURL(this.NotifyURL)
-	notifyURL.Add("channel", this.Identifier())
-	notifyURL.Add("order_no", orderNo)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", order.OrderNo)
 	notifyURL.Add("notify_type", k_WXPAY_NOTIFY_TYPE_TRADE)
 	p.NotifyURL = notifyURL.String()
 
 	p.TradeType = tradeType
-	p.SpbillCreateIP = ip
+	p.SpbillCreateIP = order.IP
 
 	p.TotalFee = amount
-	p.OutTradeNo = orderNo
+	p.FeeType = order.Currency
+	p.OutTradeNo = order.OrderNo
 
-	if timeout > 0 {
-		var offset time.Duration = 0
-		if this.location.String() == "UTC" {
-			offset = time.Hour * 8
-		}
-		var expire = time.Now().In(this.location).Add(time.Minute * time.Duration(timeout)).Add(offset)
-		p.TimeExpire = expire.Format("20060102150405")
+	if order.DelaySettle {
+		p.ProfitSharing = "Y"
+	}
+
+	var err error
+	if p.TimeExpire, err = this.timeExpire(order); err != nil {
+		return nil, err
+	}
+	if p.Detail, err = this.detail(order); err != nil {
+		return nil, err
 	}
 
 	rsp, err := this.client.UnifiedOrder(p)
@@ -97,24 +183,24 @@ func (this *WXPay) trade(tradeType, orderNo, subject, ip string, amount, timeout
 	return rsp, nil
 }
 
-func (this *WXPay) tradeWapPay(orderNo, subject, ip string, amount, timeout int) (url string, err error) {
-	rsp, err := this.trade(wxpay.K_TRADE_TYPE_MWEB, orderNo, subject, ip, amount, timeout)
+func (this *WXPay) tradeWapPay(order *Order, subject string, amount int) (url string, err error) {
+	rsp, err := this.trade(wxpay.K_TRADE_TYPE_MWEB, order, subject, amount)
 	if err != nil {
 		return "", err
 	}
 	return rsp.MWebURL, nil
 }
 
-func (this *WXPay) tradeAppPay(orderNo, subject, ip string, amount, timeout int) (url string, err error) {
-	rsp, err := this.trade(wxpay.K_TRADE_TYPE_APP, orderNo, subject, ip, amount, timeout)
+func (this *WXPay) tradeAppPay(order *Order, subject string, amount int) (url string, err error) {
+	rsp, err := this.trade(wxpay.K_TRADE_TYPE_APP, order, subject, amount)
 	if err != nil {
 		return "", err
 	}
 	return rsp.PrepayId, nil
 }
 
-func (this *WXPay) tradeQRCode(orderNo, subject, ip string, amount, timeout int) (url string, err error) {
-	rsp, err := this.trade(wxpay.K_TRADE_TYPE_NATIVE, orderNo, subject, ip, amount, timeout)
+func (this *WXPay) tradeQRCode(order *Order, subject string, amount int) (url string, err error) {
+	rsp, err := this.trade(wxpay.K_TRADE_TYPE_NATIVE, order, subject, amount)
 	if err != nil {
 		return "", err
 	}
@@ -137,7 +223,9 @@ func (this *WXPay) getTrade(tradeNo, orderNo string) (result *Trade, err error)
 	result.OrderNo = rsp.OutTradeNo
 	result.TradeNo = rsp.TransactionId
 	result.TradeStatus = rsp.TradeState
-	result.TotalAmount = fmt.Sprintf("%.2f", float64(rsp.TotalFee)/100.0)
+	result.Status = wxPayTradeStatus(result.TradeStatus)
+	result.TotalAmount = FromMinorUnit(rsp.FeeType, rsp.TotalFee)
+	result.Currency = rsp.FeeType
 	result.PayerId = rsp.OpenId
 	if result.TradeStatus == wxpay.K_TRADE_STATUS_SUCCESS {
 		result.TradeSuccess = true
@@ -153,28 +241,126 @@ func (this *WXPay) GetTradeWithOrderNo(orderNo string) (result *Trade, err error
 	return this.getTrade("", orderNo)
 }
 
-func (this *WXPay) NotifyHandler(req *http.Request) (result *Notification, err error) {
-	noti, err := this.client.GetTradeNotification(req)
+// Refund 申请退款，退款需要使用商户证书（通过 WithClientCert 设置），申请成功之后退款是异步处理的，
+// 处理的结果通过 NotifyHandler 以 K_NOTIFY_TYPE_REFUND 通知，使用相同的退款单号（out_refund_no）重试不会重复退款
+func (this *WXPay) Refund(param *RefundParam) (result *Refund, err error) {
+	var currency = param.Currency
+	if currency == "" {
+		currency = K_CURRENCY_CNY
+	}
+
+	var p = wxpay.RefundParam{}
+	p.TransactionId = param.TradeNo
+	p.OutTradeNo = param.OrderNo
+	p.OutRefundNo = param.RefundNo
+	p.TotalFee = ToMinorUnit(currency, param.TotalAmount)
+	p.RefundFee = ToMinorUnit(currency, param.Amount)
+	p.RefundFeeType = param.Currency
+	p.RefundDesc = param.Reason
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("notify_type", k_WXPAY_NOTIFY_TYPE_REFUND)
+	p.NotifyURL = notifyURL.String()
+
+	rsp, err := this.client.Refund(p)
 	if err != nil {
 		return nil, err
 	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
 
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.OrderNo = rsp.OutTradeNo
+	result.TradeNo = rsp.TransactionId
+	result.RefundNo = rsp.OutRefundNo
+	result.RefundId = rsp.RefundId
+	result.Status = K_REFUND_STATUS_PROCESSING
+	result.Amount = FromMinorUnit(currency, rsp.RefundFee)
+	result.RawRefund = rsp
+	return result, nil
+}
+
+// ReturnHandler 处理用户支付完成之后跳转回来的请求，微信支付跳转时不会附加交易信息，所以使用订单号查询交易
+func (this *WXPay) ReturnHandler(req *http.Request) (result *Trade, err error) {
 	req.ParseForm()
-	var notifyType = req.FormValue("notify_type")
+
+	if orderNo := req.FormValue("order_no"); orderNo != "" {
+		return this.GetTradeWithOrderNo(orderNo)
+	}
+	if tradeNo := req.FormValue("transaction_id"); tradeNo != "" {
+		return this.GetTrade(tradeNo)
+	}
+	return nil, ErrUnknownTradeNo
+}
+
+// NotifyHandler 处理微信支付的异步通知，通知无法通过签名验证或者退款通知无法解密时返回 ErrInvalidSignature
+func (this *WXPay) NotifyHandler(req *http.Request) (result *Notification, err error) {
+	var notifyType = req.URL.Query().Get("notify_type")
+	switch notifyType {
+	case k_WXPAY_NOTIFY_TYPE_CONTRACT:
+		return this.agreementNotify(req)
+	case k_WXPAY_NOTIFY_TYPE_REFUND:
+		// 退款通知没有签名，通知的内容在加密的 req_info 中
+		return this.refundNotify(req)
+	}
+
+	// SDK 在解析通知的时候会验证签名，返回的错误都是通知本身的问题
+	noti, err := this.client.GetTradeNotification(req)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
 
 	result = &Notification{}
 	result.Channel = this.Identifier()
 	result.RawNotify = noti
 
-	// TODO 需要处理退款
-	switch notifyType {
-	case k_WXPAY_NOTIFY_TYPE_TRADE:
+	if notifyType == k_WXPAY_NOTIFY_TYPE_TRADE {
 		result.NotifyType = K_NOTIFY_TYPE_TRADE
 		result.OrderNo = noti.OutTradeNo
 		result.TradeNo = noti.TransactionId
-	case k_WXPAY_NOTIFY_TYPE_REFUND:
-		result.NotifyType = K_NOTIFY_TYPE_REFUND
+		result.Status = K_TRADE_STATUS_FAILED
+		if noti.ResultCode == "SUCCESS" {
+			result.Status = K_TRADE_STATUS_SUCCESS
+		}
+		result.RawStatus = noti.ResultCode
+		result.Currency = noti.FeeType
+		if result.Currency == "" {
+			result.Currency = K_CURRENCY_CNY
+		}
+		result.TotalAmount = FromMinorUnit(result.Currency, noti.TotalFee)
+		result.PayerId = noti.OpenId
+		if noti.TimeEnd != "" {
+			result.PaidTime, _ = time.ParseInLocation("20060102150405", noti.TimeEnd, beijing)
+		}
 	}
 
 	return result, nil
 }
+
+// wxPayTradeStatus 将微信支付的交易状态转换为 K_TRADE_STATUS_*
+func wxPayTradeStatus(state string) string {
+	switch state {
+	case k_WXPAY_TRADE_STATUS_NOTPAY, k_WXPAY_TRADE_STATUS_USERPAYING:
+		return K_TRADE_STATUS_PENDING
+	case wxpay.K_TRADE_STATUS_SUCCESS:
+		return K_TRADE_STATUS_SUCCESS
+	case k_WXPAY_TRADE_STATUS_REFUND:
+		return K_TRADE_STATUS_REFUNDED
+	case k_WXPAY_TRADE_STATUS_CLOSED, k_WXPAY_TRADE_STATUS_REVOKED:
+		return K_TRADE_STATUS_CLOSED
+	case k_WXPAY_TRADE_STATUS_PAYERROR:
+		return K_TRADE_STATUS_FAILED
+	}
+	return ""
+}
+
+// DownloadBill 下载指定日期的对账单（包含成功支付和退款的订单）
+func (this *WXPay) DownloadBill(billDate time.Time) (data []byte, err error) {
+	var p = wxpay.DownloadBillParam{}
+	p.BillDate = billDate.Format("20060102")
+	p.BillType = wxpay.K_BILL_TYPE_ALL
+	return this.client.DownloadBill(p)
+}
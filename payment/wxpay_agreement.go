@@ -0,0 +1,147 @@
+package payment
+
+import (
+	"errors"
+	"github.com/smartwalle/ngx"
+	"github.com/smartwalle/wxpay"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	k_WXPAY_NOTIFY_TYPE_CONTRACT = "contract"
+)
+
+// CreateAgreement 生成委托代扣的签约 URL，扣款周期和金额由商户平台上配置的模板（Agreement.PlanId）决定
+func (this *WXPay) CreateAgreement(agreement *Agreement) (url string, err error) {
+	if agreement.PlanId == "" {
+		return "", ErrUnknownAgreement
+	}
+	if agreement.Currency != "" && agreement.Currency != K_CURRENCY_CNY {
+		return "", ErrCurrencyNotSupported
+	}
+
+	var p = wxpay.EntrustWebParam{}
+	p.PlanId = agreement.PlanId
+	p.ContractCode = agreement.AgreementNo
+	p.ContractDisplayAccount = strings.TrimSpace(agreement.Subject)
+	if p.ContractDisplayAccount == "" {
+		p.ContractDisplayAccount = agreement.AgreementNo
+	}
+	p.RequestSerial = time.Now().UnixNano()
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("notify_type", k_WXPAY_NOTIFY_TYPE_CONTRACT)
+	p.NotifyURL = notifyURL.String()
+
+	rawURL, err := this.client.EntrustWeb(p)
+	if err != nil {
+		return "", err
+	}
+	return rawURL.String(), err
+}
+
+func (this *WXPay) getAgreement(p wxpay.QueryContractParam) (result *Subscription, err error) {
+	rsp, err := this.client.QueryContract(p)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Subscription{}
+	result.Channel = this.Identifier()
+	result.RawAgreement = rsp
+	result.AgreementNo = rsp.ContractCode
+	result.AgreementId = rsp.ContractId
+	result.Status = rsp.ContractState
+	result.PayerId = rsp.OpenId
+	if rsp.ContractState == wxpay.K_CONTRACT_STATE_SIGNED {
+		result.Active = true
+	}
+	return result, nil
+}
+
+// AgreementReturnHandler 微信签约完成之后只会返回到 App 或者公众号页面，不会附加签约信息，
+// 所以需要由页面将 agreement_no 和 plan_id 传递过来，然后查询签约结果
+func (this *WXPay) AgreementReturnHandler(req *http.Request) (result *Subscription, err error) {
+	req.ParseForm()
+
+	var p = wxpay.QueryContractParam{}
+	p.ContractCode = req.FormValue("agreement_no")
+	p.PlanId = req.FormValue("plan_id")
+	if p.ContractCode == "" || p.PlanId == "" {
+		return nil, ErrUnknownAgreement
+	}
+	return this.getAgreement(p)
+}
+
+func (this *WXPay) GetAgreement(agreementId string) (result *Subscription, err error) {
+	var p = wxpay.QueryContractParam{}
+	p.ContractId = agreementId
+	return this.getAgreement(p)
+}
+
+// ChargeAgreement 申请委托代扣，微信支付受理之后会异步扣款，扣款结果通过 K_NOTIFY_TYPE_TRADE 通知，
+// 所以返回的交易状态为 USERPAYING
+func (this *WXPay) ChargeAgreement(param *AgreementChargeParam) (result *Trade, err error) {
+	var p = wxpay.PapPayApplyParam{}
+	p.Body = strings.TrimSpace(param.Subject)
+	if p.Body == "" {
+		p.Body = param.OrderNo
+	}
+	p.OutTradeNo = param.OrderNo
+	p.TotalFee = ToMinorUnit(K_CURRENCY_CNY, param.Amount)
+	p.SpbillCreateIP = param.IP
+	p.TradeType = wxpay.K_TRADE_TYPE_PAP
+	p.ContractId = param.AgreementId
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	addChannel(notifyURL, this.Identifier(), this.accountId)
+	notifyURL.Add("order_no", param.OrderNo)
+	notifyURL.Add("notify_type", k_WXPAY_NOTIFY_TYPE_TRADE)
+	p.NotifyURL = notifyURL.String()
+
+	rsp, err := this.client.PapPayApply(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = &Trade{}
+	result.Channel = this.Identifier()
+	result.RawTrade = rsp
+	result.OrderNo = param.OrderNo
+	result.TradeStatus = k_WXPAY_TRADE_STATUS_USERPAYING
+	result.Status = K_TRADE_STATUS_PENDING
+	return result, nil
+}
+
+func (this *WXPay) CancelAgreement(agreementId string) (err error) {
+	var p = wxpay.DeleteContractParam{}
+	p.ContractId = agreementId
+	p.ContractTerminationRemark = "cancel"
+	return this.client.DeleteContract(p)
+}
+
+func (this *WXPay) agreementNotify(req *http.Request) (result *Notification, err error) {
+	noti, err := this.client.GetContractNotification(req)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	result = &Notification{}
+	result.Channel = this.Identifier()
+	result.RawNotify = noti
+	result.AgreementNo = noti.ContractCode
+	result.AgreementId = noti.ContractId
+	switch noti.ChangeType {
+	case wxpay.K_CONTRACT_CHANGE_TYPE_ADD:
+		result.NotifyType = K_NOTIFY_TYPE_AGREEMENT_SIGN
+	case wxpay.K_CONTRACT_CHANGE_TYPE_DELETE:
+		result.NotifyType = K_NOTIFY_TYPE_AGREEMENT_UNSIGN
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+package payment
+
+import (
+	"errors"
+	"github.com/smartwalle/wxpay"
+	"strings"
+)
+
+// Payout 通过企业付款到零钱向用户付款，PayeeAccount 为用户的 openid，设置 PayeeName 时会强制校验收款人姓名，
+// 该接口需要使用商户证书，创建 WXPay 时需要通过 WithClientCert 设置
+func (this *WXPay) Payout(payout *Payout) (result *PayoutResult, err error) {
+	if payout.Currency != "" && payout.Currency != K_CURRENCY_CNY {
+		return nil, ErrCurrencyNotSupported
+	}
+
+	var p = wxpay.TransfersParam{}
+	p.PartnerTradeNo = payout.PayoutNo
+	p.OpenId = payout.PayeeAccount
+	p.CheckName = wxpay.K_CHECK_NAME_NO_CHECK
+	if payout.PayeeName != "" {
+		p.CheckName = wxpay.K_CHECK_NAME_FORCE_CHECK
+		p.ReUserName = payout.PayeeName
+	}
+	p.Amount = ToMinorUnit(K_CURRENCY_CNY, payout.Amount)
+	p.Desc = strings.TrimSpace(payout.Remark)
+	if p.Desc == "" {
+		p.Desc = payout.PayoutNo
+	}
+	p.SpbillCreateIP = payout.IP
+
+	rsp, err := this.client.Transfers(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = &PayoutResult{}
+	result.Channel = this.Identifier()
+	result.RawPayout = rsp
+	result.PayoutNo = rsp.PartnerTradeNo
+	result.PayoutId = rsp.PaymentNo
+	result.RawStatus = rsp.ResultCode
+	result.Status = K_PAYOUT_STATUS_SUCCESS
+	result.Amount = FromMinorUnit(K_CURRENCY_CNY, p.Amount)
+	return result, nil
+}
+
+// BatchPayout 微信支付会逐笔付款
+func (this *WXPay) BatchPayout(batchNo string, payouts []*Payout) (results []*PayoutResult, err error) {
+	return batchPayout(this.Identifier(), batchNo, payouts, this.Payout), nil
+}
+
+// GetPayout 微信支付只支持使用商户的付款单号查询
+func (this *WXPay) GetPayout(payoutId string) (result *PayoutResult, err error) {
+	return nil, ErrWXPayNotAllowed
+}
+
+func (this *WXPay) GetPayoutWithPayoutNo(payoutNo string) (result *PayoutResult, err error) {
+	var p = wxpay.GetTransferInfoParam{}
+	p.PartnerTradeNo = payoutNo
+
+	rsp, err := this.client.GetTransferInfo(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = &PayoutResult{}
+	result.Channel = this.Identifier()
+	result.RawPayout = rsp
+	result.PayoutNo = rsp.PartnerTradeNo
+	result.PayoutId = rsp.DetailId
+	result.RawStatus = rsp.Status
+	result.Amount = FromMinorUnit(K_CURRENCY_CNY, rsp.PaymentAmount)
+	result.FailReason = rsp.Reason
+	switch rsp.Status {
+	case wxpay.K_TRANSFER_STATUS_SUCCESS:
+		result.Status = K_PAYOUT_STATUS_SUCCESS
+	case wxpay.K_TRANSFER_STATUS_FAILED:
+		result.Status = K_PAYOUT_STATUS_FAILED
+	default:
+		result.Status = K_PAYOUT_STATUS_PROCESSING
+	}
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package payment
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// 退款通知中的退款状态（refund_status）
+const (
+	k_WXPAY_REFUND_STATUS_SUCCESS     = "SUCCESS"
+	k_WXPAY_REFUND_STATUS_CHANGE      = "CHANGE"
+	k_WXPAY_REFUND_STATUS_REFUNDCLOSE = "REFUNDCLOSE"
+)
+
+// wxpayRefundNotification 微信支付的退款通知，通知没有签名，退款信息在使用 API 密钥加密的 ReqInfo 中
+type wxpayRefundNotification struct {
+	ReturnCode string `xml:"return_code"`
+	ReturnMsg  string `xml:"return_msg"`
+	AppId      string `xml:"appid"`
+	MchId      string `xml:"mch_id"`
+	NonceStr   string `xml:"nonce_str"`
+	ReqInfo    string `xml:"req_info"`
+}
+
+// wxpayRefundInfo 退款通知中 req_info 解密之后的内容
+type wxpayRefundInfo struct {
+	TransactionId       string `xml:"transaction_id" json:"transaction_id"`
+	OutTradeNo          string `xml:"out_trade_no" json:"out_trade_no"`
+	RefundId            string `xml:"refund_id" json:"refund_id"`
+	OutRefundNo         string `xml:"out_refund_no" json:"out_refund_no"`
+	TotalFee            int    `xml:"total_fee" json:"total_fee"`
+	SettlementTotalFee  int    `xml:"settlement_total_fee" json:"settlement_total_fee"`
+	RefundFee           int    `xml:"refund_fee" json:"refund_fee"`
+	SettlementRefundFee int    `xml:"settlement_refund_fee" json:"settlement_refund_fee"`
+	RefundStatus        string `xml:"refund_status" json:"refund_status"`
+	SuccessTime         string `xml:"success_time" json:"success_time"`
+	RefundRecvAccout    string `xml:"refund_recv_accout" json:"refund_recv_accout"`
+	RefundAccount       string `xml:"refund_account" json:"refund_account"`
+	RefundRequestSource string `xml:"refund_request_source" json:"refund_request_source"`
+}
+
+// refundNotify 处理退款结果通知，req_info 使用 AES-256-ECB 加密，密钥为 API 密钥 MD5 之后的小写十六进制字符串，
+// 能够解密说明通知是微信支付发出的，所以退款的信息都从解密之后的内容中获取
+func (this *WXPay) refundNotify(req *http.Request) (result *Notification, err error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var noti = &wxpayRefundNotification{}
+	if err = xml.Unmarshal(body, noti); err != nil || noti.ReturnCode != "SUCCESS" {
+		return nil, ErrInvalidSignature
+	}
+
+	data, err := wxpayDecryptReqInfo(noti.ReqInfo, this.apiKey)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	var info = &wxpayRefundInfo{}
+	if err = xml.Unmarshal(data, info); err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	// 退款通知中没有币种，金额按照人民币换算
+	result = &Notification{}
+	result.Channel = this.Identifier()
+	result.RawNotify = info
+	result.NotifyType = K_NOTIFY_TYPE_REFUND
+	result.OrderNo = info.OutTradeNo
+	result.TradeNo = info.TransactionId
+	result.Status = K_TRADE_STATUS_REFUNDED
+	result.Currency = K_CURRENCY_CNY
+	result.TotalAmount = FromMinorUnit(result.Currency, info.TotalFee)
+	result.RefundNo = info.OutRefundNo
+	result.RefundId = info.RefundId
+	result.RefundAmount = FromMinorUnit(result.Currency, info.RefundFee)
+	result.RawStatus = info.RefundStatus
+	result.RefundStatus = wxPayRefundStatus(info.RefundStatus)
+	if info.SuccessTime != "" {
+		result.RefundTime, _ = time.ParseInLocation("2006-01-02 15:04:05", info.SuccessTime, beijing)
+	}
+	return result, nil
+}
+
+// wxPayRefundStatus 将退款通知中的退款状态转换为 K_REFUND_STATUS_*，CHANGE 表示退款异常，需要商户手动处理
+func wxPayRefundStatus(status string) string {
+	switch status {
+	case k_WXPAY_REFUND_STATUS_SUCCESS:
+		return K_REFUND_STATUS_SUCCESS
+	case k_WXPAY_REFUND_STATUS_CHANGE, k_WXPAY_REFUND_STATUS_REFUNDCLOSE:
+		return K_REFUND_STATUS_FAILED
+	}
+	return ""
+}
+
+// wxpayDecryptReqInfo 解密退款通知中的 req_info，返回 XML 格式的退款信息
+func wxpayDecryptReqInfo(reqInfo, apiKey string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(reqInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	var sum = md5.Sum([]byte(apiKey))
+	block, err := aes.NewCipher([]byte(hex.EncodeToString(sum[:])))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, ErrInvalidSignature
+	}
+
+	// ECB 模式每个分组单独解密
+	var plain = make([]byte, len(data))
+	for i := 0; i < len(data); i += block.BlockSize() {
+		block.Decrypt(plain[i:i+block.BlockSize()], data[i:i+block.BlockSize()])
+	}
+
+	// 去掉 PKCS#7 填充
+	var padding = int(plain[len(plain)-1])
+	if padding == 0 || padding > block.BlockSize() || bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) == false {
+		return nil, ErrInvalidSignature
+	}
+	return plain[:len(plain)-padding], nil
+}
@@ -0,0 +1,194 @@
+package payment
+
+import (
+	"errors"
+	"github.com/smartwalle/wxpay"
+)
+
+const (
+	k_WXPAY_RELATION_TYPE_PARTNER = "PARTNER"
+)
+
+func (this *WXPay) receiverType(receiverType string) string {
+	if receiverType == K_RECEIVER_TYPE_MERCHANT {
+		return wxpay.K_PROFIT_SHARING_RECEIVER_TYPE_MERCHANT_ID
+	}
+	return wxpay.K_PROFIT_SHARING_RECEIVER_TYPE_PERSONAL_OPENID
+}
+
+// AddSplitReceiver 添加分账接收方，微信支付只能向已经添加的接收方分账
+func (this *WXPay) AddSplitReceiver(receiver *SplitReceiver) (err error) {
+	var p = &wxpay.ProfitSharingReceiver{}
+	p.Type = this.receiverType(receiver.Type)
+	p.Account = receiver.Account
+	p.Name = receiver.Name
+	p.RelationType = receiver.Relation
+	if p.RelationType == "" {
+		p.RelationType = k_WXPAY_RELATION_TYPE_PARTNER
+	}
+
+	rsp, err := this.client.ProfitSharingAddReceiver(p)
+	if err != nil {
+		return err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return errors.New(rsp.ErrCodeDes)
+	}
+	return nil
+}
+
+// Split 请求分账，Finish 为 true 时使用单次分账，分账之后剩余的资金会解冻给商户，否则使用多次分账，需要调用 FinishSplit 完结分账，
+// 微信支付会异步处理分账请求，需要通过 GetSplit 查询分账结果；该接口需要使用商户证书
+func (this *WXPay) Split(param *SplitParam) (result *SplitResult, err error) {
+	var p = wxpay.ProfitSharingParam{}
+	p.TransactionId = param.TradeNo
+	p.OutOrderNo = param.SplitNo
+	for _, r := range param.Receivers {
+		var receiver = &wxpay.ProfitSharingReceiver{}
+		receiver.Type = this.receiverType(r.Type)
+		receiver.Account = r.Account
+		receiver.Amount = ToMinorUnit(K_CURRENCY_CNY, r.Amount)
+		receiver.Description = r.Remark
+		if receiver.Description == "" {
+			receiver.Description = param.SplitNo
+		}
+		p.Receivers = append(p.Receivers, receiver)
+	}
+
+	var rsp *wxpay.ProfitSharingRsp
+	if param.Finish {
+		rsp, err = this.client.ProfitSharing(p)
+	} else {
+		rsp, err = this.client.MultiProfitSharing(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = &SplitResult{}
+	result.Channel = this.Identifier()
+	result.RawSplit = rsp
+	result.TradeNo = rsp.TransactionId
+	result.SplitNo = rsp.OutOrderNo
+	result.SplitId = rsp.OrderId
+	result.Status = K_SPLIT_STATUS_PROCESSING
+	for _, r := range param.Receivers {
+		var receiver = &SplitReceiverResult{}
+		receiver.Type = r.Type
+		receiver.Account = r.Account
+		receiver.Amount = FormatAmount(K_CURRENCY_CNY, r.Amount)
+		receiver.Status = K_SPLIT_STATUS_PROCESSING
+		result.Receivers = append(result.Receivers, receiver)
+	}
+	return result, nil
+}
+
+func (this *WXPay) GetSplit(tradeNo, splitNo string) (result *SplitResult, err error) {
+	var p = wxpay.ProfitSharingQueryParam{}
+	p.TransactionId = tradeNo
+	p.OutOrderNo = splitNo
+
+	rsp, err := this.client.ProfitSharingQuery(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = &SplitResult{}
+	result.Channel = this.Identifier()
+	result.RawSplit = rsp
+	result.TradeNo = rsp.TransactionId
+	result.SplitNo = rsp.OutOrderNo
+	result.SplitId = rsp.OrderId
+	switch rsp.Status {
+	case wxpay.K_PROFIT_SHARING_STATUS_FINISHED:
+		result.Status = K_SPLIT_STATUS_SUCCESS
+	case wxpay.K_PROFIT_SHARING_STATUS_CLOSED:
+		result.Status = K_SPLIT_STATUS_FAILED
+	default:
+		result.Status = K_SPLIT_STATUS_PROCESSING
+	}
+
+	for _, r := range rsp.Receivers {
+		var receiver = &SplitReceiverResult{}
+		receiver.Type = K_RECEIVER_TYPE_PERSONAL
+		if r.Type == wxpay.K_PROFIT_SHARING_RECEIVER_TYPE_MERCHANT_ID {
+			receiver.Type = K_RECEIVER_TYPE_MERCHANT
+		}
+		receiver.Account = r.Account
+		receiver.Amount = FromMinorUnit(K_CURRENCY_CNY, r.Amount)
+		receiver.FailReason = r.FailReason
+		switch r.Result {
+		case wxpay.K_PROFIT_SHARING_RESULT_SUCCESS:
+			receiver.Status = K_SPLIT_STATUS_SUCCESS
+		case wxpay.K_PROFIT_SHARING_RESULT_CLOSED:
+			receiver.Status = K_SPLIT_STATUS_FAILED
+		default:
+			receiver.Status = K_SPLIT_STATUS_PROCESSING
+		}
+		result.Receivers = append(result.Receivers, receiver)
+	}
+	return result, nil
+}
+
+// ReturnSplit 分账回退，只能从商户类型的接收方回退；该接口需要使用商户证书
+func (this *WXPay) ReturnSplit(param *SplitReturnParam) (result *SplitReturn, err error) {
+	var p = wxpay.ProfitSharingReturnParam{}
+	p.OutOrderNo = param.SplitNo
+	p.OutReturnNo = param.ReturnNo
+	p.ReturnAccountType = wxpay.K_PROFIT_SHARING_RECEIVER_TYPE_MERCHANT_ID
+	p.ReturnAccount = param.Account
+	p.ReturnAmount = ToMinorUnit(K_CURRENCY_CNY, param.Amount)
+	p.Description = param.Remark
+	if p.Description == "" {
+		p.Description = param.ReturnNo
+	}
+
+	rsp, err := this.client.ProfitSharingReturn(p)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = &SplitReturn{}
+	result.Channel = this.Identifier()
+	result.RawReturn = rsp
+	result.SplitNo = rsp.OutOrderNo
+	result.ReturnNo = rsp.OutReturnNo
+	result.ReturnId = rsp.ReturnNo
+	result.Amount = FromMinorUnit(K_CURRENCY_CNY, rsp.ReturnAmount)
+	result.FailReason = rsp.FailReason
+	switch rsp.Result {
+	case wxpay.K_PROFIT_SHARING_RETURN_RESULT_SUCCESS:
+		result.Status = K_SPLIT_STATUS_SUCCESS
+	case wxpay.K_PROFIT_SHARING_RETURN_RESULT_FAILED:
+		result.Status = K_SPLIT_STATUS_FAILED
+	default:
+		result.Status = K_SPLIT_STATUS_PROCESSING
+	}
+	return result, nil
+}
+
+// FinishSplit 完结分账，splitNo 为本次完结请求的商户单号；该接口需要使用商户证书
+func (this *WXPay) FinishSplit(tradeNo, splitNo string) (err error) {
+	var p = wxpay.ProfitSharingFinishParam{}
+	p.TransactionId = tradeNo
+	p.OutOrderNo = splitNo
+	p.Description = "分账完结"
+
+	rsp, err := this.client.ProfitSharingFinish(p)
+	if err != nil {
+		return err
+	}
+	if rsp.ResultCode != wxpay.K_TRADE_STATUS_SUCCESS {
+		return errors.New(rsp.ErrCodeDes)
+	}
+	return nil
+}